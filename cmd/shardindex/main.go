@@ -0,0 +1,115 @@
+// shardindex checks the indexes in a DAG store's index repository and
+// top-level index against indexes rebuilt from the CAR files of the shards,
+// and repairs them.
+//
+// Usage:
+//
+//	shardindex check -index-dir <dir> -top-index-dir <dir> -car-dir <dir> [piece CID...]
+//	shardindex repair -index-dir <dir> -top-index-dir <dir> -car-dir <dir> [piece CID...]
+//
+// The DAG store should not be running while indexes are repaired.
+//
+// Shards that have no CAR file can only be rebuilt from an unsealed copy of
+// a sector, which needs the node's SectorAccessor. A node checks them with
+// the same library calls as this command, with stores.UnsealedShardData
+// before stores.CARFileShardData in the list of sources:
+//
+//	sources := []stores.ShardDataSource{
+//		stores.UnsealedShardData(pieceStore, sectorAccessor),
+//		stores.CARFileShardData(carDir),
+//	}
+//	reports, err := stores.CheckShardIndexes(ctx, dagStore, sources, repair)
+//	...
+//	ok := stores.WriteShardIndexReports(os.Stdout, reports)
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/ipfs/go-cid"
+	levelds "github.com/ipfs/go-ds-leveldb"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/dagstore/index"
+
+	"github.com/filecoin-project/go-fil-markets/stores"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s check|repair -index-dir <dir> -top-index-dir <dir> -car-dir <dir> [piece CID...]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var repair bool
+	switch os.Args[1] {
+	case "check":
+	case "repair":
+		repair = true
+	default:
+		usage()
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	indexDir := flags.String("index-dir", "", "directory of the DAG store's index repository")
+	topIndexDir := flags.String("top-index-dir", "", "directory of the leveldb datastore of the DAG store's top-level index")
+	carDir := flags.String("car-dir", "", "directory of CAR files named after their piece CID")
+	_ = flags.Parse(os.Args[2:])
+	if *indexDir == "" || *topIndexDir == "" || *carDir == "" {
+		usage()
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	ok, err := run(ctx, *indexDir, *topIndexDir, *carDir, flags.Args(), repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// run checks the shards and prints a line for each, returning false if any
+// shard has an index that does not match its data and was not repaired
+func run(ctx context.Context, indexDir string, topIndexDir string, carDir string, args []string, repair bool) (bool, error) {
+	repo, err := index.NewFSRepo(indexDir)
+	if err != nil {
+		return false, xerrors.Errorf("opening index repository %s: %w", indexDir, err)
+	}
+	topds, err := levelds.NewDatastore(topIndexDir, nil)
+	if err != nil {
+		return false, xerrors.Errorf("opening top-level index datastore %s: %w", topIndexDir, err)
+	}
+	defer topds.Close() // nolint
+
+	shards := stores.IndexRepoShards(repo, index.NewInverted(topds))
+	sources := []stores.ShardDataSource{stores.CARFileShardData(carDir)}
+
+	var reports []stores.ShardIndexReport
+	if len(args) == 0 {
+		reports, err = stores.CheckShardIndexes(ctx, shards, sources, repair)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		for _, arg := range args {
+			pieceCid, err := cid.Parse(arg)
+			if err != nil {
+				return false, xerrors.Errorf("parsing piece CID %s: %w", arg, err)
+			}
+			reports = append(reports, stores.CheckShardIndex(ctx, shards, sources, pieceCid, repair))
+		}
+	}
+	return stores.WriteShardIndexReports(os.Stdout, reports), nil
+}
@@ -1,9 +1,267 @@
 package discoveryimpl
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
 	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
 
-func Multi(r discovery.PeerResolver) discovery.PeerResolver { // TODO: actually support multiple mechanisms
-	return r
+// DefaultBackendTimeout is how long a MultiResolver waits for a backend that
+// has no timeout of its own
+const DefaultBackendTimeout = 10 * time.Second
+
+// Backend is a PeerResolver queried by a MultiResolver
+type Backend struct {
+	// Name identifies the backend in errors and logs
+	Name     string
+	Resolver discovery.PeerResolver
+	// Timeout is how long to wait for the backend to answer. If zero,
+	// DefaultBackendTimeout is used.
+	Timeout time.Duration
+}
+
+// BackendError is an error returned by one backend of a MultiResolver
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Backend, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// LookupResult is the result of looking up peers with a MultiResolver
+type LookupResult struct {
+	// Peers are the peers found by all backends, without duplicates
+	Peers []retrievalmarket.RetrievalPeer
+	// Errors are the errors from backends that failed or timed out
+	Errors []*BackendError
+}
+
+// MultiResolver is a PeerResolver that combines the peers found by several
+// backends
+type MultiResolver struct {
+	backends []Backend
+}
+
+var _ discovery.StreamingPeerResolver = (*MultiResolver)(nil)
+
+// NewMultiResolver creates a resolver that queries all the given backends
+// at the same time
+func NewMultiResolver(backends ...Backend) *MultiResolver {
+	return &MultiResolver{backends: backends}
+}
+
+// Multi combines the given resolvers into one, using the default timeout for
+// each of them
+func Multi(resolvers ...discovery.PeerResolver) discovery.PeerResolver {
+	if len(resolvers) == 1 {
+		return resolvers[0]
+	}
+	backends := make([]Backend, 0, len(resolvers))
+	for i, r := range resolvers {
+		backends = append(backends, Backend{Name: fmt.Sprintf("resolver-%d", i), Resolver: r})
+	}
+	return NewMultiResolver(backends...)
+}
+
+// GetPeers returns the peers found by all backends. Errors from individual
+// backends are logged; an error is only returned if every backend failed.
+func (m *MultiResolver) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	res := m.Lookup(payloadCID)
+	for _, err := range res.Errors {
+		log.Warnf("getting peers for %s from %s", payloadCID, err)
+	}
+	if len(m.backends) > 0 && len(res.Errors) == len(m.backends) {
+		msgs := make([]string, 0, len(res.Errors))
+		for _, err := range res.Errors {
+			msgs = append(msgs, err.Error())
+		}
+		return nil, xerrors.Errorf("all peer resolvers failed: %s", strings.Join(msgs, "; "))
+	}
+	return res.Peers, nil
+}
+
+// Lookup queries all backends at the same time, and returns the peers they
+// found along with an error for each backend that failed or timed out
+func (m *MultiResolver) Lookup(payloadCID cid.Cid) LookupResult {
+	type backendResult struct {
+		peers []retrievalmarket.RetrievalPeer
+		err   error
+	}
+	results := make([]backendResult, len(m.backends))
+
+	var wg sync.WaitGroup
+	for i, b := range m.backends {
+		wg.Add(1)
+		go func(i int, b Backend) {
+			defer wg.Done()
+			peers, err := getPeersWithTimeout(context.Background(), b, payloadCID)
+			results[i] = backendResult{peers: peers, err: err}
+		}(i, b)
+	}
+	wg.Wait()
+
+	// Merge results in backend order, so that the output is deterministic
+	var res LookupResult
+	for i, r := range results {
+		if r.err != nil {
+			res.Errors = append(res.Errors, &BackendError{Backend: m.backends[i].Name, Err: r.err})
+			continue
+		}
+		for _, p := range r.peers {
+			res.Peers = mergePeer(res.Peers, p)
+		}
+	}
+	if res.Peers == nil {
+		res.Peers = []retrievalmarket.RetrievalPeer{}
+	}
+	return res
+}
+
+// GetPeersAsync queries all backends at the same time, and sends the peers
+// found by each backend as soon as it answers, followed by an error for each
+// backend that failed or timed out. Each peer is only sent once: if another
+// backend finds the same peer, it is not sent again. Backends that are still
+// looking up peers are cancelled when the context is cancelled.
+func (m *MultiResolver) GetPeersAsync(ctx context.Context, payloadCID cid.Cid) <-chan discovery.PeerResult {
+	type backendResult struct {
+		backend string
+		peers   []retrievalmarket.RetrievalPeer
+		err     error
+	}
+	// Buffered so that backends don't block if the context is cancelled
+	results := make(chan backendResult, len(m.backends))
+	for _, b := range m.backends {
+		go func(b Backend) {
+			peers, err := getPeersWithTimeout(ctx, b, payloadCID)
+			results <- backendResult{backend: b.Name, peers: peers, err: err}
+		}(b)
+	}
+
+	out := make(chan discovery.PeerResult)
+	go func() {
+		defer close(out)
+
+		send := func(res discovery.PeerResult) bool {
+			select {
+			case out <- res:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var sent []retrievalmarket.RetrievalPeer
+		for range m.backends {
+			var r backendResult
+			select {
+			case r = <-results:
+			case <-ctx.Done():
+				return
+			}
+
+			if r.err != nil {
+				if !send(discovery.PeerResult{Err: &BackendError{Backend: r.backend, Err: r.err}}) {
+					return
+				}
+				continue
+			}
+			for _, p := range r.peers {
+				var added bool
+				sent, added = addPeer(sent, p)
+				if added && !send(discovery.PeerResult{Peer: p}) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// getPeersWithTimeout calls the backend's resolver, giving up if it doesn't
+// answer within the backend's timeout or the context is cancelled. If the
+// resolver takes a context, it is cancelled as well.
+func getPeersWithTimeout(ctx context.Context, b Backend, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	timeout := b.Timeout
+	if timeout == 0 {
+		timeout = DefaultBackendTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		peers []retrievalmarket.RetrievalPeer
+		err   error
+	}
+	// Buffered so that a backend that answers after the timeout doesn't
+	// block forever
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		if cr, ok := b.Resolver.(discovery.ContextPeerResolver); ok {
+			r.peers, r.err = cr.GetPeersContext(ctx, payloadCID)
+		} else {
+			r.peers, r.err = b.Resolver.GetPeers(payloadCID)
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		return r.peers, r.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, xerrors.Errorf("timed out after %s", timeout)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// mergePeer adds a peer to the list, merging it with an existing entry for
+// the same peer. Entries are the same peer if they have the same address and
+// their peer IDs match (or one of them has no peer ID). A peer can have one
+// entry for each piece CID hint; an entry without a hint is merged into an
+// entry with one.
+func mergePeer(peers []retrievalmarket.RetrievalPeer, p retrievalmarket.RetrievalPeer) []retrievalmarket.RetrievalPeer {
+	peers, _ = addPeer(peers, p)
+	return peers
+}
+
+// addPeer merges a peer into the list like mergePeer, and also reports
+// whether the peer was added as a new entry rather than merged into an
+// existing one
+func addPeer(peers []retrievalmarket.RetrievalPeer, p retrievalmarket.RetrievalPeer) ([]retrievalmarket.RetrievalPeer, bool) {
+	for i, existing := range peers {
+		if existing.Address != p.Address {
+			continue
+		}
+		if existing.ID != "" && p.ID != "" && existing.ID != p.ID {
+			continue
+		}
+		if existing.PieceCID != nil && p.PieceCID != nil && !existing.PieceCID.Equals(*p.PieceCID) {
+			continue
+		}
+
+		if existing.ID == "" && p.ID != "" {
+			peers[i].ID = p.ID
+		}
+		if existing.PieceCID == nil && p.PieceCID != nil {
+			peers[i].PieceCID = p.PieceCID
+		}
+		return peers, false
+	}
+	return append(peers, p), true
 }
@@ -0,0 +1,254 @@
+package discoveryimpl_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/stretchr/testify/require"
+
+	specst "github.com/filecoin-project/specs-actors/support/testing"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+type fakeResolver struct {
+	peers []retrievalmarket.RetrievalPeer
+	err   error
+	delay time.Duration
+}
+
+func (r *fakeResolver) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	time.Sleep(r.delay)
+	return r.peers, r.err
+}
+
+// blockingResolver blocks until the context it is given is cancelled
+type blockingResolver struct {
+	cancelled chan struct{}
+}
+
+func (r *blockingResolver) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	return r.GetPeersContext(context.Background(), payloadCID)
+}
+
+func (r *blockingResolver) GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	<-ctx.Done()
+	close(r.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestMultiResolver(t *testing.T) {
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	pieceCIDs := shared_testutil.GenerateCids(2)
+	peerIDs := shared_testutil.GeneratePeers(2)
+	addr1 := specst.NewIDAddr(t, 1)
+	addr2 := specst.NewIDAddr(t, 2)
+
+	t.Run("merges duplicate peers and piece CID hints", func(t *testing.T) {
+		local := &fakeResolver{peers: []retrievalmarket.RetrievalPeer{
+			{Address: addr1, ID: peerIDs[0]},
+			{Address: addr2, ID: peerIDs[1], PieceCID: &pieceCIDs[0]},
+		}}
+		indexer := &fakeResolver{peers: []retrievalmarket.RetrievalPeer{
+			{Address: addr1, ID: peerIDs[0], PieceCID: &pieceCIDs[0]},
+			{Address: addr2, ID: peerIDs[1], PieceCID: &pieceCIDs[1]},
+		}}
+		static := &fakeResolver{peers: []retrievalmarket.RetrievalPeer{
+			{Address: addr1},
+			{Address: addr2, ID: peerIDs[1], PieceCID: &pieceCIDs[0]},
+		}}
+
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "local", Resolver: local},
+			discoveryimpl.Backend{Name: "indexer", Resolver: indexer},
+			discoveryimpl.Backend{Name: "static", Resolver: static},
+		)
+		peers, err := m.GetPeers(payloadCID)
+		require.NoError(t, err)
+		require.Equal(t, []retrievalmarket.RetrievalPeer{
+			{Address: addr1, ID: peerIDs[0], PieceCID: &pieceCIDs[0]},
+			{Address: addr2, ID: peerIDs[1], PieceCID: &pieceCIDs[0]},
+			{Address: addr2, ID: peerIDs[1], PieceCID: &pieceCIDs[1]},
+		}, peers)
+	})
+
+	t.Run("peers with different IDs are not merged", func(t *testing.T) {
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "a", Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{{Address: addr1, ID: peerIDs[0]}}}},
+			discoveryimpl.Backend{Name: "b", Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{{Address: addr1, ID: peerIDs[1]}}}},
+		)
+		peers, err := m.GetPeers(payloadCID)
+		require.NoError(t, err)
+		require.Len(t, peers, 2)
+	})
+
+	t.Run("reports backend errors and timeouts without failing", func(t *testing.T) {
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "ok", Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{{Address: addr1}}}},
+			discoveryimpl.Backend{Name: "broken", Resolver: &fakeResolver{err: errors.New("boom")}},
+			discoveryimpl.Backend{Name: "slow", Resolver: &fakeResolver{delay: time.Second}, Timeout: 10 * time.Millisecond},
+		)
+		start := time.Now()
+		res := m.Lookup(payloadCID)
+		require.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+		require.Equal(t, []retrievalmarket.RetrievalPeer{{Address: addr1}}, res.Peers)
+		require.Len(t, res.Errors, 2)
+		require.Equal(t, "broken", res.Errors[0].Backend)
+		require.EqualError(t, res.Errors[0].Err, "boom")
+		require.Equal(t, "slow", res.Errors[1].Backend)
+
+		peers, err := m.GetPeers(payloadCID)
+		require.NoError(t, err)
+		require.Len(t, peers, 1)
+	})
+
+	t.Run("fails if every backend fails", func(t *testing.T) {
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "a", Resolver: &fakeResolver{err: errors.New("boom")}},
+			discoveryimpl.Backend{Name: "b", Resolver: &fakeResolver{err: errors.New("bang")}},
+		)
+		_, err := m.GetPeers(payloadCID)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "a: boom")
+		require.Contains(t, err.Error(), "b: bang")
+	})
+}
+
+func TestMultiResolverAsync(t *testing.T) {
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	peerID := test.RandPeerIDFatal(t)
+	addr1 := specst.NewIDAddr(t, 1)
+	addr2 := specst.NewIDAddr(t, 2)
+
+	t.Run("sends peers as each backend answers", func(t *testing.T) {
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "slow", Resolver: &fakeResolver{
+				peers: []retrievalmarket.RetrievalPeer{{Address: addr1, ID: peerID, PieceCID: &pieceCID}, {Address: addr2}},
+				delay: 200 * time.Millisecond,
+			}},
+			discoveryimpl.Backend{Name: "fast", Resolver: &fakeResolver{peers: []retrievalmarket.RetrievalPeer{{Address: addr1}}}},
+			discoveryimpl.Backend{Name: "broken", Resolver: &fakeResolver{err: errors.New("boom")}},
+		)
+
+		start := time.Now()
+		var results []discovery.PeerResult
+		for res := range m.GetPeersAsync(context.Background(), payloadCID) {
+			if len(results) == 0 {
+				require.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+			}
+			results = append(results, res)
+		}
+
+		var peers []retrievalmarket.RetrievalPeer
+		var errs []error
+		for _, res := range results {
+			if res.Err != nil {
+				errs = append(errs, res.Err)
+			} else {
+				peers = append(peers, res.Peer)
+			}
+		}
+		require.Len(t, errs, 1)
+		require.Contains(t, errs[0].Error(), "broken: boom")
+		// addr1 was already sent when the slow backend found it
+		require.Equal(t, []retrievalmarket.RetrievalPeer{
+			{Address: addr1},
+			{Address: addr2},
+		}, peers)
+	})
+
+	t.Run("cancels backends that time out", func(t *testing.T) {
+		r := &blockingResolver{cancelled: make(chan struct{})}
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "blocked", Resolver: r, Timeout: 50 * time.Millisecond},
+		)
+		var errs []error
+		for res := range m.GetPeersAsync(context.Background(), payloadCID) {
+			errs = append(errs, res.Err)
+		}
+		require.Len(t, errs, 1)
+		require.Contains(t, errs[0].Error(), "blocked: timed out")
+		select {
+		case <-r.cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("backend was not cancelled")
+		}
+	})
+
+	t.Run("cancels backends when the context is cancelled", func(t *testing.T) {
+		r := &blockingResolver{cancelled: make(chan struct{})}
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "blocked", Resolver: r},
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		results := m.GetPeersAsync(ctx, payloadCID)
+		cancel()
+		for range results {
+		}
+		select {
+		case <-r.cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("backend was not cancelled")
+		}
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		m := discoveryimpl.NewMultiResolver(
+			discoveryimpl.Backend{Name: "slow", Resolver: &fakeResolver{delay: time.Second}},
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		results := m.GetPeersAsync(ctx, payloadCID)
+		cancel()
+		select {
+		case _, ok := <-results:
+			require.False(t, ok)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("channel was not closed")
+		}
+	})
+
+	t.Run("streams resolvers that don't support it", func(t *testing.T) {
+		r := &fakeResolver{peers: []retrievalmarket.RetrievalPeer{{Address: addr1}, {Address: addr2}}}
+		var peers []retrievalmarket.RetrievalPeer
+		for res := range discovery.StreamPeers(context.Background(), r, payloadCID) {
+			require.NoError(t, res.Err)
+			peers = append(peers, res.Peer)
+		}
+		require.Equal(t, r.peers, peers)
+	})
+}
+
+func TestLoadStatic(t *testing.T) {
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	pieceCID := shared_testutil.GenerateCids(1)[0]
+	p := retrievalmarket.RetrievalPeer{
+		Address:  specst.NewIDAddr(t, 1),
+		ID:       test.RandPeerIDFatal(t),
+		PieceCID: &pieceCID,
+	}
+
+	path := filepath.Join(t.TempDir(), "peers.json")
+	content := `{"` + payloadCID.String() + `": [{"Address": "` + p.Address.String() + `", "ID": "` + p.ID.Pretty() + `", "PieceCID": {"/": "` + pieceCID.String() + `"}}]}`
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), os.ModePerm))
+
+	s, err := discoveryimpl.LoadStatic(path)
+	require.NoError(t, err)
+	peers, err := s.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, []retrievalmarket.RetrievalPeer{p}, peers)
+
+	peers, err = s.GetPeers(pieceCID)
+	require.NoError(t, err)
+	require.Empty(t, peers)
+}
@@ -0,0 +1,235 @@
+package discoveryimpl
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multicodec"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	metadata2 "github.com/filecoin-project/index-provider/metadata"
+	stiapi "github.com/filecoin-project/storetheindex/api/v0"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// DefaultIndexerCacheTTL is how long an Indexer caches the peers it found
+// for a payload CID
+const DefaultIndexerCacheTTL = 5 * time.Minute
+
+// DefaultIndexerRequestTimeout is how long an Indexer waits for the indexer
+// to answer a find request
+const DefaultIndexerRequestTimeout = 30 * time.Second
+
+// MinerAddressResolver looks up the address of the miner for a provider's
+// peer ID
+type MinerAddressResolver func(ctx context.Context, p peer.ID) (address.Address, error)
+
+// Indexer is a PeerResolver that finds the providers of a payload CID with
+// a network indexer's find-by-multihash HTTP API. Only providers that
+// announced the payload with Filecoin graphsync metadata are returned.
+type Indexer struct {
+	baseURL        string
+	client         *http.Client
+	ttl            time.Duration
+	requestTimeout time.Duration
+	resolveAddr    MinerAddressResolver
+	now            func() time.Time
+
+	lk    sync.Mutex
+	cache map[string]indexerCacheEntry
+}
+
+type indexerCacheEntry struct {
+	peers   []retrievalmarket.RetrievalPeer
+	expires time.Time
+}
+
+var _ discovery.ContextPeerResolver = (*Indexer)(nil)
+
+// IndexerOption configures an Indexer
+type IndexerOption func(*Indexer)
+
+// IndexerHTTPClient sets the HTTP client used to make requests to the indexer
+func IndexerHTTPClient(client *http.Client) IndexerOption {
+	return func(i *Indexer) {
+		i.client = client
+	}
+}
+
+// IndexerCacheTTL sets how long the peers found for a payload CID are cached.
+// A TTL of zero disables the cache.
+func IndexerCacheTTL(ttl time.Duration) IndexerOption {
+	return func(i *Indexer) {
+		i.ttl = ttl
+	}
+}
+
+// IndexerRequestTimeout sets how long to wait for the indexer to answer
+func IndexerRequestTimeout(timeout time.Duration) IndexerOption {
+	return func(i *Indexer) {
+		i.requestTimeout = timeout
+	}
+}
+
+// IndexerMinerAddresses sets how the miner address of each provider is
+// looked up. Without it, peers are returned with an undefined address.
+func IndexerMinerAddresses(resolve MinerAddressResolver) IndexerOption {
+	return func(i *Indexer) {
+		i.resolveAddr = resolve
+	}
+}
+
+// IndexerClock sets the function used to get the current time when expiring
+// cache entries
+func IndexerClock(now func() time.Time) IndexerOption {
+	return func(i *Indexer) {
+		i.now = now
+	}
+}
+
+// NewIndexer creates a resolver that queries the indexer at the given base
+// URL, eg https://cid.contact
+func NewIndexer(baseURL string, options ...IndexerOption) *Indexer {
+	i := &Indexer{
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		client:         http.DefaultClient,
+		ttl:            DefaultIndexerCacheTTL,
+		requestTimeout: DefaultIndexerRequestTimeout,
+		now:            time.Now,
+		cache:          make(map[string]indexerCacheEntry),
+	}
+	for _, option := range options {
+		option(i)
+	}
+	return i
+}
+
+// GetPeers returns the providers that announced the payload CID to the
+// indexer, with the piece CID each of them announced it in
+func (i *Indexer) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	return i.GetPeersContext(context.Background(), payloadCID)
+}
+
+// GetPeersContext is like GetPeers, but gives up on the request to the
+// indexer when the context is cancelled
+func (i *Indexer) GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	key := payloadCID.Hash().B58String()
+
+	i.lk.Lock()
+	entry, ok := i.cache[key]
+	if ok && i.now().Before(entry.expires) {
+		i.lk.Unlock()
+		return append([]retrievalmarket.RetrievalPeer{}, entry.peers...), nil
+	}
+	delete(i.cache, key)
+	i.lk.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, i.requestTimeout)
+	defer cancel()
+	peers, err := i.find(ctx, key)
+	if err != nil {
+		return nil, xerrors.Errorf("finding %s in indexer: %w", payloadCID, err)
+	}
+
+	if i.ttl > 0 {
+		i.lk.Lock()
+		i.cache[key] = indexerCacheEntry{peers: peers, expires: i.now().Add(i.ttl)}
+		i.lk.Unlock()
+	}
+	return append([]retrievalmarket.RetrievalPeer{}, peers...), nil
+}
+
+// indexerFindResponse is the body of a response to a find request
+type indexerFindResponse struct {
+	MultihashResults []struct {
+		ProviderResults []indexerProviderResult
+	}
+}
+
+type indexerProviderResult struct {
+	ContextID []byte
+	// Metadata is the binary encoding of the metadata the provider
+	// announced with the multihash
+	Metadata []byte
+	Provider struct {
+		ID peer.ID
+	}
+}
+
+// find asks the indexer for the providers of the multihash
+func (i *Indexer) find(ctx context.Context, mh string) ([]retrievalmarket.RetrievalPeer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, i.baseURL+"/multihash/"+mh, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return []retrievalmarket.RetrievalPeer{}, nil
+	default:
+		return nil, xerrors.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	var body indexerFindResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, xerrors.Errorf("decoding find response: %w", err)
+	}
+
+	peers := []retrievalmarket.RetrievalPeer{}
+	for _, mhr := range body.MultihashResults {
+		for _, pr := range mhr.ProviderResults {
+			p, ok, err := i.toRetrievalPeer(ctx, pr)
+			if err != nil {
+				log.Warnf("skipping indexer result from provider %s: %s", pr.Provider.ID, err)
+				continue
+			}
+			if ok {
+				peers = mergePeer(peers, p)
+			}
+		}
+	}
+	return peers, nil
+}
+
+// toRetrievalPeer converts a provider result to a retrieval peer. It returns
+// false if the result is not for Filecoin graphsync retrieval.
+func (i *Indexer) toRetrievalPeer(ctx context.Context, pr indexerProviderResult) (retrievalmarket.RetrievalPeer, bool, error) {
+	var md stiapi.Metadata
+	if err := md.UnmarshalBinary(pr.Metadata); err != nil {
+		return retrievalmarket.RetrievalPeer{}, false, xerrors.Errorf("decoding metadata: %w", err)
+	}
+	if md.ProtocolID != multicodec.TransportGraphsyncFilecoinv1 {
+		return retrievalmarket.RetrievalPeer{}, false, nil
+	}
+	var fm metadata2.GraphsyncFilecoinV1Metadata
+	if err := fm.FromIndexerMetadata(md); err != nil {
+		return retrievalmarket.RetrievalPeer{}, false, xerrors.Errorf("decoding graphsync metadata: %w", err)
+	}
+
+	p := retrievalmarket.RetrievalPeer{ID: pr.Provider.ID, PieceCID: &fm.PieceCID}
+	if i.resolveAddr != nil {
+		addr, err := i.resolveAddr(ctx, pr.Provider.ID)
+		if err != nil {
+			return retrievalmarket.RetrievalPeer{}, false, xerrors.Errorf("looking up miner address: %w", err)
+		}
+		p.Address = addr
+	}
+	return p, true, nil
+}
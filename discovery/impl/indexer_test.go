@@ -0,0 +1,154 @@
+package discoveryimpl_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	metadata2 "github.com/filecoin-project/index-provider/metadata"
+	specst "github.com/filecoin-project/specs-actors/support/testing"
+	stiapi "github.com/filecoin-project/storetheindex/api/v0"
+
+	discoveryimpl "github.com/filecoin-project/go-fil-markets/discovery/impl"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+)
+
+type fakeProviderResult struct {
+	ContextID []byte
+	Metadata  []byte
+	Provider  struct {
+		ID    peer.ID
+		Addrs []string
+	}
+}
+
+// fakeIndexer is a stand-in for an indexer's find API
+type fakeIndexer struct {
+	lk       sync.Mutex
+	requests int
+	results  map[string][]fakeProviderResult
+}
+
+func (f *fakeIndexer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	f.requests++
+	mh := r.URL.Path[len("/multihash/"):]
+	results, ok := f.results[mh]
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	resp := map[string]interface{}{
+		"MultihashResults": []interface{}{
+			map[string]interface{}{"ProviderResults": results},
+		},
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeIndexer) requestCount() int {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.requests
+}
+
+func TestIndexer(t *testing.T) {
+	payloadCID := shared_testutil.GenerateCids(1)[0]
+	pieceCIDs := shared_testutil.GenerateCids(2)
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+	addrs := map[peer.ID]address.Address{
+		p1: specst.NewIDAddr(t, 1),
+		p2: specst.NewIDAddr(t, 2),
+	}
+
+	result := func(p peer.ID, md stiapi.Metadata) fakeProviderResult {
+		data, err := md.MarshalBinary()
+		require.NoError(t, err)
+		r := fakeProviderResult{ContextID: []byte("deal"), Metadata: data}
+		r.Provider.ID = p
+		return r
+	}
+	graphsync := func(pieceCID int) stiapi.Metadata {
+		md, err := metadata2.GraphsyncFilecoinV1Metadata{PieceCID: pieceCIDs[pieceCID], FastRetrieval: true}.ToIndexerMetadata()
+		require.NoError(t, err)
+		return md
+	}
+
+	fi := &fakeIndexer{results: map[string][]fakeProviderResult{
+		payloadCID.Hash().B58String(): {
+			result(p1, graphsync(0)),
+			result(p2, graphsync(1)),
+			// Announced for another retrieval protocol
+			result(p2, stiapi.Metadata{ProtocolID: 0x300000, Data: []byte("bitswap")}),
+		},
+	}}
+	srv := httptest.NewServer(fi)
+	defer srv.Close()
+
+	now := time.Now()
+	var nowLk sync.Mutex
+	clock := func() time.Time {
+		nowLk.Lock()
+		defer nowLk.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowLk.Lock()
+		defer nowLk.Unlock()
+		now = now.Add(d)
+	}
+
+	idx := discoveryimpl.NewIndexer(srv.URL,
+		discoveryimpl.IndexerCacheTTL(time.Minute),
+		discoveryimpl.IndexerClock(clock),
+		discoveryimpl.IndexerMinerAddresses(func(ctx context.Context, p peer.ID) (address.Address, error) {
+			return addrs[p], nil
+		}),
+	)
+
+	expected := []retrievalmarket.RetrievalPeer{
+		{Address: addrs[p1], ID: p1, PieceCID: &pieceCIDs[0]},
+		{Address: addrs[p2], ID: p2, PieceCID: &pieceCIDs[1]},
+	}
+	peers, err := idx.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, expected, peers)
+	require.Equal(t, 1, fi.requestCount())
+
+	// Served from the cache within the TTL
+	advance(30 * time.Second)
+	peers, err = idx.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, expected, peers)
+	require.Equal(t, 1, fi.requestCount())
+
+	// Fetched again once the TTL has expired
+	advance(time.Minute)
+	peers, err = idx.GetPeers(payloadCID)
+	require.NoError(t, err)
+	require.Equal(t, expected, peers)
+	require.Equal(t, 2, fi.requestCount())
+
+	// Unknown payload CIDs have no peers
+	peers, err = idx.GetPeers(pieceCIDs[0])
+	require.NoError(t, err)
+	require.Empty(t, peers)
+
+	// Errors from the indexer are returned
+	srv.Close()
+	_, err = discoveryimpl.NewIndexer(srv.URL).GetPeers(payloadCID)
+	require.Error(t, err)
+}
@@ -3,12 +3,16 @@ package discoveryimpl
 import (
 	"bytes"
 	"context"
+	"time"
 
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
 
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
@@ -18,24 +22,57 @@ import (
 	"github.com/filecoin-project/go-fil-markets/discovery/migrations"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
 var log = logging.Logger("retrieval-discovery")
 
+// Local is a PeerResolver backed by a local list of peers for each payload
+// CID. Entries record when they were last seen, and if a TTL is set, entries
+// that have not been seen within the TTL are no longer returned.
 type Local struct {
 	ds        datastore.Datastore
 	migrateDs func(context.Context) error
 	readySub  *pubsub.PubSub
+	ttl       time.Duration
+	now       func() time.Time
 }
 
-func NewLocal(ds datastore.Batching) (*Local, error) {
+// LocalOption configures the local discovery list
+type LocalOption func(*Local)
+
+// LocalPeerTTL sets how long a peer stays in the list after it was last seen.
+// A TTL of zero (the default) means peers never expire.
+func LocalPeerTTL(ttl time.Duration) LocalOption {
+	return func(l *Local) {
+		l.ttl = ttl
+	}
+}
+
+// LocalClock sets the function used to get the current time
+func LocalClock(now func() time.Time) LocalOption {
+	return func(l *Local) {
+		l.now = now
+	}
+}
+
+func NewLocal(ds datastore.Batching, options ...LocalOption) (*Local, error) {
 	migrations, err := migrations.RetrievalPeersMigrations.Build()
 	if err != nil {
 		return nil, err
 	}
-	versionedDs, migrateDs := versionedds.NewVersionedDatastore(ds, migrations, versioning.VersionKey("1"))
+	versionedDs, migrateDs := versionedds.NewVersionedDatastore(ds, migrations, versioning.VersionKey("2"))
 	readySub := pubsub.New(shared.ReadyDispatcher)
-	return &Local{versionedDs, migrateDs, readySub}, nil
+	l := &Local{
+		ds:        versionedDs,
+		migrateDs: migrateDs,
+		readySub:  readySub,
+		now:       time.Now,
+	}
+	for _, option := range options {
+		option(l)
+	}
+	return l, nil
 }
 
 func (l *Local) Start(ctx context.Context) error {
@@ -57,65 +94,229 @@ func (l *Local) OnReady(ready shared.ReadyFunc) {
 	l.readySub.Subscribe(ready)
 }
 
+// AddPeer adds a peer to the list for the payload CID. If the peer is
+// already in the list, its last seen time is updated.
 func (l *Local) AddPeer(ctx context.Context, cid cid.Cid, peer retrievalmarket.RetrievalPeer) error {
-	key := dshelp.MultihashToDsKey(cid.Hash())
-	exists, err := l.ds.Has(ctx, key)
+	return l.update(ctx, cid.Hash(), func(entries []discovery.RetrievalPeerEntry) []discovery.RetrievalPeerEntry {
+		now := cbg.CborTime(time.Unix(0, l.now().UnixNano()).UTC())
+		for i, e := range entries {
+			if samePeer(e.Peer, peer) {
+				entries[i].LastSeen = now
+				return entries
+			}
+		}
+		return append(entries, discovery.RetrievalPeerEntry{Peer: peer, LastSeen: now})
+	})
+}
+
+// RemovePeer removes a peer from the list for the payload CID
+func (l *Local) RemovePeer(ctx context.Context, cid cid.Cid, peer retrievalmarket.RetrievalPeer) error {
+	return l.update(ctx, cid.Hash(), func(entries []discovery.RetrievalPeerEntry) []discovery.RetrievalPeerEntry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !samePeer(e.Peer, peer) {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+}
+
+// update applies a change to the list of entries for a multihash. Expired
+// entries are dropped, and the record is deleted if no entries are left.
+func (l *Local) update(ctx context.Context, mh multihash.Multihash, change func([]discovery.RetrievalPeerEntry) []discovery.RetrievalPeerEntry) error {
+	key := dshelp.MultihashToDsKey(mh)
+	entries, err := l.get(ctx, key)
 	if err != nil {
 		return err
 	}
 
+	entries = l.unexpired(change(entries))
+	if len(entries) == 0 {
+		return l.ds.Delete(ctx, key)
+	}
+
 	var newRecord bytes.Buffer
+	if err := cborutil.WriteCborRPC(&newRecord, &discovery.RetrievalPeerEntries{Peers: entries}); err != nil {
+		return err
+	}
+	return l.ds.Put(ctx, key, newRecord.Bytes())
+}
+
+func (l *Local) get(ctx context.Context, key datastore.Key) ([]discovery.RetrievalPeerEntry, error) {
+	entry, err := l.ds.Get(ctx, key)
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers discovery.RetrievalPeerEntries
+	if err := cborutil.ReadCborRPC(bytes.NewReader(entry), &peers); err != nil {
+		return nil, err
+	}
+	return peers.Peers, nil
+}
+
+// unexpired filters out the entries that have not been seen within the TTL
+func (l *Local) unexpired(entries []discovery.RetrievalPeerEntry) []discovery.RetrievalPeerEntry {
+	if l.ttl == 0 {
+		return entries
+	}
+	cutoff := l.now().Add(-l.ttl)
+	kept := entries[:0:0]
+	for _, e := range entries {
+		if time.Time(e.LastSeen).After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// samePeer compares peers by value, including the value of the piece CID
+func samePeer(a, b retrievalmarket.RetrievalPeer) bool {
+	if a.Address != b.Address || a.ID != b.ID {
+		return false
+	}
+	if a.PieceCID == nil || b.PieceCID == nil {
+		return a.PieceCID == nil && b.PieceCID == nil
+	}
+	return a.PieceCID.Equals(*b.PieceCID)
+}
+
+// GetPeers returns the peers for the payload CID that have not expired
+func (l *Local) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	return l.GetPeersContext(context.TODO(), payloadCID)
+}
+
+// GetPeersContext is like GetPeers, with a context for reading the list
+func (l *Local) GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	entries, err := l.GetPeerEntries(ctx, payloadCID)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]retrievalmarket.RetrievalPeer, 0, len(entries))
+	for _, e := range entries {
+		peers = append(peers, e.Peer)
+	}
+	return peers, nil
+}
+
+// GetPeerEntries returns the peers for the payload CID that have not
+// expired, with the last time each of them was seen
+func (l *Local) GetPeerEntries(ctx context.Context, payloadCID cid.Cid) ([]discovery.RetrievalPeerEntry, error) {
+	entries, err := l.get(ctx, dshelp.MultihashToDsKey(payloadCID.Hash()))
+	if err != nil {
+		return nil, err
+	}
+	return l.unexpired(entries), nil
+}
+
+// LocalPeers are the peers in the local list for a payload
+type LocalPeers struct {
+	// PayloadHash is the multihash of the payload CID. Peers are stored by
+	// multihash, so the same list is used for every CID with this multihash.
+	PayloadHash multihash.Multihash
+	Peers       []discovery.RetrievalPeerEntry
+}
 
-	if !exists {
-		peers := discovery.RetrievalPeers{Peers: []retrievalmarket.RetrievalPeer{peer}}
-		err = cborutil.WriteCborRPC(&newRecord, &peers)
+// ListPeers returns all the peers in the list that have not expired
+func (l *Local) ListPeers(ctx context.Context) ([]LocalPeers, error) {
+	var list []LocalPeers
+	err := l.forEach(ctx, func(mh multihash.Multihash, entries []discovery.RetrievalPeerEntry) error {
+		if entries = l.unexpired(entries); len(entries) > 0 {
+			list = append(list, LocalPeers{PayloadHash: mh, Peers: entries})
+		}
+		return nil
+	})
+	return list, err
+}
+
+// ExpirePeers deletes the peers that have not been seen within the TTL from
+// the list, and returns the number of peers deleted
+func (l *Local) ExpirePeers(ctx context.Context) (int, error) {
+	if l.ttl == 0 {
+		return 0, nil
+	}
+	var expired []multihash.Multihash
+	err := l.forEach(ctx, func(mh multihash.Multihash, entries []discovery.RetrievalPeerEntry) error {
+		if len(l.unexpired(entries)) < len(entries) {
+			expired = append(expired, mh)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, mh := range expired {
+		err := l.update(ctx, mh, func(entries []discovery.RetrievalPeerEntry) []discovery.RetrievalPeerEntry {
+			count += len(entries) - len(l.unexpired(entries))
+			return entries
+		})
 		if err != nil {
-			return err
+			return count, err
 		}
-	} else {
-		entry, err := l.ds.Get(ctx, key)
+	}
+	return count, nil
+}
+
+func (l *Local) forEach(ctx context.Context, cb func(multihash.Multihash, []discovery.RetrievalPeerEntry) error) error {
+	res, err := l.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return err
+	}
+	defer res.Close() // nolint
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		mh, err := dshelp.DsKeyToMultihash(datastore.RawKey(r.Key))
 		if err != nil {
-			return err
+			log.Warnf("skipping retrieval peers with unexpected key %s: %s", r.Key, err)
+			continue
 		}
-		var peers discovery.RetrievalPeers
-		if err = cborutil.ReadCborRPC(bytes.NewReader(entry), &peers); err != nil {
+		var peers discovery.RetrievalPeerEntries
+		if err := cborutil.ReadCborRPC(bytes.NewReader(r.Value), &peers); err != nil {
 			return err
 		}
-		if hasPeer(peers, peer) {
-			return nil
-		}
-		peers.Peers = append(peers.Peers, peer)
-		err = cborutil.WriteCborRPC(&newRecord, &peers)
-		if err != nil {
+		if err := cb(mh, peers.Peers); err != nil {
 			return err
 		}
 	}
-
-	return l.ds.Put(ctx, key, newRecord.Bytes())
+	return nil
 }
 
-func hasPeer(peerList discovery.RetrievalPeers, peer retrievalmarket.RetrievalPeer) bool {
-	for _, p := range peerList.Peers {
-		if p == peer {
-			return true
-		}
+// OnStorageClientEvent keeps the list up to date with the deals made by a
+// storage client: the provider is added as a peer for the deal's root CID
+// when the deal becomes active, and removed when the deal is slashed or
+// expires. Register it with StorageClient.SubscribeToEvents to enable it.
+func (l *Local) OnStorageClientEvent(event storagemarket.ClientEvent, deal storagemarket.ClientDeal) {
+	if deal.DataRef == nil {
+		return
+	}
+	pieceCID := deal.Proposal.PieceCID
+	peer := retrievalmarket.RetrievalPeer{
+		Address:  deal.Proposal.Provider,
+		ID:       deal.Miner,
+		PieceCID: &pieceCID,
 	}
-	return false
-}
 
-func (l *Local) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
-	entry, err := l.ds.Get(context.TODO(), dshelp.MultihashToDsKey(payloadCID.Hash()))
-	if err == datastore.ErrNotFound {
-		return []retrievalmarket.RetrievalPeer{}, nil
+	ctx := context.TODO()
+	var err error
+	switch event {
+	case storagemarket.ClientEventDealActivated:
+		err = l.AddPeer(ctx, deal.DataRef.Root, peer)
+	case storagemarket.ClientEventDealSlashed, storagemarket.ClientEventDealExpired:
+		err = l.RemovePeer(ctx, deal.DataRef.Root, peer)
+	default:
+		return
 	}
 	if err != nil {
-		return nil, err
+		log.Errorf("updating retrieval peers for deal %s: %s", deal.ProposalCid, err)
 	}
-	var peers discovery.RetrievalPeers
-	if err := cborutil.ReadCborRPC(bytes.NewReader(entry), &peers); err != nil {
-		return nil, err
-	}
-	return peers.Peers, nil
 }
 
-var _ discovery.PeerResolver = &Local{}
+var _ discovery.ContextPeerResolver = &Local{}
@@ -9,6 +9,7 @@ import (
 	"github.com/ipfs/go-datastore"
 	dshelp "github.com/ipfs/go-ipfs-ds-help"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	retrievalmigrations "github.com/filecoin-project/go-fil-markets/retrievalmarket/migrations"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
 func TestLocal_AddPeer(t *testing.T) {
@@ -125,3 +127,94 @@ func TestLocalMigrations(t *testing.T) {
 		require.Equal(t, expectedPeers, peers)
 	}
 }
+
+func TestLocalLifecycle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pieceCid := shared_testutil.GenerateCids(1)[0]
+	peer1 := retrievalmarket.RetrievalPeer{Address: specst.NewIDAddr(t, 1), ID: test.RandPeerIDFatal(t)}
+	peer2 := retrievalmarket.RetrievalPeer{Address: specst.NewIDAddr(t, 2), ID: test.RandPeerIDFatal(t), PieceCID: &pieceCid}
+	payloadCids := shared_testutil.GenerateCids(2)
+
+	now := time.Now()
+	l, err := discoveryimpl.NewLocal(datastore.NewMapDatastore(),
+		discoveryimpl.LocalPeerTTL(time.Hour),
+		discoveryimpl.LocalClock(func() time.Time { return now }))
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, l)
+
+	require.NoError(t, l.AddPeer(ctx, payloadCids[0], peer1))
+	require.NoError(t, l.AddPeer(ctx, payloadCids[0], peer2))
+	require.NoError(t, l.AddPeer(ctx, payloadCids[1], peer2))
+
+	// Removing a peer only removes it for the given payload
+	copyCid := pieceCid
+	require.NoError(t, l.RemovePeer(ctx, payloadCids[0], retrievalmarket.RetrievalPeer{Address: peer2.Address, ID: peer2.ID, PieceCID: &copyCid}))
+	peers, err := l.GetPeers(payloadCids[0])
+	require.NoError(t, err)
+	require.Equal(t, []retrievalmarket.RetrievalPeer{peer1}, peers)
+
+	list, err := l.ListPeers(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	// Refreshing a peer updates its last seen time
+	now = now.Add(40 * time.Minute)
+	require.NoError(t, l.AddPeer(ctx, payloadCids[1], peer2))
+	entries, err := l.GetPeerEntries(ctx, payloadCids[1])
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, time.Time(entries[0].LastSeen).Equal(now))
+
+	// peer1 was last seen more than an hour ago
+	now = now.Add(40 * time.Minute)
+	peers, err = l.GetPeers(payloadCids[0])
+	require.NoError(t, err)
+	require.Empty(t, peers)
+	peers, err = l.GetPeers(payloadCids[1])
+	require.NoError(t, err)
+	require.Equal(t, []retrievalmarket.RetrievalPeer{peer2}, peers)
+
+	expired, err := l.ExpirePeers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+	list, err = l.ListPeers(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, payloadCids[1].Hash(), list[0].PayloadHash)
+}
+
+func TestLocalStorageClientHook(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := discoveryimpl.NewLocal(datastore.NewMapDatastore())
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, l)
+
+	deal, err := shared_testutil.MakeTestClientDeal(storagemarket.StorageDealActive, shared_testutil.MakeTestClientDealProposal(), false)
+	require.NoError(t, err)
+	expected := retrievalmarket.RetrievalPeer{
+		Address:  deal.Proposal.Provider,
+		ID:       deal.Miner,
+		PieceCID: &deal.Proposal.PieceCID,
+	}
+
+	// Events other than activation are ignored
+	l.OnStorageClientEvent(storagemarket.ClientEventDealPublished, *deal)
+	peers, err := l.GetPeers(deal.DataRef.Root)
+	require.NoError(t, err)
+	require.Empty(t, peers)
+
+	l.OnStorageClientEvent(storagemarket.ClientEventDealActivated, *deal)
+	peers, err = l.GetPeers(deal.DataRef.Root)
+	require.NoError(t, err)
+	require.Equal(t, []retrievalmarket.RetrievalPeer{expected}, peers)
+
+	deal.State = storagemarket.StorageDealSlashed
+	l.OnStorageClientEvent(storagemarket.ClientEventDealSlashed, *deal)
+	peers, err = l.GetPeers(deal.DataRef.Root)
+	require.NoError(t, err)
+	require.Empty(t, peers)
+}
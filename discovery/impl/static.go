@@ -0,0 +1,59 @@
+package discoveryimpl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/discovery"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// Static is a PeerResolver with a fixed list of peers for each payload CID,
+// for example loaded from a config file
+type Static struct {
+	peers map[cid.Cid][]retrievalmarket.RetrievalPeer
+}
+
+var _ discovery.PeerResolver = (*Static)(nil)
+
+// NewStatic creates a resolver from a map of payload CID to peers
+func NewStatic(peers map[cid.Cid][]retrievalmarket.RetrievalPeer) *Static {
+	return &Static{peers: peers}
+}
+
+// LoadStatic creates a resolver from a JSON file that maps payload CIDs to
+// lists of peers, eg
+//
+//	{"bafy...": [{"Address": "f01000", "ID": "12D3Koo...", "PieceCID": {"/": "baga..."}}]}
+func LoadStatic(path string) (*Static, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("reading static peers file: %w", err)
+	}
+	var entries map[string][]retrievalmarket.RetrievalPeer
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, xerrors.Errorf("parsing static peers file %s: %w", path, err)
+	}
+
+	peers := make(map[cid.Cid][]retrievalmarket.RetrievalPeer, len(entries))
+	for k, v := range entries {
+		c, err := cid.Parse(k)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing payload CID %s in static peers file: %w", k, err)
+		}
+		peers[c] = append(peers[c], v...)
+	}
+	return NewStatic(peers), nil
+}
+
+// GetPeers returns the peers configured for the payload CID
+func (s *Static) GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) {
+	peers, ok := s.peers[payloadCID]
+	if !ok {
+		return []retrievalmarket.RetrievalPeer{}, nil
+	}
+	return append([]retrievalmarket.RetrievalPeer{}, peers...), nil
+}
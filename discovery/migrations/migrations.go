@@ -1,6 +1,10 @@
 package migrations
 
 import (
+	"time"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	"github.com/filecoin-project/go-ds-versioning/pkg/versioned"
 
@@ -31,7 +35,25 @@ func MigrateRetrievalPeers0To1(oldRps *RetrievalPeers0) (*discovery.RetrievalPee
 	}, nil
 }
 
+// MigrateRetrievalPeers1To2 migrates a list of retrieval peers to a list of
+// entries with a last seen time. Existing peers are treated as seen at the
+// time of the migration.
+func MigrateRetrievalPeers1To2(oldRps *discovery.RetrievalPeers) (*discovery.RetrievalPeerEntries, error) {
+	now := cbg.CborTime(time.Unix(0, time.Now().UnixNano()).UTC())
+	entries := make([]discovery.RetrievalPeerEntry, 0, len(oldRps.Peers))
+	for _, p := range oldRps.Peers {
+		entries = append(entries, discovery.RetrievalPeerEntry{
+			Peer:     p,
+			LastSeen: now,
+		})
+	}
+	return &discovery.RetrievalPeerEntries{
+		Peers: entries,
+	}, nil
+}
+
 // RetrievalPeersMigrations are migrations for the store local discovery list of peers we can retrieve from
 var RetrievalPeersMigrations = versioned.BuilderList{
 	versioned.NewVersionedBuilder(MigrateRetrievalPeers0To1, versioning.VersionKey("1")),
+	versioned.NewVersionedBuilder(MigrateRetrievalPeers1To2, versioning.VersionKey("2")).OldVersion("1"),
 }
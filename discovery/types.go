@@ -1,19 +1,91 @@
 package discovery
 
 import (
+	"context"
+
 	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 )
 
-//go:generate cbor-gen-for --map-encoding RetrievalPeers
+//go:generate cbor-gen-for --map-encoding RetrievalPeers RetrievalPeerEntry RetrievalPeerEntries
 
 // RetrievalPeers is a convenience struct for encoding slices of RetrievalPeer
 type RetrievalPeers struct {
 	Peers []retrievalmarket.RetrievalPeer
 }
 
+// RetrievalPeerEntry is a peer in the local list of peers for a payload CID,
+// with the last time it was added or refreshed
+type RetrievalPeerEntry struct {
+	Peer     retrievalmarket.RetrievalPeer
+	LastSeen cbg.CborTime
+}
+
+// RetrievalPeerEntries is the local list of peers for a payload CID
+type RetrievalPeerEntries struct {
+	Peers []RetrievalPeerEntry
+}
+
 // PeerResolver is an interface for looking up providers that may have a piece
 type PeerResolver interface {
-	GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error) // TODO: channel
+	GetPeers(payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error)
+}
+
+// ContextPeerResolver is a PeerResolver that can stop looking up peers when
+// the context is cancelled, eg because the caller has given up waiting
+type ContextPeerResolver interface {
+	PeerResolver
+
+	GetPeersContext(ctx context.Context, payloadCID cid.Cid) ([]retrievalmarket.RetrievalPeer, error)
+}
+
+// PeerResult is a peer found by a StreamingPeerResolver, or an error from
+// one of the places it looks for peers
+type PeerResult struct {
+	Peer retrievalmarket.RetrievalPeer
+	Err  error
+}
+
+// StreamingPeerResolver is a PeerResolver that can send peers as soon as
+// they are found, rather than waiting for the whole list
+type StreamingPeerResolver interface {
+	PeerResolver
+
+	// GetPeersAsync sends the peers for a payload CID on the returned
+	// channel as they are found. The channel is closed once the lookup is
+	// complete or the context is cancelled.
+	GetPeersAsync(ctx context.Context, payloadCID cid.Cid) <-chan PeerResult
+}
+
+// StreamPeers looks up the peers for a payload CID with the given resolver,
+// streaming them if the resolver supports it. For other resolvers, all the
+// peers are sent at once when GetPeers returns.
+func StreamPeers(ctx context.Context, r PeerResolver, payloadCID cid.Cid) <-chan PeerResult {
+	if sr, ok := r.(StreamingPeerResolver); ok {
+		return sr.GetPeersAsync(ctx, payloadCID)
+	}
+
+	out := make(chan PeerResult)
+	go func() {
+		defer close(out)
+
+		peers, err := r.GetPeers(payloadCID)
+		if err != nil {
+			select {
+			case out <- PeerResult{Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		for _, p := range peers {
+			select {
+			case out <- PeerResult{Peer: p}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
 }
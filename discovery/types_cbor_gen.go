@@ -128,3 +128,219 @@ func (t *RetrievalPeers) UnmarshalCBOR(r io.Reader) error {
 
 	return nil
 }
+func (t *RetrievalPeerEntry) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{162}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Peer (retrievalmarket.RetrievalPeer) (struct)
+	if len("Peer") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Peer\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Peer"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Peer")); err != nil {
+		return err
+	}
+
+	if err := t.Peer.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.LastSeen (typegen.CborTime) (struct)
+	if len("LastSeen") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"LastSeen\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("LastSeen"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("LastSeen")); err != nil {
+		return err
+	}
+
+	if err := t.LastSeen.MarshalCBOR(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *RetrievalPeerEntry) UnmarshalCBOR(r io.Reader) error {
+	*t = RetrievalPeerEntry{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("RetrievalPeerEntry: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Peer (retrievalmarket.RetrievalPeer) (struct)
+		case "Peer":
+
+			{
+
+				if err := t.Peer.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.Peer: %w", err)
+				}
+
+			}
+			// t.LastSeen (typegen.CborTime) (struct)
+		case "LastSeen":
+
+			{
+
+				if err := t.LastSeen.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.LastSeen: %w", err)
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *RetrievalPeerEntries) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{161}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Peers ([]discovery.RetrievalPeerEntry) (slice)
+	if len("Peers") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Peers\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Peers"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Peers")); err != nil {
+		return err
+	}
+
+	if len(t.Peers) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.Peers was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, uint64(len(t.Peers))); err != nil {
+		return err
+	}
+	for _, v := range t.Peers {
+		if err := v.MarshalCBOR(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *RetrievalPeerEntries) UnmarshalCBOR(r io.Reader) error {
+	*t = RetrievalPeerEntries{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("RetrievalPeerEntries: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Peers ([]discovery.RetrievalPeerEntry) (slice)
+		case "Peers":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.Peers: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.Peers = make([]RetrievalPeerEntry, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				var v RetrievalPeerEntry
+				if err := v.UnmarshalCBOR(br); err != nil {
+					return err
+				}
+
+				t.Peers[i] = v
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
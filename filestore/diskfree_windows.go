@@ -0,0 +1,7 @@
+package filestore
+
+// diskFree does not know the free space on Windows, so only quotas limit
+// the space used
+func diskFree(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,481 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageRescanInterval is how often the space used in a root directory is
+// recomputed from the files on disk, to account for files that were added or
+// removed outside of the file store
+const usageRescanInterval = 10 * time.Minute
+
+// ErrInsufficientSpace is returned when a file store does not have enough
+// space for a file
+var ErrInsufficientSpace = errors.New("insufficient space in file store")
+
+// Root is a root directory of a multi-directory file store
+type Root struct {
+	Path OsPath
+	// Quota is the maximum number of bytes of files in the root directory,
+	// or zero for no quota
+	Quota int64
+}
+
+// RootUsage is the space used in a root directory
+type RootUsage struct {
+	Path  OsPath
+	Quota int64
+	// Used is the total size of the files in the root directory
+	Used int64
+	// Reserved is the space reserved for files to grow into
+	Reserved int64
+	// Available is the space left for new data, within both the quota and
+	// the free space on disk
+	Available int64
+}
+
+// Usage is the space used in each root directory of a file store, and in
+// total
+type Usage struct {
+	Roots     []RootUsage
+	Used      int64
+	Reserved  int64
+	Available int64
+}
+
+// SpaceReserver is implemented by file stores that account for the space
+// their files use, so that space can be reserved for a file before it is
+// written, eg for the data of a deal that is being transferred
+type SpaceReserver interface {
+	// Reserve reserves space for the file at the given path to grow to the
+	// given size. It returns ErrInsufficientSpace if there is not enough
+	// space in the file's root directory. The reservation is released when
+	// the file is deleted. Reservations are only held in memory, so they
+	// have to be made again when the process restarts.
+	Reserve(p OsPath, size int64) error
+	// Release releases the space reserved for a file
+	Release(p OsPath)
+	// Usage reports the space used by the file store
+	Usage() (Usage, error)
+}
+
+// MultiFileStore is a FileStore that spreads files across several root
+// directories
+type MultiFileStore interface {
+	FileStore
+	SpaceReserver
+}
+
+type multiRoot struct {
+	base  string
+	quota int64
+
+	// used is the total size of the files in the root directory, other
+	// than the files that are being written
+	used int64
+	// scanned is when used was last computed from the files on disk, or
+	// zero if it never was
+	scanned time.Time
+}
+
+type reservation struct {
+	root *multiRoot
+	size int64
+}
+
+type multiFileStore struct {
+	roots []*multiRoot
+	// diskFree returns the free space on the disk of a directory, or -1 if
+	// it is not known
+	diskFree func(dir string) (int64, error)
+
+	lk           sync.Mutex
+	reservations map[OsPath]reservation
+	// writing holds the files that may still grow: the files that were
+	// created by the file store and are still open, and the files that have
+	// space reserved. Their size is read each time usage is computed, and
+	// is added to the used space of their root once they are done.
+	writing map[OsPath]*writingFile
+}
+
+type writingFile struct {
+	root *multiRoot
+	open bool
+}
+
+var _ MultiFileStore = (*multiFileStore)(nil)
+
+// NewMultiFileStore creates a file store with files in several local root
+// directories. New files are created in the root directory with the most
+// space available, within its quota and the free space on its disk.
+func NewMultiFileStore(roots []Root) (MultiFileStore, error) {
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no root directories")
+	}
+
+	mroots := make([]*multiRoot, 0, len(roots))
+	for _, r := range roots {
+		base, err := checkIsDir(string(r.Path))
+		if err != nil {
+			return nil, err
+		}
+		// Absolute paths are needed to find the root directory of OS paths
+		base, err = filepath.Abs(base)
+		if err != nil {
+			return nil, err
+		}
+		if r.Quota < 0 {
+			return nil, fmt.Errorf("negative quota %d for %s", r.Quota, base)
+		}
+		mroots = append(mroots, &multiRoot{base: base, quota: r.Quota})
+	}
+	return &multiFileStore{
+		roots:        mroots,
+		diskFree:     diskFree,
+		reservations: make(map[OsPath]reservation),
+		writing:      make(map[OsPath]*writingFile),
+	}, nil
+}
+
+// find returns the root directory that has a file
+func (fs *multiFileStore) find(p Path) (*multiRoot, bool) {
+	for _, r := range fs.roots {
+		if _, err := os.Stat(filepath.Join(r.base, string(p))); err == nil {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func (fs *multiFileStore) Open(p Path) (File, error) {
+	r, ok := fs.find(p)
+	if !ok {
+		return nil, fmt.Errorf("error trying to open %s: no such file in any root directory", p)
+	}
+	return newFile(OsPath(r.base), p)
+}
+
+func (fs *multiFileStore) Create(p Path) (File, error) {
+	if r, ok := fs.find(p); ok {
+		return nil, fmt.Errorf("file %s already exists", filepath.Join(r.base, string(p)))
+	}
+	return fs.create(func(r *multiRoot) (File, error) {
+		return newFile(OsPath(r.base), p)
+	})
+}
+
+func (fs *multiFileStore) Store(p Path, src File) (Path, error) {
+	dest, err := fs.Create(p)
+	if err != nil {
+		return Path(""), err
+	}
+
+	if _, err = io.Copy(dest, src); err != nil {
+		dest.Close()
+		return Path(""), err
+	}
+	return p, dest.Close()
+}
+
+func (fs *multiFileStore) Delete(p Path) error {
+	r, ok := fs.find(p)
+	if !ok {
+		return fmt.Errorf("error trying to delete %s: no such file in any root directory", p)
+	}
+	full := OsPath(filepath.Join(r.base, string(p)))
+
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	delete(fs.reservations, full)
+	_, writing := fs.writing[full]
+	delete(fs.writing, full)
+	size := fileSize(full)
+	if err := os.Remove(string(full)); err != nil {
+		return err
+	}
+	// The size of a file that was being written is not in the used space
+	if !writing && !r.scanned.IsZero() && size > 0 {
+		r.used -= size
+		if r.used < 0 {
+			r.used = 0
+		}
+	}
+	return nil
+}
+
+func (fs *multiFileStore) CreateTemp() (File, error) {
+	return fs.create(func(r *multiRoot) (File, error) {
+		f, err := ioutil.TempFile(r.base, "fstmp")
+		if err != nil {
+			return nil, err
+		}
+		filename := filepath.Base(f.Name())
+		return &fd{File: f, basepath: r.base, filename: filename}, nil
+	})
+}
+
+// create creates a file in the root directory with the most space available,
+// and tracks its size until it is closed
+func (fs *multiFileStore) create(open func(r *multiRoot) (File, error)) (File, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	r, err := fs.pickRootLocked()
+	if err != nil {
+		return nil, err
+	}
+	// The file is created under the lock so that it is not counted by a
+	// scan of the root directory as well as a file being written
+	f, err := open(r)
+	if err != nil {
+		return nil, err
+	}
+	p, err := absPath(f.OsPath())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fs.writing[p] = &writingFile{root: r, open: true}
+	return &trackedFile{File: f, fs: fs, path: p}, nil
+}
+
+// trackedFile is a file created by a multi-directory file store, which stops
+// tracking the size of the file as it is written once the file is closed
+type trackedFile struct {
+	File
+	fs   *multiFileStore
+	path OsPath
+	once sync.Once
+}
+
+func (f *trackedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() {
+		f.fs.lk.Lock()
+		defer f.fs.lk.Unlock()
+		if w, ok := f.fs.writing[f.path]; ok {
+			w.open = false
+			f.fs.doneWritingLocked(f.path)
+		}
+	})
+	return err
+}
+
+func (fs *multiFileStore) Reserve(p OsPath, size int64) error {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	p, err := absPath(p)
+	if err != nil {
+		return err
+	}
+	r, ok := fs.rootOf(p)
+	if !ok {
+		return fmt.Errorf("%s is not in any root directory", p)
+	}
+
+	current := fileSize(p)
+	if current < 0 {
+		return fmt.Errorf("error reserving space for %s: no such file", p)
+	}
+
+	// Replace any earlier reservation for the file, and track its size as
+	// it grows
+	delete(fs.reservations, p)
+	if _, ok := fs.writing[p]; !ok {
+		if !r.scanned.IsZero() {
+			r.used -= current
+		}
+		fs.writing[p] = &writingFile{root: r}
+	}
+	ru, err := fs.usageLocked(r, false)
+	if err != nil {
+		fs.doneWritingLocked(p)
+		return err
+	}
+	need := size - current
+	if need > ru.Available {
+		fs.doneWritingLocked(p)
+		return fmt.Errorf("reserving %d bytes for %s with %d bytes available in %s: %w", need, p, ru.Available, r.base, ErrInsufficientSpace)
+	}
+	fs.reservations[p] = reservation{root: r, size: size}
+	return nil
+}
+
+func (fs *multiFileStore) Release(p OsPath) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	if p, err := absPath(p); err == nil {
+		delete(fs.reservations, p)
+		fs.doneWritingLocked(p)
+	}
+}
+
+// doneWritingLocked stops tracking the size of a file that is neither open
+// nor reserved, and adds its size to the used space of its root
+func (fs *multiFileStore) doneWritingLocked(p OsPath) {
+	w, ok := fs.writing[p]
+	if !ok || w.open {
+		return
+	}
+	if _, ok := fs.reservations[p]; ok {
+		return
+	}
+	delete(fs.writing, p)
+	if size := fileSize(p); size > 0 && !w.root.scanned.IsZero() {
+		w.root.used += size
+	}
+}
+
+func (fs *multiFileStore) Usage() (Usage, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	var u Usage
+	for _, r := range fs.roots {
+		ru, err := fs.usageLocked(r, true)
+		if err != nil {
+			return Usage{}, err
+		}
+		u.Roots = append(u.Roots, ru)
+		u.Used += ru.Used
+		u.Reserved += ru.Reserved
+		if u.Available > math.MaxInt64-ru.Available {
+			u.Available = math.MaxInt64
+		} else {
+			u.Available += ru.Available
+		}
+	}
+	return u, nil
+}
+
+// pickRootLocked returns the root directory with the most space available
+func (fs *multiFileStore) pickRootLocked() (*multiRoot, error) {
+	var best *multiRoot
+	var bestAvailable int64
+	for _, r := range fs.roots {
+		ru, err := fs.usageLocked(r, false)
+		if err != nil {
+			return nil, err
+		}
+		if ru.Available > bestAvailable {
+			best, bestAvailable = r, ru.Available
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no space available in any root directory: %w", ErrInsufficientSpace)
+	}
+	return best, nil
+}
+
+// rootOf returns the root directory that contains an OS path
+func (fs *multiFileStore) rootOf(p OsPath) (*multiRoot, bool) {
+	for _, r := range fs.roots {
+		rel, err := filepath.Rel(r.base, string(p))
+		if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// usageLocked computes the space used in a root directory, from the cached
+// size of the files that are done and the current size of the files that are
+// being written. The root directory is scanned again if rescan is true or if
+// the cached size is out of date. Files being written that no longer exist
+// are dropped, along with their reservations.
+func (fs *multiFileStore) usageLocked(r *multiRoot, rescan bool) (RootUsage, error) {
+	ru := RootUsage{Path: OsPath(r.base), Quota: r.quota}
+
+	if rescan || r.scanned.IsZero() || time.Since(r.scanned) > usageRescanInterval {
+		if err := fs.scanLocked(r); err != nil {
+			return RootUsage{}, err
+		}
+	}
+	ru.Used = r.used
+
+	for p, w := range fs.writing {
+		if w.root != r {
+			continue
+		}
+		size := fileSize(p)
+		if size < 0 {
+			delete(fs.writing, p)
+			delete(fs.reservations, p)
+			continue
+		}
+		ru.Used += size
+		if res, ok := fs.reservations[p]; ok && res.size > size {
+			ru.Reserved += res.size - size
+		}
+	}
+
+	ru.Available = math.MaxInt64
+	free, err := fs.diskFree(r.base)
+	if err != nil {
+		return RootUsage{}, fmt.Errorf("error getting free space on disk of %s: %w", r.base, err)
+	}
+	if free >= 0 {
+		ru.Available = free - ru.Reserved
+	}
+	if r.quota > 0 && r.quota-ru.Used-ru.Reserved < ru.Available {
+		ru.Available = r.quota - ru.Used - ru.Reserved
+	}
+	if ru.Available < 0 {
+		ru.Available = 0
+	}
+	return ru, nil
+}
+
+// scanLocked computes the total size of the files in a root directory, other
+// than the files that are being written
+func (fs *multiFileStore) scanLocked(r *multiRoot) error {
+	var used int64
+	err := filepath.Walk(r.base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files can be deleted while the directory is walked
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, ok := fs.writing[OsPath(path)]; !ok {
+			used += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error computing usage of %s: %w", r.base, err)
+	}
+	r.used = used
+	r.scanned = time.Now()
+	return nil
+}
+
+func absPath(p OsPath) (OsPath, error) {
+	abs, err := filepath.Abs(string(p))
+	return OsPath(abs), err
+}
+
+// fileSize returns the size of a file, or -1 if it does not exist
+func fileSize(p OsPath) int64 {
+	info, err := os.Stat(string(p))
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
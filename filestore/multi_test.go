@@ -0,0 +1,147 @@
+package filestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMultiFileStore(t *testing.T, quotas ...int64) (*multiFileStore, []string) {
+	var roots []Root
+	var dirs []string
+	for _, quota := range quotas {
+		dir := t.TempDir()
+		roots = append(roots, Root{Path: OsPath(dir), Quota: quota})
+		dirs = append(dirs, dir)
+	}
+	store, err := NewMultiFileStore(roots)
+	require.NoError(t, err)
+	fs := store.(*multiFileStore)
+	fs.diskFree = func(string) (int64, error) { return 10000, nil }
+	return fs, dirs
+}
+
+func Test_MultiCreatesInRootWithMostSpace(t *testing.T) {
+	fs, dirs := newTestMultiFileStore(t, 1000, 3000)
+
+	f, err := fs.CreateTemp()
+	require.NoError(t, err)
+	require.Equal(t, dirs[1], filepath.Dir(string(f.OsPath())))
+	_, err = f.Write(randBytes(500))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Reserve space for the file to grow to 2600 bytes
+	require.NoError(t, fs.Reserve(f.OsPath(), 2600))
+	u, err := fs.Usage()
+	require.NoError(t, err)
+	require.Equal(t, RootUsage{Path: OsPath(dirs[1]), Quota: 3000, Used: 500, Reserved: 2100, Available: 400}, u.Roots[1])
+	require.Equal(t, RootUsage{Path: OsPath(dirs[0]), Quota: 1000, Available: 1000}, u.Roots[0])
+	require.Equal(t, int64(1400), u.Available)
+
+	// The other root now has more space
+	f2, err := fs.Create("b.txt")
+	require.NoError(t, err)
+	require.Equal(t, dirs[0], filepath.Dir(string(f2.OsPath())))
+	require.NoError(t, f2.Close())
+	err = fs.Reserve(f2.OsPath(), 1500)
+	require.True(t, errors.Is(err, ErrInsufficientSpace))
+
+	// Files are found in whichever root they are in
+	_, err = fs.Create("b.txt")
+	require.Error(t, err)
+	opened, err := fs.Open(f.Path())
+	require.NoError(t, err)
+	require.Equal(t, int64(500), opened.Size())
+	require.NoError(t, opened.Close())
+
+	// Deleting a file releases its reservation
+	require.NoError(t, fs.Delete(f.Path()))
+	u, err = fs.Usage()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), u.Reserved)
+	require.Equal(t, int64(3000), u.Roots[1].Available)
+}
+
+func Test_MultiLimitedByDiskFree(t *testing.T) {
+	fs, _ := newTestMultiFileStore(t, 1000, 0)
+	fs.diskFree = func(string) (int64, error) { return 200, nil }
+
+	f, err := fs.CreateTemp()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.Reserve(f.OsPath(), 200))
+	err = fs.Reserve(f.OsPath(), 201)
+	require.True(t, errors.Is(err, ErrInsufficientSpace))
+
+	// A reservation for a file that was removed outside the file store is
+	// dropped
+	require.NoError(t, fs.Reserve(f.OsPath(), 150))
+	require.NoError(t, os.Remove(string(f.OsPath())))
+	u, err := fs.Usage()
+	require.NoError(t, err)
+	require.Equal(t, int64(400), u.Available)
+
+	// No space left in any root
+	fs.diskFree = func(string) (int64, error) { return 0, nil }
+	_, err = fs.CreateTemp()
+	require.True(t, errors.Is(err, ErrInsufficientSpace))
+}
+
+func Test_MultiCachesUsage(t *testing.T) {
+	fs, dirs := newTestMultiFileStore(t, 1000)
+	r := fs.roots[0]
+
+	// A file that is being written is counted at its current size
+	f, err := fs.Create("a.txt")
+	require.NoError(t, err)
+	_, err = f.Write(randBytes(100))
+	require.NoError(t, err)
+	ru, err := fs.usageLocked(r, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), ru.Used)
+	scanned := r.scanned
+
+	// Closing the file adds its size to the cached usage, without scanning
+	// the root directory again
+	require.NoError(t, f.Close())
+	require.Equal(t, int64(100), r.used)
+	ru, err = fs.usageLocked(r, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), ru.Used)
+	require.Equal(t, scanned, r.scanned)
+
+	// A file added outside the file store is counted once the root
+	// directory is scanned again
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dirs[0], "b.txt"), randBytes(50), 0644))
+	ru, err = fs.usageLocked(r, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), ru.Used)
+	u, err := fs.Usage()
+	require.NoError(t, err)
+	require.Equal(t, int64(150), u.Used)
+
+	// Deleting a file removes its size from the cached usage
+	require.NoError(t, fs.Delete("a.txt"))
+	ru, err = fs.usageLocked(r, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), ru.Used)
+
+	// A reserved file is counted at its current size as it grows, and
+	// added to the cached usage when its reservation is released
+	f, err = fs.CreateTemp()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, fs.Reserve(f.OsPath(), 500))
+	require.NoError(t, ioutil.WriteFile(string(f.OsPath()), randBytes(200), 0644))
+	ru, err = fs.usageLocked(r, false)
+	require.NoError(t, err)
+	require.Equal(t, int64(250), ru.Used)
+	require.Equal(t, int64(300), ru.Reserved)
+	fs.Release(f.OsPath())
+	require.Equal(t, int64(250), r.used)
+}
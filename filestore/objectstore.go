@@ -0,0 +1,372 @@
+package filestore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrObjectNotFound is returned by an ObjectStore for an object that does
+// not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// CompletedPart is a part of a multipart upload that has been uploaded
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// ObjectStore is an S3-style object store API
+type ObjectStore interface {
+	// Location returns a URL for an object, eg s3://bucket/key
+	Location(key string) string
+	// Head returns the size of an object
+	Head(ctx context.Context, key string) (int64, error)
+	// GetRange reads length bytes of an object from the given offset
+	GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error)
+	// CreateMultipartUpload starts a multipart upload of an object
+	CreateMultipartUpload(ctx context.Context, key string) (string, error)
+	// UploadPart uploads a part of a multipart upload, and returns the
+	// part's ETag. Part numbers start at 1.
+	UploadPart(ctx context.Context, key string, uploadID string, partNumber int, data []byte) (string, error)
+	// CompleteMultipartUpload creates the object from the uploaded parts
+	CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []CompletedPart) error
+	// AbortMultipartUpload discards the parts of a multipart upload
+	AbortMultipartUpload(ctx context.Context, key string, uploadID string) error
+	// Delete deletes an object
+	Delete(ctx context.Context, key string) error
+}
+
+// NonLocalFileStore is implemented by file stores whose files are not on
+// the local file system. The OsPath of their files cannot be opened with
+// the os package, and is mapped back to a path in the store with PathFor.
+type NonLocalFileStore interface {
+	FileStore
+	// PathFor returns the path in the store of a file, given its OsPath. It
+	// returns false if the OsPath is not a file of the store.
+	PathFor(p OsPath) (Path, bool)
+}
+
+// DefaultPartSize is the default size of the parts of a multipart upload
+const DefaultPartSize = 16 << 20
+
+// ObjectFileStoreOption configures an object file store
+type ObjectFileStoreOption func(*objectFileStore)
+
+// KeyPrefix sets a prefix for the keys of the objects of a file store, eg
+// staging/
+func KeyPrefix(prefix string) ObjectFileStoreOption {
+	return func(fs *objectFileStore) {
+		fs.prefix = prefix
+	}
+}
+
+// PartSize sets the size of the parts of multipart uploads. S3 needs parts
+// of at least 5MiB, except for the last part.
+func PartSize(size int) ObjectFileStoreOption {
+	return func(fs *objectFileStore) {
+		fs.partSize = size
+	}
+}
+
+type objectFileStore struct {
+	store    ObjectStore
+	prefix   string
+	partSize int
+}
+
+var _ NonLocalFileStore = (*objectFileStore)(nil)
+
+// NewObjectFileStore creates a file store that keeps files as objects in an
+// object store. Files are written with multipart uploads, and are not
+// visible to Open until they are closed, or seeked or read back. Files that
+// have been written are read-only.
+func NewObjectFileStore(store ObjectStore, opts ...ObjectFileStoreOption) (NonLocalFileStore, error) {
+	fs := &objectFileStore{store: store, partSize: DefaultPartSize}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	if fs.partSize <= 0 {
+		return nil, fmt.Errorf("invalid part size %d", fs.partSize)
+	}
+	return fs, nil
+}
+
+func (fs *objectFileStore) key(p Path) string {
+	return fs.prefix + strings.TrimPrefix(string(p), "/")
+}
+
+func (fs *objectFileStore) Open(p Path) (File, error) {
+	key := fs.key(p)
+	size, err := fs.store.Head(context.TODO(), key)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to open %s: %w", fs.store.Location(key), err)
+	}
+	return &objectFile{fs: fs, path: p, key: key, size: size}, nil
+}
+
+func (fs *objectFileStore) Create(p Path) (File, error) {
+	key := fs.key(p)
+	_, err := fs.store.Head(context.TODO(), key)
+	if err == nil {
+		return nil, fmt.Errorf("file %s already exists", fs.store.Location(key))
+	}
+	if !errors.Is(err, ErrObjectNotFound) {
+		return nil, fmt.Errorf("error checking if %s exists: %w", fs.store.Location(key), err)
+	}
+	return &objectFile{fs: fs, path: p, key: key, writing: true}, nil
+}
+
+func (fs *objectFileStore) Store(p Path, src File) (Path, error) {
+	dest, err := fs.Create(p)
+	if err != nil {
+		return Path(""), err
+	}
+
+	if _, err = io.Copy(dest, src); err != nil {
+		dest.Close()
+		return Path(""), err
+	}
+	return p, dest.Close()
+}
+
+func (fs *objectFileStore) Delete(p Path) error {
+	return fs.store.Delete(context.TODO(), fs.key(p))
+}
+
+func (fs *objectFileStore) CreateTemp() (File, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	return fs.Create(Path("fstmp" + hex.EncodeToString(b[:])))
+}
+
+func (fs *objectFileStore) PathFor(p OsPath) (Path, bool) {
+	base := fs.store.Location(fs.prefix)
+	if !strings.HasPrefix(string(p), base) || len(p) == len(base) {
+		return "", false
+	}
+	return Path(strings.TrimPrefix(string(p), base)), true
+}
+
+// objectFile is a file that is being uploaded, or an object that is read
+// with ranged reads
+type objectFile struct {
+	fs   *objectFileStore
+	path Path
+	key  string
+
+	// writing is true until the upload is completed
+	writing  bool
+	uploadID string
+	parts    []CompletedPart
+	buf      []byte
+	written  int64
+	err      error
+
+	size   int64
+	offset int64
+	// body is the response of the ranged read from offset to the end of
+	// the object, while reading sequentially
+	body io.ReadCloser
+}
+
+var _ io.ReaderAt = (*objectFile)(nil)
+
+func (f *objectFile) Path() Path {
+	return f.path
+}
+
+func (f *objectFile) OsPath() OsPath {
+	return OsPath(f.fs.store.Location(f.key))
+}
+
+func (f *objectFile) Size() int64 {
+	if f.writing {
+		return f.written
+	}
+	return f.size
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if !f.writing {
+		return 0, fmt.Errorf("cannot write to %s: file has been uploaded", f.OsPath())
+	}
+
+	f.buf = append(f.buf, p...)
+	f.written += int64(len(p))
+	for len(f.buf) >= f.fs.partSize {
+		if err := f.uploadPart(f.buf[:f.fs.partSize]); err != nil {
+			return 0, err
+		}
+		f.buf = append(f.buf[:0], f.buf[f.fs.partSize:]...)
+	}
+	return len(p), nil
+}
+
+func (f *objectFile) uploadPart(data []byte) error {
+	ctx := context.TODO()
+	if f.uploadID == "" {
+		uploadID, err := f.fs.store.CreateMultipartUpload(ctx, f.key)
+		if err != nil {
+			f.err = fmt.Errorf("error starting upload of %s: %w", f.OsPath(), err)
+			return f.err
+		}
+		f.uploadID = uploadID
+	}
+
+	partNumber := len(f.parts) + 1
+	etag, err := f.fs.store.UploadPart(ctx, f.key, f.uploadID, partNumber, data)
+	if err != nil {
+		f.err = f.abort(fmt.Errorf("error uploading part %d of %s: %w", partNumber, f.OsPath(), err))
+		return f.err
+	}
+	f.parts = append(f.parts, CompletedPart{PartNumber: partNumber, ETag: etag})
+	return nil
+}
+
+// abort aborts a failed upload, adding any error aborting it to the error
+// of the failure
+func (f *objectFile) abort(err error) error {
+	if aerr := f.fs.store.AbortMultipartUpload(context.TODO(), f.key, f.uploadID); aerr != nil {
+		return fmt.Errorf("%w (error aborting upload: %s)", err, aerr)
+	}
+	return err
+}
+
+// complete uploads the last part and completes the upload, after which the
+// file can be read
+func (f *objectFile) complete() error {
+	if f.err != nil {
+		return f.err
+	}
+	if !f.writing {
+		return nil
+	}
+
+	// An empty file is uploaded as a single empty part
+	if len(f.buf) > 0 || len(f.parts) == 0 {
+		if err := f.uploadPart(f.buf); err != nil {
+			return err
+		}
+		f.buf = nil
+	}
+	if err := f.fs.store.CompleteMultipartUpload(context.TODO(), f.key, f.uploadID, f.parts); err != nil {
+		f.err = f.abort(fmt.Errorf("error completing upload of %s: %w", f.OsPath(), err))
+		return f.err
+	}
+
+	f.writing = false
+	f.size = f.written
+	// Like a file opened for appending, the offset is at the end
+	f.offset = f.size
+	return nil
+}
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	if err := f.complete(); err != nil {
+		return 0, err
+	}
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if f.body == nil {
+		body, err := f.fs.store.GetRange(context.TODO(), f.key, f.offset, f.size-f.offset)
+		if err != nil {
+			return 0, fmt.Errorf("error reading %s at offset %d: %w", f.OsPath(), f.offset, err)
+		}
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF {
+		f.closeBody()
+		if f.offset < f.size {
+			// The response ended early, the next read starts a new one
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func (f *objectFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.complete(); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	length := int64(len(p))
+	if length > f.size-off {
+		length = f.size - off
+	}
+	body, err := f.fs.store.GetRange(context.TODO(), f.key, off, length)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s at offset %d: %w", f.OsPath(), off, err)
+	}
+	defer body.Close() // nolint
+
+	n, err := io.ReadFull(body, p[:length])
+	if err != nil {
+		return n, err
+	}
+	if length < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.complete(); err != nil {
+		return 0, err
+	}
+
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.offset + offset
+	case io.SeekEnd:
+		abs = f.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("negative position %d", abs)
+	}
+	if abs != f.offset {
+		f.closeBody()
+		f.offset = abs
+	}
+	return abs, nil
+}
+
+func (f *objectFile) closeBody() {
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+}
+
+func (f *objectFile) Close() error {
+	f.closeBody()
+	return f.complete()
+}
@@ -0,0 +1,281 @@
+package filestore
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-process stand-in for an S3 bucket, addressed path-style
+type fakeS3 struct {
+	t      *testing.T
+	bucket string
+
+	lk        sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	nextID    int
+	parts     int
+	aborted   int
+	failParts bool
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, ObjectStore) {
+	f := &fakeS3{
+		t:       t,
+		bucket:  "staging",
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	store, err := NewS3ObjectStore(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    f.bucket,
+		AccessKey: "AKID",
+		SecretKey: "secret",
+	})
+	require.NoError(t, err)
+	return f, store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("x-amz-date") == "" {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "request is not signed")
+		return
+	}
+	prefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "no such bucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	query := r.URL.Query()
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(f.t, err)
+
+	switch {
+	case r.Method == http.MethodPost && has(query, "uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+
+	case r.Method == http.MethodPut && has(query, "uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "no such upload")
+			return
+		}
+		if f.failParts {
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "part failed")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[n] = body
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+
+	case r.Method == http.MethodPost && has(query, "uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "no such upload")
+			return
+		}
+		var complete completeMultipartUpload
+		require.NoError(f.t, xml.Unmarshal(body, &complete))
+		var data []byte
+		for i, p := range complete.Parts {
+			require.Equal(f.t, i+1, p.PartNumber)
+			require.Equal(f.t, fmt.Sprintf(`"%d"`, p.PartNumber), p.ETag)
+			data = append(data, parts[p.PartNumber]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = data
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodDelete && has(query, "uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "no such key")
+			return
+		}
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		var start, end int
+		_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		require.NoError(f.t, err)
+		if start >= len(data) {
+			writeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "invalid range")
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[start : end+1])
+
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func has(query url.Values, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+func Test_ObjectWriteAndRead(t *testing.T) {
+	s3, store := newFakeS3(t)
+	fs, err := NewObjectFileStore(store, KeyPrefix("deals/"), PartSize(10))
+	require.NoError(t, err)
+
+	data := randBytes(35)
+	f, err := fs.Create("piece.car")
+	require.NoError(t, err)
+	for i := 0; i < len(data); i += 7 {
+		_, err := f.Write(data[i : i+7])
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(35), f.Size())
+	require.Equal(t, OsPath("s3://staging/deals/piece.car"), f.OsPath())
+	require.NoError(t, f.Close())
+	require.Equal(t, 4, s3.parts)
+	require.Equal(t, data, s3.objects["deals/piece.car"])
+
+	p, ok := fs.PathFor(f.OsPath())
+	require.True(t, ok)
+	require.Equal(t, Path("piece.car"), p)
+	_, ok = fs.PathFor("/tmp/piece.car")
+	require.False(t, ok)
+
+	// Read sequentially, with seeking
+	f, err = fs.Open("piece.car")
+	require.NoError(t, err)
+	require.Equal(t, int64(35), f.Size())
+	read, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	pos, err := f.Seek(-15, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), pos)
+	read, err = ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, data[20:], read)
+
+	// Ranged reads
+	buf := make([]byte, 5)
+	n, err := f.(io.ReaderAt).ReadAt(buf, 12)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, data[12:17], buf)
+	n, err = f.(io.ReaderAt).ReadAt(buf, 32)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, data[32:], buf[:n])
+
+	_, err = f.Write([]byte("more"))
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+
+	// Copy and delete
+	f, err = fs.Open("piece.car")
+	require.NoError(t, err)
+	_, err = fs.Store("piece.car", f)
+	require.Error(t, err)
+	_, err = fs.Store("copy.car", f)
+	require.NoError(t, err)
+	require.Equal(t, data, s3.objects["deals/copy.car"])
+
+	require.NoError(t, fs.Delete("piece.car"))
+	_, err = fs.Open("piece.car")
+	require.True(t, errors.Is(err, ErrObjectNotFound))
+}
+
+func Test_ObjectTempFileReadBack(t *testing.T) {
+	s3, store := newFakeS3(t)
+	fs, err := NewObjectFileStore(store, PartSize(8))
+	require.NoError(t, err)
+
+	// Write a temp file then read it back, as imported deal data is
+	data := randBytes(20)
+	f, err := fs.CreateTemp()
+	require.NoError(t, err)
+	_, err = io.Copy(f, bytes.NewReader(data))
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+	require.NoError(t, f.Close())
+
+	keys := make([]string, 0, len(s3.objects))
+	for k := range s3.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	require.Equal(t, []string{string(f.Path())}, keys)
+
+	// An empty file is uploaded as an empty object
+	f, err = fs.Create("empty")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = fs.Open("empty")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), f.Size())
+	_, err = f.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func Test_ObjectFailedUploadIsAborted(t *testing.T) {
+	s3, store := newFakeS3(t)
+	fs, err := NewObjectFileStore(store, PartSize(4))
+	require.NoError(t, err)
+
+	s3.failParts = true
+	f, err := fs.Create("failed")
+	require.NoError(t, err)
+	_, err = f.Write(randBytes(4))
+	require.Error(t, err)
+	require.Error(t, f.Close())
+	require.Equal(t, 1, s3.aborted)
+	require.Empty(t, s3.uploads)
+
+	_, err = fs.Open("failed")
+	require.True(t, errors.Is(err, ErrObjectNotFound))
+}
@@ -0,0 +1,228 @@
+package piecestoreimpl
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+)
+
+// DSIndexPrefix is the name space for the secondary indexes of piece infos,
+// by sector ID and by deal ID, and of CID infos, by piece
+var DSIndexPrefix = "/piece-indexes"
+
+var indexesKey = datastore.NewKey(DSIndexPrefix)
+
+// indexVersionKey is set once the indexes have been backfilled from the
+// piece infos that were stored before there were indexes
+var indexVersionKey = indexesKey.ChildString("version")
+
+const indexVersion = "1"
+
+// backfillProgressKey holds the CID of the last piece indexed by a backfill
+// that has not completed yet
+var backfillProgressKey = indexesKey.ChildString("backfill")
+
+// backfillPayloadsProgressKey is set once a backfill has indexed all the
+// piece infos, and holds the last payload CID whose CID info it indexed
+var backfillPayloadsProgressKey = indexesKey.ChildString("backfill-payloads")
+
+// backfillBatchSize is the number of pieces indexed in each batch of a
+// backfill
+const backfillBatchSize = 1000
+
+var sectorsKey = indexesKey.ChildString("sector")
+var dealsKey = indexesKey.ChildString("deal")
+var payloadsKey = indexesKey.ChildString("payload")
+
+// pieceIndexes maps each sector ID to the pieces with a deal in the sector,
+// each deal ID to the piece of the deal, and each piece to the payload CIDs
+// with block locations in the piece. The index entries are written to the
+// piece store's datastore in the same batch as the piece infos and CID infos
+// they are for.
+type pieceIndexes struct {
+	ds datastore.Batching
+	// complete is set to 1 once the indexes have been backfilled
+	complete int32
+}
+
+func sectorKey(sectorID abi.SectorNumber) datastore.Key {
+	return sectorsKey.ChildString(strconv.FormatUint(uint64(sectorID), 10))
+}
+
+func dealKey(dealID abi.DealID) datastore.Key {
+	return dealsKey.ChildString(strconv.FormatUint(uint64(dealID), 10))
+}
+
+func payloadKey(pieceCID cid.Cid) datastore.Key {
+	return payloadsKey.ChildString(pieceCID.String())
+}
+
+// add indexes the deals of a piece
+func (pi *pieceIndexes) add(ctx context.Context, b datastore.Write, pieceCID cid.Cid, deals []piecestore.DealInfo) error {
+	for _, di := range deals {
+		if err := b.Put(ctx, sectorKey(di.SectorID).ChildString(pieceCID.String()), nil); err != nil {
+			return err
+		}
+		if err := b.Put(ctx, dealKey(di.DealID), pieceCID.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the index entries for deals that were removed from a
+// piece, keeping the sector entries of sectors that have remaining deals
+func (pi *pieceIndexes) remove(ctx context.Context, b datastore.Write, pieceCID cid.Cid, removed []piecestore.DealInfo, remaining []piecestore.DealInfo) error {
+	sectors := make(map[abi.SectorNumber]struct{}, len(remaining))
+	for _, di := range remaining {
+		sectors[di.SectorID] = struct{}{}
+	}
+
+	for _, di := range removed {
+		if err := b.Delete(ctx, dealKey(di.DealID)); err != nil {
+			return err
+		}
+		if _, ok := sectors[di.SectorID]; ok {
+			continue
+		}
+		if err := b.Delete(ctx, sectorKey(di.SectorID).ChildString(pieceCID.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPayload indexes a payload CID with block locations in a piece
+func (pi *pieceIndexes) addPayload(ctx context.Context, b datastore.Write, pieceCID cid.Cid, payloadCID cid.Cid) error {
+	return b.Put(ctx, payloadKey(pieceCID).ChildString(payloadCID.String()), nil)
+}
+
+// removePayload removes the index entry of a payload CID that no longer has
+// block locations in a piece
+func (pi *pieceIndexes) removePayload(ctx context.Context, b datastore.Write, pieceCID cid.Cid, payloadCID cid.Cid) error {
+	return b.Delete(ctx, payloadKey(pieceCID).ChildString(payloadCID.String()))
+}
+
+// isComplete returns true if the indexes have been backfilled, so that they
+// can be used for lookups
+func (pi *pieceIndexes) isComplete(ctx context.Context) (bool, error) {
+	if atomic.LoadInt32(&pi.complete) == 1 {
+		return true, nil
+	}
+	has, err := pi.ds.Has(ctx, indexVersionKey)
+	if err != nil {
+		return false, err
+	}
+	if has {
+		atomic.StoreInt32(&pi.complete, 1)
+	}
+	return has, nil
+}
+
+// backfillProgress returns the CID of the last piece indexed by an
+// interrupted backfill, or cid.Undef if no backfill was interrupted
+func (pi *pieceIndexes) backfillProgress(ctx context.Context) (cid.Cid, error) {
+	v, err := pi.ds.Get(ctx, backfillProgressKey)
+	if xerrors.Is(err, datastore.ErrNotFound) {
+		return cid.Undef, nil
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.Cast(v)
+}
+
+// backfillPayloadsProgress returns true if a backfill has indexed all the
+// piece infos, and the last payload CID whose CID info it indexed, or
+// cid.Undef if it has not indexed any CID infos yet
+func (pi *pieceIndexes) backfillPayloadsProgress(ctx context.Context) (bool, cid.Cid, error) {
+	v, err := pi.ds.Get(ctx, backfillPayloadsProgressKey)
+	if xerrors.Is(err, datastore.ErrNotFound) {
+		return false, cid.Undef, nil
+	}
+	if err != nil {
+		return false, cid.Undef, err
+	}
+	if len(v) == 0 {
+		return true, cid.Undef, nil
+	}
+	c, err := cid.Cast(v)
+	return true, c, err
+}
+
+// startBackfillPayloads records that a backfill has indexed all the piece
+// infos
+func (pi *pieceIndexes) startBackfillPayloads(ctx context.Context) error {
+	return pi.ds.Put(ctx, backfillPayloadsProgressKey, []byte{})
+}
+
+// completeBackfill marks the indexes as backfilled
+func (pi *pieceIndexes) completeBackfill(ctx context.Context) error {
+	b, err := pi.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(ctx, indexVersionKey, []byte(indexVersion)); err != nil {
+		return err
+	}
+	if err := b.Delete(ctx, backfillProgressKey); err != nil {
+		return err
+	}
+	if err := b.Delete(ctx, backfillPayloadsProgressKey); err != nil {
+		return err
+	}
+	if err := b.Commit(ctx); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&pi.complete, 1)
+	return nil
+}
+
+func (pi *pieceIndexes) piecesInSector(ctx context.Context, sectorID abi.SectorNumber) ([]cid.Cid, error) {
+	return pi.childCIDs(ctx, sectorKey(sectorID))
+}
+
+func (pi *pieceIndexes) payloadsInPiece(ctx context.Context, pieceCID cid.Cid) ([]cid.Cid, error) {
+	return pi.childCIDs(ctx, payloadKey(pieceCID))
+}
+
+// childCIDs returns the CIDs in the keys of the index entries under a key
+func (pi *pieceIndexes) childCIDs(ctx context.Context, key datastore.Key) ([]cid.Cid, error) {
+	// The trailing slash stops sector 1 from matching sector 10
+	res, err := pi.ds.Query(ctx, query.Query{Prefix: key.String() + "/", KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close() // nolint
+
+	var cids []cid.Cid
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		k := datastore.RawKey(r.Key).BaseNamespace()
+		c, err := cid.Parse(k)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing CID in index key %s: %w", r.Key, err)
+		}
+		cids = append(cids, c)
+	}
+	return cids, nil
+}
+
+func (pi *pieceIndexes) pieceForDeal(ctx context.Context, dealID abi.DealID) (cid.Cid, error) {
+	v, err := pi.ds.Get(ctx, dealKey(dealID))
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.Cast(v)
+}
@@ -2,6 +2,9 @@ package piecestoreimpl
 
 import (
 	"context"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
@@ -12,6 +15,7 @@ import (
 
 	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	versioned "github.com/filecoin-project/go-ds-versioning/pkg/statestore"
+	"github.com/filecoin-project/go-state-types/abi"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore/migrations"
@@ -27,93 +31,697 @@ var DSPiecePrefix = "/pieces"
 // DSCIDPrefix is the name space for storing CID infos
 var DSCIDPrefix = "/cid-infos"
 
+// backfillRetryInterval is the time to wait before retrying a backfill of
+// the indexes that failed
+var backfillRetryInterval = time.Minute
+
 // NewPieceStore returns a new piecestore based on the given datastore
 func NewPieceStore(ds datastore.Batching) (piecestore.PieceStore, error) {
 	pieceInfoMigrations, err := migrations.PieceInfoMigrations.Build()
 	if err != nil {
 		return nil, err
 	}
-	pieces, migratePieces := versioned.NewVersionedStateStore(namespace.Wrap(ds, datastore.NewKey(DSPiecePrefix)), pieceInfoMigrations, versioning.VersionKey("1"))
+	// The state stores write to the open batch, if there is one
+	bds := &batchingDatastore{Batching: ds}
+	pieces, migratePieces := versioned.NewVersionedStateStore(namespace.Wrap(bds, datastore.NewKey(DSPiecePrefix)), pieceInfoMigrations, versioning.VersionKey("1"))
 	cidInfoMigrations, err := migrations.CIDInfoMigrations.Build()
 	if err != nil {
 		return nil, err
 	}
-	cidInfos, migrateCidInfos := versioned.NewVersionedStateStore(namespace.Wrap(ds, datastore.NewKey(DSCIDPrefix)), cidInfoMigrations, versioning.VersionKey("1"))
+	cidInfos, migrateCidInfos := versioned.NewVersionedStateStore(namespace.Wrap(bds, datastore.NewKey(DSCIDPrefix)), cidInfoMigrations, versioning.VersionKey("1"))
 	return &pieceStore{
+		ds:              bds,
 		readySub:        pubsub.New(shared.ReadyDispatcher),
 		pieces:          pieces,
 		migratePieces:   migratePieces,
 		cidInfos:        cidInfos,
 		migrateCidInfos: migrateCidInfos,
+		indexes:         &pieceIndexes{ds: ds},
 	}, nil
 }
 
 type pieceStore struct {
+	// lk serialises changes to piece infos and CID infos with compaction
+	lk              sync.Mutex
+	ds              *batchingDatastore
 	readySub        *pubsub.PubSub
 	migratePieces   func(ctx context.Context) error
 	pieces          versioned.StateStore
 	migrateCidInfos func(ctx context.Context) error
 	cidInfos        versioned.StateStore
+	indexes         *pieceIndexes
 }
 
 func (ps *pieceStore) Start(ctx context.Context) error {
 	go func() {
-		var err error
-		defer func() {
-			err = ps.readySub.Publish(err)
-			if err != nil {
-				log.Warnf("Publish piecestore migration ready event: %s", err.Error())
-			}
-		}()
-		err = ps.migratePieces(ctx)
-		if err != nil {
-			log.Errorf("Migrating pieceInfos: %s", err.Error())
-			return
+		err := ps.migrate(ctx)
+		if pubErr := ps.readySub.Publish(err); pubErr != nil {
+			log.Warnf("Publish piecestore migration ready event: %s", pubErr.Error())
 		}
-		err = ps.migrateCidInfos(ctx)
 		if err != nil {
-			log.Errorf("Migrating cidInfos: %s", err.Error())
+			return
 		}
+		// Lookups scan the piece infos until the indexes are backfilled, so
+		// the piece store is ready before the backfill completes
+		ps.backfillIndexes(ctx)
 	}()
 	return nil
 }
 
+func (ps *pieceStore) migrate(ctx context.Context) error {
+	if err := ps.migratePieces(ctx); err != nil {
+		log.Errorf("Migrating pieceInfos: %s", err.Error())
+		return err
+	}
+	if err := ps.migrateCidInfos(ctx); err != nil {
+		log.Errorf("Migrating cidInfos: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
 func (ps *pieceStore) OnReady(ready shared.ReadyFunc) {
 	ps.readySub.Subscribe(ready)
 }
 
 // Store `dealInfo` in the PieceStore with key `pieceCID`.
 func (ps *pieceStore) AddDealForPiece(pieceCID cid.Cid, dealInfo piecestore.DealInfo) error {
-	return ps.mutatePieceInfo(pieceCID, func(pi *piecestore.PieceInfo) error {
-		for _, di := range pi.Deals {
-			if di == dealInfo {
-				return nil
-			}
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	ctx := context.TODO()
+	pi := piecestore.PieceInfo{PieceCID: pieceCID}
+	found := true
+	if err := ps.pieces.Get(pieceCID).Get(&pi); err != nil {
+		if !xerrors.Is(err, datastore.ErrNotFound) {
+			return err
 		}
-		pi.Deals = append(pi.Deals, dealInfo)
-		return nil
+		found = false
+	}
+	for _, di := range pi.Deals {
+		if di == dealInfo {
+			return nil
+		}
+	}
+	pi.Deals = append(pi.Deals, dealInfo)
+
+	return ps.batch(ctx, func(b datastore.Write) error {
+		if err := ps.putPieceInfo(pi, found); err != nil {
+			return err
+		}
+		return ps.indexes.add(ctx, b, pieceCID, []piecestore.DealInfo{dealInfo})
 	})
 }
 
 // Store the map of blockLocations in the PieceStore's CIDInfo store, with key `pieceCID`
 func (ps *pieceStore) AddPieceBlockLocations(pieceCID cid.Cid, blockLocations map[cid.Cid]piecestore.BlockLocation) error {
-	for c, blockLocation := range blockLocations {
-		err := ps.mutateCIDInfo(c, func(ci *piecestore.CIDInfo) error {
-			for _, pbl := range ci.PieceBlockLocations {
-				if pbl.PieceCID.Equals(pieceCID) && pbl.BlockLocation == blockLocation {
-					return nil
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	ctx := context.TODO()
+	return ps.batch(ctx, func(b datastore.Write) error {
+		for c, blockLocation := range blockLocations {
+			ci := piecestore.CIDInfo{CID: c}
+			found := true
+			if err := ps.cidInfos.Get(c).Get(&ci); err != nil {
+				if !xerrors.Is(err, datastore.ErrNotFound) {
+					return err
 				}
+				found = false
+			}
+			if hasPieceBlockLocation(ci, pieceCID, blockLocation) {
+				continue
 			}
 			ci.PieceBlockLocations = append(ci.PieceBlockLocations, piecestore.PieceBlockLocation{BlockLocation: blockLocation, PieceCID: pieceCID})
+			if err := ps.putCIDInfo(ci, found); err != nil {
+				return err
+			}
+			if err := ps.indexes.addPayload(ctx, b, pieceCID, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func hasPieceBlockLocation(ci piecestore.CIDInfo, pieceCID cid.Cid, blockLocation piecestore.BlockLocation) bool {
+	for _, pbl := range ci.PieceBlockLocations {
+		if pbl.PieceCID.Equals(pieceCID) && pbl.BlockLocation == blockLocation {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the deal with ID `dealID` from the PieceInfo with key `pieceCID`.
+func (ps *pieceStore) RemoveDealForPiece(pieceCID cid.Cid, dealID abi.DealID) error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	ctx := context.TODO()
+	var pi piecestore.PieceInfo
+	if err := ps.pieces.Get(pieceCID).Get(&pi); err != nil {
+		if xerrors.Is(err, datastore.ErrNotFound) {
+			return xerrors.Errorf("piece with CID %s: %w", pieceCID, retrievalmarket.ErrNotFound)
+		}
+		return err
+	}
+
+	var removed []piecestore.DealInfo
+	remaining := make([]piecestore.DealInfo, 0, len(pi.Deals))
+	for _, di := range pi.Deals {
+		if di.DealID == dealID {
+			removed = append(removed, di)
+		} else {
+			remaining = append(remaining, di)
+		}
+	}
+	pi.Deals = remaining
+
+	return ps.batch(ctx, func(b datastore.Write) error {
+		if err := ps.putPieceInfo(pi, true); err != nil {
+			return err
+		}
+		return ps.indexes.remove(ctx, b, pieceCID, removed, remaining)
+	})
+}
+
+// Remove the PieceInfo with key `pieceCID`, and the locations of blocks in
+// the piece from the CID info store.
+func (ps *pieceStore) RemovePieceInfo(pieceCID cid.Cid) error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	var pi piecestore.PieceInfo
+	if err := ps.pieces.Get(pieceCID).Get(&pi); err != nil {
+		if xerrors.Is(err, datastore.ErrNotFound) {
+			return xerrors.Errorf("piece with CID %s: %w", pieceCID, retrievalmarket.ErrNotFound)
+		}
+		return err
+	}
+
+	ctx := context.TODO()
+	payloadCIDs, err := ps.payloadCIDLookup(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = ps.removePiece(ctx, pi, payloadCIDs)
+	return err
+}
+
+// removePiece removes a piece info and the locations of blocks in the piece,
+// in one batch, and returns what it removed
+func (ps *pieceStore) removePiece(ctx context.Context, pi piecestore.PieceInfo, payloadCIDs func(pieceCID cid.Cid) ([]cid.Cid, error)) (piecestore.CompactionResult, error) {
+	var res piecestore.CompactionResult
+	cids, err := payloadCIDs(pi.PieceCID)
+	if err != nil {
+		return res, xerrors.Errorf("finding payload CIDs in piece %s: %w", pi.PieceCID, err)
+	}
+	err = ps.batch(ctx, func(b datastore.Write) error {
+		var err error
+		res, err = ps.removePieceBlockLocations(ctx, b, pi.PieceCID, cids)
+		if err != nil {
+			return err
+		}
+		if err := ps.pieces.End(pi.PieceCID); err != nil {
+			return err
+		}
+		return ps.indexes.remove(ctx, b, pi.PieceCID, pi.Deals, nil)
+	})
+	if err != nil {
+		return piecestore.CompactionResult{}, err
+	}
+	res.PieceInfos = 1
+	return res, nil
+}
+
+// putCIDInfo writes a CID info to the CID info state store. found is true if
+// the CID info is already in the store.
+func (ps *pieceStore) putCIDInfo(ci piecestore.CIDInfo, found bool) error {
+	if !found {
+		return ps.cidInfos.Begin(ci.CID, &ci)
+	}
+	return ps.cidInfos.Get(ci.CID).Mutate(func(stored *piecestore.CIDInfo) error {
+		*stored = ci
+		return nil
+	})
+}
+
+// putPieceInfo writes a piece info to the piece info state store. found is
+// true if the piece info is already in the store.
+func (ps *pieceStore) putPieceInfo(pi piecestore.PieceInfo, found bool) error {
+	if !found {
+		return ps.pieces.Begin(pi.PieceCID, &pi)
+	}
+	return ps.pieces.Get(pi.PieceCID).Mutate(func(stored *piecestore.PieceInfo) error {
+		*stored = pi
+		return nil
+	})
+}
+
+// batch applies the writes to the piece store's datastore in one batch,
+// including the writes made through the state stores. It must be called
+// with the piece store lock held.
+func (ps *pieceStore) batch(ctx context.Context, write func(b datastore.Write) error) error {
+	b, err := ps.ds.Batching.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	ps.ds.setBatch(b)
+	err = write(b)
+	ps.ds.setBatch(nil)
+	if err != nil {
+		return err
+	}
+	return b.Commit(ctx)
+}
+
+// batchingDatastore is the datastore under the piece store's state stores.
+// While a batch is open, writes go to the batch instead of the datastore, so
+// that changes made through the versioned state stores, with their own key
+// layout and migrations, are committed together with the index entries.
+// Reads always go to the datastore, so a batch must not read back what it
+// has written.
+type batchingDatastore struct {
+	datastore.Batching
+
+	lk sync.Mutex
+	b  datastore.Batch
+}
+
+func (d *batchingDatastore) setBatch(b datastore.Batch) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.b = b
+}
+
+func (d *batchingDatastore) writer() datastore.Write {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.b != nil {
+		return d.b
+	}
+	return d.Batching
+}
+
+func (d *batchingDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	return d.writer().Put(ctx, key, value)
+}
+
+func (d *batchingDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	return d.writer().Delete(ctx, key)
+}
+
+// Remove the CIDInfo with key `payloadCID`.
+func (ps *pieceStore) RemoveCIDInfo(payloadCID cid.Cid) error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	var ci piecestore.CIDInfo
+	if err := ps.cidInfos.Get(payloadCID).Get(&ci); err != nil {
+		if xerrors.Is(err, datastore.ErrNotFound) {
+			return xerrors.Errorf("payload CID %s: %w", payloadCID, retrievalmarket.ErrNotFound)
+		}
+		return err
+	}
+	ctx := context.TODO()
+	return ps.batch(ctx, func(b datastore.Write) error {
+		if err := ps.cidInfos.End(payloadCID); err != nil {
+			return err
+		}
+		for _, pbl := range ci.PieceBlockLocations {
+			if err := ps.indexes.removePayload(ctx, b, pbl.PieceCID, payloadCID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compact removes the piece infos with no deals, and the locations of
+// blocks in those pieces. Pieces are compacted one at a time, so that deals
+// can still be added while the piece store is compacted.
+func (ps *pieceStore) Compact(ctx context.Context) (piecestore.CompactionResult, error) {
+	var res piecestore.CompactionResult
+
+	var pis []piecestore.PieceInfo
+	if err := ps.pieces.List(&pis); err != nil {
+		return res, xerrors.Errorf("listing piece infos: %w", err)
+	}
+	var unused []cid.Cid
+	for _, pi := range pis {
+		if len(pi.Deals) == 0 {
+			unused = append(unused, pi.PieceCID)
+		}
+	}
+	if len(unused) == 0 {
+		return res, nil
+	}
+
+	payloadCIDs, err := ps.payloadCIDLookup(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	for _, pieceCID := range unused {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		if err := ps.compactPiece(ctx, pieceCID, payloadCIDs, &res); err != nil {
+			return res, xerrors.Errorf("compacting piece %s: %w", pieceCID, err)
+		}
+	}
+	return res, nil
+}
+
+func (ps *pieceStore) compactPiece(ctx context.Context, pieceCID cid.Cid, payloadCIDs func(pieceCID cid.Cid) ([]cid.Cid, error), res *piecestore.CompactionResult) error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	// A deal may have been added for the piece since it was listed
+	var pi piecestore.PieceInfo
+	if err := ps.pieces.Get(pieceCID).Get(&pi); err != nil {
+		if xerrors.Is(err, datastore.ErrNotFound) {
 			return nil
-		})
+		}
+		return err
+	}
+	if len(pi.Deals) > 0 {
+		return nil
+	}
+
+	removed, err := ps.removePiece(ctx, pi, payloadCIDs)
+	if err != nil {
+		return err
+	}
+	res.PieceInfos += removed.PieceInfos
+	res.CIDInfos += removed.CIDInfos
+	res.BlockLocations += removed.BlockLocations
+	return nil
+}
+
+// payloadCIDLookup returns a function that finds the payload CIDs with
+// block locations in a piece. The piece's index entries are used once the
+// indexes have been backfilled. Until then, the CID infos are scanned, once
+// for all the lookups made with the function.
+func (ps *pieceStore) payloadCIDLookup(ctx context.Context) (func(pieceCID cid.Cid) ([]cid.Cid, error), error) {
+	complete, err := ps.indexes.isComplete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if complete {
+		return func(pieceCID cid.Cid) ([]cid.Cid, error) {
+			return ps.indexes.payloadsInPiece(ctx, pieceCID)
+		}, nil
+	}
+
+	var byPiece map[cid.Cid][]cid.Cid
+	return func(pieceCID cid.Cid) ([]cid.Cid, error) {
+		if byPiece == nil {
+			var err error
+			if byPiece, err = ps.payloadCIDsByPiece(); err != nil {
+				return nil, err
+			}
+		}
+		return byPiece[pieceCID], nil
+	}, nil
+}
+
+// payloadCIDsByPiece returns the payload CIDs that have block locations in
+// each piece
+func (ps *pieceStore) payloadCIDsByPiece() (map[cid.Cid][]cid.Cid, error) {
+	var cis []piecestore.CIDInfo
+	if err := ps.cidInfos.List(&cis); err != nil {
+		return nil, xerrors.Errorf("listing CID infos: %w", err)
+	}
+
+	byPiece := make(map[cid.Cid][]cid.Cid)
+	for _, ci := range cis {
+		seen := make(map[cid.Cid]struct{})
+		for _, pbl := range ci.PieceBlockLocations {
+			if _, ok := seen[pbl.PieceCID]; ok {
+				continue
+			}
+			seen[pbl.PieceCID] = struct{}{}
+			byPiece[pbl.PieceCID] = append(byPiece[pbl.PieceCID], ci.CID)
+		}
+	}
+	return byPiece, nil
+}
+
+// removePieceBlockLocations removes the locations of blocks in the piece
+// from the CID infos of the given payload CIDs, removing CID infos that
+// have no locations left, and removes the piece's payload index entries. It
+// returns the numbers of block locations and of CID infos removed.
+func (ps *pieceStore) removePieceBlockLocations(ctx context.Context, b datastore.Write, pieceCID cid.Cid, payloadCIDs []cid.Cid) (piecestore.CompactionResult, error) {
+	var res piecestore.CompactionResult
+	for _, c := range payloadCIDs {
+		if err := ps.indexes.removePayload(ctx, b, pieceCID, c); err != nil {
+			return res, err
+		}
+
+		var ci piecestore.CIDInfo
+		if err := ps.cidInfos.Get(c).Get(&ci); err != nil {
+			if xerrors.Is(err, datastore.ErrNotFound) {
+				continue
+			}
+			return res, err
+		}
+
+		kept := make([]piecestore.PieceBlockLocation, 0, len(ci.PieceBlockLocations))
+		for _, pbl := range ci.PieceBlockLocations {
+			if !pbl.PieceCID.Equals(pieceCID) {
+				kept = append(kept, pbl)
+			}
+		}
+		removed := len(ci.PieceBlockLocations) - len(kept)
+		switch {
+		case removed == 0:
+			continue
+		case len(kept) == 0:
+			if err := ps.cidInfos.End(c); err != nil {
+				return res, err
+			}
+			res.CIDInfos++
+		default:
+			ci.PieceBlockLocations = kept
+			if err := ps.putCIDInfo(ci, true); err != nil {
+				return res, err
+			}
+		}
+		res.BlockLocations += removed
+	}
+	return res, nil
+}
+
+// Retrieve the CIDs of the pieces with a deal in the sector with ID
+// `sectorID`.
+func (ps *pieceStore) ListPiecesInSector(sectorID abi.SectorNumber) ([]cid.Cid, error) {
+	ctx := context.TODO()
+	complete, err := ps.indexes.isComplete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if complete {
+		return ps.indexes.piecesInSector(ctx, sectorID)
+	}
+
+	var pis []piecestore.PieceInfo
+	if err := ps.pieces.List(&pis); err != nil {
+		return nil, err
+	}
+	var pieceCIDs []cid.Cid
+	for _, pi := range pis {
+		for _, di := range pi.Deals {
+			if di.SectorID == sectorID {
+				pieceCIDs = append(pieceCIDs, pi.PieceCID)
+				break
+			}
+		}
+	}
+	return pieceCIDs, nil
+}
+
+// Retrieve the CID of the piece of the deal with ID `dealID`.
+func (ps *pieceStore) GetPieceCIDForDeal(dealID abi.DealID) (cid.Cid, error) {
+	ctx := context.TODO()
+	complete, err := ps.indexes.isComplete(ctx)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !complete {
+		var pis []piecestore.PieceInfo
+		if err := ps.pieces.List(&pis); err != nil {
+			return cid.Undef, err
+		}
+		for _, pi := range pis {
+			for _, di := range pi.Deals {
+				if di.DealID == dealID {
+					return pi.PieceCID, nil
+				}
+			}
+		}
+		return cid.Undef, xerrors.Errorf("deal with ID %d: %w", dealID, retrievalmarket.ErrNotFound)
+	}
+
+	pieceCID, err := ps.indexes.pieceForDeal(ctx, dealID)
+	if err != nil {
+		if xerrors.Is(err, datastore.ErrNotFound) {
+			return cid.Undef, xerrors.Errorf("deal with ID %d: %w", dealID, retrievalmarket.ErrNotFound)
+		}
+		return cid.Undef, err
+	}
+	return pieceCID, nil
+}
+
+// backfillIndexes indexes the piece infos by sector and deal the first
+// time the piece store starts with indexes, retrying until it succeeds or
+// the context is cancelled
+func (ps *pieceStore) backfillIndexes(ctx context.Context) {
+	for {
+		err := ps.backfill(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		log.Errorf("Indexing pieceInfos, retrying in %s: %s", backfillRetryInterval, err.Error())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backfillRetryInterval):
+		}
+	}
+}
+
+// backfill indexes the piece infos in order of piece CID, and then the CID
+// infos in order of payload CID, a batch at a time. Each batch records the
+// last piece or payload CID it indexed, so a backfill that is interrupted
+// resumes after it.
+func (ps *pieceStore) backfill(ctx context.Context) error {
+	complete, err := ps.indexes.isComplete(ctx)
+	if err != nil {
+		return err
+	}
+	if complete {
+		return nil
+	}
+
+	piecesDone, afterPayload, err := ps.indexes.backfillPayloadsProgress(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting backfill progress: %w", err)
+	}
+	if !piecesDone {
+		afterPiece, err := ps.indexes.backfillProgress(ctx)
+		if err != nil {
+			return xerrors.Errorf("getting backfill progress: %w", err)
+		}
+		pieceCIDs, err := ps.ListPieceInfoKeys()
 		if err != nil {
+			return xerrors.Errorf("listing piece infos: %w", err)
+		}
+		if err := backfillInBatches(ctx, pieceCIDs, afterPiece, ps.backfillPiecesBatch); err != nil {
 			return err
 		}
+		if err := ps.indexes.startBackfillPayloads(ctx); err != nil {
+			return xerrors.Errorf("recording backfill progress: %w", err)
+		}
+	}
+
+	payloadCIDs, err := ps.ListCidInfoKeys()
+	if err != nil {
+		return xerrors.Errorf("listing CID infos: %w", err)
 	}
+	if err := backfillInBatches(ctx, payloadCIDs, afterPayload, ps.backfillPayloadsBatch); err != nil {
+		return err
+	}
+
+	if err := ps.indexes.completeBackfill(ctx); err != nil {
+		return xerrors.Errorf("completing backfill: %w", err)
+	}
+	log.Infof("indexed pieceInfos by sector and deal, and cidInfos by piece")
 	return nil
 }
 
+// backfillInBatches runs a backfill batch for each backfillBatchSize keys,
+// in order, starting after the given key if it is defined
+func backfillInBatches(ctx context.Context, keys []cid.Cid, after cid.Cid, batch func(ctx context.Context, keys []cid.Cid) error) error {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].KeyString() < keys[j].KeyString()
+	})
+	if after.Defined() {
+		start := sort.Search(len(keys), func(i int) bool {
+			return keys[i].KeyString() > after.KeyString()
+		})
+		log.Infof("resuming indexing after %s", after)
+		keys = keys[start:]
+	}
+
+	for len(keys) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := backfillBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		if err := batch(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// backfillPiecesBatch indexes the deals of the pieces and records the last
+// piece as the backfill's progress, in one batch
+func (ps *pieceStore) backfillPiecesBatch(ctx context.Context, pieceCIDs []cid.Cid) error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	return ps.batch(ctx, func(b datastore.Write) error {
+		for _, pieceCID := range pieceCIDs {
+			var pi piecestore.PieceInfo
+			if err := ps.pieces.Get(pieceCID).Get(&pi); err != nil {
+				// The piece was removed after it was listed
+				if xerrors.Is(err, datastore.ErrNotFound) {
+					continue
+				}
+				return xerrors.Errorf("getting piece info %s: %w", pieceCID, err)
+			}
+			if err := ps.indexes.add(ctx, b, pieceCID, pi.Deals); err != nil {
+				return xerrors.Errorf("indexing piece %s: %w", pieceCID, err)
+			}
+		}
+		return b.Put(ctx, backfillProgressKey, pieceCIDs[len(pieceCIDs)-1].Bytes())
+	})
+}
+
+// backfillPayloadsBatch indexes the pieces with block locations of the
+// payload CIDs and records the last payload CID as the backfill's progress,
+// in one batch
+func (ps *pieceStore) backfillPayloadsBatch(ctx context.Context, payloadCIDs []cid.Cid) error {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	return ps.batch(ctx, func(b datastore.Write) error {
+		for _, payloadCID := range payloadCIDs {
+			var ci piecestore.CIDInfo
+			if err := ps.cidInfos.Get(payloadCID).Get(&ci); err != nil {
+				// The CID info was removed after it was listed
+				if xerrors.Is(err, datastore.ErrNotFound) {
+					continue
+				}
+				return xerrors.Errorf("getting CID info %s: %w", payloadCID, err)
+			}
+			for _, pbl := range ci.PieceBlockLocations {
+				if err := ps.indexes.addPayload(ctx, b, pbl.PieceCID, payloadCID); err != nil {
+					return xerrors.Errorf("indexing payload CID %s: %w", payloadCID, err)
+				}
+			}
+		}
+		return b.Put(ctx, backfillPayloadsProgressKey, payloadCIDs[len(payloadCIDs)-1].Bytes())
+	})
+}
+
 func (ps *pieceStore) ListPieceInfoKeys() ([]cid.Cid, error) {
 	var pis []piecestore.PieceInfo
 	if err := ps.pieces.List(&pis); err != nil {
@@ -165,50 +773,3 @@ func (ps *pieceStore) GetCIDInfo(payloadCID cid.Cid) (piecestore.CIDInfo, error)
 	}
 	return out, nil
 }
-
-func (ps *pieceStore) ensurePieceInfo(pieceCID cid.Cid) error {
-	has, err := ps.pieces.Has(pieceCID)
-
-	if err != nil {
-		return err
-	}
-	if has {
-		return nil
-	}
-
-	pieceInfo := piecestore.PieceInfo{PieceCID: pieceCID}
-	return ps.pieces.Begin(pieceCID, &pieceInfo)
-}
-
-func (ps *pieceStore) ensureCIDInfo(c cid.Cid) error {
-	has, err := ps.cidInfos.Has(c)
-
-	if err != nil {
-		return err
-	}
-
-	if has {
-		return nil
-	}
-
-	cidInfo := piecestore.CIDInfo{CID: c}
-	return ps.cidInfos.Begin(c, &cidInfo)
-}
-
-func (ps *pieceStore) mutatePieceInfo(pieceCID cid.Cid, mutator interface{}) error {
-	err := ps.ensurePieceInfo(pieceCID)
-	if err != nil {
-		return err
-	}
-
-	return ps.pieces.Get(pieceCID).Mutate(mutator)
-}
-
-func (ps *pieceStore) mutateCIDInfo(c cid.Cid, mutator interface{}) error {
-	err := ps.ensureCIDInfo(c)
-	if err != nil {
-		return err
-	}
-
-	return ps.cidInfos.Get(c).Mutate(mutator)
-}
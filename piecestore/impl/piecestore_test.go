@@ -3,12 +3,14 @@ package piecestoreimpl_test
 import (
 	"context"
 	"math/rand"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/xerrors"
@@ -208,6 +210,310 @@ func TestStoreCIDInfo(t *testing.T) {
 	})
 }
 
+func TestRemoveAndCompact(t *testing.T) {
+	ctx := context.Background()
+	pieceCids := shared_testutil.GenerateCids(2)
+	pieceCid1 := pieceCids[0]
+	pieceCid2 := pieceCids[1]
+	testCIDs := shared_testutil.GenerateCids(3)
+	dealInfo := func(dealID abi.DealID) piecestore.DealInfo {
+		return piecestore.DealInfo{
+			DealID:   dealID,
+			SectorID: abi.SectorNumber(rand.Uint64()),
+			Offset:   abi.PaddedPieceSize(rand.Uint64()),
+			Length:   abi.PaddedPieceSize(rand.Uint64()),
+		}
+	}
+	blockLocation := piecestore.BlockLocation{RelOffset: rand.Uint64(), BlockSize: rand.Uint64()}
+
+	// testCIDs[0] is only in piece 1, testCIDs[1] is in both pieces and
+	// testCIDs[2] is only in piece 2
+	initializePieceStore := func(t *testing.T, ctx context.Context) piecestore.PieceStore {
+		ps, err := piecestoreimpl.NewPieceStore(datastore.NewMapDatastore())
+		require.NoError(t, err)
+		shared_testutil.StartAndWaitForReady(ctx, t, ps)
+
+		require.NoError(t, ps.AddDealForPiece(pieceCid1, dealInfo(1)))
+		require.NoError(t, ps.AddDealForPiece(pieceCid1, dealInfo(2)))
+		require.NoError(t, ps.AddDealForPiece(pieceCid2, dealInfo(3)))
+		require.NoError(t, ps.AddPieceBlockLocations(pieceCid1, map[cid.Cid]piecestore.BlockLocation{
+			testCIDs[0]: blockLocation,
+			testCIDs[1]: blockLocation,
+		}))
+		require.NoError(t, ps.AddPieceBlockLocations(pieceCid2, map[cid.Cid]piecestore.BlockLocation{
+			testCIDs[1]: blockLocation,
+			testCIDs[2]: blockLocation,
+		}))
+		return ps
+	}
+
+	t.Run("remove deal", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		ps := initializePieceStore(t, ctx)
+
+		require.NoError(t, ps.RemoveDealForPiece(pieceCid1, 1))
+		pi, err := ps.GetPieceInfo(pieceCid1)
+		require.NoError(t, err)
+		require.Len(t, pi.Deals, 1)
+		require.Equal(t, abi.DealID(2), pi.Deals[0].DealID)
+
+		// Removing an unknown deal does nothing
+		require.NoError(t, ps.RemoveDealForPiece(pieceCid1, 1))
+		pi, err = ps.GetPieceInfo(pieceCid1)
+		require.NoError(t, err)
+		require.Len(t, pi.Deals, 1)
+
+		err = ps.RemoveDealForPiece(shared_testutil.GenerateCids(1)[0], 1)
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	})
+
+	t.Run("remove piece info", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		ps := initializePieceStore(t, ctx)
+
+		require.NoError(t, ps.RemovePieceInfo(pieceCid1))
+		_, err := ps.GetPieceInfo(pieceCid1)
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+
+		// Block locations in the piece are removed too
+		_, err = ps.GetCIDInfo(testCIDs[0])
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+		ci, err := ps.GetCIDInfo(testCIDs[1])
+		require.NoError(t, err)
+		require.Equal(t, []piecestore.PieceBlockLocation{{BlockLocation: blockLocation, PieceCID: pieceCid2}}, ci.PieceBlockLocations)
+
+		err = ps.RemovePieceInfo(pieceCid1)
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	})
+
+	t.Run("remove CID info", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		ps := initializePieceStore(t, ctx)
+
+		require.NoError(t, ps.RemoveCIDInfo(testCIDs[1]))
+		_, err := ps.GetCIDInfo(testCIDs[1])
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+		keys, err := ps.ListCidInfoKeys()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []cid.Cid{testCIDs[0], testCIDs[2]}, keys)
+
+		err = ps.RemoveCIDInfo(testCIDs[1])
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		ps := initializePieceStore(t, ctx)
+
+		// Nothing to compact while all pieces have deals
+		res, err := ps.Compact(ctx)
+		require.NoError(t, err)
+		require.Equal(t, piecestore.CompactionResult{}, res)
+
+		require.NoError(t, ps.RemoveDealForPiece(pieceCid2, 3))
+		res, err = ps.Compact(ctx)
+		require.NoError(t, err)
+		require.Equal(t, piecestore.CompactionResult{PieceInfos: 1, CIDInfos: 1, BlockLocations: 2}, res)
+
+		keys, err := ps.ListPieceInfoKeys()
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{pieceCid1}, keys)
+		keys, err = ps.ListCidInfoKeys()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []cid.Cid{testCIDs[0], testCIDs[1]}, keys)
+		ci, err := ps.GetCIDInfo(testCIDs[1])
+		require.NoError(t, err)
+		require.Equal(t, []piecestore.PieceBlockLocation{{BlockLocation: blockLocation, PieceCID: pieceCid1}}, ci.PieceBlockLocations)
+	})
+}
+
+func TestIndexes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pieceCids := shared_testutil.GenerateCids(3)
+	dealInfo := func(dealID abi.DealID, sectorID abi.SectorNumber) piecestore.DealInfo {
+		return piecestore.DealInfo{
+			DealID:   dealID,
+			SectorID: sectorID,
+			Offset:   abi.PaddedPieceSize(rand.Uint64()),
+			Length:   abi.PaddedPieceSize(rand.Uint64()),
+		}
+	}
+	ds := datastore.NewMapDatastore()
+
+	ps, err := piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+
+	require.NoError(t, ps.AddDealForPiece(pieceCids[0], dealInfo(1, 10)))
+	require.NoError(t, ps.AddDealForPiece(pieceCids[0], dealInfo(2, 11)))
+	require.NoError(t, ps.AddDealForPiece(pieceCids[1], dealInfo(3, 10)))
+	require.NoError(t, ps.AddDealForPiece(pieceCids[1], dealInfo(4, 10)))
+	require.NoError(t, ps.AddDealForPiece(pieceCids[2], dealInfo(5, 100)))
+	payloadCids := shared_testutil.GenerateCids(2)
+	blockLocation := piecestore.BlockLocation{RelOffset: rand.Uint64(), BlockSize: rand.Uint64()}
+	require.NoError(t, ps.AddPieceBlockLocations(pieceCids[0], map[cid.Cid]piecestore.BlockLocation{
+		payloadCids[0]: blockLocation,
+		payloadCids[1]: blockLocation,
+	}))
+	require.NoError(t, ps.AddPieceBlockLocations(pieceCids[1], map[cid.Cid]piecestore.BlockLocation{
+		payloadCids[1]: blockLocation,
+	}))
+
+	requireIndexes := func(t *testing.T, ps piecestore.PieceStore) {
+		pieces, err := ps.ListPiecesInSector(10)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []cid.Cid{pieceCids[0], pieceCids[1]}, pieces)
+		// Sector 1 is a prefix of sector 10 and 100, but has no pieces
+		pieces, err = ps.ListPiecesInSector(1)
+		require.NoError(t, err)
+		require.Empty(t, pieces)
+
+		pieceCid, err := ps.GetPieceCIDForDeal(4)
+		require.NoError(t, err)
+		require.Equal(t, pieceCids[1], pieceCid)
+		_, err = ps.GetPieceCIDForDeal(6)
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	}
+	requireIndexes(t, ps)
+
+	// The indexes are backfilled for piece infos stored without indexes
+	res, err := ds.Query(ctx, query.Query{Prefix: piecestoreimpl.DSIndexPrefix, KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	for _, e := range entries {
+		require.NoError(t, ds.Delete(ctx, datastore.RawKey(e.Key)))
+	}
+	ps, err = piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+	require.Eventually(t, func() bool {
+		has, err := ds.Has(ctx, datastore.NewKey(piecestoreimpl.DSIndexPrefix).ChildString("version"))
+		return err == nil && has
+	}, 5*time.Second, 10*time.Millisecond)
+	requireIndexes(t, ps)
+
+	// Removing a deal keeps the sector index while another deal for the
+	// piece is in the sector
+	require.NoError(t, ps.RemoveDealForPiece(pieceCids[1], 3))
+	_, err = ps.GetPieceCIDForDeal(3)
+	require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	pieces, err := ps.ListPiecesInSector(10)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []cid.Cid{pieceCids[0], pieceCids[1]}, pieces)
+
+	require.NoError(t, ps.RemoveDealForPiece(pieceCids[1], 4))
+	pieces, err = ps.ListPiecesInSector(10)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{pieceCids[0]}, pieces)
+
+	// Removing a piece removes all its deals from the indexes
+	require.NoError(t, ps.RemovePieceInfo(pieceCids[0]))
+	pieces, err = ps.ListPiecesInSector(10)
+	require.NoError(t, err)
+	require.Empty(t, pieces)
+	pieces, err = ps.ListPiecesInSector(11)
+	require.NoError(t, err)
+	require.Empty(t, pieces)
+	_, err = ps.GetPieceCIDForDeal(1)
+	require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+
+	// Removing a piece finds the block locations to remove through the
+	// backfilled index of payload CIDs by piece
+	_, err = ps.GetCIDInfo(payloadCids[0])
+	require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	ci, err := ps.GetCIDInfo(payloadCids[1])
+	require.NoError(t, err)
+	require.Equal(t, []piecestore.PieceBlockLocation{{BlockLocation: blockLocation, PieceCID: pieceCids[1]}}, ci.PieceBlockLocations)
+	res, err = ds.Query(ctx, query.Query{Prefix: datastore.NewKey(piecestoreimpl.DSIndexPrefix).ChildString("payload").String(), KeysOnly: true})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestPieceInfoVersionedWrites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pieceCid := shared_testutil.GenerateCids(1)[0]
+	dealInfo := piecestore.DealInfo{DealID: 1, SectorID: 10, Offset: 100, Length: 200}
+	ds := datastore.NewMapDatastore()
+
+	ps, err := piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+	require.NoError(t, ps.AddDealForPiece(pieceCid, dealInfo))
+	require.NoError(t, ps.AddDealForPiece(pieceCid, piecestore.DealInfo{DealID: 2, SectorID: 11}))
+	require.NoError(t, ps.RemoveDealForPiece(pieceCid, 2))
+
+	// Piece infos written together with their indexes are read back through
+	// the versioned state store of a new piece store
+	ps, err = piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+	pi, err := ps.GetPieceInfo(pieceCid)
+	require.NoError(t, err)
+	require.Equal(t, piecestore.PieceInfo{PieceCID: pieceCid, Deals: []piecestore.DealInfo{dealInfo}}, pi)
+
+	require.NoError(t, ps.RemovePieceInfo(pieceCid))
+	_, err = ps.GetPieceInfo(pieceCid)
+	require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+}
+
+func TestResumeIndexBackfill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pieceCids := shared_testutil.GenerateCids(3)
+	sort.Slice(pieceCids, func(i, j int) bool {
+		return pieceCids[i].KeyString() < pieceCids[j].KeyString()
+	})
+	ds := datastore.NewMapDatastore()
+
+	ps, err := piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+	for i, pieceCid := range pieceCids {
+		require.NoError(t, ps.AddDealForPiece(pieceCid, piecestore.DealInfo{DealID: abi.DealID(i + 1), SectorID: 10}))
+	}
+
+	// Remove the indexes, and record that an interrupted backfill had
+	// indexed the first piece
+	indexesKey := datastore.NewKey(piecestoreimpl.DSIndexPrefix)
+	res, err := ds.Query(ctx, query.Query{Prefix: indexesKey.String(), KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.NoError(t, ds.Delete(ctx, datastore.RawKey(e.Key)))
+	}
+	require.NoError(t, ds.Put(ctx, indexesKey.ChildString("backfill"), pieceCids[0].Bytes()))
+
+	// The backfill resumes after the first piece
+	ps, err = piecestoreimpl.NewPieceStore(ds)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, ps)
+	require.Eventually(t, func() bool {
+		has, err := ds.Has(ctx, indexesKey.ChildString("version"))
+		return err == nil && has
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = ps.GetPieceCIDForDeal(1)
+	require.True(t, xerrors.Is(err, retrievalmarket.ErrNotFound))
+	for i, pieceCid := range pieceCids[1:] {
+		indexed, err := ps.GetPieceCIDForDeal(abi.DealID(i + 2))
+		require.NoError(t, err)
+		require.Equal(t, pieceCid, indexed)
+	}
+	pieces, err := ps.ListPiecesInSector(10)
+	require.NoError(t, err)
+	require.ElementsMatch(t, pieceCids[1:], pieces)
+}
+
 func TestMigrations(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
@@ -2,14 +2,18 @@ package piecestore
 
 import (
 	"context"
+	"time"
 
 	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
 
 	"github.com/filecoin-project/go-state-types/abi"
 
 	"github.com/filecoin-project/go-fil-markets/shared"
 )
 
+var log = logging.Logger("piecestore")
+
 //go:generate cbor-gen-for --map-encoding PieceInfo DealInfo BlockLocation PieceBlockLocation CIDInfo
 
 // DealInfo is information about a single deal for a given piece
@@ -53,6 +57,18 @@ type PieceInfo struct {
 // PieceInfoUndefined is piece info with no information
 var PieceInfoUndefined = PieceInfo{}
 
+// CompactionResult is what was removed by compacting a piece store
+type CompactionResult struct {
+	// PieceInfos is the number of piece infos with no deals that were removed
+	PieceInfos int
+	// CIDInfos is the number of CID infos that were removed because all
+	// their block locations were in removed pieces
+	CIDInfos int
+	// BlockLocations is the number of block locations in removed pieces
+	// that were removed from CID infos
+	BlockLocations int
+}
+
 // PieceStore is a saved database of piece info that can be modified and queried
 type PieceStore interface {
 	Start(ctx context.Context) error
@@ -63,4 +79,46 @@ type PieceStore interface {
 	GetCIDInfo(payloadCID cid.Cid) (CIDInfo, error)
 	ListCidInfoKeys() ([]cid.Cid, error)
 	ListPieceInfoKeys() ([]cid.Cid, error)
+	// ListPiecesInSector returns the CIDs of the pieces with a deal in the
+	// sector
+	ListPiecesInSector(sectorID abi.SectorNumber) ([]cid.Cid, error)
+	// GetPieceCIDForDeal returns the CID of the piece of the deal
+	GetPieceCIDForDeal(dealID abi.DealID) (cid.Cid, error)
+	// RemoveDealForPiece removes the deal with the given ID from the piece
+	// info. The piece info is kept, with no deals, until the piece store is
+	// compacted.
+	RemoveDealForPiece(pieceCID cid.Cid, dealID abi.DealID) error
+	// RemovePieceInfo removes the piece info, and the locations of blocks
+	// in the piece from all CID infos
+	RemovePieceInfo(pieceCID cid.Cid) error
+	// RemoveCIDInfo removes the CID info for a payload CID
+	RemoveCIDInfo(payloadCID cid.Cid) error
+	// Compact removes the piece infos that have no deals, along with the
+	// locations of blocks in those pieces
+	Compact(ctx context.Context) (CompactionResult, error)
+}
+
+// RunCompaction compacts the piece store at the given interval until the
+// context is cancelled
+func RunCompaction(ctx context.Context, ps PieceStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := ps.Compact(ctx)
+		if err != nil {
+			log.Errorf("compacting piece store: %s", err)
+			continue
+		}
+		if res.PieceInfos > 0 || res.CIDInfos > 0 {
+			log.Infof("compacted piece store: removed %d piece infos, %d CID infos and %d block locations",
+				res.PieceInfos, res.CIDInfos, res.BlockLocations)
+		}
+	}
 }
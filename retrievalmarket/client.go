@@ -2,7 +2,9 @@ package retrievalmarket
 
 import (
 	"context"
+	"io"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 
@@ -18,6 +20,11 @@ type PayloadCID = cid.Cid
 // blockstore when needed, concretely to store blocks received from the provider.
 // This abstraction allows the caller to provider any blockstore implementation:
 // a CARv2 file, an IPFS blockstore, or something else.
+//
+// When a deal is resumed with ResumeRetrieval, Get is called again with the
+// ID of the original deal, possibly after Done was called for it. To support
+// resuming deals, the accessor must return a blockstore that contains the
+// blocks received so far.
 type BlockstoreAccessor interface {
 	Get(DealID, PayloadCID) (bstore.Blockstore, error)
 	Done(DealID) error
@@ -31,6 +38,31 @@ type RetrieveResponse struct {
 	CarFilePath string
 }
 
+// RetrievalStream gives access to the data for a retrieval deal as it is
+// received from the provider, before the deal completes.
+//
+// If the consumer falls behind the data received from the provider, the
+// client pauses the data transfer until the consumer catches up.
+type RetrievalStream interface {
+	// DealID is the ID of the retrieval deal
+	DealID() DealID
+
+	// Next waits for the next block received from the provider and returns
+	// it. The block's data has been checked against its CID.
+	// Next returns io.EOF once all blocks have been received, or an error
+	// if the deal fails.
+	Next(ctx context.Context) (blocks.Block, error)
+
+	// FileReader returns a reader over the UnixFS file with the deal's
+	// payload CID as its root. Reads block until the data for the part of
+	// the file being read has been received.
+	FileReader(ctx context.Context) (io.Reader, error)
+
+	// Close stops tracking the consumer of the stream. It does not cancel
+	// the deal.
+	Close() error
+}
+
 // RetrievalClient is a client interface for making retrieval deals
 type RetrievalClient interface {
 
@@ -46,6 +78,12 @@ type RetrievalClient interface {
 	// Find Providers finds retrieval providers who may be storing a given piece
 	FindProviders(payloadCID cid.Cid) []RetrievalPeer
 
+	// FindProvidersAsync finds retrieval providers who may be storing a given
+	// piece, sending each provider on the returned channel as soon as it is
+	// found so that the caller can start querying it. The channel is closed
+	// once all providers have been found or the context is cancelled.
+	FindProvidersAsync(ctx context.Context, payloadCID cid.Cid) <-chan RetrievalPeer
+
 	// Query asks a provider for information about a piece it is storing
 	Query(
 		ctx context.Context,
@@ -54,6 +92,13 @@ type RetrievalClient interface {
 		params QueryParams,
 	) (QueryResponse, error)
 
+	// BatchQuery asks a provider for information about many payloads at once
+	BatchQuery(
+		ctx context.Context,
+		p RetrievalPeer,
+		items []BatchQueryItem,
+	) (BatchQueryResponse, error)
+
 	// Retrieve retrieves all or part of a piece with the given retrieval parameters
 	Retrieve(
 		ctx context.Context,
@@ -66,6 +111,24 @@ type RetrievalClient interface {
 		minerWallet address.Address,
 	) (DealID, error)
 
+	// RetrieveStream starts a retrieval deal in the same way as Retrieve,
+	// and returns a stream that yields the deal's data as it arrives
+	RetrieveStream(
+		ctx context.Context,
+		id DealID,
+		payloadCID cid.Cid,
+		params Params,
+		totalFunds abi.TokenAmount,
+		p RetrievalPeer,
+		clientWallet address.Address,
+		minerWallet address.Address,
+	) (RetrievalStream, error)
+
+	// ResumeRetrieval starts a new deal that continues an earlier deal that
+	// ended before all blocks were received. The new deal only requests the
+	// parts of the DAG the client doesn't already have.
+	ResumeRetrieval(ctx context.Context, prevDealID DealID, totalFunds abi.TokenAmount) (DealID, error)
+
 	// SubscribeToEvents listens for events that happen related to client retrievals
 	SubscribeToEvents(subscriber ClientSubscriber) Unsubscribe
 
@@ -83,4 +146,8 @@ type RetrievalClient interface {
 
 	// ListDeals returns all deals
 	ListDeals() (map[DealID]ClientDealState, error)
+
+	// ListVerificationEvidence returns the signed evidence kept for deals in
+	// which the provider's data or payment requests failed verification
+	ListVerificationEvidence() ([]SignedVerificationEvidence, error)
 }
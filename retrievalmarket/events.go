@@ -138,6 +138,14 @@ const (
 	// ClientEventFinalizeBlockstoreErrored is fired when there is an error
 	// finalizing the blockstore
 	ClientEventFinalizeBlockstoreErrored
+
+	// ClientEventVerificationFailed is fired when the data received from the
+	// provider, or a payment request from the provider, fails verification
+	ClientEventVerificationFailed
+
+	// ClientEventPaymentOwedVerified is fired when the client has verified
+	// the bytes that the provider requested payment for
+	ClientEventPaymentOwedVerified
 )
 
 // ClientEvents is a human readable map of client event name -> event description
@@ -181,6 +189,8 @@ var ClientEvents = map[ClientEvent]string{
 	ClientEventPaymentNotSent:                "ClientEventPaymentNotSent",
 	ClientEventBlockstoreFinalized:           "ClientEventBlockstoreFinalized",
 	ClientEventFinalizeBlockstoreErrored:     "ClientEventFinalizeBlockstoreErrored",
+	ClientEventVerificationFailed:            "ClientEventVerificationFailed",
+	ClientEventPaymentOwedVerified:           "ClientEventPaymentOwedVerified",
 }
 
 func (e ClientEvent) String() string {
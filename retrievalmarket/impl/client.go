@@ -1,6 +1,7 @@
 package retrievalimpl
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,10 +10,14 @@ import (
 	"github.com/hannahhoward/go-pubsub"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p-core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
@@ -21,6 +26,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/go-statestore"
 
 	"github.com/filecoin-project/go-fil-markets/discovery"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -49,6 +55,27 @@ type Client struct {
 
 	// Guards concurrent access to Retrieve method
 	retrieveLk sync.Mutex
+
+	streamsLk         sync.Mutex
+	streams           map[retrievalmarket.DealID]*retrievalStream
+	maxStreamBuffered uint64
+
+	verifiersLk sync.Mutex
+	verifiers   map[retrievalmarket.DealID]*dealVerifier
+	evidence    *statestore.StateStore
+	evidenceLk  sync.Mutex
+}
+
+// RetrievalClientOption is a function that configures a retrieval client
+type RetrievalClientOption func(c *Client)
+
+// StreamBufferSize sets the number of bytes that may be received for a
+// streamed retrieval deal but not yet read by the consumer of the stream,
+// before the client pauses the data transfer
+func StreamBufferSize(bytes uint64) RetrievalClientOption {
+	return func(c *Client) {
+		c.maxStreamBuffered = bytes
+	}
 }
 
 type internalEvent struct {
@@ -80,16 +107,24 @@ func NewClient(
 	resolver discovery.PeerResolver,
 	ds datastore.Batching,
 	ba retrievalmarket.BlockstoreAccessor,
+	opts ...RetrievalClientOption,
 ) (retrievalmarket.RetrievalClient, error) {
 	c := &Client{
-		network:      network,
-		dataTransfer: dataTransfer,
-		node:         node,
-		resolver:     resolver,
-		dealIDGen:    shared.NewTimeCounter(),
-		subscribers:  pubsub.New(dispatcher),
-		readySub:     pubsub.New(shared.ReadyDispatcher),
-		bstores:      ba,
+		network:           network,
+		dataTransfer:      dataTransfer,
+		node:              node,
+		resolver:          resolver,
+		dealIDGen:         shared.NewTimeCounter(),
+		subscribers:       pubsub.New(dispatcher),
+		readySub:          pubsub.New(shared.ReadyDispatcher),
+		bstores:           ba,
+		streams:           make(map[retrievalmarket.DealID]*retrievalStream),
+		maxStreamBuffered: DefaultMaxStreamBuffered,
+		verifiers:         make(map[retrievalmarket.DealID]*dealVerifier),
+		evidence:          statestore.New(namespace.Wrap(ds, datastore.NewKey("verification-evidence"))),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 	retrievalMigrations, err := migrations.ClientMigrations.Build()
 	if err != nil {
@@ -179,6 +214,29 @@ func (c *Client) FindProviders(payloadCID cid.Cid) []retrievalmarket.RetrievalPe
 	return peers
 }
 
+// FindProvidersAsync uses the PeerResolver interface to locate providers who
+// may have a given payload CID, sending them as soon as they are found. If
+// the resolver doesn't support streaming, all providers are sent at once.
+func (c *Client) FindProvidersAsync(ctx context.Context, payloadCID cid.Cid) <-chan retrievalmarket.RetrievalPeer {
+	results := discovery.StreamPeers(ctx, c.resolver, payloadCID)
+	out := make(chan retrievalmarket.RetrievalPeer)
+	go func() {
+		defer close(out)
+		for res := range results {
+			if res.Err != nil {
+				log.Errorf("failed to get peers: %s", res.Err)
+				continue
+			}
+			select {
+			case out <- res.Peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
 /*
 Query sends a retrieval query to a specific retrieval provider, to determine
 if the provider can serve a retrieval request and what its specific parameters for
@@ -212,6 +270,36 @@ func (c *Client) Query(ctx context.Context, p retrievalmarket.RetrievalPeer, pay
 	return s.ReadQueryResponse()
 }
 
+// BatchQuery asks a provider about many payload CIDs over a single stream.
+// For each payload CID the response lists the pieces that contain it, with
+// their unsealed status and retrieval price.
+func (c *Client) BatchQuery(ctx context.Context, p retrievalmarket.RetrievalPeer, items []retrievalmarket.BatchQueryItem) (retrievalmarket.BatchQueryResponse, error) {
+	if len(items) > retrievalmarket.MaxBatchQueryItems {
+		return retrievalmarket.BatchQueryResponseUndefined, xerrors.Errorf("too many items in batch query: %d > max %d",
+			len(items), retrievalmarket.MaxBatchQueryItems)
+	}
+
+	err := c.addMultiaddrs(ctx, p)
+	if err != nil {
+		log.Warn(err)
+		return retrievalmarket.BatchQueryResponseUndefined, err
+	}
+	s, err := c.network.NewBatchQueryStream(p.ID)
+	if err != nil {
+		log.Warn(err)
+		return retrievalmarket.BatchQueryResponseUndefined, err
+	}
+	defer s.Close()
+
+	err = s.WriteBatchQuery(retrievalmarket.BatchQuery{Items: items})
+	if err != nil {
+		log.Warn(err)
+		return retrievalmarket.BatchQueryResponseUndefined, err
+	}
+
+	return s.ReadBatchQueryResponse()
+}
+
 // Retrieve initiates the retrieval deal flow, which involves multiple requests and responses
 //
 // To start this processes, the client creates a new `RetrievalDealStream`.  Currently, this connection is
@@ -256,16 +344,117 @@ func (c *Client) Retrieve(
 	c.retrieveLk.Lock()
 	defer c.retrieveLk.Unlock()
 
+	dealState, err := c.newDeal(ctx, id, payloadCID, params, totalFunds, p, clientWallet, minerWallet)
+	if err != nil {
+		return 0, err
+	}
+	err = c.startDeal(dealState)
+	if err != nil {
+		return 0, err
+	}
+	return dealState.ID, nil
+}
+
+// RetrieveStream starts a retrieval deal in the same way as Retrieve, and
+// returns a stream that hands out the blocks for the deal as they are
+// written to the blockstore, before the deal completes.
+//
+// If the consumer of the stream falls behind the data received by more
+// than the stream buffer size, the client pauses the data transfer until
+// the consumer catches up.
+func (c *Client) RetrieveStream(
+	ctx context.Context,
+	id retrievalmarket.DealID,
+	payloadCID cid.Cid,
+	params retrievalmarket.Params,
+	totalFunds abi.TokenAmount,
+	p retrievalmarket.RetrievalPeer,
+	clientWallet address.Address,
+	minerWallet address.Address,
+) (retrievalmarket.RetrievalStream, error) {
+	c.retrieveLk.Lock()
+	defer c.retrieveLk.Unlock()
+
+	dealState, err := c.newDeal(ctx, id, payloadCID, params, totalFunds, p, clientWallet, minerWallet)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := c.bstores.Get(dealState.ID, payloadCID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting blockstore for deal %d: %w", dealState.ID, err)
+	}
+
+	// Register the stream before starting the deal, so that it receives
+	// all blocks written to the blockstore
+	stream := newRetrievalStream(dealState.ID, payloadCID, bs, c.maxStreamBuffered, c.pauseStreamTransfer(dealState.ID))
+	c.streamsLk.Lock()
+	c.streams[dealState.ID] = stream
+	c.streamsLk.Unlock()
+
+	err = c.startDeal(dealState)
+	if err != nil {
+		c.removeStream(dealState.ID)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// pauseStreamTransfer returns a function that pauses or resumes the data
+// transfer for a streamed deal
+func (c *Client) pauseStreamTransfer(dealID retrievalmarket.DealID) pauseTransferFunc {
+	return func(ctx context.Context, pause bool) error {
+		var deal retrievalmarket.ClientDealState
+		if err := c.stateMachines.Get(dealID).Get(&deal); err != nil {
+			return xerrors.Errorf("getting deal %d: %w", dealID, err)
+		}
+		if deal.ChannelID == nil {
+			return xerrors.Errorf("deal %d has no data transfer channel", dealID)
+		}
+		if pause {
+			return c.dataTransfer.PauseDataTransferChannel(ctx, *deal.ChannelID)
+		}
+		return c.dataTransfer.ResumeDataTransferChannel(ctx, *deal.ChannelID)
+	}
+}
+
+func (c *Client) getStream(dealID retrievalmarket.DealID) (*retrievalStream, bool) {
+	c.streamsLk.Lock()
+	defer c.streamsLk.Unlock()
+
+	stream, ok := c.streams[dealID]
+	return stream, ok
+}
+
+func (c *Client) removeStream(dealID retrievalmarket.DealID) {
+	c.streamsLk.Lock()
+	defer c.streamsLk.Unlock()
+
+	delete(c.streams, dealID)
+}
+
+// newDeal checks that a new deal can be made with the provider, and
+// creates the initial state for the deal
+func (c *Client) newDeal(
+	ctx context.Context,
+	id retrievalmarket.DealID,
+	payloadCID cid.Cid,
+	params retrievalmarket.Params,
+	totalFunds abi.TokenAmount,
+	p retrievalmarket.RetrievalPeer,
+	clientWallet address.Address,
+	minerWallet address.Address,
+) (*retrievalmarket.ClientDealState, error) {
 	// Check if there's already an active retrieval deal with the same peer
 	// for the same payload CID
 	err := c.checkForActiveDeal(payloadCID, p.ID)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	err = c.addMultiaddrs(ctx, p)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	// assign a new ID.
@@ -274,7 +463,111 @@ func (c *Client) Retrieve(
 		id = retrievalmarket.DealID(next)
 	}
 
-	dealState := retrievalmarket.ClientDealState{
+	return newClientDealState(id, payloadCID, params, totalFunds, p, clientWallet, minerWallet), nil
+}
+
+// ResumeRetrieval starts a new retrieval deal that continues an earlier
+// retrieval deal which ended before all blocks were received (for example
+// because it failed or was cancelled).
+//
+// The new deal is made with the same provider, for the same payload CID and
+// with the same parameters as the earlier deal, except for the selector:
+// the blockstore of the earlier deal is walked from the payload root, and
+// the new deal only selects the subtrees with blocks that are missing. The
+// provider leaves the blocks the client already has out of the transfer,
+// and charges for the blocks it sends as for any other deal, so resuming
+// works the same way against providers that predate resumption. Blocks
+// received by the new deal are written to the same blockstore as the
+// earlier deal.
+//
+// Only deals for the whole DAG under the payload CID can be resumed.
+func (c *Client) ResumeRetrieval(ctx context.Context, prevDealID retrievalmarket.DealID, totalFunds abi.TokenAmount) (retrievalmarket.DealID, error) {
+	c.retrieveLk.Lock()
+	defer c.retrieveLk.Unlock()
+
+	prev, err := c.GetDeal(prevDealID)
+	if err != nil {
+		return 0, xerrors.Errorf("getting deal %d: %w", prevDealID, err)
+	}
+
+	if !clientstates.IsFinalityState(prev.Status) {
+		return 0, xerrors.Errorf("cannot resume deal %d: deal is still active (state %s)",
+			prevDealID, retrievalmarket.DealStatuses[prev.Status])
+	}
+	if prev.Status == retrievalmarket.DealStatusCompleted {
+		return 0, xerrors.Errorf("cannot resume deal %d: deal is already complete", prevDealID)
+	}
+
+	// A resumed deal's selector is computed from what is missing, so it is
+	// always narrower than the whole DAG. Only the first deal in the chain
+	// reflects the selector the caller asked for.
+	if prev.ResumedFrom == nil {
+		all, err := isExploreAll(prev.Params)
+		if err != nil {
+			return 0, xerrors.Errorf("checking selector for deal %d: %w", prevDealID, err)
+		}
+		if !all {
+			return 0, xerrors.Errorf("cannot resume deal %d: only deals for the whole DAG can be resumed", prevDealID)
+		}
+	}
+
+	err = c.checkForActiveDeal(prev.PayloadCID, prev.Sender)
+	if err != nil {
+		return 0, err
+	}
+
+	// Work out which parts of the DAG are missing from the blockstore of
+	// the earlier deal
+	bsDealID := prev.BlockstoreDealID()
+	bs, err := c.bstores.Get(bsDealID, prev.PayloadCID)
+	if err != nil {
+		return 0, xerrors.Errorf("getting blockstore for deal %d: %w", bsDealID, err)
+	}
+	sel, err := remainingSelector(ctx, bs, prev.PayloadCID)
+	if err != nil {
+		return 0, xerrors.Errorf("finding blocks missing from deal %d: %w", bsDealID, err)
+	}
+	if sel == nil {
+		return 0, xerrors.Errorf("cannot resume deal %d: all blocks have already been received", prevDealID)
+	}
+	var selBuf bytes.Buffer
+	if err := dagcbor.Encode(sel, &selBuf); err != nil {
+		return 0, xerrors.Errorf("encoding selector: %w", err)
+	}
+	params := prev.Params
+	params.Selector = &cbg.Deferred{Raw: selBuf.Bytes()}
+
+	p := retrievalmarket.RetrievalPeer{
+		Address: prev.ProviderAddress,
+		ID:      prev.Sender,
+	}
+	err = c.addMultiaddrs(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+
+	id := retrievalmarket.DealID(c.dealIDGen.Next())
+	dealState := newClientDealState(id, prev.PayloadCID, params, totalFunds, p, prev.ClientWallet, prev.MinerWallet)
+	dealState.ResumedFrom = &bsDealID
+
+	log.Infow("resuming retrieval", "deal", prevDealID, "new deal", id)
+	err = c.startDeal(dealState)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func newClientDealState(
+	id retrievalmarket.DealID,
+	payloadCID cid.Cid,
+	params retrievalmarket.Params,
+	totalFunds abi.TokenAmount,
+	p retrievalmarket.RetrievalPeer,
+	clientWallet address.Address,
+	minerWallet address.Address,
+) *retrievalmarket.ClientDealState {
+	return &retrievalmarket.ClientDealState{
 		DealProposal: retrievalmarket.DealProposal{
 			PayloadCID: payloadCID,
 			ID:         id,
@@ -290,21 +583,19 @@ func (c *Client) Retrieve(
 		FundsSpent:       abi.NewTokenAmount(0),
 		Status:           retrievalmarket.DealStatusNew,
 		Sender:           p.ID,
+		ProviderAddress:  p.Address,
 		UnsealFundsPaid:  big.Zero(),
 	}
+}
 
-	// start the deal processing
-	err = c.stateMachines.Begin(dealState.ID, &dealState)
-	if err != nil {
-		return 0, err
-	}
-
-	err = c.stateMachines.Send(dealState.ID, retrievalmarket.ClientEventOpen)
+// startDeal starts the deal processing for a new deal
+func (c *Client) startDeal(dealState *retrievalmarket.ClientDealState) error {
+	err := c.stateMachines.Begin(dealState.ID, dealState)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return id, nil
+	return c.stateMachines.Send(dealState.ID, retrievalmarket.ClientEventOpen)
 }
 
 // Check if there's already an active retrieval deal with the same peer
@@ -335,9 +626,179 @@ func (c *Client) checkForActiveDeal(payloadCID cid.Cid, pid peer.ID) error {
 func (c *Client) notifySubscribers(eventName fsm.EventName, state fsm.StateType) {
 	evt := eventName.(retrievalmarket.ClientEvent)
 	ds := state.(retrievalmarket.ClientDealState)
+	c.finishStream(ds)
+	c.closeVerifier(ds)
 	_ = c.subscribers.Publish(internalEvent{evt, ds})
 }
 
+// finishStream ends the stream for a deal, if there is one, once the deal
+// reaches a final state
+func (c *Client) finishStream(ds retrievalmarket.ClientDealState) {
+	if !clientstates.IsFinalityState(ds.Status) {
+		return
+	}
+	stream, ok := c.getStream(ds.ID)
+	if !ok {
+		return
+	}
+	c.removeStream(ds.ID)
+
+	if ds.Status == retrievalmarket.DealStatusCompleted {
+		stream.finish(nil)
+		return
+	}
+	stream.finish(xerrors.Errorf("deal %d ended in state %s: %s",
+		ds.ID, retrievalmarket.DealStatuses[ds.Status], ds.Message))
+}
+
+// closeVerifier stops verifying data for a deal once the deal reaches a
+// final state
+func (c *Client) closeVerifier(ds retrievalmarket.ClientDealState) {
+	if !clientstates.IsFinalityState(ds.Status) {
+		return
+	}
+
+	c.verifiersLk.Lock()
+	v, ok := c.verifiers[ds.ID]
+	delete(c.verifiers, ds.ID)
+	c.verifiersLk.Unlock()
+
+	if ok {
+		v.close()
+	}
+}
+
+func (c *Client) getVerifier(dealID retrievalmarket.DealID) (*dealVerifier, bool) {
+	c.verifiersLk.Lock()
+	defer c.verifiersLk.Unlock()
+
+	v, ok := c.verifiers[dealID]
+	return v, ok
+}
+
+// getOrCreateVerifier returns the verifier for a deal, creating it the first
+// time the deal's blockstore is requested
+func (c *Client) getOrCreateVerifier(deal retrievalmarket.ClientDealState, bs bstore.Blockstore) (*dealVerifier, error) {
+	c.verifiersLk.Lock()
+	defer c.verifiersLk.Unlock()
+
+	if v, ok := c.verifiers[deal.ID]; ok {
+		return v, nil
+	}
+	sel, err := dealSelector(&deal.DealProposal)
+	if err != nil {
+		return nil, err
+	}
+	dealID := deal.ID
+	v := newDealVerifier(dealID, deal.PayloadCID, sel, bs, func(blockCID *cid.Cid, err error) {
+		c.verificationFailed(dealID, blockCID, err)
+	})
+	c.verifiers[dealID] = v
+	return v, nil
+}
+
+// verificationFailed is called when a block received for a deal fails
+// verification
+func (c *Client) verificationFailed(dealID retrievalmarket.DealID, blockCID *cid.Cid, verr error) {
+	log.Warnf("client: deal %d: %s", dealID, verr)
+
+	deal, err := c.GetDeal(dealID)
+	if err != nil {
+		log.Errorf("getting deal %d to record verification failure: %s", dealID, err)
+	} else {
+		c.recordVerificationFailure(context.TODO(), deal, blockCID, verr)
+	}
+
+	err = c.stateMachines.Send(dealID, retrievalmarket.ClientEventVerificationFailed, verr)
+	if err != nil {
+		log.Errorf("sending verification failure for deal %d: %s", dealID, err)
+	}
+}
+
+// recordVerificationFailure signs evidence of a verification failure with
+// the client's wallet and saves it
+func (c *Client) recordVerificationFailure(ctx context.Context, deal retrievalmarket.ClientDealState, blockCID *cid.Cid, verr error) {
+	var verifiedBytes uint64
+	if v, ok := c.getVerifier(deal.ID); ok {
+		verifiedBytes = v.verified()
+	}
+	evidence := retrievalmarket.VerificationEvidence{
+		DealID:        deal.ID,
+		PayloadCID:    deal.PayloadCID,
+		Provider:      deal.Sender,
+		MinerWallet:   deal.MinerWallet,
+		Reason:        verr.Error(),
+		BlockCID:      blockCID,
+		VerifiedBytes: verifiedBytes,
+		PaymentOwed:   deal.PaymentOwed,
+		FundsSpent:    deal.FundsSpent,
+		PricePerByte:  deal.PricePerByte,
+		UnsealPrice:   deal.UnsealPrice,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := evidence.MarshalCBOR(buf); err != nil {
+		log.Errorf("serializing verification evidence for deal %d: %s", deal.ID, err)
+		return
+	}
+	signed := retrievalmarket.SignedVerificationEvidence{Evidence: evidence}
+	if signer, ok := c.node.(retrievalmarket.RetrievalClientSigner); ok {
+		sig, err := signer.SignBytes(ctx, deal.ClientWallet, buf.Bytes())
+		if err != nil {
+			// Keep the evidence even if it can't be signed
+			log.Errorf("signing verification evidence for deal %d: %s", deal.ID, err)
+		} else {
+			signed.Signature = sig
+		}
+	}
+
+	c.evidenceLk.Lock()
+	defer c.evidenceLk.Unlock()
+
+	// A deal can fail verification more than once, for example when it is
+	// retried, so each failure is kept under its own attempt number
+	key := evidenceKey{dealID: deal.ID}
+	for {
+		has, err := c.evidence.Has(key)
+		if err != nil {
+			log.Errorf("saving verification evidence for deal %d: %s", deal.ID, err)
+			return
+		}
+		if !has {
+			break
+		}
+		key.attempt++
+	}
+	if err := c.evidence.Begin(key, &signed); err != nil {
+		log.Errorf("saving verification evidence for deal %d: %s", deal.ID, err)
+	}
+}
+
+// evidenceKey is the key of the evidence of a deal's verification failure.
+// The first failure of a deal is keyed by the deal ID, and each later
+// failure by the deal ID and its attempt number, eg "12-1".
+type evidenceKey struct {
+	dealID  retrievalmarket.DealID
+	attempt uint64
+}
+
+func (k evidenceKey) String() string {
+	if k.attempt == 0 {
+		return k.dealID.String()
+	}
+	return fmt.Sprintf("%s-%d", k.dealID, k.attempt)
+}
+
+// ListVerificationEvidence lists the signed evidence kept for deals that
+// failed verification
+func (c *Client) ListVerificationEvidence() ([]retrievalmarket.SignedVerificationEvidence, error) {
+	var evidence []retrievalmarket.SignedVerificationEvidence
+	if err := c.evidence.List(&evidence); err != nil {
+		return nil, err
+	}
+	return evidence, nil
+}
+
 func (c *Client) addMultiaddrs(ctx context.Context, p retrievalmarket.RetrievalPeer) error {
 	tok, _, err := c.node.GetChainHead(ctx)
 	if err != nil {
@@ -418,14 +879,22 @@ func (c *clientDealEnvironment) Node() retrievalmarket.RetrievalClientNode {
 	return c.c.node
 }
 
+// dealSelector returns the selector for the data requested by a deal
+func dealSelector(proposal *retrievalmarket.DealProposal) (ipld.Node, error) {
+	if !proposal.SelectorSpecified() {
+		return selectorparse.CommonSelector_ExploreAllRecursively, nil
+	}
+	sel, err := retrievalmarket.DecodeNode(proposal.Selector)
+	if err != nil {
+		return nil, xerrors.Errorf("selector is invalid: %w", err)
+	}
+	return sel, nil
+}
+
 func (c *clientDealEnvironment) OpenDataTransfer(ctx context.Context, to peer.ID, proposal *retrievalmarket.DealProposal, legacy bool) (datatransfer.ChannelID, error) {
-	sel := selectorparse.CommonSelector_ExploreAllRecursively
-	if proposal.SelectorSpecified() {
-		var err error
-		sel, err = retrievalmarket.DecodeNode(proposal.Selector)
-		if err != nil {
-			return datatransfer.ChannelID{}, xerrors.Errorf("selector is invalid: %w", err)
-		}
+	sel, err := dealSelector(proposal)
+	if err != nil {
+		return datatransfer.ChannelID{}, err
 	}
 
 	var vouch datatransfer.Voucher = proposal
@@ -473,6 +942,32 @@ func (c *clientDealEnvironment) CloseDataTransfer(ctx context.Context, channelID
 	return err
 }
 
+// VerifiedBytes returns the number of bytes verified for the deal so far
+func (c *clientDealEnvironment) VerifiedBytes(dealID retrievalmarket.DealID) (uint64, bool) {
+	v, ok := c.c.getVerifier(dealID)
+	if !ok {
+		return 0, false
+	}
+	return v.verified(), true
+}
+
+// AwaitVerifiedBytes waits until the given number of bytes have been
+// verified for the deal, or until verifiedBytesTimeout passes
+func (c *clientDealEnvironment) AwaitVerifiedBytes(ctx context.Context, dealID retrievalmarket.DealID, bytes uint64) (uint64, bool) {
+	v, ok := c.c.getVerifier(dealID)
+	if !ok {
+		return 0, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, verifiedBytesTimeout)
+	defer cancel()
+	return v.awaitVerified(ctx, bytes), true
+}
+
+// RecordVerificationFailure keeps signed evidence of a verification failure
+func (c *clientDealEnvironment) RecordVerificationFailure(ctx context.Context, deal retrievalmarket.ClientDealState, err error) {
+	c.c.recordVerificationFailure(ctx, deal, nil, err)
+}
+
 // FinalizeBlockstore is called when all blocks have been received
 func (c *clientDealEnvironment) FinalizeBlockstore(ctx context.Context, dealID retrievalmarket.DealID) error {
 	return c.c.bstores.Done(dealID)
@@ -488,7 +983,24 @@ func (csg *clientStoreGetter) Get(_ peer.ID, id retrievalmarket.DealID) (bstore.
 	if err != nil {
 		return nil, err
 	}
-	return csg.c.bstores.Get(id, deal.PayloadCID)
+	bs, err := csg.c.bstores.Get(deal.BlockstoreDealID(), deal.PayloadCID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check received blocks against the deal's selector before they are
+	// written to the blockstore
+	v, err := csg.c.getOrCreateVerifier(deal, bs)
+	if err != nil {
+		return nil, err
+	}
+	bs = &verifyingBlockstore{Blockstore: bs, v: v}
+
+	// If the deal is being streamed, pass received blocks on to the stream
+	if stream, ok := csg.c.getStream(id); ok {
+		bs = &streamBlockstore{Blockstore: bs, s: stream}
+	}
+	return bs, nil
 }
 
 // ClientFSMParameterSpec is a valid set of parameters for a client deal FSM - used in doc generation
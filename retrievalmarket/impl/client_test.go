@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
 	dss "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-merkledag"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -219,6 +221,21 @@ func TestClient_FindProviders(t *testing.T) {
 		testCid := tut.GenerateCids(1)[0]
 		assert.Len(t, c.FindProviders(testCid), 0)
 	})
+
+	t.Run("streams providers as they are found", func(t *testing.T) {
+		peers := tut.RequireGenerateRetrievalPeers(t, 3)
+		testResolver := tut.TestPeerResolver{Peers: peers}
+		c, err := retrievalimpl.NewClient(net, dt, &testnodes.TestRetrievalClientNode{}, &testResolver, ds, ba)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var found []retrievalmarket.RetrievalPeer
+		for p := range c.FindProvidersAsync(ctx, tut.GenerateCids(1)[0]) {
+			found = append(found, p)
+		}
+		assert.Equal(t, peers, found)
+	})
 }
 
 // TestClient_DuplicateRetrieve verifies that it's not possible to make a
@@ -352,6 +369,91 @@ func TestClient_DuplicateRetrieve(t *testing.T) {
 	}
 }
 
+func TestClient_ResumeRetrieval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rpeer := retrievalmarket.RetrievalPeer{
+		Address: address.TestAddress2,
+		ID:      peer.ID("p1"),
+	}
+
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	dt := tut.NewTestDataTransfer()
+	ba := tut.NewTestRetrievalBlockstoreAccessor()
+	net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+	node.ExpectKnownAddresses(rpeer, nil)
+
+	// Simulate the first deal receiving the root block and one of the two
+	// leaves before it was interrupted
+	leaves := []*merkledag.RawNode{
+		merkledag.NewRawNode([]byte("leaf 1")),
+		merkledag.NewRawNode([]byte("leaf 2")),
+	}
+	root := &merkledag.ProtoNode{}
+	for _, leaf := range leaves {
+		require.NoError(t, root.AddNodeLink(leaf.Cid().String(), leaf))
+	}
+	require.NoError(t, ba.Blockstore.Put(ctx, root))
+	require.NoError(t, ba.Blockstore.Put(ctx, leaves[0]))
+
+	client, err := retrievalimpl.NewClient(net, dt, node, &tut.TestPeerResolver{}, ds, ba)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, client)
+
+	params := retrievalmarket.Params{
+		PieceCID:                &tut.GenerateCids(1)[0],
+		PricePerByte:            abi.NewTokenAmount(1),
+		PaymentInterval:         1,
+		PaymentIntervalIncrease: 0,
+		UnsealPrice:             abi.NewTokenAmount(0),
+	}
+	payloadCID := root.Cid()
+	dealID, err := client.Retrieve(ctx, 0, payloadCID, params, abi.NewTokenAmount(10), rpeer, address.TestAddress, rpeer.Address)
+	require.NoError(t, err)
+
+	// An active deal cannot be resumed
+	_, err = client.ResumeRetrieval(ctx, dealID, abi.NewTokenAmount(10))
+	require.Error(t, err)
+
+	cancelled := make(chan struct{})
+	var once sync.Once
+	client.SubscribeToEvents(func(event retrievalmarket.ClientEvent, state retrievalmarket.ClientDealState) {
+		if state.ID == dealID && state.Status == retrievalmarket.DealStatusCancelled {
+			once.Do(func() { close(cancelled) })
+		}
+	})
+	err = client.CancelDeal(dealID)
+	require.NoError(t, err)
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		t.Fatal("deal was not cancelled")
+	case <-time.After(time.Second):
+		t.Fatal("deal was not cancelled")
+	}
+
+	resumedID, err := client.ResumeRetrieval(ctx, dealID, abi.NewTokenAmount(10))
+	require.NoError(t, err)
+	require.NotEqual(t, dealID, resumedID)
+
+	resumed, err := client.GetDeal(resumedID)
+	require.NoError(t, err)
+	require.Equal(t, payloadCID, resumed.PayloadCID)
+	require.Equal(t, rpeer.ID, resumed.Sender)
+	require.Equal(t, rpeer.Address, resumed.ProviderAddress)
+	require.NotNil(t, resumed.ResumedFrom)
+	require.Equal(t, dealID, *resumed.ResumedFrom)
+	require.Equal(t, dealID, resumed.BlockstoreDealID())
+
+	// The resumed deal only selects the part of the DAG that is missing
+	require.True(t, resumed.SelectorSpecified())
+	var allSel bytes.Buffer
+	require.NoError(t, dagcbor.Encode(selectorparse.CommonSelector_ExploreAllRecursively, &allSel))
+	require.NotEqual(t, allSel.Bytes(), resumed.Selector.Raw)
+}
+
 func TestMigrations(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
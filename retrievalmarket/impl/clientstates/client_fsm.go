@@ -154,9 +154,14 @@ var ClientEvents = fsm.Events{
 
 	// Transfer Channel Errors
 	fsm.Event(rm.ClientEventDataTransferError).
+		// If the deal is already failing, the data transfer error is most
+		// likely a result of the failure, so keep the original message
+		From(rm.DealStatusFailing).ToJustRecord().
 		FromAny().To(rm.DealStatusErroring).
 		Action(func(deal *rm.ClientDealState, err error) error {
-			deal.Message = fmt.Sprintf("error generated by data transfer: %s", err.Error())
+			if deal.Status != rm.DealStatusFailing {
+				deal.Message = fmt.Sprintf("error generated by data transfer: %s", err.Error())
+			}
 			return nil
 		}),
 
@@ -173,6 +178,7 @@ var ClientEvents = fsm.Events{
 			paymentChannelCreationStates...).ToJustRecord().
 		Action(func(deal *rm.ClientDealState, paymentOwed abi.TokenAmount) error {
 			deal.PaymentRequested = big.Add(deal.PaymentRequested, paymentOwed)
+			deal.PaymentOwed = paymentOwed
 			deal.LastPaymentRequested = true
 			return nil
 		}),
@@ -188,6 +194,7 @@ var ClientEvents = fsm.Events{
 			paymentChannelCreationStates...).ToJustRecord().
 		Action(func(deal *rm.ClientDealState, paymentOwed abi.TokenAmount) error {
 			deal.PaymentRequested = big.Add(deal.PaymentRequested, paymentOwed)
+			deal.PaymentOwed = paymentOwed
 			return nil
 		}),
 
@@ -195,6 +202,7 @@ var ClientEvents = fsm.Events{
 		FromMany(rm.DealStatusWaitForAcceptance, rm.DealStatusWaitForAcceptanceLegacy).To(rm.DealStatusAccepted).
 		Action(func(deal *rm.ClientDealState, paymentOwed abi.TokenAmount) error {
 			deal.PaymentRequested = big.Add(deal.PaymentRequested, paymentOwed)
+			deal.PaymentOwed = paymentOwed
 			return nil
 		}),
 
@@ -224,6 +232,20 @@ var ClientEvents = fsm.Events{
 		FromMany(paymentChannelCreationStates...).ToJustRecord().
 		Action(recordReceived),
 
+	// The data received from the provider, or a payment request from the
+	// provider, failed verification
+	fsm.Event(rm.ClientEventVerificationFailed).
+		FromMany(rm.DealStatusFailing, rm.DealStatusCancelling, rm.DealStatusErroring).ToJustRecord().
+		FromAny().To(rm.DealStatusFailing).
+		Action(func(deal *rm.ClientDealState, err error) error {
+			switch deal.Status {
+			case rm.DealStatusFailing, rm.DealStatusCancelling, rm.DealStatusErroring:
+			default:
+				deal.Message = xerrors.Errorf("verifying retrieval: %w", err).Error()
+			}
+			return nil
+		}),
+
 	fsm.Event(rm.ClientEventSendFunds).
 		FromMany(rm.DealStatusSendFunds, rm.DealStatusSendFundsLastPayment).To(rm.DealStatusOngoing).
 		From(rm.DealStatusFundsNeeded).To(rm.DealStatusSendFunds).
@@ -261,6 +283,15 @@ var ClientEvents = fsm.Events{
 			return nil
 		}),
 
+	// The bytes the provider requested payment for have been verified, so
+	// the payment request is processed again. The deal may have moved on
+	// while the client waited for them to be verified.
+	fsm.Event(rm.ClientEventPaymentOwedVerified).
+		FromMany(
+			rm.DealStatusFundsNeeded,
+			rm.DealStatusFundsNeededLastPayment).ToNoChange().
+		FromAny().ToJustRecord(),
+
 	// Payment was requested, but there was not actually any payment due, so
 	// no payment voucher was actually sent
 	fsm.Event(rm.ClientEventPaymentNotSent).
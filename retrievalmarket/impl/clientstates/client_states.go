@@ -6,6 +6,7 @@ import (
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -27,6 +28,18 @@ type ClientDealEnvironment interface {
 	SendDataTransferVoucher(context.Context, datatransfer.ChannelID, *rm.DealPayment, bool) error
 	CloseDataTransfer(context.Context, datatransfer.ChannelID) error
 	FinalizeBlockstore(context.Context, rm.DealID) error
+	// VerifiedBytes returns the number of bytes the client has received and
+	// verified for the deal so far, and false if the deal's data is not being
+	// verified
+	VerifiedBytes(dealID rm.DealID) (uint64, bool)
+	// AwaitVerifiedBytes waits, for a limited time, until the client has
+	// received and verified at least the given number of bytes for the deal.
+	// It returns the number of bytes verified, and false if the deal's data
+	// is not being verified.
+	AwaitVerifiedBytes(ctx context.Context, dealID rm.DealID, bytes uint64) (uint64, bool)
+	// RecordVerificationFailure keeps signed evidence of a verification
+	// failure for the deal
+	RecordVerificationFailure(ctx context.Context, deal rm.ClientDealState, err error)
 }
 
 // ProposeDeal sends the proposal to the other party
@@ -97,6 +110,21 @@ func Ongoing(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientD
 
 // ProcessPaymentRequested processes a request for payment from the provider
 func ProcessPaymentRequested(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
+	// Check that the provider is not asking to be paid for more data than
+	// the client has received and verified
+	bytesOwed, err := paymentOwedBytes(deal)
+	if err != nil {
+		environment.RecordVerificationFailure(ctx.Context(), deal, err)
+		return ctx.Trigger(rm.ClientEventVerificationFailed, err)
+	}
+	if verified, ok := environment.VerifiedBytes(deal.ID); ok && verified < bytesOwed {
+		// Payment requests can arrive before the blocks they cover have been
+		// verified, so wait for verification to catch up without blocking
+		// the deal's other events
+		go awaitPaymentOwedVerified(ctx, environment, deal, bytesOwed)
+		return nil
+	}
+
 	// If the unseal payment hasn't been made, we need to send funds
 	if deal.UnsealPrice.GreaterThan(deal.UnsealFundsPaid) {
 		log.Debugf("client: payment needed: unseal price %d > unseal paid %d",
@@ -134,6 +162,44 @@ func ProcessPaymentRequested(ctx fsm.Context, environment ClientDealEnvironment,
 	return nil
 }
 
+// paymentOwedBytes returns the number of bytes the provider is charging
+// for, from the total it has asked to be paid
+func paymentOwedBytes(deal rm.ClientDealState) (uint64, error) {
+	if deal.PaymentOwed.Nil() {
+		return 0, nil
+	}
+
+	// The provider's total charge for transferring data, excluding unsealing
+	totalOwed := big.Add(deal.FundsSpent, deal.PaymentOwed)
+	transferOwed := big.Sub(totalOwed, deal.UnsealPrice)
+	if transferOwed.LessThanEqual(big.Zero()) {
+		return 0, nil
+	}
+	if deal.PricePerByte.IsZero() {
+		return 0, xerrors.Errorf("provider requested %s for transfer with zero price per byte: %w",
+			transferOwed, rm.ErrVerification)
+	}
+
+	// Round up to whole bytes
+	return big.Div(big.Sub(big.Add(transferOwed, deal.PricePerByte), big.NewInt(1)), deal.PricePerByte).Uint64(), nil
+}
+
+// awaitPaymentOwedVerified waits for the client to verify the bytes the
+// provider is charging for. The deal fails verification if they are not
+// verified in time, and the payment request is processed again if they are.
+func awaitPaymentOwedVerified(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState, bytesOwed uint64) {
+	verified, ok := environment.AwaitVerifiedBytes(ctx.Context(), deal.ID, bytesOwed)
+	if !ok || verified >= bytesOwed {
+		_ = ctx.Trigger(rm.ClientEventPaymentOwedVerified)
+		return
+	}
+
+	err := xerrors.Errorf("provider requested payment for %d bytes but only %d bytes were verified: %w",
+		bytesOwed, verified, rm.ErrVerification)
+	_ = ctx.Trigger(rm.ClientEventVerificationFailed, err)
+	environment.RecordVerificationFailure(ctx.Context(), deal, err)
+}
+
 // SendFunds sends the next amount requested by the provider
 func SendFunds(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
 	totalBytesToPayFor := deal.TotalReceived
@@ -228,7 +294,7 @@ func CancelDeal(ctx fsm.Context, environment ClientDealEnvironment, deal rm.Clie
 	// Attempt to finalize the blockstore. If it fails just log an error as
 	// we want to make sure we end up in the cancelled state (not an error
 	// state)
-	if err := environment.FinalizeBlockstore(ctx.Context(), deal.ID); err != nil {
+	if err := environment.FinalizeBlockstore(ctx.Context(), deal.BlockstoreDealID()); err != nil {
 		log.Errorf("failed to finalize blockstore for deal %s: %s", deal.ID, err)
 	}
 
@@ -269,7 +335,7 @@ func CheckComplete(ctx fsm.Context, environment ClientDealEnvironment, deal rm.C
 // FinalizeBlockstore is called once all blocks have been received and the
 // blockstore needs to be finalized before completing the deal
 func FinalizeBlockstore(ctx fsm.Context, environment ClientDealEnvironment, deal rm.ClientDealState) error {
-	if err := environment.FinalizeBlockstore(ctx.Context(), deal.ID); err != nil {
+	if err := environment.FinalizeBlockstore(ctx.Context(), deal.BlockstoreDealID()); err != nil {
 		return ctx.Trigger(rm.ClientEventFinalizeBlockstoreErrored, err)
 	}
 	return ctx.Trigger(rm.ClientEventBlockstoreFinalized)
@@ -284,7 +350,7 @@ func FailsafeFinalizeBlockstore(ctx fsm.Context, environment ClientDealEnvironme
 	// Attempt to finalize the blockstore. If it fails just log an error as
 	// we want to make sure we end up in a specific termination state (not
 	// necessarily the error state)
-	if err := environment.FinalizeBlockstore(ctx.Context(), deal.ID); err != nil {
+	if err := environment.FinalizeBlockstore(ctx.Context(), deal.BlockstoreDealID()); err != nil {
 		log.Errorf("failed to finalize blockstore for deal %s: %s", deal.ID, err)
 	}
 	return ctx.Trigger(rm.ClientEventBlockstoreFinalized)
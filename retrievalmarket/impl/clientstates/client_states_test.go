@@ -10,6 +10,7 @@ import (
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -38,6 +39,12 @@ type fakeEnvironment struct {
 	SendDataTransferVoucherError error
 	CloseDataTransferError       error
 	FinalizeBlockstoreError      error
+	VerifyingData                bool
+	Verified                     uint64
+	AwaitedVerified              uint64
+	AwaitVerified                chan struct{}
+	VerificationFailure          error
+	VerificationFailures         chan error
 }
 
 func (e *fakeEnvironment) Node() retrievalmarket.RetrievalClientNode {
@@ -60,6 +67,25 @@ func (e *fakeEnvironment) FinalizeBlockstore(ctx context.Context, id rm.DealID)
 	return e.FinalizeBlockstoreError
 }
 
+func (e *fakeEnvironment) VerifiedBytes(id rm.DealID) (uint64, bool) {
+	return e.Verified, e.VerifyingData
+}
+
+func (e *fakeEnvironment) AwaitVerifiedBytes(ctx context.Context, id rm.DealID, bytes uint64) (uint64, bool) {
+	if e.AwaitVerified != nil {
+		<-e.AwaitVerified
+	}
+	return e.AwaitedVerified, e.VerifyingData
+}
+
+func (e *fakeEnvironment) RecordVerificationFailure(ctx context.Context, deal rm.ClientDealState, err error) {
+	if e.VerificationFailures != nil {
+		e.VerificationFailures <- err
+		return
+	}
+	e.VerificationFailure = err
+}
+
 func TestProposeDeal(t *testing.T) {
 	ctx := context.Background()
 	node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
@@ -369,6 +395,86 @@ func TestProcessPaymentRequested(t *testing.T) {
 		runProcessPaymentRequested(t, dealState)
 		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeeded)
 	})
+
+	runCheckPaymentOwed := func(t *testing.T, verifiedBytes uint64, dealState *retrievalmarket.ClientDealState) *fakeEnvironment {
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		environment := &fakeEnvironment{node: node, VerifyingData: true, Verified: verifiedBytes}
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		err := clientstates.ProcessPaymentRequested(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+		fsmCtx.ReplayEvents(t, dealState)
+		return environment
+	}
+
+	t.Run("send funds if payment owed is covered by verified bytes", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusFundsNeeded)
+		dealState.BytesPaidFor = 900
+		dealState.TotalReceived = 1000
+		dealState.CurrentInterval = 900
+		dealState.FundsSpent = big.Mul(dealState.PricePerByte, abi.NewTokenAmount(900))
+		dealState.PaymentOwed = big.Mul(dealState.PricePerByte, abi.NewTokenAmount(100))
+		env := runCheckPaymentOwed(t, 1000, dealState)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusSendFunds)
+		require.NoError(t, env.VerificationFailure)
+	})
+
+	t.Run("fail if provider requests payment for more bytes than verified", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusFundsNeeded)
+		dealState.BytesPaidFor = 900
+		dealState.TotalReceived = 1000
+		dealState.CurrentInterval = 900
+		dealState.FundsSpent = big.Mul(dealState.PricePerByte, abi.NewTokenAmount(900))
+		dealState.PaymentOwed = big.Mul(dealState.PricePerByte, abi.NewTokenAmount(500))
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		environment := &fakeEnvironment{
+			node:                 node,
+			VerifyingData:        true,
+			Verified:             1000,
+			AwaitedVerified:      1000,
+			VerificationFailures: make(chan error, 1),
+		}
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+		err := clientstates.ProcessPaymentRequested(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+
+		// The deal fails once the client has waited for the bytes to be
+		// verified
+		select {
+		case err = <-environment.VerificationFailures:
+		case <-ctx.Done():
+			t.Fatal("verification failure was not recorded")
+		}
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrVerification))
+		fsmCtx.ReplayEvents(t, dealState)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFailing)
+		require.Contains(t, dealState.Message, "1400 bytes but only 1000 bytes were verified")
+	})
+
+	t.Run("wait for verified bytes without blocking", func(t *testing.T) {
+		dealState := makeDealState(retrievalmarket.DealStatusFundsNeeded)
+		dealState.BytesPaidFor = 900
+		dealState.TotalReceived = 1000
+		dealState.CurrentInterval = 900
+		dealState.FundsSpent = big.Mul(dealState.PricePerByte, abi.NewTokenAmount(900))
+		dealState.PaymentOwed = big.Mul(dealState.PricePerByte, abi.NewTokenAmount(100))
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		environment := &fakeEnvironment{
+			node:            node,
+			VerifyingData:   true,
+			Verified:        900,
+			AwaitedVerified: 1000,
+			AwaitVerified:   make(chan struct{}),
+		}
+		defer close(environment.AwaitVerified)
+		fsmCtx := fsmtest.NewTestContext(ctx, eventMachine)
+
+		// The handler returns while the client is still verifying the bytes
+		// the provider requested payment for
+		err := clientstates.ProcessPaymentRequested(fsmCtx, environment, *dealState)
+		require.NoError(t, err)
+		fsmCtx.ReplayEvents(t, dealState)
+		require.Equal(t, dealState.Status, retrievalmarket.DealStatusFundsNeeded)
+	})
 }
 
 func TestSendFunds(t *testing.T) {
@@ -10,6 +10,7 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
@@ -99,6 +100,15 @@ func DisableNewDeals() RetrievalProviderOption {
 	}
 }
 
+// ReadOnlyBlockstoresOpt configures how the blockstores that deals are
+// served from are shared between deals, and how long they are kept open.
+// It must be passed to NewProvider, before any deals are served.
+func ReadOnlyBlockstoresOpt(opts ...stores.ReadOnlyBlockstoresOption) RetrievalProviderOption {
+	return func(provider *Provider) {
+		provider.stores = stores.NewReadOnlyBlockstores(opts...)
+	}
+}
+
 // NewProvider returns a new retrieval Provider
 func NewProvider(minerAddress address.Address,
 	node retrievalmarket.RetrievalProviderNode,
@@ -212,9 +222,20 @@ func NewProvider(minerAddress address.Address,
 	return p, nil
 }
 
-// Stop stops handling incoming requests.
+// Stop stops handling incoming requests, and closes the blockstores that
+// deals are served from.
 func (p *Provider) Stop() error {
-	return p.network.StopHandlingRequests()
+	err := p.network.StopHandlingRequests()
+	if closeErr := p.stores.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// BlockstoreStats returns statistics about the blockstores that deals are
+// served from
+func (p *Provider) BlockstoreStats() stores.ReadOnlyBlockstoresStats {
+	return p.stores.Stats()
 }
 
 // Start begins listening for deals on the given host.
@@ -286,7 +307,9 @@ A Provider handling a retrieval `Query` does the following:
 
 3. Combine these results with its existing parameters for retrieval deals to construct a `retrievalmarket.QueryResponse` struct.
 
-4. Writes this response to the `Query` stream.
+4. List every piece that contains the payload, with its unsealed status and price, in the response (only sent to clients that support the pieces query protocol).
+
+5. Writes this response to the `Query` stream.
 
 The connection is kept open only as long as the query-response exchange.
 */
@@ -387,12 +410,189 @@ func (p *Provider) HandleQueryStream(stream rmnet.RetrievalQueryStream) {
 	answer.MaxPaymentInterval = ask.PaymentInterval
 	answer.MaxPaymentIntervalIncrease = ask.PaymentIntervalIncrease
 	answer.UnsealPrice = ask.UnsealPrice
+
+	// list all the pieces containing the payload, so the client can choose
+	// which piece to retrieve from, if the protocol version of the stream
+	// can send them
+	if ps, ok := stream.(rmnet.PiecesQueryStream); ok && ps.WithPieces() {
+		answer.Pieces, err = p.queryPieces(ctx, query.PayloadCID, query.PieceCID, stream.RemotePeer())
+		if err != nil {
+			log.Warnf("Retrieval query: listing pieces for payload %s: %s", query.PayloadCID, err)
+		}
+	}
 	sendResp(answer)
 }
 
 // Given the CID of a block, find a piece that contains that block.
 // If the client has specified which piece they want, return that piece.
 // Otherwise prefer pieces that are already unsealed.
+/*
+HandleBatchQueryStream is called by the network implementation whenever a new message is received on the batch query protocol
+
+A Provider handling a `BatchQuery` does the following:
+
+1. Get the node's chain head in order to get its miner worker address.
+
+2. For each payload CID in the query, look up all the pieces that contain the payload, whether each piece is unsealed, and the price of retrieving the payload from each piece.
+
+3. Writes a `retrievalmarket.BatchQueryResponse` with the results for every payload CID, in the same order as the query, to the stream.
+
+The connection is kept open only as long as the query-response exchange.
+*/
+func (p *Provider) HandleBatchQueryStream(stream rmnet.RetrievalBatchQueryStream) {
+	ctx, cancel := context.WithTimeout(context.TODO(), queryTimeout)
+	defer cancel()
+
+	defer stream.Close()
+	query, err := stream.ReadBatchQuery()
+	if err != nil {
+		return
+	}
+
+	sendResp := func(resp retrievalmarket.BatchQueryResponse) {
+		if err := stream.WriteBatchQueryResponse(resp); err != nil {
+			log.Errorf("Retrieval batch query: writing query response: %s", err)
+		}
+	}
+
+	answer := retrievalmarket.BatchQueryResponse{
+		Status: retrievalmarket.QueryResponseAvailable,
+	}
+
+	if len(query.Items) > retrievalmarket.MaxBatchQueryItems {
+		answer.Status = retrievalmarket.QueryResponseError
+		answer.Message = fmt.Sprintf("too many items in batch query: %d > max %d",
+			len(query.Items), retrievalmarket.MaxBatchQueryItems)
+		sendResp(answer)
+		return
+	}
+
+	// get chain head to query actor states.
+	tok, _, err := p.node.GetChainHead(ctx)
+	if err != nil {
+		log.Errorf("Retrieval batch query: GetChainHead: %s", err)
+		return
+	}
+
+	// fetch the payment address the client should send the payment to.
+	paymentAddress, err := p.node.GetMinerWorkerAddress(ctx, p.minerAddress, tok)
+	if err != nil {
+		log.Errorf("Retrieval batch query: Lookup Payment Address: %s", err)
+		answer.Status = retrievalmarket.QueryResponseError
+		answer.Message = fmt.Sprintf("failed to look up payment address: %s", err)
+		sendResp(answer)
+		return
+	}
+	answer.PaymentAddress = paymentAddress
+
+	answer.Items = make([]retrievalmarket.BatchQueryItemResponse, 0, len(query.Items))
+	for _, item := range query.Items {
+		answer.Items = append(answer.Items, p.batchQueryItemResponse(ctx, item, stream.RemotePeer()))
+	}
+	sendResp(answer)
+}
+
+func (p *Provider) batchQueryItemResponse(ctx context.Context, item retrievalmarket.BatchQueryItem, client peer.ID) retrievalmarket.BatchQueryItemResponse {
+	resp := retrievalmarket.BatchQueryItemResponse{
+		PayloadCID:    item.PayloadCID,
+		Status:        retrievalmarket.QueryResponseUnavailable,
+		PieceCIDFound: retrievalmarket.QueryItemUnavailable,
+	}
+
+	pieces, err := p.queryPieces(ctx, item.PayloadCID, item.PieceCID, client)
+	if err != nil {
+		log.Errorf("Retrieval batch query: queryPieces: %s", err)
+		if !xerrors.Is(err, retrievalmarket.ErrNotFound) {
+			resp.Status = retrievalmarket.QueryResponseError
+			resp.Message = fmt.Sprintf("failed to fetch pieces containing payload: %s", err)
+		} else {
+			resp.Message = "piece info for cid not found (deal has not been added to a piece yet)"
+		}
+		return resp
+	}
+
+	resp.Status = retrievalmarket.QueryResponseAvailable
+	resp.Pieces = pieces
+	if item.PieceCID != nil {
+		resp.PieceCIDFound = retrievalmarket.QueryItemAvailable
+	}
+	return resp
+}
+
+// queryPieces gets all pieces that contain the payload, or just the given
+// piece if pieceCID is not nil, and the price of retrieving the payload from
+// each piece. Pieces with an unsealed copy are listed first.
+func (p *Provider) queryPieces(ctx context.Context, payloadCID cid.Cid, pieceCID *cid.Cid, client peer.ID) ([]retrievalmarket.QueryPiece, error) {
+	// Get all pieces that contain the target block
+	piecesWithTargetBlock, err := p.dagStore.GetPiecesContainingBlock(payloadCID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting pieces for cid %s: %w", payloadCID, err)
+	}
+
+	var lastErr error
+	var unsealed, sealed []retrievalmarket.QueryPiece
+	for _, pieceWithTargetBlock := range piecesWithTargetBlock {
+		if pieceCID != nil && !pieceWithTargetBlock.Equals(*pieceCID) {
+			continue
+		}
+
+		// Get the deals for the piece
+		pieceInfo, err := p.pieceStore.GetPieceInfo(pieceWithTargetBlock)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(pieceInfo.Deals) == 0 {
+			continue
+		}
+
+		var storageDeals []abi.DealID
+		for _, d := range pieceInfo.Deals {
+			storageDeals = append(storageDeals, d.DealID)
+		}
+
+		isUnsealed := p.pieceInUnsealedSector(ctx, pieceInfo)
+		input := retrievalmarket.PricingInput{
+			PieceCID:   pieceInfo.PieceCID,
+			PayloadCID: payloadCID,
+			Unsealed:   isUnsealed,
+			Client:     client,
+		}
+		ask, err := p.GetDynamicAsk(ctx, input, storageDeals)
+		if err != nil {
+			lastErr = xerrors.Errorf("pricing piece %s: %w", pieceInfo.PieceCID, err)
+			continue
+		}
+
+		qp := retrievalmarket.QueryPiece{
+			PieceCID:                pieceInfo.PieceCID,
+			Size:                    uint64(pieceInfo.Deals[0].Length.Unpadded()),
+			Unsealed:                isUnsealed,
+			PricePerByte:            ask.PricePerByte,
+			UnsealPrice:             ask.UnsealPrice,
+			PaymentInterval:         ask.PaymentInterval,
+			PaymentIntervalIncrease: ask.PaymentIntervalIncrease,
+		}
+		if isUnsealed {
+			unsealed = append(unsealed, qp)
+		} else {
+			sealed = append(sealed, qp)
+		}
+	}
+
+	pieces := append(unsealed, sealed...)
+	if len(pieces) == 0 {
+		if lastErr != nil {
+			return nil, xerrors.Errorf("could not locate piece: %w", lastErr)
+		}
+		if pieceCID != nil {
+			return nil, xerrors.Errorf("payload %s is not in piece %s: %w", payloadCID, *pieceCID, retrievalmarket.ErrNotFound)
+		}
+		return nil, xerrors.Errorf("no pieces with deals found for payload %s: %w", payloadCID, retrievalmarket.ErrNotFound)
+	}
+	return pieces, nil
+}
+
 func (p *Provider) getPieceInfoFromCid(ctx context.Context, payloadCID, clientPieceCID cid.Cid) (piecestore.PieceInfo, bool, error) {
 	// Get all pieces that contain the target block
 	piecesWithTargetBlock, err := p.dagStore.GetPiecesContainingBlock(payloadCID)
@@ -128,16 +128,17 @@ func (pde *providerDealEnvironment) Node() retrievalmarket.RetrievalProviderNode
 // PrepareBlockstore is called when the deal data has been unsealed and we need
 // to add all blocks to a blockstore that is used to serve retrieval
 func (pde *providerDealEnvironment) PrepareBlockstore(ctx context.Context, dealID retrievalmarket.DealID, pieceCid cid.Cid) error {
-	// Load the blockstore that has the deal data
-	bs, err := pde.p.dagStore.LoadShard(ctx, pieceCid)
+	// Load the blockstore that has the deal data, sharing it with any other
+	// deals that are being served from the same piece
+	log.Debugf("acquiring blockstore for deal %d from tracker", dealID)
+	_, err := pde.p.stores.Acquire(ctx, dealID.String(), pieceCid.String(), func(ctx context.Context) (bstore.Blockstore, error) {
+		return pde.p.dagStore.LoadShard(ctx, pieceCid)
+	})
 	if err != nil {
 		return xerrors.Errorf("failed to load blockstore for piece %s: %w", pieceCid, err)
 	}
-
-	log.Debugf("adding blockstore for deal %d to tracker", dealID)
-	_, err = pde.p.stores.Track(dealID.String(), bs)
-	log.Debugf("added blockstore for deal %d to tracker", dealID)
-	return err
+	log.Debugf("acquired blockstore for deal %d from tracker", dealID)
+	return nil
 }
 
 func (pde *providerDealEnvironment) TrackTransfer(deal retrievalmarket.ProviderDealState) error {
@@ -170,7 +171,8 @@ func (pde *providerDealEnvironment) CloseDataTransfer(ctx context.Context, chid
 }
 
 func (pde *providerDealEnvironment) DeleteStore(dealID retrievalmarket.DealID) error {
-	// close the read-only blockstore and stop tracking it for the deal
+	// stop tracking the read-only blockstore for the deal, releasing the
+	// shard once no other deal is using it
 	if err := pde.p.stores.Untrack(dealID.String()); err != nil {
 		return xerrors.Errorf("failed to clean read-only blockstore for deal %d: %w", dealID, err)
 	}
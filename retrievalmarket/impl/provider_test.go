@@ -679,6 +679,22 @@ func TestHandleQueryStream(t *testing.T) {
 	// differential pricing
 	expectedUnsealDiscount := abi.NewTokenAmount(1)
 
+	queryPiece := func(pieceCID cid.Cid, size uint64, unsealed bool) retrievalmarket.QueryPiece {
+		unsealPrice := expectedUnsealPrice
+		if unsealed {
+			unsealPrice = expectedUnsealDiscount
+		}
+		return retrievalmarket.QueryPiece{
+			PieceCID:                pieceCID,
+			Size:                    size,
+			Unsealed:                unsealed,
+			PricePerByte:            expectedPricePerByte,
+			UnsealPrice:             unsealPrice,
+			PaymentInterval:         expectedPaymentInterval,
+			PaymentIntervalIncrease: expectedPaymentIntervalIncrease,
+		}
+	}
+
 	readWriteQueryStream := func() network.RetrievalQueryStream {
 		qRead, qWrite := tut.QueryReadWriter()
 		qrRead, qrWrite := tut.QueryResponseReadWriter()
@@ -688,6 +704,7 @@ func TestHandleQueryStream(t *testing.T) {
 			Writer:     qWrite,
 			RespReader: qrRead,
 			RespWriter: qrWrite,
+			WithPieces: true,
 		})
 		return qs
 	}
@@ -751,6 +768,10 @@ func TestHandleQueryStream(t *testing.T) {
 				Status:        retrievalmarket.QueryResponseAvailable,
 				PieceCIDFound: retrievalmarket.QueryItemAvailable,
 				Size:          expectedSize,
+				Pieces: []retrievalmarket.QueryPiece{
+					queryPiece(expectedPieceCID, expectedSize, false),
+					queryPiece(expectedPieceCID2, expectedSize2, false),
+				},
 			},
 			expectedPricePerByte:            expectedPricePerByte,
 			expectedPaymentInterval:         expectedPaymentInterval,
@@ -774,6 +795,10 @@ func TestHandleQueryStream(t *testing.T) {
 				Status:        retrievalmarket.QueryResponseAvailable,
 				PieceCIDFound: retrievalmarket.QueryItemAvailable,
 				Size:          expectedSize2,
+				Pieces: []retrievalmarket.QueryPiece{
+					queryPiece(expectedPieceCID2, expectedSize2, true),
+					queryPiece(expectedPieceCID, expectedSize, false),
+				},
 			},
 			expectedPricePerByte:            expectedPricePerByte,
 			expectedPaymentInterval:         expectedPaymentInterval,
@@ -794,6 +819,9 @@ func TestHandleQueryStream(t *testing.T) {
 				Status:        retrievalmarket.QueryResponseAvailable,
 				PieceCIDFound: retrievalmarket.QueryItemAvailable,
 				Size:          expectedSize,
+				Pieces: []retrievalmarket.QueryPiece{
+					queryPiece(expectedPieceCID, expectedSize, false),
+				},
 			},
 			expectedPricePerByte:            expectedPricePerByte,
 			expectedPaymentInterval:         expectedPaymentInterval,
@@ -873,6 +901,37 @@ func TestHandleQueryStream(t *testing.T) {
 		})
 	}
 
+	t.Run("protocol version without pieces", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalProviderNode()
+		sa := testnodes.NewTestSectorAccessor()
+		qRead, qWrite := tut.QueryReadWriter()
+		qrRead, qrWrite := tut.QueryResponseReadWriter()
+		qs := tut.NewTestRetrievalQueryStream(tut.TestQueryStreamParams{
+			PeerID:     expectedPeer,
+			Reader:     qRead,
+			Writer:     qWrite,
+			RespReader: qrRead,
+			RespWriter: qrWrite,
+		})
+		err := qs.WriteQuery(retrievalmarket.Query{PayloadCID: payloadCID})
+		require.NoError(t, err)
+		pieceStore := tut.NewTestPieceStore()
+		dagStore := tut.NewMockDagStoreWrapper(pieceStore, sa)
+		pieceStore.ExpectPiece(expectedPieceCID, expectedPiece)
+		dagStore.AddBlockToPieceIndex(payloadCID, expectedPieceCID)
+
+		receiveStreamOnProvider(t, node, sa, qs, pieceStore, dagStore)
+
+		// The piece is priced as before, without listing the pieces
+		response, err := qs.ReadQueryResponse()
+		require.NoError(t, err)
+		pieceStore.VerifyExpectations(t)
+		require.Equal(t, retrievalmarket.QueryResponseAvailable, response.Status)
+		require.Equal(t, expectedSize, response.Size)
+		require.Equal(t, expectedPricePerByte, response.MinPricePerByte)
+		require.Empty(t, response.Pieces)
+	})
+
 	t.Run("error reading piece", func(t *testing.T) {
 		node := testnodes.NewTestRetrievalProviderNode()
 		sa := testnodes.NewTestSectorAccessor()
@@ -934,6 +993,153 @@ func TestHandleQueryStream(t *testing.T) {
 
 }
 
+func TestHandleBatchQueryStream(t *testing.T) {
+	ctx := context.Background()
+
+	payloadCIDs := tut.GenerateCids(3)
+	pieceCIDs := tut.GenerateCids(2)
+	expectedPeer := peer.ID("somepeer")
+	expectedAddress := address.TestAddress2
+	expectedPricePerByte := abi.NewTokenAmount(4321)
+	expectedUnsealPrice := abi.NewTokenAmount(100)
+	expectedUnsealDiscount := abi.NewTokenAmount(1)
+
+	sealedPiece := piecestore.PieceInfo{
+		PieceCID: pieceCIDs[0],
+		Deals: []piecestore.DealInfo{{
+			DealID:   1,
+			SectorID: 1,
+			Length:   abi.PaddedPieceSize(1024),
+		}},
+	}
+	unsealedPiece := piecestore.PieceInfo{
+		PieceCID: pieceCIDs[1],
+		Deals: []piecestore.DealInfo{{
+			DealID:   2,
+			SectorID: 2,
+			Length:   abi.PaddedPieceSize(2048),
+		}},
+	}
+
+	priceFunc := func(ctx context.Context, dealPricingParams retrievalmarket.PricingInput) (retrievalmarket.Ask, error) {
+		ask := retrievalmarket.Ask{PricePerByte: expectedPricePerByte}
+		if dealPricingParams.Unsealed {
+			ask.UnsealPrice = expectedUnsealDiscount
+		} else {
+			ask.UnsealPrice = expectedUnsealPrice
+		}
+		return ask, nil
+	}
+
+	runBatchQuery := func(t *testing.T, query retrievalmarket.BatchQuery) retrievalmarket.BatchQueryResponse {
+		node := testnodes.NewTestRetrievalProviderNode()
+		sa := testnodes.NewTestSectorAccessor()
+		d := unsealedPiece.Deals[0]
+		sa.MarkUnsealed(ctx, d.SectorID, d.Offset.Unpadded(), d.Length.Unpadded())
+
+		pieceStore := tut.NewTestPieceStore()
+		pieceStore.StubPiece(sealedPiece.PieceCID, sealedPiece)
+		pieceStore.StubPiece(unsealedPiece.PieceCID, unsealedPiece)
+		dagStore := tut.NewMockDagStoreWrapper(pieceStore, sa)
+		// the first payload is in both pieces, the second only in the
+		// sealed piece, and the third is not in any piece
+		dagStore.AddBlockToPieceIndex(payloadCIDs[0], sealedPiece.PieceCID)
+		dagStore.AddBlockToPieceIndex(payloadCIDs[0], unsealedPiece.PieceCID)
+		dagStore.AddBlockToPieceIndex(payloadCIDs[1], sealedPiece.PieceCID)
+
+		var resp retrievalmarket.BatchQueryResponse
+		qs := tut.NewTestRetrievalBatchQueryStream(tut.TestBatchQueryStreamParams{
+			PeerID: expectedPeer,
+			Reader: func() (retrievalmarket.BatchQuery, error) {
+				return query, nil
+			},
+			RespWriter: func(r retrievalmarket.BatchQueryResponse) error {
+				resp = r
+				return nil
+			},
+		})
+
+		ds := dss.MutexWrap(datastore.NewMapDatastore())
+		dt := tut.NewTestDataTransfer()
+		net := tut.NewTestRetrievalMarketNetwork(tut.TestNetworkParams{})
+		p, err := retrievalimpl.NewProvider(expectedAddress, node, sa, net, pieceStore, dagStore, dt, ds, priceFunc)
+		require.NoError(t, err)
+		tut.StartAndWaitForReady(ctx, t, p)
+
+		net.ReceiveBatchQueryStream(qs)
+		return resp
+	}
+
+	expectedSealed := retrievalmarket.QueryPiece{
+		PieceCID:     sealedPiece.PieceCID,
+		Size:         uint64(sealedPiece.Deals[0].Length.Unpadded()),
+		Unsealed:     false,
+		PricePerByte: expectedPricePerByte,
+		UnsealPrice:  expectedUnsealPrice,
+	}
+	expectedUnsealed := retrievalmarket.QueryPiece{
+		PieceCID:     unsealedPiece.PieceCID,
+		Size:         uint64(unsealedPiece.Deals[0].Length.Unpadded()),
+		Unsealed:     true,
+		PricePerByte: expectedPricePerByte,
+		UnsealPrice:  expectedUnsealDiscount,
+	}
+
+	t.Run("lists all pieces for each payload", func(t *testing.T) {
+		resp := runBatchQuery(t, retrievalmarket.BatchQuery{
+			Items: []retrievalmarket.BatchQueryItem{
+				{PayloadCID: payloadCIDs[0]},
+				{PayloadCID: payloadCIDs[1]},
+				{PayloadCID: payloadCIDs[2]},
+			},
+		})
+
+		require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Status)
+		require.Equal(t, expectedAddress, resp.PaymentAddress)
+		require.Len(t, resp.Items, 3)
+
+		// unsealed pieces are listed first
+		require.Equal(t, payloadCIDs[0], resp.Items[0].PayloadCID)
+		require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Items[0].Status)
+		require.Equal(t, []retrievalmarket.QueryPiece{expectedUnsealed, expectedSealed}, resp.Items[0].Pieces)
+
+		require.Equal(t, payloadCIDs[1], resp.Items[1].PayloadCID)
+		require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Items[1].Status)
+		require.Equal(t, []retrievalmarket.QueryPiece{expectedSealed}, resp.Items[1].Pieces)
+
+		require.Equal(t, payloadCIDs[2], resp.Items[2].PayloadCID)
+		require.Equal(t, retrievalmarket.QueryResponseUnavailable, resp.Items[2].Status)
+		require.Empty(t, resp.Items[2].Pieces)
+	})
+
+	t.Run("filters by piece CID", func(t *testing.T) {
+		resp := runBatchQuery(t, retrievalmarket.BatchQuery{
+			Items: []retrievalmarket.BatchQueryItem{
+				{PayloadCID: payloadCIDs[0], PieceCID: &sealedPiece.PieceCID},
+				{PayloadCID: payloadCIDs[1], PieceCID: &unsealedPiece.PieceCID},
+			},
+		})
+
+		require.Len(t, resp.Items, 2)
+		require.Equal(t, retrievalmarket.QueryResponseAvailable, resp.Items[0].Status)
+		require.Equal(t, retrievalmarket.QueryItemAvailable, resp.Items[0].PieceCIDFound)
+		require.Equal(t, []retrievalmarket.QueryPiece{expectedSealed}, resp.Items[0].Pieces)
+
+		require.Equal(t, retrievalmarket.QueryResponseUnavailable, resp.Items[1].Status)
+		require.Equal(t, retrievalmarket.QueryItemUnavailable, resp.Items[1].PieceCIDFound)
+	})
+
+	t.Run("too many items", func(t *testing.T) {
+		items := make([]retrievalmarket.BatchQueryItem, retrievalmarket.MaxBatchQueryItems+1)
+		for i := range items {
+			items[i].PayloadCID = payloadCIDs[0]
+		}
+		resp := runBatchQuery(t, retrievalmarket.BatchQuery{Items: items})
+		require.Equal(t, retrievalmarket.QueryResponseError, resp.Status)
+		require.Empty(t, resp.Items)
+	})
+}
+
 func TestProvider_Construct(t *testing.T) {
 	ds := datastore.NewMapDatastore()
 	pieceStore := tut.NewTestPieceStore()
@@ -0,0 +1,231 @@
+package retrievalimpl
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// isExploreAll returns true if the deal params select the whole DAG
+func isExploreAll(params retrievalmarket.Params) (bool, error) {
+	if !params.SelectorSpecified() {
+		return true, nil
+	}
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(selectorparse.CommonSelector_ExploreAllRecursively, &buf); err != nil {
+		return false, err
+	}
+	return bytes.Equal(params.Selector.Raw, buf.Bytes()), nil
+}
+
+// remainingSelector returns a selector for the parts of the DAG under root
+// that are missing from the blockstore, or nil if no blocks are missing.
+//
+// A resumed deal requests the remaining selector instead of the whole DAG,
+// so the provider leaves the subtrees the client already holds out of its
+// traversal, and only sends (and charges for) the rest. The blocks on the
+// path from the root to a missing block are sent again, because the
+// traversal has to pass through them.
+func remainingSelector(ctx context.Context, bs bstore.Blockstore, root cid.Cid) (ipld.Node, error) {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, xerrors.Errorf("unsupported link type %T", lnk)
+		}
+		blk, err := bs.Get(lctx.Ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	w := &remainingWalker{
+		ctx:  ctx,
+		bs:   bs,
+		lsys: lsys,
+		chooser: dagpb.AddSupportToChooser(func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+			return basicnode.Prototype.Any, nil
+		}),
+		ssb:      ssb,
+		all:      ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())),
+		complete: make(map[cid.Cid]struct{}),
+	}
+
+	spec, _, err := w.link(cidlink.Link{Cid: root})
+	if err != nil || spec == nil {
+		return nil, err
+	}
+	return spec.Node(), nil
+}
+
+// remainingWalker walks the blocks of a DAG that are in a blockstore, and
+// builds a selector for the blocks that are missing
+type remainingWalker struct {
+	ctx     context.Context
+	bs      bstore.Blockstore
+	lsys    ipld.LinkSystem
+	chooser traversal.LinkTargetNodePrototypeChooser
+	ssb     builder.SelectorSpecBuilder
+	// all selects a whole subtree
+	all builder.SelectorSpec
+	// the blocks whose whole subtree is in the blockstore
+	complete map[cid.Cid]struct{}
+}
+
+// link returns the selector to apply to the node a link points to, so that
+// the missing blocks under it are selected. It returns a nil selector if
+// no blocks are missing, and whole is true if the linked block itself is
+// missing (so the whole subtree is selected).
+func (w *remainingWalker) link(lnk cidlink.Link) (spec builder.SelectorSpec, whole bool, err error) {
+	if _, ok := w.complete[lnk.Cid]; ok {
+		return nil, false, nil
+	}
+
+	has, err := w.bs.Has(w.ctx, lnk.Cid)
+	if err != nil {
+		return nil, false, err
+	}
+	if !has {
+		return w.all, true, nil
+	}
+
+	lctx := ipld.LinkContext{Ctx: w.ctx}
+	proto, err := w.chooser(lnk, lctx)
+	if err != nil {
+		return nil, false, err
+	}
+	nd, err := w.lsys.Load(lctx, lnk, proto)
+	if err != nil {
+		return nil, false, xerrors.Errorf("loading block %s: %w", lnk.Cid, err)
+	}
+
+	spec, _, err = w.node(nd)
+	if err != nil {
+		return nil, false, err
+	}
+	if spec == nil {
+		w.complete[lnk.Cid] = struct{}{}
+	}
+	return spec, false, nil
+}
+
+// node returns the selector for the missing blocks under a node
+func (w *remainingWalker) node(nd ipld.Node) (builder.SelectorSpec, bool, error) {
+	switch nd.Kind() {
+	case ipld.Kind_Link:
+		lnk, err := nd.AsLink()
+		if err != nil {
+			return nil, false, err
+		}
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, false, xerrors.Errorf("unsupported link type %T", lnk)
+		}
+		return w.link(cl)
+	case ipld.Kind_Map:
+		spec, err := w.mapNode(nd)
+		return spec, false, err
+	case ipld.Kind_List:
+		spec, err := w.listNode(nd)
+		return spec, false, err
+	default:
+		return nil, false, nil
+	}
+}
+
+func (w *remainingWalker) mapNode(nd ipld.Node) (builder.SelectorSpec, error) {
+	var keys []string
+	specs := make(map[string]builder.SelectorSpec)
+	it := nd.MapIterator()
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		ks, err := k.AsString()
+		if err != nil {
+			return nil, err
+		}
+		spec, _, err := w.node(v)
+		if err != nil {
+			return nil, err
+		}
+		if spec != nil {
+			keys = append(keys, ks)
+			specs[ks] = spec
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return w.ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		for _, k := range keys {
+			efsb.Insert(k, specs[k])
+		}
+	}), nil
+}
+
+// listNode selects the list items with missing blocks. Runs of items whose
+// blocks are missing entirely, such as the part of a file that was not
+// reached before a deal was interrupted, are selected with a single range.
+func (w *remainingWalker) listNode(nd ipld.Node) (builder.SelectorSpec, error) {
+	var specs []builder.SelectorSpec
+	runStart := int64(-1)
+	endRun := func(end int64) {
+		if runStart >= 0 {
+			specs = append(specs, w.ssb.ExploreRange(runStart, end, w.all))
+			runStart = -1
+		}
+	}
+
+	it := nd.ListIterator()
+	for !it.Done() {
+		i, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		spec, whole, err := w.node(v)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case whole:
+			if runStart < 0 {
+				runStart = i
+			}
+		case spec != nil:
+			endRun(i)
+			specs = append(specs, w.ssb.ExploreIndex(i, spec))
+		default:
+			endRun(i)
+		}
+	}
+	endRun(nd.Length())
+
+	switch len(specs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return specs[0], nil
+	default:
+		return w.ssb.ExploreUnion(specs...), nil
+	}
+}
@@ -0,0 +1,111 @@
+package retrievalimpl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemainingSelector(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	root, blks := makeVerifierDAG(ctx, t)
+	full := bstore.NewBlockstore(ds.NewMapDatastore())
+	require.NoError(t, full.PutMany(ctx, blks))
+
+	t.Run("all blocks received", func(t *testing.T) {
+		sel, err := remainingSelector(ctx, full, root)
+		require.NoError(t, err)
+		require.Nil(t, sel)
+	})
+
+	t.Run("no blocks received", func(t *testing.T) {
+		bs := bstore.NewBlockstore(ds.NewMapDatastore())
+		sel, err := remainingSelector(ctx, bs, root)
+		require.NoError(t, err)
+		require.NotNil(t, sel)
+		require.ElementsMatch(t, cidsOf(blks), selectedCIDs(ctx, t, full, root, sel))
+	})
+
+	t.Run("some blocks received", func(t *testing.T) {
+		// blks is in traversal order, so the first half is the part of the
+		// DAG received before a deal was interrupted
+		received := blks[:len(blks)/2]
+		bs := bstore.NewBlockstore(ds.NewMapDatastore())
+		require.NoError(t, bs.PutMany(ctx, received))
+
+		sel, err := remainingSelector(ctx, bs, root)
+		require.NoError(t, err)
+		require.NotNil(t, sel)
+
+		selected := selectedCIDs(ctx, t, full, root, sel)
+		for _, blk := range blks[len(blks)/2:] {
+			require.Contains(t, selected, blk.Cid())
+		}
+		// Received blocks are only selected if they are on the path to a
+		// missing block
+		require.Less(t, len(selected), len(blks))
+	})
+}
+
+func cidsOf(blks []blocks.Block) []cid.Cid {
+	cids := make([]cid.Cid, 0, len(blks))
+	for _, blk := range blks {
+		cids = append(cids, blk.Cid())
+	}
+	return cids
+}
+
+// selectedCIDs returns the CIDs of the blocks loaded when walking sel from
+// root over the blockstore
+func selectedCIDs(ctx context.Context, t *testing.T, bs bstore.Blockstore, root cid.Cid, sel ipld.Node) []cid.Cid {
+	compiled, err := selector.CompileSelector(sel)
+	require.NoError(t, err)
+
+	var loaded []cid.Cid
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		c := lnk.(cidlink.Link).Cid
+		blk, err := bs.Get(lctx.Ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, c)
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	chooser := dagpb.AddSupportToChooser(func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+		return basicnode.Prototype.Any, nil
+	})
+
+	rootLnk := cidlink.Link{Cid: root}
+	lctx := ipld.LinkContext{Ctx: ctx}
+	proto, err := chooser(rootLnk, lctx)
+	require.NoError(t, err)
+	nd, err := lsys.Load(lctx, rootLnk, proto)
+	require.NoError(t, err)
+
+	err = traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}.WalkAdv(nd, compiled, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+	require.NoError(t, err)
+	return loaded
+}
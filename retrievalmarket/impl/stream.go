@@ -0,0 +1,382 @@
+package retrievalimpl
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// DefaultMaxStreamBuffered is the default number of bytes that may be
+// received for a streamed retrieval deal but not yet read by the consumer,
+// before the client pauses the data transfer
+const DefaultMaxStreamBuffered = 64 << 20
+
+// pauseTransferTimeout is the longest the client waits for the data
+// transfer for a streamed deal to be paused or resumed
+var pauseTransferTimeout = 10 * time.Second
+
+// ErrBlockVerification is returned when a block received for a streamed
+// retrieval deal does not match its CID
+var ErrBlockVerification = xerrors.New("block data does not match CID")
+
+// pauseTransferFunc pauses (or resumes) the data transfer for a streamed
+// deal
+type pauseTransferFunc func(ctx context.Context, pause bool) error
+
+// retrievalStream collects the blocks that are written to the blockstore for
+// a retrieval deal, and hands them out to the consumer of the stream.
+//
+// When the consumer falls behind by more than maxBuffered bytes, the stream
+// pauses the data transfer, and it resumes the transfer when the consumer
+// catches up.
+type retrievalStream struct {
+	dealID        retrievalmarket.DealID
+	payloadCID    cid.Cid
+	bs            bstore.Blockstore
+	maxBuffered   uint64
+	pauseTransfer pauseTransferFunc
+
+	// pauseLk serializes calls to pauseTransfer. paused is true if the
+	// transfer has been paused. It is protected by pauseLk.
+	pauseLk sync.Mutex
+	paused  bool
+
+	lk sync.Mutex
+	// changed is closed (and replaced) whenever the state of the stream
+	// changes
+	changed chan struct{}
+	// CIDs of the blocks that have been received but not yet returned by
+	// Next. Next reads the blocks back from the blockstore, so that the
+	// stream doesn't hold on to the data of blocks that are only read
+	// through the file reader.
+	queue []cid.Cid
+	// sizes of the blocks that have been received but not yet read by the
+	// consumer, either through Next or through the file reader
+	unread      map[cid.Cid]uint64
+	unreadBytes uint64
+	// the number of consumer calls that are waiting for data
+	waiting  int
+	finished bool
+	err      error
+	closed   bool
+	// pause is true if the transfer should be paused
+	pause bool
+}
+
+var _ retrievalmarket.RetrievalStream = (*retrievalStream)(nil)
+
+func newRetrievalStream(dealID retrievalmarket.DealID, payloadCID cid.Cid, bs bstore.Blockstore, maxBuffered uint64, pauseTransfer pauseTransferFunc) *retrievalStream {
+	return &retrievalStream{
+		dealID:        dealID,
+		payloadCID:    payloadCID,
+		bs:            bs,
+		maxBuffered:   maxBuffered,
+		pauseTransfer: pauseTransfer,
+		changed:       make(chan struct{}),
+		unread:        make(map[cid.Cid]uint64),
+	}
+}
+
+func (s *retrievalStream) DealID() retrievalmarket.DealID {
+	return s.dealID
+}
+
+// received is called when a block for the deal is written to the blockstore
+func (s *retrievalStream) received(blk blocks.Block) {
+	var err error
+	if !verifyBlock(blk) {
+		err = xerrors.Errorf("block %s: %w", blk.Cid(), ErrBlockVerification)
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.finished || s.closed {
+		return
+	}
+	if err != nil {
+		s.finishLocked(err)
+		return
+	}
+	if _, ok := s.unread[blk.Cid()]; ok {
+		return
+	}
+
+	size := uint64(len(blk.RawData()))
+	s.queue = append(s.queue, blk.Cid())
+	s.unread[blk.Cid()] = size
+	s.unreadBytes += size
+	s.notifyLocked()
+}
+
+// finish is called when the deal reaches a final state. If err is nil
+// the stream ends with io.EOF once all blocks have been read.
+func (s *retrievalStream) finish(err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.finishLocked(err)
+}
+
+func (s *retrievalStream) finishLocked(err error) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	s.err = err
+	s.notifyLocked()
+}
+
+func (s *retrievalStream) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.updatePauseLocked()
+}
+
+// updatePauseLocked pauses the transfer if the consumer has fallen behind
+// the data received, and resumes it once the consumer has caught up. The
+// transfer isn't paused while the consumer is waiting for more data.
+func (s *retrievalStream) updatePauseLocked() {
+	pause := !s.closed && !s.finished && s.waiting == 0 && s.unreadBytes > s.maxBuffered
+	if s.pauseTransfer == nil || pause == s.pause {
+		return
+	}
+	if pause {
+		log.Debugf("client: deal %d: stream consumer has %d unread bytes (max %d), pausing transfer",
+			s.dealID, s.unreadBytes, s.maxBuffered)
+	}
+	s.pause = pause
+
+	// Pausing the transfer may wait for the data transfer layer, which
+	// writes blocks to the stream while holding its own locks, so it
+	// happens in the background
+	go s.applyPause()
+}
+
+// applyPause pauses or resumes the transfer to match the latest state of
+// the stream
+func (s *retrievalStream) applyPause() {
+	s.pauseLk.Lock()
+	defer s.pauseLk.Unlock()
+
+	s.lk.Lock()
+	pause := s.pause
+	s.lk.Unlock()
+	if pause == s.paused {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pauseTransferTimeout)
+	defer cancel()
+	if err := s.pauseTransfer(ctx, pause); err != nil {
+		log.Warnf("client: deal %d: setting stream transfer paused to %t: %s", s.dealID, pause, err)
+
+		// Let the next change to the stream try again
+		s.lk.Lock()
+		s.pause = s.paused
+		s.lk.Unlock()
+		return
+	}
+	s.paused = pause
+}
+
+// consumedLocked records that the consumer has read the block with the
+// given CID
+func (s *retrievalStream) consumedLocked(c cid.Cid) {
+	size, ok := s.unread[c]
+	if !ok {
+		return
+	}
+	delete(s.unread, c)
+	s.unreadBytes -= size
+	s.notifyLocked()
+}
+
+// waitLocked waits for the state of the stream to change. It must be called
+// with the lock held, and returns with the lock held.
+func (s *retrievalStream) waitLocked(ctx context.Context) error {
+	// Let the transfer resume while the consumer is waiting for data
+	s.waiting++
+	s.updatePauseLocked()
+	changed := s.changed
+	s.lk.Unlock()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-changed:
+	}
+
+	s.lk.Lock()
+	s.waiting--
+	return err
+}
+
+func (s *retrievalStream) Next(ctx context.Context) (blocks.Block, error) {
+	c, err := s.nextCid(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := s.bs.Get(ctx, c)
+	if err != nil {
+		return nil, xerrors.Errorf("reading block %s: %w", c, err)
+	}
+	return blk, nil
+}
+
+// nextCid waits for the next block that hasn't been read by the consumer
+// and returns its CID
+func (s *retrievalStream) nextCid(ctx context.Context) (cid.Cid, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for {
+		if s.closed {
+			return cid.Undef, xerrors.New("stream closed")
+		}
+
+		// Skip over blocks that were already read through the file reader
+		for len(s.queue) > 0 {
+			c := s.queue[0]
+			s.queue = s.queue[1:]
+			if _, ok := s.unread[c]; ok {
+				s.consumedLocked(c)
+				return c, nil
+			}
+		}
+
+		if s.finished {
+			if s.err != nil {
+				return cid.Undef, s.err
+			}
+			return cid.Undef, io.EOF
+		}
+
+		if err := s.waitLocked(ctx); err != nil {
+			return cid.Undef, err
+		}
+	}
+}
+
+func (s *retrievalStream) FileReader(ctx context.Context) (io.Reader, error) {
+	wbs := &waitingBlockstore{Blockstore: s.bs, s: s}
+	dserv := merkledag.NewDAGService(blockservice.New(wbs, offline.Exchange(wbs)))
+	root, err := dserv.Get(ctx, s.payloadCID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting root node %s: %w", s.payloadCID, err)
+	}
+	return uio.NewDagReader(ctx, root, dserv)
+}
+
+func (s *retrievalStream) Close() error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.closed = true
+	s.queue = nil
+	s.unread = make(map[cid.Cid]uint64)
+	s.unreadBytes = 0
+	s.notifyLocked()
+	return nil
+}
+
+// waitingBlockstore is the blockstore used by the file reader of a stream.
+// Get waits for blocks that haven't been received yet.
+type waitingBlockstore struct {
+	bstore.Blockstore
+	s *retrievalStream
+}
+
+func (w *waitingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	for {
+		// The block is read without holding the lock of the stream, which
+		// the transfer takes for every block it writes
+		w.s.lk.Lock()
+		changed := w.s.changed
+		w.s.lk.Unlock()
+
+		blk, err := w.Blockstore.Get(ctx, c)
+		if err == nil {
+			w.s.lk.Lock()
+			w.s.consumedLocked(c)
+			w.s.lk.Unlock()
+			return blk, nil
+		}
+		if !xerrors.Is(err, bstore.ErrNotFound) {
+			return nil, err
+		}
+
+		if err := w.waitForBlock(ctx, c, changed); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitForBlock waits for more blocks to be received, after a block was not
+// found in the blockstore. It returns straight away if the stream changed
+// while the blockstore was read, as the block may have been received since.
+func (w *waitingBlockstore) waitForBlock(ctx context.Context, c cid.Cid, changed chan struct{}) error {
+	w.s.lk.Lock()
+	defer w.s.lk.Unlock()
+
+	if w.s.closed {
+		return xerrors.New("stream closed")
+	}
+	if w.s.changed != changed {
+		return nil
+	}
+	if w.s.finished {
+		if w.s.err != nil {
+			return w.s.err
+		}
+		return xerrors.Errorf("block %s was not received: %w", c, bstore.ErrNotFound)
+	}
+	return w.s.waitLocked(ctx)
+}
+
+// streamBlockstore passes the blocks written to a deal's blockstore on to
+// the deal's stream
+type streamBlockstore struct {
+	bstore.Blockstore
+	s *retrievalStream
+}
+
+func (b *streamBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	if err := b.Blockstore.Put(ctx, blk); err != nil {
+		return err
+	}
+	b.s.received(blk)
+	return nil
+}
+
+func (b *streamBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if err := b.Blockstore.PutMany(ctx, blks); err != nil {
+		return err
+	}
+	for _, blk := range blks {
+		b.s.received(blk)
+	}
+	return nil
+}
+
+// verifyBlock checks that the hash of the block's data matches its CID
+func verifyBlock(blk blocks.Block) bool {
+	c, err := blk.Cid().Prefix().Sum(blk.RawData())
+	if err != nil {
+		return false
+	}
+	return c.Equals(blk.Cid())
+}
@@ -0,0 +1,166 @@
+package retrievalimpl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	ds "github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil/unixfs"
+)
+
+func TestRetrievalStreamNext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bs := bstore.NewBlockstore(ds.NewMapDatastore())
+	blks := shared_testutil.GenerateBlocksOfSize(3, 100)
+	s := newRetrievalStream(1, blks[0].Cid(), bs, DefaultMaxStreamBuffered, nil)
+	sbs := &streamBlockstore{Blockstore: bs, s: s}
+
+	go func() {
+		for _, blk := range blks {
+			_ = sbs.Put(ctx, blk)
+		}
+		s.finish(nil)
+	}()
+
+	for _, expected := range blks {
+		blk, err := s.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, expected.Cid(), blk.Cid())
+	}
+	_, err := s.Next(ctx)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestRetrievalStreamVerification(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bs := bstore.NewBlockstore(ds.NewMapDatastore())
+	blks := shared_testutil.GenerateBlocksOfSize(2, 100)
+	s := newRetrievalStream(1, blks[0].Cid(), bs, DefaultMaxStreamBuffered, nil)
+
+	// A block with data that doesn't match its CID
+	bad, err := blocks.NewBlockWithCid(blks[0].RawData(), blks[1].Cid())
+	require.NoError(t, err)
+	s.received(bad)
+
+	_, err = s.Next(ctx)
+	require.True(t, xerrors.Is(err, ErrBlockVerification))
+}
+
+func TestRetrievalStreamBackpressure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pauses := make(chan bool, 10)
+	pauseTransfer := func(ctx context.Context, pause bool) error {
+		pauses <- pause
+		return nil
+	}
+	expectPause := func(expected bool) {
+		select {
+		case pause := <-pauses:
+			require.Equal(t, expected, pause)
+		case <-ctx.Done():
+			t.Fatalf("expected transfer paused to be set to %t", expected)
+		}
+	}
+	expectNoPause := func() {
+		select {
+		case pause := <-pauses:
+			t.Fatalf("expected no change to transfer, got paused set to %t", pause)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	bs := bstore.NewBlockstore(ds.NewMapDatastore())
+	blks := shared_testutil.GenerateBlocksOfSize(3, 100)
+	require.NoError(t, bs.PutMany(ctx, blks))
+	s := newRetrievalStream(1, blks[0].Cid(), bs, 150, pauseTransfer)
+
+	// 200 unread bytes is more than the 150 byte buffer, so the transfer
+	// is paused
+	s.received(blks[0])
+	expectNoPause()
+	s.received(blks[1])
+	expectPause(true)
+	s.received(blks[2])
+	expectNoPause()
+
+	// The transfer is resumed once the consumer has caught up
+	_, err := s.Next(ctx)
+	require.NoError(t, err)
+	expectNoPause()
+	_, err = s.Next(ctx)
+	require.NoError(t, err)
+	expectPause(false)
+
+	// Closing the stream resumes a paused transfer
+	s2 := newRetrievalStream(2, blks[0].Cid(), bs, 150, pauseTransfer)
+	for _, blk := range blks {
+		s2.received(blk)
+	}
+	expectPause(true)
+	require.NoError(t, s2.Close())
+	expectPause(false)
+}
+
+func TestRetrievalStreamFileReader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Create a UnixFS file in a source blockstore
+	data := make([]byte, 64*1024)
+	copy(data, bytes.Repeat([]byte("retrieval stream "), len(data)/17))
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, ioutil.WriteFile(path, data, os.ModePerm))
+
+	srcBs := bstore.NewBlockstore(ds.NewMapDatastore())
+	srcDAG := merkledag.NewDAGService(blockservice.New(srcBs, offline.Exchange(srcBs)))
+	root := unixfs.WriteUnixfsDAGTo(t, path, srcDAG)
+
+	keys, err := srcBs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var srcBlks []blocks.Block
+	for k := range keys {
+		blk, err := srcBs.Get(ctx, k)
+		require.NoError(t, err)
+		srcBlks = append(srcBlks, blk)
+	}
+
+	// Write the blocks to the deal blockstore in the background, while
+	// reading the file from the stream
+	bs := bstore.NewBlockstore(ds.NewMapDatastore())
+	s := newRetrievalStream(1, root, bs, DefaultMaxStreamBuffered, nil)
+	sbs := &streamBlockstore{Blockstore: bs, s: s}
+	go func() {
+		for _, blk := range srcBlks {
+			time.Sleep(time.Millisecond)
+			_ = sbs.Put(ctx, blk)
+		}
+		s.finish(nil)
+	}()
+
+	r, err := s.FileReader(ctx)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+}
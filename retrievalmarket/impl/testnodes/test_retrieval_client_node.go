@@ -13,6 +13,7 @@ import (
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
@@ -33,6 +34,7 @@ type TestRetrievalClientNode struct {
 	voucherError, waitErr             error
 	channelAvailableFunds             retrievalmarket.ChannelAvailableFunds
 	checkAvailableFundsErr            error
+	signBytesErr                      error
 	fundsAdded                        abi.TokenAmount
 	intergrationTest                  bool
 	knownAddreses                     map[retrievalmarket.RetrievalPeer][]ma.Multiaddr
@@ -59,10 +61,12 @@ type TestRetrievalClientNodeParams struct {
 	WaitForReadyErr             error
 	ChannelAvailableFunds       retrievalmarket.ChannelAvailableFunds
 	CheckAvailableFundsErr      error
+	SignBytesErr                error
 	IntegrationTest             bool
 }
 
 var _ retrievalmarket.RetrievalClientNode = &TestRetrievalClientNode{}
+var _ retrievalmarket.RetrievalClientSigner = &TestRetrievalClientNode{}
 
 // NewTestRetrievalClientNode initializes a new TestRetrievalClientNode based on the given params
 func NewTestRetrievalClientNode(params TestRetrievalClientNodeParams) *TestRetrievalClientNode {
@@ -82,6 +86,7 @@ func NewTestRetrievalClientNode(params TestRetrievalClientNodeParams) *TestRetri
 		addFundsMsgCID:                  params.AddFundsCID,
 		channelAvailableFunds:           addZeroesToAvailableFunds(params.ChannelAvailableFunds),
 		checkAvailableFundsErr:          params.CheckAvailableFundsErr,
+		signBytesErr:                    params.SignBytesErr,
 		intergrationTest:                params.IntegrationTest,
 		knownAddreses:                   map[retrievalmarket.RetrievalPeer][]ma.Multiaddr{},
 		expectedKnownAddresses:          map[retrievalmarket.RetrievalPeer]struct{}{},
@@ -175,6 +180,14 @@ func (trcn *TestRetrievalClientNode) GetKnownAddresses(ctx context.Context, p re
 	return addrs, nil
 }
 
+// SignBytes simulates signing data by returning a test signature
+func (trcn *TestRetrievalClientNode) SignBytes(ctx context.Context, signer address.Address, b []byte) (*crypto.Signature, error) {
+	if trcn.signBytesErr != nil {
+		return nil, trcn.signBytesErr
+	}
+	return shared_testutil.MakeTestSignature(), nil
+}
+
 // ResetChannelAvailableFunds is a way to manually change the funds in the payment channel
 func (trcn *TestRetrievalClientNode) ResetChannelAvailableFunds(channelAvailableFunds retrievalmarket.ChannelAvailableFunds) {
 	trcn.channelAvailableFunds = addZeroesToAvailableFunds(channelAvailableFunds)
@@ -0,0 +1,349 @@
+package retrievalimpl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// verifiedBytesTimeout is the longest the client waits for received blocks
+// to be verified before checking a payment request against them
+var verifiedBytesTimeout = 10 * time.Second
+
+// dealVerifier checks the blocks received for a retrieval deal, and counts
+// the bytes that have been verified.
+//
+// It runs its own traversal of the deal's selector in step with the blocks
+// that are written to the deal's blockstore. Graphsync writes blocks in
+// traversal order, so each new block received must be the block the
+// verifier's traversal is waiting for.
+type dealVerifier struct {
+	dealID retrievalmarket.DealID
+	bs     bstore.Blockstore
+	cancel context.CancelFunc
+	// onFailed is called once, when verification first fails
+	onFailed func(blockCID *cid.Cid, err error)
+
+	lk sync.Mutex
+	// changed is closed (and replaced) whenever the state of the verifier
+	// changes
+	changed chan struct{}
+	// the CID of the block the traversal is waiting for, if any
+	wanted cid.Cid
+	// the block received for the wanted CID
+	delivered blocks.Block
+	// the blocks the traversal has reached so far
+	seen map[cid.Cid]struct{}
+	// blocks that have been verified but not yet written to the blockstore
+	pending       map[cid.Cid]blocks.Block
+	verifiedBytes uint64
+	done          bool
+	closed        bool
+	err           error
+}
+
+func newDealVerifier(
+	dealID retrievalmarket.DealID,
+	root cid.Cid,
+	sel ipld.Node,
+	bs bstore.Blockstore,
+	onFailed func(blockCID *cid.Cid, err error),
+) *dealVerifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &dealVerifier{
+		dealID:   dealID,
+		bs:       bs,
+		cancel:   cancel,
+		onFailed: onFailed,
+		changed:  make(chan struct{}),
+		seen:     make(map[cid.Cid]struct{}),
+		pending:  make(map[cid.Cid]blocks.Block),
+	}
+	go v.traverse(ctx, root, sel)
+	return v
+}
+
+func (v *dealVerifier) traverse(ctx context.Context, root cid.Cid, sel ipld.Node) {
+	err := v.walk(ctx, root, sel)
+
+	v.lk.Lock()
+	v.done = true
+	var failed error
+	if err != nil && ctx.Err() == nil && v.err == nil {
+		failed = xerrors.Errorf("traversing selector: %s: %w", err, retrievalmarket.ErrVerification)
+		v.err = failed
+	}
+	v.notifyLocked()
+	v.lk.Unlock()
+
+	if failed != nil {
+		v.onFailed(nil, failed)
+	}
+}
+
+func (v *dealVerifier) walk(ctx context.Context, root cid.Cid, sel ipld.Node) error {
+	compiled, err := selector.CompileSelector(sel)
+	if err != nil {
+		return xerrors.Errorf("compiling selector: %w", err)
+	}
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, xerrors.Errorf("unsupported link type %T", lnk)
+		}
+		blk, err := v.load(lctx.Ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+	chooser := dagpb.AddSupportToChooser(func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+		return basicnode.Prototype.Any, nil
+	})
+
+	rootLnk := cidlink.Link{Cid: root}
+	lctx := ipld.LinkContext{Ctx: ctx}
+	proto, err := chooser(rootLnk, lctx)
+	if err != nil {
+		return err
+	}
+	nd, err := lsys.Load(lctx, rootLnk, proto)
+	if err != nil {
+		return xerrors.Errorf("loading root %s: %w", root, err)
+	}
+
+	return traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+		},
+	}.WalkAdv(nd, compiled, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+}
+
+// load returns the block for a link reached by the traversal. Blocks that
+// are already in the blockstore are returned straight away, otherwise load
+// waits for the block to be received.
+func (v *dealVerifier) load(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	if blk, ok := v.pending[c]; ok {
+		return blk, nil
+	}
+	has, err := v.bs.Has(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		blk, err := v.bs.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := v.seen[c]; !ok {
+			v.seen[c] = struct{}{}
+			v.verifiedBytes += uint64(len(blk.RawData()))
+			v.notifyLocked()
+		}
+		return blk, nil
+	}
+
+	v.wanted = c
+	v.notifyLocked()
+	for v.delivered == nil {
+		if v.err != nil {
+			v.wanted = cid.Undef
+			return nil, v.err
+		}
+		if err := v.waitLocked(ctx); err != nil {
+			v.wanted = cid.Undef
+			return nil, err
+		}
+	}
+	blk := v.delivered
+	v.delivered = nil
+	return blk, nil
+}
+
+// received checks a block that is about to be written to the deal's
+// blockstore
+func (v *dealVerifier) received(ctx context.Context, blk blocks.Block) error {
+	c := blk.Cid()
+	if !verifyBlock(blk) {
+		return v.fail(c, xerrors.Errorf("block %s data does not match CID: %w", c, retrievalmarket.ErrVerification))
+	}
+
+	v.lk.Lock()
+	for {
+		if v.err != nil {
+			err := v.err
+			v.lk.Unlock()
+			return err
+		}
+		if v.closed {
+			v.lk.Unlock()
+			return xerrors.New("deal verifier closed")
+		}
+		if _, ok := v.seen[c]; ok {
+			v.lk.Unlock()
+			return nil
+		}
+		if v.wanted.Defined() {
+			break
+		}
+		if v.done {
+			v.lk.Unlock()
+			return v.fail(c, xerrors.Errorf("block %s is not part of the selector traversal: %w", c, retrievalmarket.ErrVerification))
+		}
+		if err := v.waitLocked(ctx); err != nil {
+			v.lk.Unlock()
+			return err
+		}
+	}
+
+	if !v.wanted.Equals(c) {
+		wanted := v.wanted
+		v.lk.Unlock()
+		return v.fail(c, xerrors.Errorf("received block %s but selector traversal expected %s: %w", c, wanted, retrievalmarket.ErrVerification))
+	}
+
+	v.seen[c] = struct{}{}
+	v.pending[c] = blk
+	v.verifiedBytes += uint64(len(blk.RawData()))
+	v.delivered = blk
+	v.wanted = cid.Undef
+	v.notifyLocked()
+	v.lk.Unlock()
+	return nil
+}
+
+// stored is called once a verified block has been written to the
+// blockstore
+func (v *dealVerifier) stored(c cid.Cid) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	delete(v.pending, c)
+}
+
+// fail records a verification failure. onFailed is only called for the
+// first failure.
+func (v *dealVerifier) fail(c cid.Cid, err error) error {
+	v.lk.Lock()
+	first := v.err == nil
+	if first {
+		v.err = err
+		v.notifyLocked()
+	}
+	v.lk.Unlock()
+
+	if first {
+		v.onFailed(&c, err)
+	}
+	return err
+}
+
+// awaitVerified waits until at least the given number of bytes have been
+// verified, or the verifier stops, and returns the number of bytes verified
+func (v *dealVerifier) awaitVerified(ctx context.Context, bytes uint64) uint64 {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	for v.verifiedBytes < bytes && !v.done && !v.closed && v.err == nil {
+		if err := v.waitLocked(ctx); err != nil {
+			break
+		}
+	}
+	return v.verifiedBytes
+}
+
+func (v *dealVerifier) verified() uint64 {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	return v.verifiedBytes
+}
+
+// close stops the verifier's traversal
+func (v *dealVerifier) close() {
+	v.cancel()
+
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	v.closed = true
+	v.notifyLocked()
+}
+
+func (v *dealVerifier) notifyLocked() {
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+// waitLocked waits for the state of the verifier to change. It must be
+// called with the lock held, and returns with the lock held.
+func (v *dealVerifier) waitLocked(ctx context.Context) error {
+	changed := v.changed
+	v.lk.Unlock()
+	defer v.lk.Lock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+		return nil
+	}
+}
+
+// verifyingBlockstore checks blocks with the deal's verifier before
+// writing them to the deal's blockstore
+type verifyingBlockstore struct {
+	bstore.Blockstore
+	v *dealVerifier
+}
+
+func (b *verifyingBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	if err := b.v.received(ctx, blk); err != nil {
+		return err
+	}
+	if err := b.Blockstore.Put(ctx, blk); err != nil {
+		return err
+	}
+	b.v.stored(blk.Cid())
+	return nil
+}
+
+func (b *verifyingBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		if err := b.v.received(ctx, blk); err != nil {
+			return err
+		}
+	}
+	if err := b.Blockstore.PutMany(ctx, blks); err != nil {
+		return err
+	}
+	for _, blk := range blks {
+		b.v.stored(blk.Cid())
+	}
+	return nil
+}
+
+var _ bstore.Blockstore = (*verifyingBlockstore)(nil)
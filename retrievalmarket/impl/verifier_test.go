@@ -0,0 +1,220 @@
+package retrievalimpl
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-statestore"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket/impl/testnodes"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil/unixfs"
+)
+
+type verifierFailure struct {
+	lk       sync.Mutex
+	blockCID *cid.Cid
+	err      error
+}
+
+func (f *verifierFailure) onFailed(blockCID *cid.Cid, err error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.blockCID = blockCID
+	f.err = err
+}
+
+func (f *verifierFailure) get() (*cid.Cid, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.blockCID, f.err
+}
+
+func TestDealVerifier(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	root, blks := makeVerifierDAG(ctx, t)
+	var total uint64
+	for _, blk := range blks {
+		total += uint64(len(blk.RawData()))
+	}
+
+	t.Run("blocks in traversal order", func(t *testing.T) {
+		bs := bstore.NewBlockstore(ds.NewMapDatastore())
+		failure := &verifierFailure{}
+		v := newDealVerifier(1, root, selectorparse.CommonSelector_ExploreAllRecursively, bs, failure.onFailed)
+		defer v.close()
+		vbs := &verifyingBlockstore{Blockstore: bs, v: v}
+
+		for _, blk := range blks {
+			require.NoError(t, vbs.Put(ctx, blk))
+		}
+		require.Equal(t, total, v.awaitVerified(ctx, total))
+		_, err := failure.get()
+		require.NoError(t, err)
+	})
+
+	t.Run("resumed with some blocks already received", func(t *testing.T) {
+		bs := bstore.NewBlockstore(ds.NewMapDatastore())
+		require.NoError(t, bs.PutMany(ctx, blks[:len(blks)/2]))
+		failure := &verifierFailure{}
+		v := newDealVerifier(1, root, selectorparse.CommonSelector_ExploreAllRecursively, bs, failure.onFailed)
+		defer v.close()
+		vbs := &verifyingBlockstore{Blockstore: bs, v: v}
+
+		// The provider sends all blocks again
+		for _, blk := range blks {
+			require.NoError(t, vbs.Put(ctx, blk))
+		}
+		require.Equal(t, total, v.awaitVerified(ctx, total))
+		_, err := failure.get()
+		require.NoError(t, err)
+	})
+
+	t.Run("block outside selector", func(t *testing.T) {
+		bs := bstore.NewBlockstore(ds.NewMapDatastore())
+		failure := &verifierFailure{}
+		v := newDealVerifier(1, root, selectorparse.CommonSelector_ExploreAllRecursively, bs, failure.onFailed)
+		defer v.close()
+		vbs := &verifyingBlockstore{Blockstore: bs, v: v}
+
+		require.NoError(t, vbs.Put(ctx, blks[0]))
+		other := shared_testutil.GenerateBlocksOfSize(1, 100)[0]
+		err := vbs.Put(ctx, other)
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrVerification))
+
+		blockCID, err := failure.get()
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrVerification))
+		require.Equal(t, other.Cid(), *blockCID)
+
+		// The block is not written to the blockstore
+		has, err := bs.Has(ctx, other.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+
+		// Later blocks fail too
+		err = vbs.Put(ctx, blks[1])
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrVerification))
+	})
+
+	t.Run("block data does not match CID", func(t *testing.T) {
+		bs := bstore.NewBlockstore(ds.NewMapDatastore())
+		failure := &verifierFailure{}
+		v := newDealVerifier(1, root, selectorparse.CommonSelector_ExploreAllRecursively, bs, failure.onFailed)
+		defer v.close()
+		vbs := &verifyingBlockstore{Blockstore: bs, v: v}
+
+		bad, err := blocks.NewBlockWithCid(blks[1].RawData(), blks[0].Cid())
+		require.NoError(t, err)
+		err = vbs.Put(ctx, bad)
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrVerification))
+
+		blockCID, err := failure.get()
+		require.True(t, xerrors.Is(err, retrievalmarket.ErrVerification))
+		require.Equal(t, blks[0].Cid(), *blockCID)
+	})
+
+	t.Run("await verified bytes times out", func(t *testing.T) {
+		bs := bstore.NewBlockstore(ds.NewMapDatastore())
+		failure := &verifierFailure{}
+		v := newDealVerifier(1, root, selectorparse.CommonSelector_ExploreAllRecursively, bs, failure.onFailed)
+		defer v.close()
+		vbs := &verifyingBlockstore{Blockstore: bs, v: v}
+
+		require.NoError(t, vbs.Put(ctx, blks[0]))
+		waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer waitCancel()
+		verified := v.awaitVerified(waitCtx, total)
+		require.Equal(t, uint64(len(blks[0].RawData())), verified)
+	})
+}
+
+// makeVerifierDAG creates a UnixFS DAG, and returns its root and its blocks
+// in the order they are reached by a selector traversal
+func makeVerifierDAG(ctx context.Context, t *testing.T) (cid.Cid, []blocks.Block) {
+	data := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, ioutil.WriteFile(path, data, os.ModePerm))
+
+	srcBs := bstore.NewBlockstore(ds.NewMapDatastore())
+	dag := merkledag.NewDAGService(blockservice.New(srcBs, offline.Exchange(srcBs)))
+	root := unixfs.WriteUnixfsDAGTo(t, path, dag)
+
+	var blks []blocks.Block
+	seen := make(map[cid.Cid]struct{})
+	var walk func(c cid.Cid)
+	walk = func(c cid.Cid) {
+		if _, ok := seen[c]; ok {
+			return
+		}
+		seen[c] = struct{}{}
+		nd, err := dag.Get(ctx, c)
+		require.NoError(t, err)
+		blks = append(blks, nd)
+		for _, l := range nd.Links() {
+			walk(l.Cid)
+		}
+	}
+	walk(root)
+	require.Greater(t, len(blks), 2)
+	return root, blks
+}
+
+func TestRecordVerificationFailure(t *testing.T) {
+	ctx := context.Background()
+	deal := retrievalmarket.ClientDealState{
+		DealProposal: retrievalmarket.DealProposal{ID: 1, PayloadCID: shared_testutil.GenerateCids(1)[0]},
+		ClientWallet: address.TestAddress,
+	}
+	verr := xerrors.Errorf("bad block: %w", retrievalmarket.ErrVerification)
+
+	t.Run("keeps each failure of a deal", func(t *testing.T) {
+		node := testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})
+		c := &Client{node: node, evidence: statestore.New(ds.NewMapDatastore())}
+		c.recordVerificationFailure(ctx, deal, nil, verr)
+		c.recordVerificationFailure(ctx, deal, nil, verr)
+
+		evidence, err := c.ListVerificationEvidence()
+		require.NoError(t, err)
+		require.Len(t, evidence, 2)
+		for _, e := range evidence {
+			require.Equal(t, deal.ID, e.Evidence.DealID)
+			require.NotNil(t, e.Signature)
+		}
+	})
+
+	t.Run("keeps unsigned evidence if the node cannot sign", func(t *testing.T) {
+		// Embedding the node interface hides the node's SignBytes method
+		node := struct {
+			retrievalmarket.RetrievalClientNode
+		}{testnodes.NewTestRetrievalClientNode(testnodes.TestRetrievalClientNodeParams{})}
+		c := &Client{node: node, evidence: statestore.New(ds.NewMapDatastore())}
+		c.recordVerificationFailure(ctx, deal, nil, verr)
+
+		evidence, err := c.ListVerificationEvidence()
+		require.NoError(t, err)
+		require.Len(t, evidence, 1)
+		require.Nil(t, evidence[0].Signature)
+	})
+}
@@ -257,6 +257,17 @@ func (e *mockClientEnv) FinalizeBlockstore(ctx context.Context, id retrievalmark
 	return nil
 }
 
+func (e *mockClientEnv) VerifiedBytes(id retrievalmarket.DealID) (uint64, bool) {
+	return 0, false
+}
+
+func (e *mockClientEnv) AwaitVerifiedBytes(ctx context.Context, id retrievalmarket.DealID, bytes uint64) (uint64, bool) {
+	return 0, false
+}
+
+func (e *mockClientEnv) RecordVerificationFailure(ctx context.Context, deal retrievalmarket.ClientDealState, err error) {
+}
+
 var _ clientstates.ClientDealEnvironment = &mockClientEnv{}
 
 type mockProviderEnv struct {
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"bufio"
+
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+type batchQueryStream struct {
+	p        peer.ID
+	rw       mux.MuxedStream
+	buffered *bufio.Reader
+}
+
+var _ RetrievalBatchQueryStream = (*batchQueryStream)(nil)
+
+func (qs *batchQueryStream) ReadBatchQuery() (retrievalmarket.BatchQuery, error) {
+	var q retrievalmarket.BatchQuery
+
+	if err := q.UnmarshalCBOR(qs.buffered); err != nil {
+		log.Warn(err)
+		return retrievalmarket.BatchQuery{}, err
+	}
+
+	return q, nil
+}
+
+func (qs *batchQueryStream) RemotePeer() peer.ID {
+	return qs.p
+}
+
+func (qs *batchQueryStream) WriteBatchQuery(q retrievalmarket.BatchQuery) error {
+	return cborutil.WriteCborRPC(qs.rw, &q)
+}
+
+func (qs *batchQueryStream) ReadBatchQueryResponse() (retrievalmarket.BatchQueryResponse, error) {
+	var resp retrievalmarket.BatchQueryResponse
+
+	if err := resp.UnmarshalCBOR(qs.buffered); err != nil {
+		log.Warn(err)
+		return retrievalmarket.BatchQueryResponseUndefined, err
+	}
+
+	return resp, nil
+}
+
+func (qs *batchQueryStream) WriteBatchQueryResponse(qr retrievalmarket.BatchQueryResponse) error {
+	return cborutil.WriteCborRPC(qs.rw, &qr)
+}
+
+func (qs *batchQueryStream) Close() error {
+	return qs.rw.Close()
+}
@@ -43,6 +43,7 @@ func NewFromLibp2pHost(h host.Host, options ...Option) RetrievalMarketNetwork {
 		host:        h,
 		retryStream: shared.NewRetryStream(h),
 		supportedProtocols: []protocol.ID{
+			retrievalmarket.PiecesQueryProtocolID,
 			retrievalmarket.QueryProtocolID,
 			retrievalmarket.OldQueryProtocolID,
 		},
@@ -75,7 +76,18 @@ func (impl *libp2pRetrievalMarketNetwork) NewQueryStream(id peer.ID) (RetrievalQ
 	if s.Protocol() == retrievalmarket.OldQueryProtocolID {
 		return &oldQueryStream{p: id, rw: s, buffered: buffered}, nil
 	}
-	return &queryStream{p: id, rw: s, buffered: buffered}, nil
+	return &queryStream{p: id, rw: s, buffered: buffered, withPieces: s.Protocol() == retrievalmarket.PiecesQueryProtocolID}, nil
+}
+
+// NewBatchQueryStream creates a new RetrievalBatchQueryStream using the provided peer.ID
+func (impl *libp2pRetrievalMarketNetwork) NewBatchQueryStream(id peer.ID) (RetrievalBatchQueryStream, error) {
+	s, err := impl.retryStream.OpenStream(context.Background(), id, []protocol.ID{retrievalmarket.BatchQueryProtocolID})
+	if err != nil {
+		log.Warn(err)
+		return nil, err
+	}
+	buffered := bufio.NewReaderSize(s, 16)
+	return &batchQueryStream{p: id, rw: s, buffered: buffered}, nil
 }
 
 // SetDelegate sets a RetrievalReceiver to handle stream data
@@ -84,6 +96,7 @@ func (impl *libp2pRetrievalMarketNetwork) SetDelegate(r RetrievalReceiver) error
 	for _, proto := range impl.supportedProtocols {
 		impl.host.SetStreamHandler(proto, impl.handleNewQueryStream)
 	}
+	impl.host.SetStreamHandler(retrievalmarket.BatchQueryProtocolID, impl.handleNewBatchQueryStream)
 	return nil
 }
 
@@ -94,6 +107,7 @@ func (impl *libp2pRetrievalMarketNetwork) StopHandlingRequests() error {
 	for _, proto := range impl.supportedProtocols {
 		impl.host.RemoveStreamHandler(proto)
 	}
+	impl.host.RemoveStreamHandler(retrievalmarket.BatchQueryProtocolID)
 	return nil
 }
 
@@ -109,11 +123,22 @@ func (impl *libp2pRetrievalMarketNetwork) handleNewQueryStream(s network.Stream)
 	if s.Protocol() == retrievalmarket.OldQueryProtocolID {
 		qs = &oldQueryStream{remotePID, s, buffered}
 	} else {
-		qs = &queryStream{remotePID, s, buffered}
+		qs = &queryStream{remotePID, s, buffered, s.Protocol() == retrievalmarket.PiecesQueryProtocolID}
 	}
 	impl.receiver.HandleQueryStream(qs)
 }
 
+func (impl *libp2pRetrievalMarketNetwork) handleNewBatchQueryStream(s network.Stream) {
+	if impl.receiver == nil {
+		log.Warn("no receiver set")
+		s.Reset() // nolint: errcheck,gosec
+		return
+	}
+	remotePID := s.Conn().RemotePeer()
+	buffered := bufio.NewReaderSize(s, 16)
+	impl.receiver.HandleBatchQueryStream(&batchQueryStream{remotePID, s, buffered})
+}
+
 func (impl *libp2pRetrievalMarketNetwork) ID() peer.ID {
 	return impl.host.ID()
 }
@@ -10,14 +10,18 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket/network"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 )
 
 type testReceiver struct {
-	t                  *testing.T
-	queryStreamHandler func(network.RetrievalQueryStream)
+	t                       *testing.T
+	queryStreamHandler      func(network.RetrievalQueryStream)
+	batchQueryStreamHandler func(network.RetrievalBatchQueryStream)
 }
 
 func (tr *testReceiver) HandleQueryStream(s network.RetrievalQueryStream) {
@@ -27,6 +31,13 @@ func (tr *testReceiver) HandleQueryStream(s network.RetrievalQueryStream) {
 	}
 }
 
+func (tr *testReceiver) HandleBatchQueryStream(s network.RetrievalBatchQueryStream) {
+	defer s.Close()
+	if tr.batchQueryStreamHandler != nil {
+		tr.batchQueryStreamHandler(s)
+	}
+}
+
 func TestQueryStreamSendReceiveQuery(t *testing.T) {
 	ctx := context.Background()
 
@@ -168,6 +179,130 @@ func TestQueryStreamSendReceiveMultipleSuccessful(t *testing.T) {
 	assert.Equal(t, qr, resp)
 }
 
+func TestQueryStreamResponsePieces(t *testing.T) {
+	testCases := map[string]struct {
+		receiverProtocols []protocol.ID
+		expectPieces      bool
+	}{
+		"receiver supports pieces query": {
+			expectPieces: true,
+		},
+		"receiver does not support pieces query": {
+			receiverProtocols: []protocol.ID{retrievalmarket.QueryProtocolID},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctxBg := context.Background()
+			td := shared_testutil.NewLibp2pTestData(ctxBg, t)
+			nw1 := network.NewFromLibp2pHost(td.Host1)
+			var nw2 network.RetrievalMarketNetwork
+			if data.receiverProtocols != nil {
+				nw2 = network.NewFromLibp2pHost(td.Host2, network.SupportedProtocols(data.receiverProtocols))
+			} else {
+				nw2 = network.NewFromLibp2pHost(td.Host2)
+			}
+			require.NoError(t, td.Host1.Connect(ctxBg, peer.AddrInfo{ID: td.Host2.ID()}))
+
+			qr := shared_testutil.MakeTestQueryResponse()
+			qr.Pieces = []retrievalmarket.QueryPiece{{
+				PieceCID:     shared_testutil.GenerateCids(1)[0],
+				Size:         1024,
+				Unsealed:     true,
+				PricePerByte: abi.NewTokenAmount(1),
+				UnsealPrice:  abi.NewTokenAmount(0),
+			}}
+			tr2 := &testReceiver{t: t, queryStreamHandler: func(s network.RetrievalQueryStream) {
+				_, err := s.ReadQuery()
+				require.NoError(t, err)
+				require.NoError(t, s.WriteQueryResponse(qr))
+			}}
+			require.NoError(t, nw2.SetDelegate(tr2))
+
+			qs, err := nw1.NewQueryStream(td.Host2.ID())
+			require.NoError(t, err)
+			defer qs.Close()
+
+			require.NoError(t, qs.WriteQuery(retrievalmarket.Query{PayloadCID: shared_testutil.GenerateCids(1)[0]}))
+			resp, err := qs.ReadQueryResponse()
+			require.NoError(t, err)
+
+			if data.expectPieces {
+				require.Equal(t, qr.Pieces, resp.Pieces)
+			} else {
+				require.Empty(t, resp.Pieces)
+				qr.Pieces = nil
+			}
+			require.Equal(t, qr, resp)
+		})
+	}
+}
+
+func TestBatchQueryStreamSendReceive(t *testing.T) {
+	ctxBg := context.Background()
+	td := shared_testutil.NewLibp2pTestData(ctxBg, t)
+	nw1 := network.NewFromLibp2pHost(td.Host1)
+	nw2 := network.NewFromLibp2pHost(td.Host2)
+	require.NoError(t, td.Host1.Connect(ctxBg, peer.AddrInfo{ID: td.Host2.ID()}))
+
+	cids := shared_testutil.GenerateCids(3)
+	query := retrievalmarket.BatchQuery{
+		Items: []retrievalmarket.BatchQueryItem{
+			{PayloadCID: cids[0]},
+			{PayloadCID: cids[1], PieceCID: &cids[2]},
+		},
+	}
+	qr := retrievalmarket.BatchQueryResponse{
+		Status:         retrievalmarket.QueryResponseAvailable,
+		PaymentAddress: address.TestAddress,
+		Items: []retrievalmarket.BatchQueryItemResponse{{
+			PayloadCID:    cids[0],
+			Status:        retrievalmarket.QueryResponseAvailable,
+			PieceCIDFound: retrievalmarket.QueryItemUnavailable,
+			Pieces: []retrievalmarket.QueryPiece{{
+				PieceCID:     cids[2],
+				Size:         1024,
+				Unsealed:     true,
+				PricePerByte: abi.NewTokenAmount(2),
+				UnsealPrice:  abi.NewTokenAmount(0),
+			}},
+		}, {
+			PayloadCID:    cids[1],
+			Status:        retrievalmarket.QueryResponseUnavailable,
+			PieceCIDFound: retrievalmarket.QueryItemUnavailable,
+			Message:       "not found",
+		}},
+	}
+
+	// host2 gets a batch query and sends a response
+	qchan := make(chan retrievalmarket.BatchQuery, 1)
+	tr2 := &testReceiver{t: t, batchQueryStreamHandler: func(s network.RetrievalBatchQueryStream) {
+		q, err := s.ReadBatchQuery()
+		require.NoError(t, err)
+		qchan <- q
+		require.NoError(t, s.WriteBatchQueryResponse(qr))
+	}}
+	require.NoError(t, nw2.SetDelegate(tr2))
+
+	qs, err := nw1.NewBatchQueryStream(td.Host2.ID())
+	require.NoError(t, err)
+	defer qs.Close()
+
+	require.NoError(t, qs.WriteBatchQuery(query))
+	resp, err := qs.ReadBatchQueryResponse()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(ctxBg, 10*time.Second)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		t.Fatal("query not received")
+	case q := <-qchan:
+		assert.Equal(t, query, q)
+	}
+	assert.Equal(t, qr, resp)
+}
+
 func TestLibp2pRetrievalMarketNetwork_StopHandlingRequests(t *testing.T) {
 	bgCtx := context.Background()
 	td := shared_testutil.NewLibp2pTestData(bgCtx, t)
@@ -21,12 +21,34 @@ type RetrievalQueryStream interface {
 	RemotePeer() peer.ID
 }
 
+// PiecesQueryStream is implemented by query streams that know whether the
+// protocol version of the stream supports listing the pieces that contain
+// the payload in the query response
+type PiecesQueryStream interface {
+	WithPieces() bool
+}
+
+// RetrievalBatchQueryStream is the API needed to send and receive batch
+// retrieval queries, that ask about many payload CIDs at once
+type RetrievalBatchQueryStream interface {
+	ReadBatchQuery() (retrievalmarket.BatchQuery, error)
+	WriteBatchQuery(retrievalmarket.BatchQuery) error
+	ReadBatchQueryResponse() (retrievalmarket.BatchQueryResponse, error)
+	WriteBatchQueryResponse(retrievalmarket.BatchQueryResponse) error
+	Close() error
+	RemotePeer() peer.ID
+}
+
 // RetrievalReceiver is the API for handling data coming in on
 // both query and deal streams
 type RetrievalReceiver interface {
 	// HandleQueryStream sends and receives data-transfer data via the
 	// RetrievalQueryStream provided
 	HandleQueryStream(RetrievalQueryStream)
+
+	// HandleBatchQueryStream sends and receives batch queries via the
+	// RetrievalBatchQueryStream provided
+	HandleBatchQueryStream(RetrievalBatchQueryStream)
 }
 
 // RetrievalMarketNetwork is the API for creating query and deal streams and
@@ -35,6 +57,9 @@ type RetrievalMarketNetwork interface {
 	//  NewQueryStream creates a new RetrievalQueryStream implementer using the provided peer.ID
 	NewQueryStream(peer.ID) (RetrievalQueryStream, error)
 
+	// NewBatchQueryStream creates a new RetrievalBatchQueryStream using the provided peer.ID
+	NewBatchQueryStream(peer.ID) (RetrievalBatchQueryStream, error)
+
 	// SetDelegate sets a RetrievalReceiver implementer to handle stream data
 	SetDelegate(RetrievalReceiver) error
 
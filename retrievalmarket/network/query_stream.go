@@ -15,9 +15,13 @@ type queryStream struct {
 	p        peer.ID
 	rw       mux.MuxedStream
 	buffered *bufio.Reader
+	// withPieces is true if the stream protocol version supports listing
+	// the pieces that contain the payload in the query response
+	withPieces bool
 }
 
 var _ RetrievalQueryStream = (*queryStream)(nil)
+var _ PiecesQueryStream = (*queryStream)(nil)
 
 func (qs *queryStream) ReadQuery() (retrievalmarket.Query, error) {
 	var q retrievalmarket.Query
@@ -51,9 +55,16 @@ func (qs *queryStream) ReadQueryResponse() (retrievalmarket.QueryResponse, error
 }
 
 func (qs *queryStream) WriteQueryResponse(qr retrievalmarket.QueryResponse) error {
+	if !qs.withPieces {
+		qr.Pieces = nil
+	}
 	return cborutil.WriteCborRPC(qs.rw, &qr)
 }
 
+func (qs *queryStream) WithPieces() bool {
+	return qs.withPieces
+}
+
 func (qs *queryStream) Close() error {
 	return qs.rw.Close()
 }
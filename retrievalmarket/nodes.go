@@ -8,6 +8,7 @@ import (
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -43,6 +44,15 @@ type RetrievalClientNode interface {
 	GetKnownAddresses(ctx context.Context, p RetrievalPeer, tok shared.TipSetToken) ([]ma.Multiaddr, error)
 }
 
+// RetrievalClientSigner is implemented by a RetrievalClientNode that can sign
+// data with the private key of a wallet address. The client signs the
+// evidence it keeps of verification failures if its node implements this
+// interface, and keeps the evidence unsigned otherwise.
+type RetrievalClientSigner interface {
+	// SignBytes signs the given data with the given address's private key
+	SignBytes(ctx context.Context, signer address.Address, b []byte) (*crypto.Signature, error)
+}
+
 // RetrievalProviderNode are the node dependencies for a RetrievalProvider
 type RetrievalProviderNode interface {
 	GetChainHead(ctx context.Context) (shared.TipSetToken, abi.ChainEpoch, error)
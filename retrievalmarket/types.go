@@ -17,12 +17,18 @@ import (
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
 
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 )
 
-//go:generate cbor-gen-for --map-encoding Query QueryResponse DealProposal DealResponse Params QueryParams DealPayment ClientDealState ProviderDealState PaymentInfo RetrievalPeer Ask
+//go:generate cbor-gen-for --map-encoding Query QueryResponse DealProposal DealResponse Params QueryParams DealPayment ClientDealState ProviderDealState PaymentInfo RetrievalPeer Ask QueryPiece BatchQueryItem BatchQuery BatchQueryItemResponse BatchQueryResponse VerificationEvidence SignedVerificationEvidence
+
+// PiecesQueryProtocolID is the protocol for querying information about
+// retrieval deal parameters, where the response lists every piece that
+// contains the payload
+const PiecesQueryProtocolID = protocol.ID("/fil/retrieval/qry/1.1.0")
 
 // QueryProtocolID is the protocol for querying information about retrieval
 // deal parameters
@@ -31,6 +37,13 @@ const QueryProtocolID = protocol.ID("/fil/retrieval/qry/1.0.0")
 // OldQueryProtocolID is the old query protocol for tuple structs
 const OldQueryProtocolID = protocol.ID("/fil/retrieval/qry/0.0.1")
 
+// BatchQueryProtocolID is the protocol for querying information about
+// retrieval deal parameters for many payload CIDs at once
+const BatchQueryProtocolID = protocol.ID("/fil/retrieval/qry/batch/1.0.0")
+
+// MaxBatchQueryItems is the maximum number of payload CIDs in a batch query
+const MaxBatchQueryItems = 1024
+
 // Unsubscribe is a function that unsubscribes a subscriber for either the
 // client or the provider
 type Unsubscribe func()
@@ -66,12 +79,31 @@ type ClientDealState struct {
 	WaitMsgCID           *cid.Cid // the CID of any message the client deal is waiting for
 	VoucherShortfall     abi.TokenAmount
 	LegacyProtocol       bool
+	// ProviderAddress is the address of the provider the deal was made with,
+	// kept so that the deal can be resumed after a client restart
+	ProviderAddress address.Address
+	// ResumedFrom is set when the deal was started by ResumeRetrieval. It is
+	// the ID of the deal whose blockstore this deal continues to fill.
+	ResumedFrom *DealID
+	// PaymentOwed is the amount the provider asked for in its most recent
+	// payment request
+	PaymentOwed abi.TokenAmount
 }
 
 func (deal *ClientDealState) NextInterval() uint64 {
 	return deal.Params.NextInterval(deal.CurrentInterval)
 }
 
+// BlockstoreDealID is the ID the deal's blockstore is registered under in
+// the BlockstoreAccessor. For a resumed deal this is the ID of the first
+// deal in the chain of resumed deals.
+func (deal *ClientDealState) BlockstoreDealID() DealID {
+	if deal.ResumedFrom != nil {
+		return *deal.ResumedFrom
+	}
+	return deal.ID
+}
+
 // ProviderDealState is the current state of a deal from the point of view
 // of a retrieval provider
 type ProviderDealState struct {
@@ -206,6 +238,11 @@ type QueryResponse struct {
 	MaxPaymentIntervalIncrease uint64
 	Message                    string
 	UnsealPrice                abi.TokenAmount
+
+	// Pieces lists all the pieces that contain the payload, with pieces that
+	// have an unsealed copy listed first. It is only sent over
+	// PiecesQueryProtocolID.
+	Pieces []QueryPiece
 }
 
 // QueryResponseUndefined is an empty QueryResponse
@@ -216,6 +253,63 @@ func (qr QueryResponse) PieceRetrievalPrice() abi.TokenAmount {
 	return big.Add(big.Mul(qr.MinPricePerByte, abi.NewTokenAmount(int64(qr.Size))), qr.UnsealPrice)
 }
 
+// QueryPiece describes a piece that contains a queried payload, and the
+// price of retrieving the payload from that piece
+type QueryPiece struct {
+	PieceCID cid.Cid
+	// Size is the unpadded size of the piece in bytes
+	Size uint64
+	// Unsealed is true if there is an unsealed copy of the piece
+	Unsealed                bool
+	PricePerByte            abi.TokenAmount
+	UnsealPrice             abi.TokenAmount
+	PaymentInterval         uint64
+	PaymentIntervalIncrease uint64
+}
+
+// RetrievalPrice is the total price to retrieve the piece (size * PricePerByte + UnsealPrice)
+func (qp QueryPiece) RetrievalPrice() abi.TokenAmount {
+	return big.Add(big.Mul(qp.PricePerByte, abi.NewTokenAmount(int64(qp.Size))), qp.UnsealPrice)
+}
+
+// BatchQueryItem is a single payload CID in a batch query, with an optional
+// piece CID the payload should be retrieved from
+type BatchQueryItem struct {
+	PayloadCID cid.Cid
+	PieceCID   *cid.Cid
+}
+
+// BatchQuery is a query to a given provider to determine information about
+// many payloads they may have available for retrieval
+type BatchQuery struct {
+	Items []BatchQueryItem
+}
+
+// BatchQueryItemResponse is the provider's response for a single payload
+// CID in a batch query
+type BatchQueryItemResponse struct {
+	PayloadCID cid.Cid
+	Status     QueryResponseStatus
+	// PieceCIDFound is the result for the piece CID, if one was requested
+	PieceCIDFound QueryItemStatus
+	// Pieces are the pieces that contain the payload. Pieces with an
+	// unsealed copy are listed first.
+	Pieces  []QueryPiece
+	Message string
+}
+
+// BatchQueryResponse is a miners response to a batch query. Items are in
+// the same order as the items in the query.
+type BatchQueryResponse struct {
+	Status         QueryResponseStatus
+	PaymentAddress address.Address // address to send funds to -- may be different than miner addr
+	Items          []BatchQueryItemResponse
+	Message        string
+}
+
+// BatchQueryResponseUndefined is an empty BatchQueryResponse
+var BatchQueryResponseUndefined = BatchQueryResponse{}
+
 // PayloadRetrievalPrice is the expected price to retrieve just the given payload
 // & selector (V1)
 //func (qr QueryResponse) PayloadRetrievalPrice() abi.TokenAmount {
@@ -375,6 +469,37 @@ var (
 	ErrVerification = errors.New("Error when verify data")
 )
 
+// VerificationEvidence records a retrieval deal in which the data sent by
+// the provider, or a payment the provider requested, failed the client's
+// verification
+type VerificationEvidence struct {
+	DealID      DealID
+	PayloadCID  cid.Cid
+	Provider    peer.ID
+	MinerWallet address.Address
+	// Reason describes the verification failure
+	Reason string
+	// BlockCID is the CID of the block that failed verification, if the
+	// failure was caused by a block
+	BlockCID *cid.Cid
+	// VerifiedBytes is the number of bytes the client had received and
+	// verified at the time of the failure
+	VerifiedBytes uint64
+	// PaymentOwed is the amount the provider asked for in its most recent
+	// payment request
+	PaymentOwed  abi.TokenAmount
+	FundsSpent   abi.TokenAmount
+	PricePerByte abi.TokenAmount
+	UnsealPrice  abi.TokenAmount
+}
+
+// SignedVerificationEvidence is verification evidence signed by the
+// client's wallet
+type SignedVerificationEvidence struct {
+	Evidence  VerificationEvidence
+	Signature *crypto.Signature
+}
+
 type Ask struct {
 	PricePerByte            abi.TokenAmount
 	UnsealPrice             abi.TokenAmount
@@ -118,3 +118,14 @@ func TestParamsIntervalBounds(t *testing.T) {
 		})
 	}
 }
+
+func TestClientDealStateResume(t *testing.T) {
+	deal := retrievalmarket.ClientDealState{
+		DealProposal: retrievalmarket.DealProposal{ID: 2},
+	}
+	require.Equal(t, retrievalmarket.DealID(2), deal.BlockstoreDealID())
+
+	prevDealID := retrievalmarket.DealID(1)
+	deal.ResumedFrom = &prevDealID
+	require.Equal(t, prevDealID, deal.BlockstoreDealID())
+}
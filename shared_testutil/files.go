@@ -70,6 +70,7 @@ func genRefCARv2(t *testing.T, path string, root cid.Cid) string {
 	tmp, err := os.CreateTemp("", "rand")
 	require.NoError(t, err)
 	require.NoError(t, tmp.Close())
+	t.Cleanup(func() { _ = stores.RemoveFilestore(tmp.Name()) })
 
 	fs, err := stores.ReadWriteFilestore(tmp.Name(), root)
 	require.NoError(t, err)
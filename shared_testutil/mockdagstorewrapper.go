@@ -10,6 +10,7 @@ import (
 	carv2 "github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
 	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/dagstore"
@@ -33,9 +34,12 @@ type MockDagStoreWrapper struct {
 	pieceStore piecestore.PieceStore
 	sa         retrievalmarket.SectorAccessor
 
-	lk              sync.Mutex
-	registrations   map[cid.Cid]registration
-	piecesWithBlock map[cid.Cid][]cid.Cid
+	lk            sync.Mutex
+	registrations map[cid.Cid]registration
+	// piecesWithBlock is keyed by block multihash, like the DAG store's
+	// top-level index
+	piecesWithBlock map[string][]cid.Cid
+	indexes         map[cid.Cid]carindex.Index
 }
 
 var _ stores.DAGStoreWrapper = (*MockDagStoreWrapper)(nil)
@@ -45,7 +49,8 @@ func NewMockDagStoreWrapper(pieceStore piecestore.PieceStore, sa retrievalmarket
 		pieceStore:      pieceStore,
 		sa:              sa,
 		registrations:   make(map[cid.Cid]registration),
-		piecesWithBlock: make(map[cid.Cid][]cid.Cid),
+		piecesWithBlock: make(map[string][]cid.Cid),
+		indexes:         make(map[cid.Cid]carindex.Index),
 	}
 }
 
@@ -62,8 +67,82 @@ func (m *MockDagStoreWrapper) RegisterShard(ctx context.Context, pieceCid cid.Ci
 	return nil
 }
 
+func (m *MockDagStoreWrapper) DestroyShard(ctx context.Context, pieceCid cid.Cid, resch chan dagstore.ShardResult) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if _, ok := m.registrations[pieceCid]; !ok {
+		resch <- dagstore.ShardResult{Error: xerrors.Errorf("no shard for piece CID %s: %w", pieceCid, dagstore.ErrShardUnknown)}
+		return nil
+	}
+	delete(m.registrations, pieceCid)
+	delete(m.indexes, pieceCid)
+	for mh, pieces := range m.piecesWithBlock {
+		kept := pieces[:0]
+		for _, p := range pieces {
+			if !p.Equals(pieceCid) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.piecesWithBlock, mh)
+		} else {
+			m.piecesWithBlock[mh] = kept
+		}
+	}
+
+	resch <- dagstore.ShardResult{}
+	return nil
+}
+
+func (m *MockDagStoreWrapper) GC(ctx context.Context) (*dagstore.GCResult, error) {
+	return &dagstore.GCResult{}, nil
+}
+
 func (m *MockDagStoreWrapper) GetIterableIndexForPiece(c cid.Cid) (carindex.IterableIndex, error) {
-	return nil, nil
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	idx, ok := m.indexes[c]
+	if !ok {
+		return nil, nil
+	}
+	iterable, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return nil, xerrors.Errorf("index for piece CID %s is not iterable", c)
+	}
+	return iterable, nil
+}
+
+func (m *MockDagStoreWrapper) ListShards(ctx context.Context) ([]cid.Cid, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	pieceCids := make([]cid.Cid, 0, len(m.registrations))
+	for pieceCid := range m.registrations {
+		pieceCids = append(pieceCids, pieceCid)
+	}
+	return pieceCids, nil
+}
+
+func (m *MockDagStoreWrapper) ReplaceIndexForPiece(ctx context.Context, pieceCid cid.Cid, idx carindex.Index) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if _, ok := m.registrations[pieceCid]; !ok {
+		return xerrors.Errorf("no shard for piece CID %s: %w", pieceCid, dagstore.ErrShardUnknown)
+	}
+	m.indexes[pieceCid] = idx
+
+	// Add the blocks in the index to the top-level index
+	iterable, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return xerrors.Errorf("index of type %T is not iterable", idx)
+	}
+	return iterable.ForEach(func(mh multihash.Multihash, _ uint64) error {
+		m.addBlockToPieceIndexLocked(string(mh), pieceCid)
+		return nil
+	})
 }
 
 func (m *MockDagStoreWrapper) MigrateDeals(ctx context.Context, deals []storagemarket.MinerDeal) (bool, error) {
@@ -146,7 +225,7 @@ func (m *MockDagStoreWrapper) GetPiecesContainingBlock(blockCID cid.Cid) ([]cid.
 	m.lk.Lock()
 	defer m.lk.Unlock()
 
-	pieces, ok := m.piecesWithBlock[blockCID]
+	pieces, ok := m.piecesWithBlock[string(blockCID.Hash())]
 	if !ok {
 		return nil, retrievalmarket.ErrNotFound
 	}
@@ -159,10 +238,14 @@ func (m *MockDagStoreWrapper) AddBlockToPieceIndex(blockCID cid.Cid, pieceCid ci
 	m.lk.Lock()
 	defer m.lk.Unlock()
 
-	pieces, ok := m.piecesWithBlock[blockCID]
-	if !ok {
-		m.piecesWithBlock[blockCID] = []cid.Cid{pieceCid}
-	} else {
-		m.piecesWithBlock[blockCID] = append(pieces, pieceCid)
+	m.addBlockToPieceIndexLocked(string(blockCID.Hash()), pieceCid)
+}
+
+func (m *MockDagStoreWrapper) addBlockToPieceIndexLocked(mh string, pieceCid cid.Cid) {
+	for _, p := range m.piecesWithBlock[mh] {
+		if p.Equals(pieceCid) {
+			return
+		}
 	}
+	m.piecesWithBlock[mh] = append(m.piecesWithBlock[mh], pieceCid)
 }
@@ -20,6 +20,8 @@ type TestFileStoreParams struct {
 	AvailableTempFiles []filestore.File
 	ExpectedDeletions  []filestore.Path
 	ExpectedOpens      []filestore.Path
+	ReserveError       error
+	Reservations       map[filestore.OsPath]int64
 }
 
 // TestFileStore is a mocked file store that can provide programmed returns
@@ -31,6 +33,8 @@ type TestFileStore struct {
 	expectedOpens      map[filestore.Path]struct{}
 	deletedFiles       map[filestore.Path]struct{}
 	openedFiles        map[filestore.Path]struct{}
+	reserveError       error
+	reservations       map[filestore.OsPath]int64
 }
 
 // NewTestFileStore returns a new test file store from the given parameters
@@ -42,6 +46,11 @@ func NewTestFileStore(params TestFileStoreParams) *TestFileStore {
 		expectedOpens:      make(map[filestore.Path]struct{}),
 		deletedFiles:       make(map[filestore.Path]struct{}),
 		openedFiles:        make(map[filestore.Path]struct{}),
+		reserveError:       params.ReserveError,
+		reservations:       make(map[filestore.OsPath]int64),
+	}
+	for path, size := range params.Reservations {
+		fs.reservations[path] = size
 	}
 	for _, path := range params.ExpectedDeletions {
 		fs.expectedDeletions[path] = struct{}{}
@@ -108,6 +117,35 @@ func (fs *TestFileStore) CreateTemp() (filestore.File, error) {
 	return tempFile, nil
 }
 
+// Reserve records a reservation of space for a file, or returns the
+// programmed error
+func (fs *TestFileStore) Reserve(p filestore.OsPath, size int64) error {
+	if fs.reserveError != nil {
+		return fs.reserveError
+	}
+	fs.reservations[p] = size
+	return nil
+}
+
+// Release removes the reservation for a file
+func (fs *TestFileStore) Release(p filestore.OsPath) {
+	delete(fs.reservations, p)
+}
+
+// Usage returns the reserved space
+func (fs *TestFileStore) Usage() (filestore.Usage, error) {
+	var u filestore.Usage
+	for _, size := range fs.reservations {
+		u.Reserved += size
+	}
+	return u, nil
+}
+
+// Reservations returns the space reserved for each file
+func (fs *TestFileStore) Reservations() map[filestore.OsPath]int64 {
+	return fs.reservations
+}
+
 // VerifyExpectations will verify that the correct files were opened and deleted
 func (fs *TestFileStore) VerifyExpectations(t *testing.T) {
 	require.Equal(t, fs.openedFiles, fs.expectedOpens)
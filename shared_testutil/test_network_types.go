@@ -37,6 +37,7 @@ type TestRetrievalQueryStream struct {
 	respReader QueryResponseReader
 	respWriter QueryResponseWriter
 	writer     QueryWriter
+	withPieces bool
 }
 
 // TestQueryStreamParams are parameters used to setup a TestRetrievalQueryStream.
@@ -47,6 +48,9 @@ type TestQueryStreamParams struct {
 	RespReader QueryResponseReader
 	RespWriter QueryResponseWriter
 	Writer     QueryWriter
+	// WithPieces is true if the stream's protocol version supports listing
+	// the pieces that contain the payload in the query response
+	WithPieces bool
 }
 
 // NewTestRetrievalQueryStream returns a new TestRetrievalQueryStream with the
@@ -58,6 +62,7 @@ func NewTestRetrievalQueryStream(params TestQueryStreamParams) *TestRetrievalQue
 		respReader: TrivialQueryResponseReader,
 		respWriter: TrivialQueryResponseWriter,
 		writer:     TrivialQueryWriter,
+		withPieces: params.WithPieces,
 	}
 	if params.Reader != nil {
 		stream.reader = params.Reader
@@ -102,9 +107,102 @@ func (trqs *TestRetrievalQueryStream) WriteQueryResponse(newResp rm.QueryRespons
 	return trqs.respWriter(newResp)
 }
 
+// WithPieces returns true if the stream was set up to list pieces in query
+// responses.
+func (trqs *TestRetrievalQueryStream) WithPieces() bool { return trqs.withPieces }
+
 // Close closes the stream (does nothing for test).
 func (trqs *TestRetrievalQueryStream) Close() error { return nil }
 
+// BatchQueryReader is a function to mock reading batch queries.
+type BatchQueryReader func() (rm.BatchQuery, error)
+
+// BatchQueryResponseReader is a function to mock reading batch query responses.
+type BatchQueryResponseReader func() (rm.BatchQueryResponse, error)
+
+// BatchQueryResponseWriter is a function to mock writing batch query responses.
+type BatchQueryResponseWriter func(rm.BatchQueryResponse) error
+
+// BatchQueryWriter is a function to mock writing batch queries.
+type BatchQueryWriter func(rm.BatchQuery) error
+
+// TestRetrievalBatchQueryStream is a retrieval batch query stream with
+// predefined stubbed behavior.
+type TestRetrievalBatchQueryStream struct {
+	p          peer.ID
+	reader     BatchQueryReader
+	respReader BatchQueryResponseReader
+	respWriter BatchQueryResponseWriter
+	writer     BatchQueryWriter
+}
+
+// TestBatchQueryStreamParams are parameters used to setup a
+// TestRetrievalBatchQueryStream. All parameters except the peer ID are optional.
+type TestBatchQueryStreamParams struct {
+	PeerID     peer.ID
+	Reader     BatchQueryReader
+	RespReader BatchQueryResponseReader
+	RespWriter BatchQueryResponseWriter
+	Writer     BatchQueryWriter
+}
+
+// NewTestRetrievalBatchQueryStream returns a new TestRetrievalBatchQueryStream
+// with the behavior specified by the paramaters, or default behaviors if not
+// specified.
+func NewTestRetrievalBatchQueryStream(params TestBatchQueryStreamParams) *TestRetrievalBatchQueryStream {
+	stream := TestRetrievalBatchQueryStream{
+		p: params.PeerID,
+		reader: func() (rm.BatchQuery, error) {
+			return rm.BatchQuery{}, nil
+		},
+		respReader: func() (rm.BatchQueryResponse, error) {
+			return rm.BatchQueryResponseUndefined, nil
+		},
+		respWriter: func(rm.BatchQueryResponse) error { return nil },
+		writer:     func(rm.BatchQuery) error { return nil },
+	}
+	if params.Reader != nil {
+		stream.reader = params.Reader
+	}
+	if params.Writer != nil {
+		stream.writer = params.Writer
+	}
+	if params.RespReader != nil {
+		stream.respReader = params.RespReader
+	}
+	if params.RespWriter != nil {
+		stream.respWriter = params.RespWriter
+	}
+	return &stream
+}
+
+func (tbqs *TestRetrievalBatchQueryStream) RemotePeer() peer.ID {
+	return tbqs.p
+}
+
+// ReadBatchQuery calls the mocked batch query reader.
+func (tbqs *TestRetrievalBatchQueryStream) ReadBatchQuery() (rm.BatchQuery, error) {
+	return tbqs.reader()
+}
+
+// WriteBatchQuery calls the mocked batch query writer.
+func (tbqs *TestRetrievalBatchQueryStream) WriteBatchQuery(q rm.BatchQuery) error {
+	return tbqs.writer(q)
+}
+
+// ReadBatchQueryResponse calls the mocked batch query response reader.
+func (tbqs *TestRetrievalBatchQueryStream) ReadBatchQueryResponse() (rm.BatchQueryResponse, error) {
+	return tbqs.respReader()
+}
+
+// WriteBatchQueryResponse calls the mocked batch query response writer.
+func (tbqs *TestRetrievalBatchQueryStream) WriteBatchQueryResponse(resp rm.BatchQueryResponse) error {
+	return tbqs.respWriter(resp)
+}
+
+// Close closes the stream (does nothing for test).
+func (tbqs *TestRetrievalBatchQueryStream) Close() error { return nil }
+
 // DealProposalReader is a function to mock reading deal proposals.
 type DealProposalReader func() (rm.DealProposal, error)
 
@@ -150,31 +248,40 @@ type TestDealStreamParams struct {
 // QueryStreamBuilder is a function that builds retrieval query streams.
 type QueryStreamBuilder func(peer.ID) (rmnet.RetrievalQueryStream, error)
 
+// BatchQueryStreamBuilder is a function that builds retrieval batch query streams.
+type BatchQueryStreamBuilder func(peer.ID) (rmnet.RetrievalBatchQueryStream, error)
+
 // TestRetrievalMarketNetwork is a test network that has stubbed behavior
 // for testing the retrieval market implementation
 type TestRetrievalMarketNetwork struct {
-	receiver  rmnet.RetrievalReceiver
-	qsbuilder QueryStreamBuilder
+	receiver   rmnet.RetrievalReceiver
+	qsbuilder  QueryStreamBuilder
+	bqsbuilder BatchQueryStreamBuilder
 }
 
 // TestNetworkParams are parameters for setting up a test network. All
 // parameters other than the receiver are optional
 type TestNetworkParams struct {
-	QueryStreamBuilder QueryStreamBuilder
-	Receiver           rmnet.RetrievalReceiver
+	QueryStreamBuilder      QueryStreamBuilder
+	BatchQueryStreamBuilder BatchQueryStreamBuilder
+	Receiver                rmnet.RetrievalReceiver
 }
 
 // NewTestRetrievalMarketNetwork returns a new TestRetrievalMarketNetwork with the
 // behavior specified by the paramaters, or default behaviors if not specified.
 func NewTestRetrievalMarketNetwork(params TestNetworkParams) *TestRetrievalMarketNetwork {
 	trmn := TestRetrievalMarketNetwork{
-		qsbuilder: TrivialNewQueryStream,
-		receiver:  params.Receiver,
+		qsbuilder:  TrivialNewQueryStream,
+		bqsbuilder: TrivialNewBatchQueryStream,
+		receiver:   params.Receiver,
 	}
 
 	if params.QueryStreamBuilder != nil {
 		trmn.qsbuilder = params.QueryStreamBuilder
 	}
+	if params.BatchQueryStreamBuilder != nil {
+		trmn.bqsbuilder = params.BatchQueryStreamBuilder
+	}
 	return &trmn
 }
 
@@ -184,6 +291,11 @@ func (trmn *TestRetrievalMarketNetwork) NewQueryStream(id peer.ID) (rmnet.Retrie
 	return trmn.qsbuilder(id)
 }
 
+// NewBatchQueryStream returns a batch query stream
+func (trmn *TestRetrievalMarketNetwork) NewBatchQueryStream(id peer.ID) (rmnet.RetrievalBatchQueryStream, error) {
+	return trmn.bqsbuilder(id)
+}
+
 // SetDelegate sets the market receiver
 func (trmn *TestRetrievalMarketNetwork) SetDelegate(r rmnet.RetrievalReceiver) error {
 	trmn.receiver = r
@@ -195,6 +307,11 @@ func (trmn *TestRetrievalMarketNetwork) ReceiveQueryStream(qs rmnet.RetrievalQue
 	trmn.receiver.HandleQueryStream(qs)
 }
 
+// ReceiveBatchQueryStream simulates receiving a batch query stream
+func (trmn *TestRetrievalMarketNetwork) ReceiveBatchQueryStream(qs rmnet.RetrievalBatchQueryStream) {
+	trmn.receiver.HandleBatchQueryStream(qs)
+}
+
 // StopHandlingRequests sets receiver to nil
 func (trmn *TestRetrievalMarketNetwork) StopHandlingRequests() error {
 	trmn.receiver = nil
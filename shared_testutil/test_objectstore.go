@@ -0,0 +1,125 @@
+package shared_testutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/filecoin-project/go-fil-markets/filestore"
+)
+
+// TestObjectStore is an in-memory object store
+type TestObjectStore struct {
+	bucket string
+
+	lk      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+var _ filestore.ObjectStore = (*TestObjectStore)(nil)
+
+// NewTestObjectStore returns a new in-memory object store for the given
+// bucket name
+func NewTestObjectStore(bucket string) *TestObjectStore {
+	return &TestObjectStore{
+		bucket:  bucket,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+// Object returns the data of an object, if it exists
+func (s *TestObjectStore) Object(key string) ([]byte, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+func (s *TestObjectStore) Location(key string) string {
+	return "mem://" + s.bucket + "/" + key
+}
+
+func (s *TestObjectStore) Head(ctx context.Context, key string) (int64, error) {
+	data, ok := s.Object(key)
+	if !ok {
+		return 0, filestore.ErrObjectNotFound
+	}
+	return int64(len(data)), nil
+}
+
+func (s *TestObjectStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	data, ok := s.Object(key)
+	if !ok {
+		return nil, filestore.ErrObjectNotFound
+	}
+	if offset < 0 || offset > int64(len(data)) {
+		return nil, fmt.Errorf("invalid offset %d", offset)
+	}
+	end := offset + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+func (s *TestObjectStore) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.nextID++
+	id := fmt.Sprint(s.nextID)
+	s.uploads[id] = make(map[int][]byte)
+	return id, nil
+}
+
+func (s *TestObjectStore) UploadPart(ctx context.Context, key string, uploadID string, partNumber int, data []byte) (string, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	parts, ok := s.uploads[uploadID]
+	if !ok {
+		return "", fmt.Errorf("no such upload %s", uploadID)
+	}
+	parts[partNumber] = append([]byte(nil), data...)
+	return fmt.Sprint(partNumber), nil
+}
+
+func (s *TestObjectStore) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []filestore.CompletedPart) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	uploaded, ok := s.uploads[uploadID]
+	if !ok {
+		return fmt.Errorf("no such upload %s", uploadID)
+	}
+	var data []byte
+	for _, p := range parts {
+		data = append(data, uploaded[p.PartNumber]...)
+	}
+	delete(s.uploads, uploadID)
+	s.objects[key] = data
+	return nil
+}
+
+func (s *TestObjectStore) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *TestObjectStore) Delete(ctx context.Context, key string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	delete(s.objects, key)
+	return nil
+}
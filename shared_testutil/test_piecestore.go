@@ -8,6 +8,8 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/stretchr/testify/require"
 
+	"github.com/filecoin-project/go-state-types/abi"
+
 	"github.com/filecoin-project/go-fil-markets/piecestore"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/shared"
@@ -24,6 +26,7 @@ type TestPieceStore struct {
 	cidInfosStubbed             map[cid.Cid]piecestore.CIDInfo
 	cidInfosExpected            map[cid.Cid]struct{}
 	cidInfosReceived            map[cid.Cid]struct{}
+	dealsRemoved                map[cid.Cid][]abi.DealID
 }
 
 // TestPieceStoreParams sets parameters for a piece store
@@ -52,6 +55,7 @@ func NewTestPieceStoreWithParams(params TestPieceStoreParams) *TestPieceStore {
 		cidInfosStubbed:             make(map[cid.Cid]piecestore.CIDInfo),
 		cidInfosExpected:            make(map[cid.Cid]struct{}),
 		cidInfosReceived:            make(map[cid.Cid]struct{}),
+		dealsRemoved:                make(map[cid.Cid][]abi.DealID),
 	}
 }
 
@@ -143,6 +147,81 @@ func (tps *TestPieceStore) GetCIDInfo(c cid.Cid) (piecestore.CIDInfo, error) {
 	return piecestore.CIDInfoUndefined, errors.New("GetCIDInfo failed")
 }
 
+// RemoveDealForPiece records the deal being removed, and removes it from
+// the piece info if it's been stubbed
+func (tps *TestPieceStore) RemoveDealForPiece(pieceCID cid.Cid, dealID abi.DealID) error {
+	tps.dealsRemoved[pieceCID] = append(tps.dealsRemoved[pieceCID], dealID)
+
+	pio, ok := tps.piecesStubbed[pieceCID]
+	if !ok {
+		return nil
+	}
+	deals := make([]piecestore.DealInfo, 0, len(pio.Deals))
+	for _, di := range pio.Deals {
+		if di.DealID != dealID {
+			deals = append(deals, di)
+		}
+	}
+	pio.Deals = deals
+	tps.piecesStubbed[pieceCID] = pio
+	return nil
+}
+
+// DealsRemoved returns the IDs of the deals removed for the given piece
+func (tps *TestPieceStore) DealsRemoved(pieceCID cid.Cid) []abi.DealID {
+	return tps.dealsRemoved[pieceCID]
+}
+
+// RemovePieceInfo removes a stubbed piece info
+func (tps *TestPieceStore) RemovePieceInfo(pieceCID cid.Cid) error {
+	delete(tps.piecesStubbed, pieceCID)
+	return nil
+}
+
+// RemoveCIDInfo removes a stubbed CID info
+func (tps *TestPieceStore) RemoveCIDInfo(payloadCID cid.Cid) error {
+	delete(tps.cidInfosStubbed, payloadCID)
+	return nil
+}
+
+// Compact removes the stubbed piece infos with no deals
+func (tps *TestPieceStore) Compact(ctx context.Context) (piecestore.CompactionResult, error) {
+	var res piecestore.CompactionResult
+	for pieceCID, pio := range tps.piecesStubbed {
+		if len(pio.Deals) == 0 {
+			delete(tps.piecesStubbed, pieceCID)
+			res.PieceInfos++
+		}
+	}
+	return res, nil
+}
+
+// ListPiecesInSector returns the stubbed pieces with a deal in the sector
+func (tps *TestPieceStore) ListPiecesInSector(sectorID abi.SectorNumber) ([]cid.Cid, error) {
+	var pieceCIDs []cid.Cid
+	for pieceCID, pio := range tps.piecesStubbed {
+		for _, di := range pio.Deals {
+			if di.SectorID == sectorID {
+				pieceCIDs = append(pieceCIDs, pieceCID)
+				break
+			}
+		}
+	}
+	return pieceCIDs, nil
+}
+
+// GetPieceCIDForDeal returns the stubbed piece with the deal
+func (tps *TestPieceStore) GetPieceCIDForDeal(dealID abi.DealID) (cid.Cid, error) {
+	for pieceCID, pio := range tps.piecesStubbed {
+		for _, di := range pio.Deals {
+			if di.DealID == dealID {
+				return pieceCID, nil
+			}
+		}
+	}
+	return cid.Undef, retrievalmarket.ErrNotFound
+}
+
 func (tps *TestPieceStore) ListCidInfoKeys() ([]cid.Cid, error) {
 	panic("do not call me")
 }
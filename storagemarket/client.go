@@ -54,12 +54,23 @@ type StorageClient interface {
 	// GetAsk returns the current ask for a storage provider
 	GetAsk(ctx context.Context, info StorageProviderInfo) (*StorageAsk, error)
 
+	// GetCapabilities returns the deals a storage provider can accept
+	GetCapabilities(ctx context.Context, info StorageProviderInfo) (*StorageCapabilities, error)
+
 	// GetProviderDealState queries a provider for the current state of a client's deal
 	GetProviderDealState(ctx context.Context, proposalCid cid.Cid) (*ProviderDealState, error)
 
 	// ProposeStorageDeal initiates deal negotiation with a Storage Provider
 	ProposeStorageDeal(ctx context.Context, params ProposeStorageDealParams) (*ProposeStorageDealResult, error)
 
+	// AcceptCounterOffer accepts the counter-offer a Storage Provider made for
+	// a deal, by proposing a new deal with the terms of the counter-offer
+	AcceptCounterOffer(ctx context.Context, proposalCid cid.Cid) (*ProposeStorageDealResult, error)
+
+	// DryRunStorageDeal asks a Storage Provider whether it would accept a deal,
+	// without starting the deal
+	DryRunStorageDeal(ctx context.Context, params ProposeStorageDealParams) (*DryRunStorageDealResult, error)
+
 	// GetPaymentEscrow returns the current funds available for deal payment
 	GetPaymentEscrow(ctx context.Context, addr address.Address) (Balance, error)
 
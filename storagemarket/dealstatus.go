@@ -109,6 +109,14 @@ const (
 
 	// StorageDealTransferQueued means the data transfer request has been queued and will be executed soon.
 	StorageDealTransferQueued
+
+	// StorageDealAwaitingHandoffRetry means handing off the deal to the sealing
+	// subsystem failed, and the provider will try again later
+	StorageDealAwaitingHandoffRetry
+
+	// StorageDealPublishConfirming means the deal publish message is on chain,
+	// and we are waiting for it to reach the confirmation depth
+	StorageDealPublishConfirming
 )
 
 // DealStates maps StorageDealStatus codes to string names
@@ -144,6 +152,8 @@ var DealStates = map[StorageDealStatus]string{
 	StorageDealClientTransferRestart:        "StorageDealClientTransferRestart",
 	StorageDealProviderTransferAwaitRestart: "StorageDealProviderTransferAwaitRestart",
 	StorageDealTransferQueued:               "StorageDealTransferQueued",
+	StorageDealAwaitingHandoffRetry:         "StorageDealAwaitingHandoffRetry",
+	StorageDealPublishConfirming:            "StorageDealPublishConfirming",
 }
 
 // DealStatesDescriptions maps StorageDealStatus codes to string description for better UX
@@ -178,6 +188,8 @@ var DealStatesDescriptions = map[StorageDealStatus]string{
 	StorageDealFinalizing:                   "Finalizing",
 	StorageDealClientTransferRestart:        "Client transfer restart",
 	StorageDealProviderTransferAwaitRestart: "ProviderTransferAwaitRestart",
+	StorageDealAwaitingHandoffRetry:         "Awaiting a retry of the hand-off to the sealing subsystem",
+	StorageDealPublishConfirming:            "Waiting for the publish message to be confirmed on chain",
 }
 
 var DealStatesDurations = map[StorageDealStatus]string{
@@ -211,4 +223,6 @@ var DealStatesDurations = map[StorageDealStatus]string{
 	StorageDealFinalizing:                   "a few minutes",
 	StorageDealClientTransferRestart:        "depending on data size, anywhere between a few minutes to a few hours",
 	StorageDealProviderTransferAwaitRestart: "a few minutes",
+	StorageDealAwaitingHandoffRetry:         "depending on the sealing subsystem, anywhere between a few minutes to a few hours",
+	StorageDealPublishConfirming:            "a few minutes",
 }
@@ -111,6 +111,22 @@ const (
 	// ClientEventDataTransferQueued happens when we queue the provider's request to transfer data to it
 	// in response to the push request we send to the provider.
 	ClientEventDataTransferQueued
+
+	// ClientEventCounterOffered happens when the provider rejects a deal with
+	// a counter-offer of terms it would accept
+	ClientEventCounterOffered
+
+	// ClientEventDealPublishIncluded happens when the publish message for a
+	// deal is on chain, but not yet at the confirmation depth
+	ClientEventDealPublishIncluded
+
+	// ClientEventDealPublishReorged happens when a chain reorg removes the
+	// publish message for a deal from the chain
+	ClientEventDealPublishReorged
+
+	// ClientEventPieceReused happens when the provider accepts a deal using a
+	// copy of the piece it already holds, so no data needs to be transferred
+	ClientEventPieceReused
 )
 
 // ClientEvents maps client event codes to string names
@@ -148,6 +164,10 @@ var ClientEvents = map[ClientEvent]string{
 	ClientEventDataTransferStalled:        "ClientEventDataTransferStalled",
 	ClientEventDataTransferCancelled:      "ClientEventDataTransferCancelled",
 	ClientEventDataTransferQueued:         "ClientEventDataTransferQueued",
+	ClientEventCounterOffered:             "ClientEventCounterOffered",
+	ClientEventDealPublishIncluded:        "ClientEventDealPublishIncluded",
+	ClientEventDealPublishReorged:         "ClientEventDealPublishReorged",
+	ClientEventPieceReused:                "ClientEventPieceReused",
 }
 
 func (e ClientEvent) String() string {
@@ -292,6 +312,31 @@ const (
 	// ProviderEventAwaitTransferRestartTimeout is dispatched after a certain amount of time a provider has been
 	// waiting for a data transfer to restart. If transfer hasn't restarted, the provider will fail the deal
 	ProviderEventAwaitTransferRestartTimeout
+
+	// ProviderEventDealCounterOffered happens when a deal is rejected because
+	// of its price, collateral or start epoch, and the provider offers terms
+	// it would accept instead
+	ProviderEventDealCounterOffered
+
+	// ProviderEventDealHandoffRetryScheduled happens when handing off a deal to
+	// the sealing subsystem fails and the provider schedules another attempt
+	ProviderEventDealHandoffRetryScheduled
+
+	// ProviderEventDealHandoffRetry happens when a deal waiting for a hand-off
+	// retry is handed off to the sealing subsystem again
+	ProviderEventDealHandoffRetry
+
+	// ProviderEventDealPublishIncluded happens when the publish message for a
+	// deal is on chain, but not yet at the confirmation depth
+	ProviderEventDealPublishIncluded
+
+	// ProviderEventDealPublishReorged happens when a chain reorg removes the
+	// publish message for a deal from the chain
+	ProviderEventDealPublishReorged
+
+	// ProviderEventPieceReused happens when the data for a deal is staged from
+	// a copy of the piece the provider already holds, instead of transferred
+	ProviderEventPieceReused
 )
 
 // ProviderEvents maps provider event codes to string names
@@ -339,6 +384,12 @@ var ProviderEvents = map[ProviderEvent]string{
 	ProviderEventDealPrecommitFailed:         "ProviderEventDealPrecommitFailed",
 	ProviderEventDealPrecommitted:            "ProviderEventDealPrecommitted",
 	ProviderEventAwaitTransferRestartTimeout: "ProviderEventAwaitTransferRestartTimeout",
+	ProviderEventDealCounterOffered:          "ProviderEventDealCounterOffered",
+	ProviderEventDealHandoffRetryScheduled:   "ProviderEventDealHandoffRetryScheduled",
+	ProviderEventDealHandoffRetry:            "ProviderEventDealHandoffRetry",
+	ProviderEventDealPublishIncluded:         "ProviderEventDealPublishIncluded",
+	ProviderEventDealPublishReorged:          "ProviderEventDealPublishReorged",
+	ProviderEventPieceReused:                 "ProviderEventPieceReused",
 }
 
 func (e ProviderEvent) String() string {
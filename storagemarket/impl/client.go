@@ -9,6 +9,7 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
 	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
@@ -59,6 +60,8 @@ type Client struct {
 	migrateStateMachines func(context.Context) error
 	pollingInterval      time.Duration
 	maxTraversalLinks    uint64
+	counterOfferLimits   *CounterOfferLimits
+	confirmationDepth    abi.ChainEpoch
 
 	unsubDataTransfer datatransfer.Unsubscribe
 
@@ -76,6 +79,18 @@ func DealPollingInterval(t time.Duration) StorageClientOption {
 	}
 }
 
+// ClientConfirmationDepth sets the number of epochs the client waits after a
+// deal is published, and after its sector is committed, before it treats the
+// result as final. If the publish message was reorged out, and not included
+// again within the confirmation depth, the client goes back to waiting for
+// the provider to publish the deal. The chain is polled at the interval set
+// by DealPollingInterval. By default the first inclusion on chain is final.
+func ClientConfirmationDepth(depth abi.ChainEpoch) StorageClientOption {
+	return func(c *Client) {
+		c.confirmationDepth = depth
+	}
+}
+
 // MaxTraversalLinks sets the maximum number of links in a DAG to traverse when calculating CommP,
 // sets a budget that limits the depth and density of a DAG that can be traversed
 func MaxTraversalLinks(m uint64) StorageClientOption {
@@ -84,6 +99,26 @@ func MaxTraversalLinks(m uint64) StorageClientOption {
 	}
 }
 
+// CounterOfferLimits are the limits within which a client accepts a
+// counter-offer from a provider automatically
+type CounterOfferLimits struct {
+	// MaxStoragePricePerEpoch is the highest price per epoch for a deal
+	MaxStoragePricePerEpoch abi.TokenAmount
+	// MaxStartDelay is the most epochs a counter-offer can move the start of
+	// a deal back by
+	MaxStartDelay abi.ChainEpoch
+}
+
+// AutoAcceptCounterOffers makes the client accept counter-offers from
+// providers within the given limits, by proposing a new deal with the terms
+// of the counter-offer. Counter-offers outside the limits are left for the
+// caller to accept with AcceptCounterOffer.
+func AutoAcceptCounterOffers(limits CounterOfferLimits) StorageClientOption {
+	return func(c *Client) {
+		c.counterOfferLimits = &limits
+	}
+}
+
 // NewClient creates a new storage client
 func NewClient(
 	net network.StorageMarketNetwork,
@@ -257,6 +292,59 @@ func (c *Client) GetAsk(ctx context.Context, info storagemarket.StorageProviderI
 	return out.Ask.Ask, nil
 }
 
+// GetCapabilities queries a provider for the deals it can accept
+//
+// The client creates a new `StorageCapabilitiesStream` for the chosen peer ID,
+// and writes a CapabilitiesRequest on it. When it receives a response, it verifies
+// the signature and returns the validated StorageCapabilities if successful
+func (c *Client) GetCapabilities(ctx context.Context, info storagemarket.StorageProviderInfo) (*storagemarket.StorageCapabilities, error) {
+	if len(info.Addrs) > 0 {
+		c.net.AddAddrs(info.PeerID, info.Addrs)
+	}
+	s, err := c.net.NewCapabilitiesStream(ctx, info.PeerID)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open stream to miner: %w", err)
+	}
+	return c.readCapabilities(ctx, s, info)
+}
+
+func (c *Client) readCapabilities(ctx context.Context, s network.StorageCapabilitiesStream, info storagemarket.StorageProviderInfo) (*storagemarket.StorageCapabilities, error) {
+	defer s.Close()
+
+	if err := s.WriteCapabilitiesRequest(network.CapabilitiesRequest{Miner: info.Address}); err != nil {
+		return nil, xerrors.Errorf("failed to send capabilities request: %w", err)
+	}
+
+	out, origBytes, err := s.ReadCapabilitiesResponse()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read capabilities response: %w", err)
+	}
+
+	if out.Capabilities == nil || out.Capabilities.Capabilities == nil || out.Capabilities.Signature == nil {
+		return nil, xerrors.Errorf("got no capabilities back")
+	}
+
+	if out.Capabilities.Capabilities.Miner != info.Address {
+		return nil, xerrors.Errorf("got back capabilities for wrong miner")
+	}
+
+	tok, _, err := c.node.GetChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	isValid, err := c.node.VerifySignature(ctx, *out.Capabilities.Signature, info.Worker, origBytes, tok)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isValid {
+		return nil, xerrors.Errorf("capabilities were not properly signed")
+	}
+
+	return out.Capabilities.Capabilities, nil
+}
+
 // GetProviderDealState queries a provider for the current state of a client's deal
 func (c *Client) GetProviderDealState(ctx context.Context, proposalCid cid.Cid) (*storagemarket.ProviderDealState, error) {
 	var deal storagemarket.ClientDeal
@@ -309,22 +397,27 @@ func (c *Client) GetProviderDealState(ctx context.Context, proposalCid cid.Cid)
 //
 // When called, the client takes the following actions:
 //
-// 1. Calculates the PieceCID for this deal from the given PayloadCID. (by writing the payload to a CAR file then calculating
+// 1. Gets the provider's signed capabilities, if the provider supports the capabilities protocol
+//
+// 2. Calculates the PieceCID for this deal from the given PayloadCID. (by writing the payload to a CAR file then calculating
 // a merkle root for the resulting data)
 //
-// 2. Constructs a `DealProposal` (spec-actors type) with deal terms
+// 3. Checks that the provider can accept a deal with the transfer type, piece size and verified status
+// of the proposal
+//
+// 4. Constructs a `DealProposal` (spec-actors type) with deal terms
 //
-// 3. Signs the `DealProposal` to make a ClientDealProposal
+// 5. Signs the `DealProposal` to make a ClientDealProposal
 //
-// 4. Gets the CID for the ClientDealProposal
+// 6. Gets the CID for the ClientDealProposal
 //
-// 5. Construct a ClientDeal to track the state of this deal.
+// 7. Construct a ClientDeal to track the state of this deal.
 //
-// 6. Tells its statemachine to begin tracking the deal state by the CID of the ClientDealProposal
+// 8. Tells its statemachine to begin tracking the deal state by the CID of the ClientDealProposal
 //
-// 7. Triggers a `ClientEventOpen` event on its statemachine.
+// 9. Triggers a `ClientEventOpen` event on its statemachine.
 //
-// 8. Records the Provider as a possible peer for retrieving this data in the future
+// 10. Records the Provider as a possible peer for retrieving this data in the future
 //
 // From then on, the statemachine controls the deal flow in the client. Other components may listen for events in this flow by calling
 // `SubscribeToEvents` on the Client. The Client also provides access to the node and network and other functionality through
@@ -337,6 +430,149 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, params storagemarket.Pr
 		return nil, xerrors.Errorf("looking up addresses: %w", err)
 	}
 
+	// Find out what deals the provider can accept, so that a proposal that
+	// would be rejected fails here. Providers running older versions do not
+	// support the capabilities protocol, and get the proposal unchecked.
+	var capabilities *storagemarket.StorageCapabilities
+	if s, err := c.net.NewCapabilitiesStream(ctx, params.Info.PeerID); err != nil {
+		log.Debugw("could not get provider capabilities, proposing deal without checking them", "provider", params.Info.Address, "err", err)
+	} else {
+		capabilities, err = c.readCapabilities(ctx, s, *params.Info)
+		if err != nil {
+			return nil, xerrors.Errorf("getting provider capabilities: %w", err)
+		}
+	}
+
+	clientDealProposal, err := c.signedDealProposal(ctx, params, capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	deal, err := c.beginDeal(clientDealProposal, params.Info.PeerID, params.Info.Worker, params.Data, params.FastRetrieval, params.ReusePiece)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storagemarket.ProposeStorageDealResult{
+			ProposalCid: deal.ProposalCid,
+		}, c.discovery.AddPeer(ctx, params.Data.Root, retrievalmarket.RetrievalPeer{
+			Address:  clientDealProposal.Proposal.Provider,
+			ID:       deal.Miner,
+			PieceCID: &clientDealProposal.Proposal.PieceCID,
+		})
+}
+
+// beginDeal starts tracking a deal for a signed proposal, and opens it
+func (c *Client) beginDeal(clientDealProposal *market.ClientDealProposal, miner peer.ID, minerWorker address.Address, data *storagemarket.DataRef, fastRetrieval bool, reusePiece bool) (*storagemarket.ClientDeal, error) {
+	proposalNd, err := cborutil.AsIpld(clientDealProposal)
+	if err != nil {
+		return nil, xerrors.Errorf("getting proposal node failed: %w", err)
+	}
+
+	deal := &storagemarket.ClientDeal{
+		ProposalCid:        proposalNd.Cid(),
+		ClientDealProposal: *clientDealProposal,
+		State:              storagemarket.StorageDealUnknown,
+		Miner:              miner,
+		MinerWorker:        minerWorker,
+		DataRef:            data,
+		FastRetrieval:      fastRetrieval,
+		ReusePiece:         reusePiece,
+		DealStages:         storagemarket.NewDealStages(),
+		CreationTime:       curTime(),
+	}
+
+	err = c.statemachines.Begin(proposalNd.Cid(), deal)
+	if err != nil {
+		return nil, xerrors.Errorf("setting up deal tracking: %w", err)
+	}
+
+	err = c.statemachines.Send(deal.ProposalCid, storagemarket.ClientEventOpen)
+	if err != nil {
+		return nil, xerrors.Errorf("initializing state machine: %w", err)
+	}
+
+	return deal, nil
+}
+
+// AcceptCounterOffer accepts the counter-offer a provider made for a deal, by
+// signing the terms of the counter-offer and proposing them as a new deal
+func (c *Client) AcceptCounterOffer(ctx context.Context, proposalCid cid.Cid) (*storagemarket.ProposeStorageDealResult, error) {
+	var deal storagemarket.ClientDeal
+	if err := c.statemachines.Get(proposalCid).Get(&deal); err != nil {
+		return nil, xerrors.Errorf("getting deal %s: %w", proposalCid, err)
+	}
+	return c.acceptCounterOffer(ctx, deal)
+}
+
+func (c *Client) acceptCounterOffer(ctx context.Context, deal storagemarket.ClientDeal) (*storagemarket.ProposeStorageDealResult, error) {
+	if deal.CounterOffer == nil {
+		return nil, xerrors.Errorf("provider made no counter-offer for deal %s", deal.ProposalCid)
+	}
+
+	clientDealProposal, err := c.node.SignProposal(ctx, deal.CounterOffer.Client, *deal.CounterOffer)
+	if err != nil {
+		return nil, xerrors.Errorf("signing counter-offer failed: %w", err)
+	}
+
+	newDeal, err := c.beginDeal(clientDealProposal, deal.Miner, deal.MinerWorker, deal.DataRef, deal.FastRetrieval, deal.ReusePiece)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infow("accepted counter-offer", "proposalCid", deal.ProposalCid, "newProposalCid", newDeal.ProposalCid)
+	return &storagemarket.ProposeStorageDealResult{ProposalCid: newDeal.ProposalCid}, nil
+}
+
+// autoAcceptCounterOffer accepts a counter-offer if it is within the limits
+// the client was configured with
+func (c *Client) autoAcceptCounterOffer(deal storagemarket.ClientDeal) {
+	limits := c.counterOfferLimits
+	counter := deal.CounterOffer
+	if counter == nil {
+		return
+	}
+
+	maxPrice := limits.MaxStoragePricePerEpoch
+	if maxPrice.Int == nil {
+		maxPrice = big.Zero()
+	}
+	if counter.StoragePricePerEpoch.GreaterThan(maxPrice) {
+		log.Infow("counter-offer price is over the limit", "proposalCid", deal.ProposalCid, "price", counter.StoragePricePerEpoch, "limit", maxPrice)
+		return
+	}
+	if err := clientutils.CheckCounterOffer(deal.Proposal, *counter); err != nil {
+		log.Infow("counter-offer changes terms that can't be accepted automatically", "proposalCid", deal.ProposalCid, "err", err)
+		return
+	}
+	if counter.StartEpoch-deal.Proposal.StartEpoch > limits.MaxStartDelay {
+		log.Infow("counter-offer start epoch is over the limit", "proposalCid", deal.ProposalCid, "startEpoch", counter.StartEpoch, "proposedStartEpoch", deal.Proposal.StartEpoch)
+		return
+	}
+
+	if _, err := c.acceptCounterOffer(context.TODO(), deal); err != nil {
+		log.Errorf("accepting counter-offer for deal %s: %s", deal.ProposalCid, err)
+	}
+}
+
+// signedDealProposal constructs and signs the deal proposal for the given
+// parameters. If the capabilities of the provider are known, the proposal is
+// checked against them.
+func (c *Client) signedDealProposal(ctx context.Context, params storagemarket.ProposeStorageDealParams, capabilities *storagemarket.StorageCapabilities) (*market.ClientDealProposal, error) {
+	dealProposal, err := c.dealProposal(ctx, params, capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDealProposal, err := c.node.SignProposal(ctx, params.Addr, *dealProposal)
+	if err != nil {
+		return nil, xerrors.Errorf("signing deal proposal failed: %w", err)
+	}
+	return clientDealProposal, nil
+}
+
+// dealProposal constructs the unsigned deal proposal for the given parameters
+func (c *Client) dealProposal(ctx context.Context, params storagemarket.ProposeStorageDealParams, capabilities *storagemarket.StorageCapabilities) (*market.DealProposal, error) {
 	bs, err := c.bstores.Get(params.Data.Root)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to get blockstore for imported root %s: %w", params.Data.Root, err)
@@ -351,6 +587,12 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, params storagemarket.Pr
 		return nil, fmt.Errorf("cannot propose a deal whose piece size (%d) is greater than sector size (%d)", pieceSize.Padded(), params.Info.SectorSize)
 	}
 
+	if capabilities != nil {
+		if err := capabilities.CheckProposal(params.Data.TransferType, pieceSize.Padded(), params.VerifiedDeal); err != nil {
+			return nil, xerrors.Errorf("provider cannot accept deal: %w", err)
+		}
+	}
+
 	pcMin := params.Collateral
 	if pcMin.Int == nil || pcMin.IsZero() {
 		pcMin, _, err = c.node.DealProviderCollateralBounds(ctx, pieceSize.Padded(), params.VerifiedDeal)
@@ -377,46 +619,81 @@ func (c *Client) ProposeStorageDeal(ctx context.Context, params storagemarket.Pr
 		ClientCollateral:     big.Zero(),
 		VerifiedDeal:         params.VerifiedDeal,
 	}
+	return &dealProposal, nil
+}
 
-	clientDealProposal, err := c.node.SignProposal(ctx, params.Addr, dealProposal)
+// DryRunStorageDeal sends a deal proposal to a provider, which checks it the
+// same way it checks a real proposal and responds with whether it would
+// accept the deal. No deal is started on either side.
+//
+// The proposal is sent unsigned, so that neither the provider nor anyone
+// observing the stream can publish it.
+func (c *Client) DryRunStorageDeal(ctx context.Context, params storagemarket.ProposeStorageDealParams) (*storagemarket.DryRunStorageDealResult, error) {
+	err := c.addMultiaddrs(ctx, params.Info.Address)
 	if err != nil {
-		return nil, xerrors.Errorf("signing deal proposal failed: %w", err)
+		return nil, xerrors.Errorf("looking up addresses: %w", err)
 	}
 
-	proposalNd, err := cborutil.AsIpld(clientDealProposal)
+	dealProposal, err := c.dealProposal(ctx, params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	proposalNd, err := cborutil.AsIpld(dealProposal)
 	if err != nil {
 		return nil, xerrors.Errorf("getting proposal node failed: %w", err)
 	}
 
-	deal := &storagemarket.ClientDeal{
-		ProposalCid:        proposalNd.Cid(),
-		ClientDealProposal: *clientDealProposal,
-		State:              storagemarket.StorageDealUnknown,
-		Miner:              params.Info.PeerID,
-		MinerWorker:        params.Info.Worker,
-		DataRef:            params.Data,
-		FastRetrieval:      params.FastRetrieval,
-		DealStages:         storagemarket.NewDealStages(),
-		CreationTime:       curTime(),
+	s, err := c.net.NewDryRunDealStream(ctx, params.Info.PeerID)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open dry run stream to provider: %w", err)
 	}
+	defer s.Close()
 
-	err = c.statemachines.Begin(proposalNd.Cid(), deal)
+	err = s.WriteDealProposal(network.Proposal{
+		Piece:          params.Data,
+		FastRetrieval:  params.FastRetrieval,
+		DryRunProposal: dealProposal,
+	})
 	if err != nil {
-		return nil, xerrors.Errorf("setting up deal tracking: %w", err)
+		return nil, xerrors.Errorf("failed to send dry run proposal: %w", err)
 	}
 
-	err = c.statemachines.Send(deal.ProposalCid, storagemarket.ClientEventOpen)
+	resp, origBytes, err := s.ReadDealResponse()
 	if err != nil {
-		return nil, xerrors.Errorf("initializing state machine: %w", err)
+		return nil, xerrors.Errorf("failed to read dry run response: %w", err)
 	}
 
-	return &storagemarket.ProposeStorageDealResult{
-			ProposalCid: deal.ProposalCid,
-		}, c.discovery.AddPeer(ctx, params.Data.Root, retrievalmarket.RetrievalPeer{
-			Address:  dealProposal.Provider,
-			ID:       deal.Miner,
-			PieceCID: &commP,
-		})
+	if resp.Signature == nil {
+		return nil, xerrors.Errorf("dry run response was not signed")
+	}
+
+	tok, _, err := c.node.GetChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	verified, err := c.node.VerifySignature(ctx, *resp.Signature, params.Info.Worker, origBytes, tok)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verified {
+		return nil, xerrors.Errorf("dry run response was not properly signed")
+	}
+
+	if !resp.Response.Proposal.Equals(proposalNd.Cid()) {
+		return nil, xerrors.Errorf("dry run response is for a different proposal")
+	}
+
+	switch resp.Response.State {
+	case storagemarket.StorageDealProposalAccepted:
+		return &storagemarket.DryRunStorageDealResult{ProposalCid: proposalNd.Cid(), Accepted: true}, nil
+	case storagemarket.StorageDealProposalRejected:
+		return &storagemarket.DryRunStorageDealResult{ProposalCid: proposalNd.Cid(), Reason: resp.Response.Message}, nil
+	default:
+		return nil, xerrors.Errorf("unexpected dry run response state %s", storagemarket.DealStates[resp.Response.State])
+	}
 }
 
 func curTime() cbg.CborTime {
@@ -531,6 +808,10 @@ func (c *Client) dispatch(eventName fsm.EventName, deal fsm.StateType) {
 	}
 	pubSubEvt := internalClientEvent{evt, realDeal}
 
+	if evt == storagemarket.ClientEventCounterOffered && c.counterOfferLimits != nil {
+		go c.autoAcceptCounterOffer(realDeal)
+	}
+
 	if err := c.pubSub.Publish(pubSubEvt); err != nil {
 		log.Errorf("failed to publish event %d", evt)
 	}
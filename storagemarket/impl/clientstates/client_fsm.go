@@ -10,6 +10,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/specs-actors/actors/builtin/market"
 
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
@@ -44,7 +45,7 @@ var ClientEvents = fsm.Events{
 			return nil
 		}),
 	fsm.Event(storagemarket.ClientEventFundsReleased).
-		FromMany(storagemarket.StorageDealProposalAccepted, storagemarket.StorageDealFailing).ToJustRecord().
+		FromMany(storagemarket.StorageDealProposalAccepted, storagemarket.StorageDealPublishConfirming, storagemarket.StorageDealFailing).ToJustRecord().
 		Action(func(deal *storagemarket.ClientDeal, fundsReleased abi.TokenAmount) error {
 			deal.FundsReserved = big.Subtract(deal.FundsReserved, fundsReleased)
 			deal.AddLog("funds released, amount <%s>", fundsReleased)
@@ -80,6 +81,12 @@ var ClientEvents = fsm.Events{
 			deal.AddLog("opening data transfer to storage provider")
 			return nil
 		}),
+	fsm.Event(storagemarket.ClientEventPieceReused).
+		From(storagemarket.StorageDealFundsReserved).To(storagemarket.StorageDealCheckForAcceptance).
+		Action(func(deal *storagemarket.ClientDeal) error {
+			deal.AddLog("provider already holds the piece, skipping data transfer")
+			return nil
+		}),
 	fsm.Event(storagemarket.ClientEventUnexpectedDealState).
 		From(storagemarket.StorageDealFundsReserved).To(storagemarket.StorageDealFailing).
 		Action(func(deal *storagemarket.ClientDeal, status storagemarket.StorageDealStatus, providerMessage string) error {
@@ -87,6 +94,14 @@ var ClientEvents = fsm.Events{
 			deal.AddLog(deal.Message)
 			return nil
 		}),
+	fsm.Event(storagemarket.ClientEventCounterOffered).
+		From(storagemarket.StorageDealFundsReserved).To(storagemarket.StorageDealFailing).
+		Action(func(deal *storagemarket.ClientDeal, counterOffer market.DealProposal, providerMessage string) error {
+			deal.CounterOffer = &counterOffer
+			deal.Message = xerrors.Errorf("provider made a counter-offer. Provider message: %s", providerMessage).Error()
+			deal.AddLog(deal.Message)
+			return nil
+		}),
 	fsm.Event(storagemarket.ClientEventDataTransferFailed).
 		FromMany(storagemarket.StorageDealStartDataTransfer, storagemarket.StorageDealTransferring, storagemarket.StorageDealTransferQueued).
 		To(storagemarket.StorageDealFailing).
@@ -209,14 +224,30 @@ var ClientEvents = fsm.Events{
 			return nil
 		}),
 	fsm.Event(storagemarket.ClientEventDealPublishFailed).
-		From(storagemarket.StorageDealProposalAccepted).To(storagemarket.StorageDealError).
+		FromMany(storagemarket.StorageDealProposalAccepted, storagemarket.StorageDealPublishConfirming).To(storagemarket.StorageDealError).
 		Action(func(deal *storagemarket.ClientDeal, err error) error {
 			deal.Message = xerrors.Errorf("error validating deal published: %w", err).Error()
 			deal.AddLog(deal.Message)
 			return nil
 		}),
+	fsm.Event(storagemarket.ClientEventDealPublishIncluded).
+		From(storagemarket.StorageDealProposalAccepted).To(storagemarket.StorageDealPublishConfirming).
+		Action(func(deal *storagemarket.ClientDeal, dealID abi.DealID) error {
+			deal.DealID = dealID
+			deal.AddLog("deal published, waiting for confirmations")
+			return nil
+		}),
+	fsm.Event(storagemarket.ClientEventDealPublishReorged).
+		From(storagemarket.StorageDealPublishConfirming).To(storagemarket.StorageDealCheckForAcceptance).
+		Action(func(deal *storagemarket.ClientDeal) error {
+			deal.Message = fmt.Sprintf("publish message %s was reorged out, waiting for provider to publish deal again", deal.PublishMessage)
+			deal.AddLog(deal.Message)
+			deal.DealID = 0
+			deal.PublishMessage = nil
+			return nil
+		}),
 	fsm.Event(storagemarket.ClientEventDealPublished).
-		From(storagemarket.StorageDealProposalAccepted).To(storagemarket.StorageDealAwaitingPreCommit).
+		FromMany(storagemarket.StorageDealProposalAccepted, storagemarket.StorageDealPublishConfirming).To(storagemarket.StorageDealAwaitingPreCommit).
 		Action(func(deal *storagemarket.ClientDeal, dealID abi.DealID) error {
 			deal.DealID = dealID
 			deal.AddLog("")
@@ -285,6 +316,7 @@ var ClientStateEntryFuncs = fsm.StateEntryFuncs{
 	storagemarket.StorageDealClientTransferRestart: RestartDataTransfer,
 	storagemarket.StorageDealCheckForAcceptance:    CheckForDealAcceptance,
 	storagemarket.StorageDealProposalAccepted:      ValidateDealPublished,
+	storagemarket.StorageDealPublishConfirming:     ConfirmDealPublished,
 	storagemarket.StorageDealAwaitingPreCommit:     VerifyDealPreCommitted,
 	storagemarket.StorageDealSealing:               VerifyDealActivated,
 	storagemarket.StorageDealActive:                WaitForDealCompletion,
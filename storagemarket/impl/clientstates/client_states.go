@@ -17,6 +17,7 @@ import (
 	"github.com/filecoin-project/go-statemachine/fsm"
 
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/clientutils"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/requestvalidation"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
 )
@@ -39,6 +40,7 @@ type ClientDealEnvironment interface {
 	RestartDataTransfer(ctx context.Context, chid datatransfer.ChannelID) error
 	GetProviderDealState(ctx context.Context, proposalCid cid.Cid) (*storagemarket.ProviderDealState, error)
 	PollingInterval() time.Duration
+	ConfirmationDepth() abi.ChainEpoch
 	network.PeerTagger
 }
 
@@ -86,6 +88,7 @@ func ProposeDeal(ctx fsm.Context, environment ClientDealEnvironment, deal storag
 		DealProposal:  &deal.ClientDealProposal,
 		Piece:         deal.DataRef,
 		FastRetrieval: deal.FastRetrieval,
+		ReusePiece:    deal.ReusePiece,
 	}
 
 	s, err := environment.NewDealStream(ctx.Context(), deal.Miner)
@@ -123,6 +126,20 @@ func ProposeDeal(ctx fsm.Context, environment ClientDealEnvironment, deal storag
 		return ctx.Trigger(storagemarket.ClientEventResponseVerificationFailed)
 	}
 
+	if resp.Response.CounterOffer != nil {
+		if err := clientutils.CheckCounterOffer(deal.Proposal, *resp.Response.CounterOffer); err != nil {
+			log.Warnf("ignoring counter-offer for deal %s: %s", deal.ProposalCid, err)
+		} else {
+			return ctx.Trigger(storagemarket.ClientEventCounterOffered, *resp.Response.CounterOffer, resp.Response.Message)
+		}
+	}
+
+	// The provider skips the data transfer if the client agreed to it and
+	// the provider already holds the piece
+	if deal.ReusePiece && resp.Response.State == storagemarket.StorageDealVerifyData {
+		return ctx.Trigger(storagemarket.ClientEventPieceReused)
+	}
+
 	if resp.Response.State != storagemarket.StorageDealWaitingForData {
 		return ctx.Trigger(storagemarket.ClientEventUnexpectedDealState, resp.Response.State, resp.Response.Message)
 	}
@@ -230,6 +247,12 @@ func ValidateDealPublished(ctx fsm.Context, environment ClientDealEnvironment, d
 		return ctx.Trigger(storagemarket.ClientEventDealPublishFailed, err)
 	}
 
+	// With a confirmation depth, funds stay reserved until the publish
+	// message is confirmed, in case a reorg means the deal is published again
+	if environment.ConfirmationDepth() > 0 && deal.PublishMessage != nil {
+		return ctx.Trigger(storagemarket.ClientEventDealPublishIncluded, dealID)
+	}
+
 	releaseReservedFunds(ctx, environment, deal)
 
 	// at this point data transfer is complete, so unprotect peer connection
@@ -238,6 +261,97 @@ func ValidateDealPublished(ctx fsm.Context, environment ClientDealEnvironment, d
 	return ctx.Trigger(storagemarket.ClientEventDealPublished, dealID)
 }
 
+// ConfirmDealPublished waits for the publish message to reach the
+// confirmation depth, and then validates the published deal again. If a chain
+// reorg removed the publish message and it is not included again, the client
+// goes back to waiting for the provider to publish the deal.
+func ConfirmDealPublished(ctx fsm.Context, environment ClientDealEnvironment, deal storagemarket.ClientDeal) error {
+	go func() {
+		confirmed, err := awaitPublishConfirmed(ctx.Context(), environment, deal)
+		if ctx.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			_ = ctx.Trigger(storagemarket.ClientEventDealPublishFailed, err)
+			return
+		}
+		if !confirmed {
+			_ = ctx.Trigger(storagemarket.ClientEventDealPublishReorged)
+			return
+		}
+
+		dealID, err := environment.Node().ValidatePublishedDeal(ctx.Context(), deal)
+		if err != nil {
+			_ = ctx.Trigger(storagemarket.ClientEventDealPublishFailed, err)
+			return
+		}
+
+		releaseReservedFunds(ctx, environment, deal)
+
+		// at this point data transfer is complete, so unprotect peer connection
+		environment.UntagPeer(deal.Miner, deal.ProposalCid.String())
+
+		_ = ctx.Trigger(storagemarket.ClientEventDealPublished, dealID)
+	}()
+	return nil
+}
+
+// awaitPublishConfirmed polls the chain until the deal's publish message is
+// the confirmation depth deep. It returns false if the message was reorged
+// out and has not been included again.
+//
+// A message that is reorged out usually goes back to the message pool and is
+// included again in a later tipset, so the message is only given up on once
+// it has been missing while the chain advanced by the confirmation depth.
+func awaitPublishConfirmed(ctx context.Context, environment ClientDealEnvironment, deal storagemarket.ClientDeal) (bool, error) {
+	// missingSince is the chain head epoch when the message was found to be
+	// missing, or -1 while it is on chain
+	missingSince := abi.ChainEpoch(-1)
+	for {
+		epoch, found, err := environment.Node().MessageInclusionEpoch(ctx, *deal.PublishMessage)
+		if err != nil {
+			return false, xerrors.Errorf("looking up publish message: %w", err)
+		}
+
+		_, head, err := environment.Node().GetChainHead(ctx)
+		switch {
+		case err != nil:
+			log.Warnf("getting chain head: %s", err)
+		case found:
+			missingSince = -1
+			if head >= epoch+environment.ConfirmationDepth() {
+				return true, nil
+			}
+		default:
+			if missingSince < 0 {
+				log.Infow("deal publish message is not on chain, waiting for it to be included again",
+					"proposalCid", deal.ProposalCid, "publishMessage", deal.PublishMessage, "epoch", head)
+				missingSince = head
+			}
+			if head >= missingSince+environment.ConfirmationDepth() {
+				return false, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(environment.PollingInterval()):
+		}
+	}
+}
+
+// isConfirmed checks whether the chain head is at least the confirmation
+// depth past the given epoch
+func isConfirmed(ctx context.Context, environment ClientDealEnvironment, epoch abi.ChainEpoch) bool {
+	_, head, err := environment.Node().GetChainHead(ctx)
+	if err != nil {
+		log.Warnf("getting chain head: %s", err)
+		return false
+	}
+	return head >= epoch+environment.ConfirmationDepth()
+}
+
 // VerifyDealPreCommitted verifies that a deal has been pre-committed
 func VerifyDealPreCommitted(ctx fsm.Context, environment ClientDealEnvironment, deal storagemarket.ClientDeal) error {
 	cb := func(sectorNumber abi.SectorNumber, isActive bool, err error) {
@@ -266,20 +380,58 @@ func VerifyDealPreCommitted(ctx fsm.Context, environment ClientDealEnvironment,
 
 // VerifyDealActivated confirms that a deal was successfully committed to a sector and is active
 func VerifyDealActivated(ctx fsm.Context, environment ClientDealEnvironment, deal storagemarket.ClientDeal) error {
+	if err := awaitDealCommitted(ctx, environment, deal); err != nil {
+		return ctx.Trigger(storagemarket.ClientEventDealActivationFailed, err)
+	}
+
+	return nil
+}
+
+// awaitDealCommitted waits for the deal's sector to be committed, and then
+// for the commit to be confirmed if there is a confirmation depth
+func awaitDealCommitted(ctx fsm.Context, environment ClientDealEnvironment, deal storagemarket.ClientDeal) error {
 	cb := func(err error) {
-		if err != nil {
+		switch {
+		case err != nil:
 			_ = ctx.Trigger(storagemarket.ClientEventDealActivationFailed, err)
-		} else {
-
+		case environment.ConfirmationDepth() > 0:
+			go confirmDealActivated(ctx, environment, deal)
+		default:
 			_ = ctx.Trigger(storagemarket.ClientEventDealActivated)
 		}
 	}
 
-	if err := environment.Node().OnDealSectorCommitted(ctx.Context(), deal.Proposal.Provider, deal.DealID, deal.SectorNumber, deal.Proposal, deal.PublishMessage, cb); err != nil {
-		return ctx.Trigger(storagemarket.ClientEventDealActivationFailed, err)
-	}
+	return environment.Node().OnDealSectorCommitted(ctx.Context(), deal.Proposal.Provider, deal.DealID, deal.SectorNumber, deal.Proposal, deal.PublishMessage, cb)
+}
 
-	return nil
+// confirmDealActivated waits for the chain to advance by the confirmation
+// depth past the epoch the deal's sector was committed at. If the commit is
+// no longer on chain, eg after a reorg, it waits for the sector to be
+// committed again.
+func confirmDealActivated(ctx fsm.Context, environment ClientDealEnvironment, deal storagemarket.ClientDeal) {
+	for {
+		committedEpoch, active, err := environment.Node().DealActivationEpoch(ctx.Context(), deal.DealID)
+		if err != nil {
+			_ = ctx.Trigger(storagemarket.ClientEventDealActivationFailed, xerrors.Errorf("getting deal activation epoch: %w", err))
+			return
+		}
+		if !active {
+			if err := awaitDealCommitted(ctx, environment, deal); err != nil {
+				_ = ctx.Trigger(storagemarket.ClientEventDealActivationFailed, err)
+			}
+			return
+		}
+		if isConfirmed(ctx.Context(), environment, committedEpoch) {
+			_ = ctx.Trigger(storagemarket.ClientEventDealActivated)
+			return
+		}
+
+		select {
+		case <-ctx.Context().Done():
+			return
+		case <-time.After(environment.PollingInterval()):
+		}
+	}
 }
 
 // WaitForDealCompletion waits for the deal to be slashed or to expire
@@ -3,6 +3,7 @@ package clientstates_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/filecoin-project/go-statemachine/fsm"
 	fsmtest "github.com/filecoin-project/go-statemachine/fsm/testutil"
@@ -216,6 +218,92 @@ func TestProposeDeal(t *testing.T) {
 			},
 		})
 	})
+	t.Run("provider makes a counter-offer", func(t *testing.T) {
+		counterOffer := clientDealProposal.Proposal
+		counterOffer.StoragePricePerEpoch = big.Add(counterOffer.StoragePricePerEpoch, big.NewInt(1))
+		counterOffer.StartEpoch += 10
+		counterOffer.EndEpoch += 10
+		ds := tut.NewTestStorageDealStream(tut.TestStorageDealStreamParams{
+			ResponseReader: testResponseReader(t, responseParams{
+				proposal:     clientDealProposal,
+				state:        storagemarket.StorageDealFailing,
+				message:      "deal rejected: storage price per epoch less than asking price",
+				counterOffer: &counterOffer,
+			}),
+		})
+		runAndInspect(t, storagemarket.StorageDealFundsReserved, clientstates.ProposeDeal, testCase{
+			envParams: envParams{
+				dealStream: ds,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
+				assert.Equal(t, "provider made a counter-offer. Provider message: deal rejected: storage price per epoch less than asking price", deal.Message)
+				if assert.NotNil(t, deal.CounterOffer) {
+					assert.Equal(t, counterOffer, *deal.CounterOffer)
+				}
+			},
+		})
+	})
+	t.Run("counter-offer that changes other terms is ignored", func(t *testing.T) {
+		counterOffer := clientDealProposal.Proposal
+		counterOffer.PieceSize *= 2
+		ds := tut.NewTestStorageDealStream(tut.TestStorageDealStreamParams{
+			ResponseReader: testResponseReader(t, responseParams{
+				proposal:     clientDealProposal,
+				state:        storagemarket.StorageDealFailing,
+				message:      "deal rejected: storage price per epoch less than asking price",
+				counterOffer: &counterOffer,
+			}),
+		})
+		runAndInspect(t, storagemarket.StorageDealFundsReserved, clientstates.ProposeDeal, testCase{
+			envParams: envParams{
+				dealStream: ds,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
+				assert.Equal(t, "unexpected deal status while waiting for data request: 11 (StorageDealFailing). Provider message: deal rejected: storage price per epoch less than asking price", deal.Message)
+				assert.Nil(t, deal.CounterOffer)
+			},
+		})
+	})
+	t.Run("skips the data transfer when the provider reuses a held piece", func(t *testing.T) {
+		var sentProposal *smnet.Proposal
+
+		ds := tut.NewTestStorageDealStream(tut.TestStorageDealStreamParams{
+			ResponseReader: testResponseReader(t, responseParams{
+				state:    storagemarket.StorageDealVerifyData,
+				proposal: clientDealProposal,
+			}),
+			ProposalWriter: func(proposal smnet.Proposal) error {
+				sentProposal = &proposal
+				return nil
+			},
+		})
+
+		runAndInspect(t, storagemarket.StorageDealFundsReserved, clientstates.ProposeDeal, testCase{
+			envParams:   envParams{dealStream: ds},
+			stateParams: dealStateParams{reusePiece: true},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealCheckForAcceptance, deal.State)
+				assert.Equal(t, true, sentProposal.ReusePiece)
+			},
+		})
+	})
+	t.Run("piece reuse without client agreement is unexpected", func(t *testing.T) {
+		ds := tut.NewTestStorageDealStream(tut.TestStorageDealStreamParams{
+			ResponseReader: testResponseReader(t, responseParams{
+				state:    storagemarket.StorageDealVerifyData,
+				proposal: clientDealProposal,
+			}),
+		})
+
+		runAndInspect(t, storagemarket.StorageDealFundsReserved, clientstates.ProposeDeal, testCase{
+			envParams: envParams{dealStream: ds},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
+			},
+		})
+	})
 }
 
 func TestInitiateDataTransfer(t *testing.T) {
@@ -421,6 +509,22 @@ func TestValidateDealPublished(t *testing.T) {
 			},
 		})
 	})
+	t.Run("waits for confirmation depth", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealProposalAccepted, clientstates.ValidateDealPublished, testCase{
+			nodeParams: nodeParams{ValidatePublishedDealID: abi.DealID(5)},
+			envParams:  envParams{confirmationDepth: 5},
+			stateParams: dealStateParams{
+				reserveFunds:   true,
+				publishMessage: &tut.GenerateCids(1)[0],
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealPublishConfirming, deal.State)
+				assert.Equal(t, abi.DealID(5), deal.DealID)
+				assert.Len(t, env.node.DealFunds.ReleaseCalls, 0)
+				assert.Len(t, env.peerTagger.UntagCalls, 0)
+			},
+		})
+	})
 	t.Run("fails", func(t *testing.T) {
 		runAndInspect(t, storagemarket.StorageDealProposalAccepted, clientstates.ValidateDealPublished, testCase{
 			nodeParams: nodeParams{
@@ -435,6 +539,103 @@ func TestValidateDealPublished(t *testing.T) {
 	})
 }
 
+func TestConfirmDealPublished(t *testing.T) {
+	publishMessage := tut.GenerateCids(1)[0]
+	t.Run("succeeds at confirmation depth", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealPublishConfirming, clientstates.ConfirmDealPublished, testCase{
+			nodeParams: nodeParams{
+				CurrentEpoch:            100,
+				ValidatePublishedDealID: abi.DealID(6),
+			},
+			envParams: envParams{confirmationDepth: 5},
+			stateParams: dealStateParams{
+				reserveFunds:   true,
+				publishMessage: &publishMessage,
+				publishEpoch:   95,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealAwaitingPreCommit, deal.State)
+				assert.Equal(t, abi.DealID(6), deal.DealID)
+				assert.Equal(t, env.node.DealFunds.ReleaseCalls[0], deal.Proposal.ClientBalanceRequirement())
+				assert.Len(t, env.peerTagger.UntagCalls, 1)
+			},
+		})
+	})
+	t.Run("waits for confirmation depth", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealPublishConfirming, clientstates.ConfirmDealPublished, testCase{
+			nodeParams: nodeParams{CurrentEpoch: 100},
+			envParams: envParams{
+				confirmationDepth: 5,
+				pollingInterval:   time.Hour,
+			},
+			stateParams: dealStateParams{
+				publishMessage: &publishMessage,
+				publishEpoch:   98,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealPublishConfirming, deal.State)
+			},
+		})
+	})
+	t.Run("publish message reorged out", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealPublishConfirming, clientstates.ConfirmDealPublished, testCase{
+			nodeParams: nodeParams{CurrentEpoch: 100},
+			envParams: envParams{
+				confirmationDepth:   5,
+				pollingInterval:     time.Millisecond,
+				reorgPublishMessage: true,
+			},
+			stateParams: dealStateParams{
+				publishMessage: &publishMessage,
+				publishEpoch:   98,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealCheckForAcceptance, deal.State)
+				assert.Nil(t, deal.PublishMessage)
+				assert.Equal(t, abi.DealID(0), deal.DealID)
+				assert.Equal(t, fmt.Sprintf("publish message %s was reorged out, waiting for provider to publish deal again", publishMessage), deal.Message)
+			},
+		})
+	})
+	t.Run("publish message included again after reorg", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealPublishConfirming, clientstates.ConfirmDealPublished, testCase{
+			nodeParams: nodeParams{CurrentEpoch: 100},
+			envParams: envParams{
+				confirmationDepth:       5,
+				pollingInterval:         time.Millisecond,
+				reorgPublishMessage:     true,
+				reincludePublishMessage: true,
+			},
+			stateParams: dealStateParams{
+				publishMessage: &publishMessage,
+				publishEpoch:   98,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				// The deal waits for the new inclusion to be confirmed
+				tut.AssertDealState(t, storagemarket.StorageDealPublishConfirming, deal.State)
+				assert.Equal(t, &publishMessage, deal.PublishMessage)
+			},
+		})
+	})
+	t.Run("fails validation at confirmation depth", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealPublishConfirming, clientstates.ConfirmDealPublished, testCase{
+			nodeParams: nodeParams{
+				CurrentEpoch:           100,
+				ValidatePublishedError: errors.New("deal not found"),
+			},
+			envParams: envParams{confirmationDepth: 5},
+			stateParams: dealStateParams{
+				publishMessage: &publishMessage,
+				publishEpoch:   95,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealError, deal.State)
+				assert.Equal(t, "error validating deal published: deal not found", deal.Message)
+			},
+		})
+	})
+}
+
 func TestVerifyDealPreCommitted(t *testing.T) {
 	t.Run("succeeds", func(t *testing.T) {
 		runAndInspect(t, storagemarket.StorageDealAwaitingPreCommit, clientstates.VerifyDealPreCommitted, testCase{
@@ -481,6 +682,30 @@ func TestVerifyDealActivated(t *testing.T) {
 			},
 		})
 	})
+	t.Run("waits for confirmation depth", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealSealing, clientstates.VerifyDealActivated, testCase{
+			envParams: envParams{
+				confirmationDepth: 5,
+				pollingInterval:   time.Hour,
+			},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealSealing, deal.State)
+			},
+		})
+	})
+	t.Run("confirmation depth counts from the commit epoch", func(t *testing.T) {
+		runAndInspect(t, storagemarket.StorageDealSealing, clientstates.VerifyDealActivated, testCase{
+			nodeParams: nodeParams{CurrentEpoch: 100},
+			envParams: envParams{
+				confirmationDepth: 5,
+				pollingInterval:   time.Hour,
+			},
+			stateParams: dealStateParams{activationEpoch: 95},
+			inspector: func(deal storagemarket.ClientDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealActive, deal.State)
+			},
+		})
+	})
 	t.Run("fails synchronously", func(t *testing.T) {
 		runAndInspect(t, storagemarket.StorageDealSealing, clientstates.VerifyDealActivated, testCase{
 			nodeParams: nodeParams{DealCommittedSyncError: errors.New("Something went wrong")},
@@ -582,13 +807,24 @@ type envParams struct {
 	providerDealState        *storagemarket.ProviderDealState
 	getDealStatusErr         error
 	pollingInterval          time.Duration
+	confirmationDepth        abi.ChainEpoch
+	reorgPublishMessage      bool
+	// reincludePublishMessage includes the publish message on chain again
+	// after it was reorged out
+	reincludePublishMessage bool
 }
 
 type dealStateParams struct {
 	addFundsCid   *cid.Cid
 	reserveFunds  bool
 	fastRetrieval bool
+	reusePiece    bool
 	startEpoch    abi.ChainEpoch
+	// publishMessage is included on chain at publishEpoch
+	publishMessage *cid.Cid
+	publishEpoch   abi.ChainEpoch
+	// activationEpoch is the epoch the deal's sector is committed on chain at
+	activationEpoch abi.ChainEpoch
 }
 
 type executor func(t *testing.T,
@@ -611,6 +847,7 @@ func makeExecutor(ctx context.Context,
 		assert.NoError(t, err)
 		dealState.AddFundsCid = &tut.GenerateCids(1)[0]
 		dealState.FastRetrieval = dealParams.fastRetrieval
+		dealState.ReusePiece = dealParams.reusePiece
 		dealState.TransferChannelID = &datatransfer.ChannelID{}
 
 		if dealParams.addFundsCid != nil {
@@ -622,6 +859,13 @@ func makeExecutor(ctx context.Context,
 		if dealParams.startEpoch != 0 {
 			dealState.Proposal.StartEpoch = dealParams.startEpoch
 		}
+		if dealParams.publishMessage != nil {
+			dealState.PublishMessage = dealParams.publishMessage
+			node.SMState.IncludeMessage(*dealParams.publishMessage, dealParams.publishEpoch)
+		}
+		if dealParams.activationEpoch != 0 {
+			node.SMState.ActivateDeal(dealState.DealID, dealParams.activationEpoch)
+		}
 
 		environment := &fakeEnvironment{
 			node:                       node,
@@ -632,6 +876,7 @@ func makeExecutor(ctx context.Context,
 			providerDealState:          envParams.providerDealState,
 			getDealStatusErr:           envParams.getDealStatusErr,
 			pollingInterval:            envParams.pollingInterval,
+			confirmationDepth:          envParams.confirmationDepth,
 			peerTagger:                 tut.NewTestPeerTagger(),
 		}
 
@@ -642,6 +887,19 @@ func makeExecutor(ctx context.Context,
 		fsmCtx := fsmtest.NewTestContext(ctx, eventProcessor)
 		err = stateEntryFunc(fsmCtx, environment, *dealState)
 		assert.NoError(t, err)
+		if envParams.reorgPublishMessage {
+			node.SMState.ReorgMessage(*dealState.PublishMessage)
+			// give the deal time to find that the message is missing, and
+			// then either include the message again, or advance the chain
+			// past the confirmation depth
+			time.Sleep(10 * time.Millisecond)
+			if envParams.reincludePublishMessage {
+				_, epoch := node.SMState.StateKey()
+				node.SMState.IncludeMessage(*dealState.PublishMessage, epoch)
+			} else {
+				node.SMState.AdvanceEpoch(envParams.confirmationDepth)
+			}
+		}
 		time.Sleep(10 * time.Millisecond)
 		fsmCtx.ReplayEvents(t, dealState)
 		dealInspector(*dealState, environment)
@@ -724,6 +982,7 @@ type fakeEnvironment struct {
 	providerDealState *storagemarket.ProviderDealState
 	getDealStatusErr  error
 	pollingInterval   time.Duration
+	confirmationDepth abi.ChainEpoch
 	peerTagger        *tut.TestPeerTagger
 }
 
@@ -777,6 +1036,10 @@ func (fe *fakeEnvironment) PollingInterval() time.Duration {
 	return fe.pollingInterval
 }
 
+func (fe *fakeEnvironment) ConfirmationDepth() abi.ChainEpoch {
+	return fe.confirmationDepth
+}
+
 func (fe *fakeEnvironment) TagPeer(id peer.ID, ident string) {
 	fe.peerTagger.TagPeer(id, ident)
 }
@@ -797,6 +1060,7 @@ type responseParams struct {
 	message        string
 	publishMessage *cid.Cid
 	proposalCid    cid.Cid
+	counterOffer   *market.DealProposal
 }
 
 func testResponseReader(t *testing.T, params responseParams) tut.StorageDealResponseReader {
@@ -805,6 +1069,7 @@ func testResponseReader(t *testing.T, params responseParams) tut.StorageDealResp
 		Proposal:       params.proposalCid,
 		Message:        params.message,
 		PublishMessage: params.publishMessage,
+		CounterOffer:   params.counterOffer,
 	}
 
 	if response.Proposal == cid.Undef {
@@ -16,6 +16,7 @@ import (
 	"github.com/filecoin-project/go-commp-utils/writer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/specs-actors/actors/builtin/market"
 
 	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
@@ -101,3 +102,34 @@ func LabelField(payloadCID cid.Cid) (string, error) {
 	}
 	return payloadCID.StringOfBase(multibase.Base64)
 }
+
+// CheckCounterOffer checks that a counter-offer from a provider only changes
+// the terms of a proposal the provider can negotiate on: the price, the
+// provider collateral and the start epoch. The deal can start later than
+// proposed, but not earlier, and it must last as long as proposed.
+func CheckCounterOffer(proposal market.DealProposal, counter market.DealProposal) error {
+	if counter.Duration() != proposal.Duration() {
+		return xerrors.Errorf("counter-offer changes the deal duration from %d to %d epochs", proposal.Duration(), counter.Duration())
+	}
+	if counter.StartEpoch < proposal.StartEpoch {
+		return xerrors.Errorf("counter-offer start epoch %d is before the proposed start epoch %d", counter.StartEpoch, proposal.StartEpoch)
+	}
+
+	counter.StoragePricePerEpoch = proposal.StoragePricePerEpoch
+	counter.ProviderCollateral = proposal.ProviderCollateral
+	counter.StartEpoch = proposal.StartEpoch
+	counter.EndEpoch = proposal.EndEpoch
+
+	proposalNd, err := cborutil.AsIpld(&proposal)
+	if err != nil {
+		return err
+	}
+	counterNd, err := cborutil.AsIpld(&counter)
+	if err != nil {
+		return err
+	}
+	if !proposalNd.Cid().Equals(counterNd.Cid()) {
+		return xerrors.New("counter-offer changes terms other than price, collateral and epochs")
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
@@ -99,6 +100,35 @@ func TestLabelField(t *testing.T) {
 	require.True(t, payloadCID.Equals(resultCid))
 }
 
+func TestCheckCounterOffer(t *testing.T) {
+	proposal := shared_testutil.MakeTestClientDealProposal().Proposal
+
+	counter := proposal
+	counter.StoragePricePerEpoch = abi.NewTokenAmount(1000)
+	counter.ProviderCollateral = abi.NewTokenAmount(2000)
+	counter.StartEpoch += 100
+	counter.EndEpoch += 100
+	require.NoError(t, clientutils.CheckCounterOffer(proposal, counter))
+
+	counter.PieceSize *= 2
+	require.Error(t, clientutils.CheckCounterOffer(proposal, counter))
+
+	counter = proposal
+	counter.ClientCollateral = big.Add(proposal.ClientCollateral, big.NewInt(1))
+	require.Error(t, clientutils.CheckCounterOffer(proposal, counter))
+
+	// The counter-offer can't change the duration of the deal
+	counter = proposal
+	counter.EndEpoch += 100
+	require.Error(t, clientutils.CheckCounterOffer(proposal, counter))
+
+	// The counter-offer can't start the deal earlier
+	counter = proposal
+	counter.StartEpoch -= 10
+	counter.EndEpoch -= 10
+	require.Error(t, clientutils.CheckCounterOffer(proposal, counter))
+}
+
 // this test doesn't belong here, it should be a unit test in CARv2, but we can
 // retain as a sentinel test.
 // TODO maybe remove and trust that CARv2 behaves well.
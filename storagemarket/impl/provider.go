@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/hannahhoward/go-pubsub"
@@ -29,6 +31,7 @@ import (
 	"github.com/filecoin-project/go-statemachine/fsm"
 	provider "github.com/filecoin-project/index-provider"
 	metadata2 "github.com/filecoin-project/index-provider/metadata"
+	"github.com/filecoin-project/specs-actors/actors/builtin/market"
 
 	"github.com/filecoin-project/go-fil-markets/filestore"
 	"github.com/filecoin-project/go-fil-markets/piecestore"
@@ -49,10 +52,19 @@ var _ network.StorageReceiver = &Provider{}
 
 const defaultAwaitRestartTimeout = 1 * time.Hour
 
+const defaultShardGCInterval = 1 * time.Hour
+
+var defaultHandoffRetryPolicy = providerstates.HandoffRetryPolicy{
+	MinBackoff: time.Minute,
+	MaxBackoff: time.Hour,
+	MaxAge:     24 * time.Hour,
+}
+
 // StoredAsk is an interface which provides access to a StorageAsk
 type StoredAsk interface {
 	GetAsk() *storagemarket.SignedStorageAsk
 	SetAsk(price abi.TokenAmount, verifiedPrice abi.TokenAmount, duration abi.ChainEpoch, options ...storagemarket.StorageAskOption) error
+	SetUnavailable(unavailable bool) error
 }
 
 type MeshCreator interface {
@@ -72,6 +84,9 @@ type Provider struct {
 	dataTransfer                datatransfer.Manager
 	customDealDeciderFunc       DealDeciderFunc
 	awaitTransferRestartTimeout time.Duration
+	handoffRetryPolicy          providerstates.HandoffRetryPolicy
+	confirmationDepth           abi.ChainEpoch
+	pollingInterval             time.Duration
 	pubSub                      *pubsub.PubSub
 	readyMgr                    *shared.ReadyManager
 
@@ -83,6 +98,26 @@ type Provider struct {
 	dagStore      stores.DAGStoreWrapper
 	indexProvider provider.Interface
 	stores        *stores.ReadWriteBlockstores
+
+	pieceLocator   PieceLocatorFunc
+	announcedDeals AnnouncedDealsFunc
+
+	transferTypes []string
+	verifiedDeals storagemarket.VerifiedDealPolicy
+
+	heldPieceData stores.ShardDataSource
+
+	compactionInterval time.Duration
+	shardGCInterval    time.Duration
+	shardLks           shardLocks
+
+	// stopBackground cancels the tasks that run in the background while the
+	// provider is running, and bgWg waits for them to exit
+	stopBackground context.CancelFunc
+	bgWg           sync.WaitGroup
+
+	drainLk  sync.RWMutex
+	draining bool
 }
 
 // StorageProviderOption allows custom configuration of a storage provider
@@ -113,6 +148,103 @@ func AwaitTransferRestartTimeout(waitTime time.Duration) StorageProviderOption {
 	}
 }
 
+// HandoffRetry sets how the provider retries handing off a deal to the
+// sealing subsystem when the sealing subsystem is unavailable. The wait
+// between attempts starts at minBackoff and doubles up to maxBackoff. The
+// provider fails the deal when it has been retrying for longer than maxAge.
+func HandoffRetry(minBackoff, maxBackoff, maxAge time.Duration) StorageProviderOption {
+	return func(p *Provider) {
+		p.handoffRetryPolicy = providerstates.HandoffRetryPolicy{
+			MinBackoff: minBackoff,
+			MaxBackoff: maxBackoff,
+			MaxAge:     maxAge,
+		}
+	}
+}
+
+// ProviderConfirmationDepth sets the number of epochs the provider waits
+// after a deal is published, and after its sector is committed, before it
+// treats the result as final. A deal whose publish message was reorged out,
+// and not included again within the confirmation depth, is published again.
+// By default the first inclusion on chain is final.
+func ProviderConfirmationDepth(depth abi.ChainEpoch) StorageProviderOption {
+	return func(p *Provider) {
+		p.confirmationDepth = depth
+	}
+}
+
+// ProviderPollingInterval sets the interval at which the provider polls the
+// chain while waiting for the confirmation depth
+func ProviderPollingInterval(t time.Duration) StorageProviderOption {
+	return func(p *Provider) {
+		p.pollingInterval = t
+	}
+}
+
+// PieceStoreCompaction makes the provider compact the piece store at the
+// given interval while it is running, removing the piece infos that no
+// longer have deals. By default the piece store is not compacted.
+func PieceStoreCompaction(interval time.Duration) StorageProviderOption {
+	return func(p *Provider) {
+		p.compactionInterval = interval
+	}
+}
+
+// ShardGCInterval sets the interval at which the provider garbage collects
+// the DAG store while it is running, removing the transient files of shards
+// that are not in use and the shards that have been destroyed. It defaults
+// to an hour; an interval of zero turns garbage collection off.
+func ShardGCInterval(interval time.Duration) StorageProviderOption {
+	return func(p *Provider) {
+		p.shardGCInterval = interval
+	}
+}
+
+// PieceLocatorOpt sets the function used to find where a deal's piece is in
+// a sector, so that Reconcile can re-record pieces missing from the piece
+// store
+func PieceLocatorOpt(locator PieceLocatorFunc) StorageProviderOption {
+	return func(p *Provider) {
+		p.pieceLocator = locator
+	}
+}
+
+// AnnouncedDealsOpt sets the function used to list the deals announced to
+// the indexer, so that Reconcile can check announcements
+func AnnouncedDealsOpt(announced AnnouncedDealsFunc) StorageProviderOption {
+	return func(p *Provider) {
+		p.announcedDeals = announced
+	}
+}
+
+// TransferTypes sets the ways deal data can be transferred that the provider
+// accepts, by default graphsync and manual transfers
+func TransferTypes(transferTypes ...string) StorageProviderOption {
+	return func(p *Provider) {
+		p.transferTypes = transferTypes
+	}
+}
+
+// VerifiedDeals sets whether the provider accepts verified deals, by default
+// both verified and unverified deals are accepted
+func VerifiedDeals(policy storagemarket.VerifiedDealPolicy) StorageProviderOption {
+	return func(p *Provider) {
+		p.verifiedDeals = policy
+	}
+}
+
+// HeldPieceData sets where the provider reads the data of pieces it already
+// holds, so that a deal for a held piece can skip the data transfer when the
+// client allows it. The source should not unseal sectors, because the client
+// waits for the data to be staged before it gets a response to its proposal;
+// stores.UnsealedShardData only reads pieces that have an unsealed copy. By
+// default held pieces are not reused.
+func HeldPieceData(source stores.ShardDataSource) StorageProviderOption {
+	return func(p *Provider) {
+		p.heldPieceData = source
+	}
+}
+
 // NewProvider returns a new storage provider
 func NewProvider(net network.StorageMarketNetwork,
 	ds datastore.Batching,
@@ -142,7 +274,11 @@ func NewProvider(net network.StorageMarketNetwork,
 		dagStore:                    dagStore,
 		stores:                      stores.NewReadWriteBlockstores(),
 		awaitTransferRestartTimeout: defaultAwaitRestartTimeout,
+		handoffRetryPolicy:          defaultHandoffRetryPolicy,
+		pollingInterval:             DefaultPollingInterval,
+		shardGCInterval:             defaultShardGCInterval,
 		indexProvider:               indexer,
+		transferTypes:               []string{storagemarket.TTGraphsync, storagemarket.TTManual},
 	}
 	storageMigrations, err := migrations.ProviderMigrations.Build()
 	if err != nil {
@@ -192,6 +328,17 @@ func (p *Provider) Start(ctx context.Context) error {
 		}
 	}()
 
+	bgCtx, cancel := context.WithCancel(ctx)
+	p.stopBackground = cancel
+	if p.compactionInterval > 0 {
+		p.runInBackground(bgCtx, func(ctx context.Context) {
+			piecestore.RunCompaction(ctx, p.pieceStore, p.compactionInterval)
+		})
+	}
+	if p.shardGCInterval > 0 {
+		p.runInBackground(bgCtx, p.runShardGC)
+	}
+
 	// connect the index provider node with the full node and protect that connection
 	if err := p.meshCreator.Connect(ctx); err != nil {
 		log.Errorf("failed to connect index provider host with the full node: %s", err)
@@ -261,6 +408,13 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 		return xerrors.Errorf("failed to read proposal message: %w", err)
 	}
 
+	if proposal.DryRunProposal != nil {
+		return p.dryRunDeal(s, proposal)
+	}
+	if proposal.DealProposal == nil {
+		return xerrors.Errorf("proposal from %s has no deal proposal", s.RemotePeer())
+	}
+
 	proposalNd, err := cborutil.AsIpld(proposal.DealProposal)
 	if err != nil {
 		return err
@@ -274,18 +428,23 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 		return p.resendProposalResponse(s, &md)
 	}
 
+	if p.isDraining() {
+		log.Infow("rejecting deal proposal while draining", "proposalCid", proposalNd.Cid(), "client", s.RemotePeer())
+		return p.respond(s, &network.Response{
+			State:    storagemarket.StorageDealProposalRejected,
+			Message:  errDraining.Error(),
+			Proposal: proposalNd.Cid(),
+		})
+	}
+
 	var path string
 	// create an empty CARv2 file at a temp location that Graphysnc will write the incoming blocks to via a CARv2 ReadWrite blockstore wrapper.
 	if proposal.Piece.TransferType != storagemarket.TTManual {
-		tmp, err := p.fs.CreateTemp()
+		var err error
+		path, err = p.createInboundCAR()
 		if err != nil {
-			return xerrors.Errorf("failed to create an empty temp CARv2 file: %w", err)
-		}
-		if err := tmp.Close(); err != nil {
-			_ = os.Remove(string(tmp.OsPath()))
-			return xerrors.Errorf("failed to close temp file: %w", err)
+			return err
 		}
-		path = string(tmp.OsPath())
 	}
 
 	deal := &storagemarket.MinerDeal{
@@ -298,6 +457,7 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 		FastRetrieval:      proposal.FastRetrieval,
 		CreationTime:       curTime(),
 		InboundCAR:         path,
+		ReusePiece:         proposal.ReusePiece,
 	}
 
 	err = p.deals.Begin(proposalNd.Cid(), deal)
@@ -311,8 +471,143 @@ func (p *Provider) receiveDeal(s network.StorageDealStream) error {
 	return p.deals.Send(proposalNd.Cid(), storagemarket.ProviderEventOpen)
 }
 
+// dryRunDeal checks a proposal the same way a real proposal is checked, and
+// responds with whether the deal would be accepted. No deal is started, the
+// peer is not tagged and no staging space is reserved.
+//
+// The proposal for a dry run is not signed, so there is no client signature
+// to verify. The response is for the CID of the unsigned proposal.
+func (p *Provider) dryRunDeal(s network.StorageDealStream, proposal network.Proposal) error {
+	ctx := context.TODO()
+	proposalNd, err := cborutil.AsIpld(proposal.DryRunProposal)
+	if err != nil {
+		return err
+	}
+	proposalCid := proposalNd.Cid()
+
+	deal := storagemarket.MinerDeal{
+		Client:             s.RemotePeer(),
+		Miner:              p.net.ID(),
+		ClientDealProposal: market.ClientDealProposal{Proposal: *proposal.DryRunProposal},
+		ProposalCid:        proposalCid,
+		State:              storagemarket.StorageDealUnknown,
+		Ref:                proposal.Piece,
+		FastRetrieval:      proposal.FastRetrieval,
+		CreationTime:       curTime(),
+	}
+
+	resp := &network.Response{State: storagemarket.StorageDealProposalAccepted, Proposal: proposalCid}
+	env := &providerDealEnvironment{p}
+	if p.isDraining() {
+		resp.State = storagemarket.StorageDealProposalRejected
+		resp.Message = errDraining.Error()
+	} else if err := providerstates.CheckDealProposal(ctx, env, deal); err != nil {
+		resp.State = storagemarket.StorageDealProposalRejected
+		resp.Message = xerrors.Errorf("deal rejected: %w", err).Error()
+	} else {
+		accept, reason, err := env.RunCustomDecisionLogic(ctx, deal)
+		if err != nil {
+			resp.State = storagemarket.StorageDealProposalRejected
+			resp.Message = xerrors.Errorf("deal rejected: custom deal decision logic failed: %w", err).Error()
+		} else if !accept {
+			resp.State = storagemarket.StorageDealProposalRejected
+			resp.Message = xerrors.Errorf("deal rejected: %s", reason).Error()
+		}
+	}
+	log.Infow("dry run of deal proposal", "proposalCid", proposalCid, "client", s.RemotePeer(), "state", storagemarket.DealStates[resp.State], "message", resp.Message)
+
+	return p.respond(s, resp)
+}
+
+// errDraining is the reason given to clients for rejecting a proposal while
+// the provider is draining
+var errDraining = xerrors.New("deal rejected: provider is draining in-flight deals and not accepting new deals")
+
+// SetDraining turns drain mode on or off. While draining, the provider
+// rejects new deal proposals and publishes an ask that has expired, so that
+// in-flight deals can finish before the provider is restarted. Drain mode
+// is not persisted.
+func (p *Provider) SetDraining(draining bool) error {
+	p.drainLk.Lock()
+	defer p.drainLk.Unlock()
+
+	if err := p.storedAsk.SetUnavailable(draining); err != nil {
+		return xerrors.Errorf("publishing ask: %w", err)
+	}
+	p.draining = draining
+	log.Infow("set drain mode", "draining", draining)
+	return nil
+}
+
+// DrainStatus reports whether the provider is draining, and how many deals
+// have not been handed off to the sealing subsystem yet. An operator can
+// restart the provider once that number reaches zero.
+func (p *Provider) DrainStatus() (storagemarket.DrainStatus, error) {
+	var deals []storagemarket.MinerDeal
+	if err := p.deals.List(&deals); err != nil {
+		return storagemarket.DrainStatus{}, err
+	}
+
+	status := storagemarket.DrainStatus{Draining: p.isDraining()}
+	for _, deal := range deals {
+		for _, state := range providerstates.StatesBeforeStaged {
+			if state == deal.State {
+				status.DealsBeforeStaged++
+				break
+			}
+		}
+	}
+	return status, nil
+}
+
+func (p *Provider) isDraining() bool {
+	p.drainLk.RLock()
+	defer p.drainLk.RUnlock()
+	return p.draining
+}
+
+// runInBackground runs a task in a goroutine until the context is cancelled
+// when the provider stops
+func (p *Provider) runInBackground(ctx context.Context, task func(ctx context.Context)) {
+	p.bgWg.Add(1)
+	go func() {
+		defer p.bgWg.Done()
+		task(ctx)
+	}()
+}
+
+// runShardGC garbage collects the DAG store at the shard GC interval until
+// the context is cancelled
+func (p *Provider) runShardGC(ctx context.Context) {
+	ticker := time.NewTicker(p.shardGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := p.dagStore.GC(ctx)
+		if err != nil {
+			log.Warnf("garbage collecting DAG store: %s", err)
+			continue
+		}
+		for key, err := range res.Shards {
+			if err != nil {
+				log.Warnf("garbage collecting DAG store shard %s: %s", key, err)
+			}
+		}
+		log.Debugw("garbage collected DAG store", "shards", len(res.Shards))
+	}
+}
+
 // Stop terminates processing of deals on a StorageProvider
 func (p *Provider) Stop() error {
+	if p.stopBackground != nil {
+		p.stopBackground()
+		p.bgWg.Wait()
+	}
 	p.readyMgr.Stop()
 	p.unsubDataTransfer()
 	err := p.deals.Stop(context.TODO())
@@ -322,11 +617,38 @@ func (p *Provider) Stop() error {
 	return p.net.StopHandlingRequests()
 }
 
+// createInboundCAR creates the empty file that the CARv2 read-write
+// blockstore for the data of a deal is written to. The blockstore can only
+// write to a local file, so if the file store is not on the local file
+// system, the file is created in the OS temp directory.
+func (p *Provider) createInboundCAR() (string, error) {
+	if _, ok := p.fs.(filestore.NonLocalFileStore); ok {
+		tmp, err := ioutil.TempFile("", "fstmp")
+		if err != nil {
+			return "", xerrors.Errorf("failed to create an empty temp CARv2 file: %w", err)
+		}
+		if err := tmp.Close(); err != nil {
+			_ = os.Remove(tmp.Name())
+			return "", xerrors.Errorf("failed to close temp file: %w", err)
+		}
+		return tmp.Name(), nil
+	}
+
+	tmp, err := p.fs.CreateTemp()
+	if err != nil {
+		return "", xerrors.Errorf("failed to create an empty temp CARv2 file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(string(tmp.OsPath()))
+		return "", xerrors.Errorf("failed to close temp file: %w", err)
+	}
+	return string(tmp.OsPath()), nil
+}
+
 // ImportDataForDeal manually imports data for an offline storage deal
 // It will verify that the data in the passed io.Reader matches the expected piece
 // cid for the given deal or it will error
 func (p *Provider) ImportDataForDeal(ctx context.Context, propCid cid.Cid, data io.Reader) error {
-	// TODO: be able to check if we have enough disk space
 	var d storagemarket.MinerDeal
 	if err := p.deals.Get(propCid).Get(&d); err != nil {
 		return xerrors.Errorf("failed getting deal %s: %w", propCid, err)
@@ -342,6 +664,15 @@ func (p *Provider) ImportDataForDeal(ctx context.Context, propCid cid.Cid, data
 		_ = p.fs.Delete(tempfi.Path())
 	}
 
+	// Check that there is enough space for the data, if the file store
+	// accounts for space
+	if reserver, ok := p.fs.(filestore.SpaceReserver); ok {
+		if err := reserver.Reserve(tempfi.OsPath(), int64(d.Proposal.PieceSize)); err != nil {
+			cleanup()
+			return xerrors.Errorf("failed to reserve space for imported data: %w", err)
+		}
+	}
+
 	log.Debugw("will copy imported file to local file", "propCid", propCid)
 	n, err := io.Copy(tempfi, data)
 	if err != nil {
@@ -455,6 +786,37 @@ func (p *Provider) RetryDealPublishing(propcid cid.Cid) error {
 	return p.deals.Send(propcid, storagemarket.ProviderEventRestart)
 }
 
+// ListHandoffRetries lists deals waiting to retry the hand-off to the
+// sealing subsystem
+func (p *Provider) ListHandoffRetries() ([]storagemarket.MinerDeal, error) {
+	var out []storagemarket.MinerDeal
+	if err := p.deals.List(&out); err != nil {
+		return nil, err
+	}
+
+	retries := make([]storagemarket.MinerDeal, 0)
+	for _, deal := range out {
+		if deal.State == storagemarket.StorageDealAwaitingHandoffRetry {
+			retries = append(retries, deal)
+		}
+	}
+	return retries, nil
+}
+
+// RetryHandoff hands a deal waiting for a hand-off retry to the sealing
+// subsystem right away, instead of waiting for the next scheduled attempt
+func (p *Provider) RetryHandoff(propCid cid.Cid) error {
+	var deal storagemarket.MinerDeal
+	if err := p.deals.Get(propCid).Get(&deal); err != nil {
+		return xerrors.Errorf("getting deal %s: %w", propCid, err)
+	}
+	if deal.State != storagemarket.StorageDealAwaitingHandoffRetry {
+		return xerrors.Errorf("deal %s is in state %s, not waiting for a hand-off retry",
+			propCid, storagemarket.DealStates[deal.State])
+	}
+	return p.deals.Send(propCid, storagemarket.ProviderEventDealHandoffRetry, deal.HandoffAttempts)
+}
+
 func (p *Provider) LocalDealCount() (int, error) {
 	var out []storagemarket.MinerDeal
 	if err := p.deals.List(&out); err != nil {
@@ -635,6 +997,76 @@ func (p *Provider) HandleAskStream(s network.StorageAskStream) {
 	}
 }
 
+/*
+HandleCapabilitiesStream is called by the network implementation whenever a new message is received on the capabilities protocol
+
+A Provider handling a `CapabilitiesRequest` does the following:
+
+1. Builds its capabilities from its configuration and the current storage ask
+
+2. Signs the capabilities with its private key
+
+3. Wraps the signed capabilities in a CapabilitiesResponse and writes it on the StorageCapabilitiesStream
+
+The connection is kept open only as long as the request-response exchange.
+*/
+func (p *Provider) HandleCapabilitiesStream(s network.StorageCapabilitiesStream) {
+	ctx := context.TODO()
+	defer s.Close()
+	request, err := s.ReadCapabilitiesRequest()
+	if err != nil {
+		log.Errorf("failed to read CapabilitiesRequest from incoming stream: %s", err)
+		return
+	}
+
+	var resp network.CapabilitiesResponse
+	if p.actor != request.Miner {
+		log.Warnf("storage provider for address %s receive capabilities request for miner with address %s", p.actor, request.Miner)
+	} else {
+		signed, err := p.signedCapabilities(ctx)
+		if err != nil {
+			log.Errorf("failed to sign capabilities: %s", err)
+			return
+		}
+		resp.Capabilities = signed
+	}
+
+	if err := s.WriteCapabilitiesResponse(resp); err != nil {
+		log.Errorf("failed to write capabilities response: %s", err)
+		return
+	}
+}
+
+// capabilities returns the deals the provider can accept
+func (p *Provider) capabilities() storagemarket.StorageCapabilities {
+	caps := storagemarket.StorageCapabilities{
+		Miner:         p.actor,
+		TransferTypes: p.transferTypes,
+		VerifiedDeals: p.verifiedDeals,
+		DealProtocols: []string{storagemarket.DryRunDealProtocolID, storagemarket.DealProtocolID, storagemarket.OldDealProtocolID},
+	}
+	if ask := p.storedAsk.GetAsk(); ask != nil {
+		caps.MinPieceSize = ask.Ask.MinPieceSize
+		caps.MaxPieceSize = ask.Ask.MaxPieceSize
+	}
+	return caps
+}
+
+func (p *Provider) signedCapabilities(ctx context.Context) (*storagemarket.SignedStorageCapabilities, error) {
+	_, height, err := p.spn.GetChainHead(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't get chain head: %w", err)
+	}
+
+	caps := p.capabilities()
+	caps.Timestamp = height
+	sig, err := p.sign(ctx, &caps)
+	if err != nil {
+		return nil, err
+	}
+	return &storagemarket.SignedStorageCapabilities{Capabilities: &caps, Signature: sig}, nil
+}
+
 /*
 HandleDealStatusStream is called by the network implementation whenever a new message is received on the deal status protocol
 
@@ -751,6 +1183,9 @@ func (p *Provider) dispatch(eventName fsm.EventName, deal fsm.StateType) {
 	if !ok {
 		log.Errorf("not a MinerDeal %v", deal)
 	}
+	if isFinalityState(realDeal.State) {
+		p.shardLks.saved(realDeal.ProposalCid)
+	}
 	pubSubEvt := internalProviderEvent{evt, realDeal}
 
 	log.Debugw("process storage provider listeners", "name", storagemarket.ProviderEvents[evt], "proposal cid", realDeal.ProposalCid)
@@ -770,6 +1205,10 @@ func (p *Provider) start(ctx context.Context) error {
 		return err
 	}
 
+	// The file store only keeps reservations in memory, so reserve staging
+	// space again for the data of deals that are still in flight
+	p.reserveStagingSpace(deals)
+
 	// Fire restart event on all active deals
 	if err := p.restartDeals(deals); err != nil {
 		return fmt.Errorf("failed to restart deals: %w", err)
@@ -841,6 +1280,27 @@ func (p *Provider) restartDeals(deals []storagemarket.MinerDeal) error {
 	return nil
 }
 
+// reserveStagingSpace reserves space in the file store for the inbound CAR
+// files of the deals that have not ended
+func (p *Provider) reserveStagingSpace(deals []storagemarket.MinerDeal) {
+	reserver, ok := p.fs.(filestore.SpaceReserver)
+	if !ok {
+		return
+	}
+	for _, deal := range deals {
+		if p.deals.IsTerminated(deal) || deal.InboundCAR == "" {
+			continue
+		}
+		if _, err := os.Stat(deal.InboundCAR); err != nil {
+			// The CAR file has already been cleaned up
+			continue
+		}
+		if err := reserver.Reserve(filestore.OsPath(deal.InboundCAR), int64(deal.Proposal.PieceSize)); err != nil {
+			log.Warnf("failed to reserve staging space for deal %s, car_path=%s: %s", deal.ProposalCid, deal.InboundCAR, err)
+		}
+	}
+}
+
 func (p *Provider) sign(ctx context.Context, data interface{}) (*crypto.Signature, error) {
 	tok, _, err := p.spn.GetChainHead(ctx)
 	if err != nil {
@@ -851,7 +1311,11 @@ func (p *Provider) sign(ctx context.Context, data interface{}) (*crypto.Signatur
 }
 
 func (p *Provider) resendProposalResponse(s network.StorageDealStream, md *storagemarket.MinerDeal) error {
-	resp := &network.Response{State: md.State, Message: md.Message, Proposal: md.ProposalCid}
+	return p.respond(s, &network.Response{State: md.State, Message: md.Message, Proposal: md.ProposalCid})
+}
+
+// respond writes a signed response to a deal proposal and closes the stream
+func (p *Provider) respond(s network.StorageDealStream, resp *network.Response) error {
 	sig, err := p.sign(context.TODO(), resp)
 	if err != nil {
 		return xerrors.Errorf("failed to sign response message: %w", err)
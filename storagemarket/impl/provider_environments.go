@@ -1,8 +1,12 @@
 package storageimpl
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"time"
 
@@ -34,6 +38,15 @@ type providerDealEnvironment struct {
 }
 
 func (p *providerDealEnvironment) RegisterShard(ctx context.Context, pieceCid cid.Cid, carPath string, eagerInit bool) error {
+	// The DAG store can only initialize a shard from a local CAR file, so a
+	// shard for a file that is not local is fetched from the sector when it
+	// is first accessed
+	if _, ok := p.storePath(carPath); ok {
+		carPath, eagerInit = "", false
+	}
+
+	unlock := p.p.shardLks.lock(pieceCid)
+	defer unlock()
 	return stores.RegisterShardSync(ctx, p.p.dagStore, pieceCid, carPath, eagerInit)
 }
 
@@ -63,8 +76,187 @@ func (p *providerDealEnvironment) RemoveIndex(ctx context.Context, proposalCid c
 	return err
 }
 
+// DestroyUnusedShard removes the shard for a deal's piece from the DAG store
+// once the deal has expired or been slashed, unless another deal that is
+// still active uses the same piece. It returns the proposal CIDs of the
+// deals that keep the shard. The check and the destroy hold the piece's
+// shard lock, and the deal is no longer counted as active from then on, so
+// that when several deals for a piece end together the last one to be
+// checked destroys the shard.
+func (p *providerDealEnvironment) DestroyUnusedShard(ctx context.Context, deal storagemarket.MinerDeal) ([]cid.Cid, error) {
+	pieceCid := deal.Proposal.PieceCID
+	unlock := p.p.shardLks.lock(pieceCid)
+	defer unlock()
+
+	p.p.shardLks.finish(deal.ProposalCid)
+	active, err := p.activeDealsForPiece(pieceCid)
+	if err != nil {
+		return nil, err
+	}
+	if len(active) > 0 {
+		return active, nil
+	}
+	return nil, stores.DestroyShardSync(ctx, p.p.dagStore, pieceCid)
+}
+
+// activeDealsForPiece returns the proposal CIDs of the deals for a piece that
+// have not yet expired, been slashed or failed
+func (p *providerDealEnvironment) activeDealsForPiece(pieceCid cid.Cid) ([]cid.Cid, error) {
+	deals, err := p.p.ListLocalDeals()
+	if err != nil {
+		return nil, xerrors.Errorf("listing deals: %w", err)
+	}
+
+	var active []cid.Cid
+	for _, d := range deals {
+		if !d.Proposal.PieceCID.Equals(pieceCid) {
+			continue
+		}
+		if isFinalityState(d.State) || d.State == storagemarket.StorageDealFailing || d.State == storagemarket.StorageDealRejecting {
+			continue
+		}
+		if p.p.shardLks.isFinished(d.ProposalCid) {
+			continue
+		}
+		active = append(active, d.ProposalCid)
+	}
+	return active, nil
+}
+
+// StageHeldPiece writes the data for a deal to its inbound CAR file from a
+// copy of the deal's piece that the provider already holds, instead of
+// transferring it from the client. The piece is only read from the source
+// set with the HeldPieceData option, and the bytes of the piece are copied
+// as they are. The staged data is checked against the deal's piece CID
+// before it is used. It returns false if the piece is not held.
+func (p *providerDealEnvironment) StageHeldPiece(ctx context.Context, deal storagemarket.MinerDeal) (bool, error) {
+	if p.p.heldPieceData == nil {
+		return false, nil
+	}
+
+	rd, err := p.p.heldPieceData(ctx, deal.Proposal.PieceCID)
+	if err != nil {
+		if stores.IsNotFound(err) {
+			return false, nil
+		}
+		return false, xerrors.Errorf("failed to read held piece %s: %w", deal.Proposal.PieceCID, err)
+	}
+	defer func() {
+		if err := rd.Close(); err != nil {
+			log.Warnf("failed to close held piece reader, pieceCid=%s: %s", deal.Proposal.PieceCID, err)
+		}
+	}()
+
+	v1, err := ioutil.TempFile("", "reusedpiece")
+	if err != nil {
+		return false, xerrors.Errorf("failed to create temp CARv1 file: %w", err)
+	}
+	defer func() { _ = os.Remove(v1.Name()) }()
+
+	if err := copyCARv1(v1, rd); err != nil {
+		_ = v1.Close()
+		return false, xerrors.Errorf("failed to copy CARv1 payload of piece %s: %w", deal.Proposal.PieceCID, err)
+	}
+	if err := v1.Close(); err != nil {
+		return false, xerrors.Errorf("failed to close temp CARv1 file: %w", err)
+	}
+
+	if err := carv2.WrapV1File(v1.Name(), deal.InboundCAR); err != nil {
+		// leave an empty file, so the data can still be transferred to it
+		_ = os.Truncate(deal.InboundCAR, 0)
+		return false, xerrors.Errorf("failed to write CARv2 file, car_path=%s: %w", deal.InboundCAR, err)
+	}
+
+	// Only tell the client it doesn't need to send the data once we know
+	// the staged data matches the deal
+	pieceCid, _, err := p.GeneratePieceCommitment(deal.ProposalCid, deal.InboundCAR, deal.Proposal.PieceSize)
+	if err == nil && !pieceCid.Equals(deal.Proposal.PieceCID) {
+		err = xerrors.Errorf("staged data has piece CID %s, expected %s", pieceCid, deal.Proposal.PieceCID)
+	}
+	if err != nil {
+		_ = os.Truncate(deal.InboundCAR, 0)
+		return false, xerrors.Errorf("failed to verify staged data for piece %s: %w", deal.Proposal.PieceCID, err)
+	}
+	return true, nil
+}
+
+// copyCARv1 copies the CARv1 payload at the start of a piece. An unsealed
+// piece is padded with zeros after the payload, which reads as a section of
+// zero length.
+func copyCARv1(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var lenBuf [binary.MaxVarintLen64]byte
+	for header := true; ; header = false {
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF && !header {
+			return nil
+		}
+		if err != nil {
+			return xerrors.Errorf("reading section length: %w", err)
+		}
+		if l == 0 {
+			if header {
+				return xerrors.New("CARv1 header is empty")
+			}
+			return nil
+		}
+
+		n := binary.PutUvarint(lenBuf[:], l)
+		if _, err := w.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, br, int64(l)); err != nil {
+			return xerrors.Errorf("copying section: %w", err)
+		}
+	}
+}
+
+func isFinalityState(state storagemarket.StorageDealStatus) bool {
+	for _, s := range providerstates.ProviderFinalityStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *providerDealEnvironment) ReadCAR(path string) (*carv2.Reader, error) {
-	return carv2.OpenReader(path)
+	return p.openCAR(path)
+}
+
+// storePath returns the path in the file store of a file that is not on the
+// local file system, given its OS path
+func (p *providerDealEnvironment) storePath(path string) (filestore.Path, bool) {
+	if p.p == nil {
+		return "", false
+	}
+	nl, ok := p.p.fs.(filestore.NonLocalFileStore)
+	if !ok {
+		return "", false
+	}
+	return nl.PathFor(filestore.OsPath(path))
+}
+
+// openCAR opens a CAR file. Files in a file store that is not on the local
+// file system, such as an object store, are read through the file store.
+func (p *providerDealEnvironment) openCAR(path string) (*carv2.Reader, error) {
+	fp, ok := p.storePath(path)
+	if !ok {
+		return carv2.OpenReader(path)
+	}
+
+	f, err := p.p.fs.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	// Reading through the ReaderAt does not keep anything open, so the file
+	// does not need to be closed with the reader
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		_ = f.Close()
+		return nil, xerrors.Errorf("file %s does not support random access reads", path)
+	}
+	return carv2.NewReader(ra)
 }
 
 func (p *providerDealEnvironment) FinalizeBlockstore(proposalCid cid.Cid) error {
@@ -92,7 +284,15 @@ func (p *providerDealEnvironment) TerminateBlockstore(proposalCid cid.Cid, path
 
 	// delete the backing CARv2 file as it was a temporary file we created for
 	// this storage deal; the piece has now been handed off, or the deal has failed.
-	if err := os.Remove(path); err != nil {
+	if fp, ok := p.storePath(path); ok {
+		if err := p.p.fs.Delete(fp); err != nil {
+			log.Warnf("failed to delete carv2 file on termination, car_path=%s: %s", path, err)
+		}
+		return nil
+	}
+	// the CAR may have been opened as a filestore, which keeps its
+	// positional mappings in a datastore next to it
+	if err := stores.RemoveFilestore(path); err != nil {
 		log.Warnf("failed to delete carv2 file on termination, car_path=%s: %s", path, err)
 	}
 
@@ -107,6 +307,10 @@ func (p *providerDealEnvironment) Node() storagemarket.StorageProviderNode {
 	return p.p.spn
 }
 
+func (p *providerDealEnvironment) Capabilities() storagemarket.StorageCapabilities {
+	return p.p.capabilities()
+}
+
 func (p *providerDealEnvironment) Ask() storagemarket.StorageAsk {
 	sask := p.p.storedAsk.GetAsk()
 	if sask == nil {
@@ -118,7 +322,7 @@ func (p *providerDealEnvironment) Ask() storagemarket.StorageAsk {
 // GeneratePieceCommitment generates the pieceCid for the CARv1 deal payload in
 // the CARv2 file that already exists at the given path.
 func (p *providerDealEnvironment) GeneratePieceCommitment(proposalCid cid.Cid, carPath string, dealSize abi.PaddedPieceSize) (c cid.Cid, path filestore.Path, finalErr error) {
-	rd, err := carv2.OpenReader(carPath)
+	rd, err := p.openCAR(carPath)
 	if err != nil {
 		return cid.Undef, "", xerrors.Errorf("failed to get CARv2 reader, proposalCid=%s, carPath=%s: %w", proposalCid, carPath, err)
 	}
@@ -192,6 +396,18 @@ func (p *providerDealEnvironment) UntagPeer(id peer.ID, s string) {
 	p.p.net.UntagPeer(id, s)
 }
 
+func (p *providerDealEnvironment) HandoffRetryPolicy() providerstates.HandoffRetryPolicy {
+	return p.p.handoffRetryPolicy
+}
+
+func (p *providerDealEnvironment) ConfirmationDepth() abi.ChainEpoch {
+	return p.p.confirmationDepth
+}
+
+func (p *providerDealEnvironment) PollingInterval() time.Duration {
+	return p.p.pollingInterval
+}
+
 func (p *providerDealEnvironment) AwaitRestartTimeout() <-chan time.Time {
 	timer := time.NewTimer(p.p.awaitTransferRestartTimeout)
 	return timer.C
@@ -1,16 +1,31 @@
 package storageimpl
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	carv2 "github.com/ipld/go-car/v2"
 	"github.com/stretchr/testify/require"
 
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	versioning "github.com/filecoin-project/go-ds-versioning/pkg"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-statemachine/fsm"
 
+	"github.com/filecoin-project/go-fil-markets/filestore"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/migrations"
+	"github.com/filecoin-project/go-fil-markets/stores"
 )
 
 func TestGeneratePieceCommitment(t *testing.T) {
@@ -42,6 +57,225 @@ func TestGeneratePieceCommitment(t *testing.T) {
 	require.Equal(t, cid.Undef, pieceCid)
 }
 
+func TestObjectStoreCARFiles(t *testing.T) {
+	ctx := context.Background()
+	pieceSize := abi.PaddedPieceSize(32768)
+
+	_, carV2File := shared_testutil.CreateDenseCARv2(t, filepath.Join(shared_testutil.ThisDir(t), "../fixtures/payload.txt"))
+	defer os.Remove(carV2File)
+	carBytes, err := ioutil.ReadFile(carV2File)
+	require.NoError(t, err)
+
+	// Copy the CAR file to an object store
+	objects := shared_testutil.NewTestObjectStore("staging")
+	fs, err := filestore.NewObjectFileStore(objects, filestore.KeyPrefix("deals/"))
+	require.NoError(t, err)
+	f, err := fs.Create("deal.car")
+	require.NoError(t, err)
+	_, err = f.Write(carBytes)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	carPath := string(f.OsPath())
+	require.Equal(t, "mem://staging/deals/deal.car", carPath)
+
+	dagStore := shared_testutil.NewMockDagStoreWrapper(nil, nil)
+	env := &providerDealEnvironment{p: &Provider{fs: fs, stores: stores.NewReadWriteBlockstores(), dagStore: dagStore}}
+
+	// The CAR file is read through the object store
+	pieceCid, _, err := env.GeneratePieceCommitment(cid.Cid{}, carPath, pieceSize)
+	require.NoError(t, err)
+	require.Equal(t, genProviderCommP(t, carV2File, pieceSize), pieceCid)
+
+	rd, err := env.ReadCAR(carPath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), rd.Version)
+	require.NoError(t, rd.Close())
+
+	// The DAG store cannot read the CAR file, so the shard is registered
+	// without it
+	require.NoError(t, env.RegisterShard(ctx, pieceCid, carPath, true))
+	reg, ok := dagStore.GetRegistration(pieceCid)
+	require.True(t, ok)
+	require.Equal(t, "", reg.CarPath)
+	require.False(t, reg.EagerInit)
+
+	// Terminating the blockstore deletes the object
+	require.NoError(t, env.TerminateBlockstore(cid.Cid{}, carPath))
+	_, ok = objects.Object("deals/deal.car")
+	require.False(t, ok)
+}
+
+func TestStageHeldPiece(t *testing.T) {
+	ctx := context.Background()
+	pieceSize := abi.PaddedPieceSize(32768)
+
+	_, carV2File := shared_testutil.CreateDenseCARv2(t, filepath.Join(shared_testutil.ThisDir(t), "../fixtures/payload.txt"))
+	defer os.Remove(carV2File)
+	pieceCid := genProviderCommP(t, carV2File, pieceSize)
+
+	// An unsealed piece is the CARv1 payload padded with zeros
+	rd, err := carv2.OpenReader(carV2File)
+	require.NoError(t, err)
+	payload, err := ioutil.ReadAll(rd.DataReader())
+	require.NoError(t, err)
+	require.NoError(t, rd.Close())
+	piece := append(payload, make([]byte, int(pieceSize.Unpadded())-len(payload))...)
+
+	source := func(ctx context.Context, c cid.Cid) (io.ReadCloser, error) {
+		if !c.Equals(pieceCid) {
+			return nil, stores.ErrNotFound
+		}
+		return ioutil.NopCloser(bytes.NewReader(piece)), nil
+	}
+	env := &providerDealEnvironment{p: &Provider{heldPieceData: source}}
+
+	stage := func(t *testing.T, c cid.Cid) (storagemarket.MinerDeal, bool, error) {
+		var deal storagemarket.MinerDeal
+		deal.Proposal.PieceCID = c
+		deal.Proposal.PieceSize = pieceSize
+		deal.InboundCAR = filepath.Join(t.TempDir(), "inbound.car")
+		require.NoError(t, ioutil.WriteFile(deal.InboundCAR, nil, 0644))
+		reused, err := env.StageHeldPiece(ctx, deal)
+		return deal, reused, err
+	}
+
+	t.Run("piece is held", func(t *testing.T) {
+		deal, reused, err := stage(t, pieceCid)
+		require.NoError(t, err)
+		require.True(t, reused)
+		require.Equal(t, pieceCid, genProviderCommP(t, deal.InboundCAR, pieceSize))
+	})
+
+	t.Run("piece is not held", func(t *testing.T) {
+		_, reused, err := stage(t, shared_testutil.GenerateCids(1)[0])
+		require.NoError(t, err)
+		require.False(t, reused)
+	})
+
+	t.Run("held data does not match piece CID", func(t *testing.T) {
+		// The source returns data for a different piece
+		other := shared_testutil.GenerateCids(1)[0]
+		env.p.heldPieceData = func(ctx context.Context, c cid.Cid) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(piece)), nil
+		}
+		defer func() { env.p.heldPieceData = source }()
+
+		deal, reused, err := stage(t, other)
+		require.Error(t, err)
+		require.False(t, reused)
+
+		// The inbound CAR file is left empty for the data transfer
+		fi, err := os.Stat(deal.InboundCAR)
+		require.NoError(t, err)
+		require.Zero(t, fi.Size())
+	})
+
+	t.Run("held pieces are not reused by default", func(t *testing.T) {
+		env := &providerDealEnvironment{p: &Provider{}}
+		reused, err := env.StageHeldPiece(ctx, storagemarket.MinerDeal{})
+		require.NoError(t, err)
+		require.False(t, reused)
+	})
+}
+
+func TestDestroyUnusedShard(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	namespaced := shared_testutil.DatastoreAtVersion(t, ds, "1")
+
+	pieceCid := shared_testutil.GenerateCids(1)[0]
+	makeDeal := func(dealID abi.DealID) storagemarket.MinerDeal {
+		proposal := shared_testutil.MakeTestClientDealProposal()
+		proposal.Proposal.PieceCID = pieceCid
+		proposalNd, err := cborutil.AsIpld(proposal)
+		require.NoError(t, err)
+		deal := storagemarket.MinerDeal{
+			ClientDealProposal: *proposal,
+			ProposalCid:        proposalNd.Cid(),
+			State:              storagemarket.StorageDealActive,
+			DealID:             dealID,
+		}
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, deal.MarshalCBOR(buf))
+		require.NoError(t, namespaced.Put(ctx, datastore.NewKey(deal.ProposalCid.String()), buf.Bytes()))
+		return deal
+	}
+	deals := []storagemarket.MinerDeal{makeDeal(1), makeDeal(2)}
+
+	dagStore := shared_testutil.NewMockDagStoreWrapper(nil, nil)
+	require.NoError(t, stores.RegisterShardSync(ctx, dagStore, pieceCid, "", false))
+
+	p := &Provider{dagStore: dagStore}
+	env := &providerDealEnvironment{p}
+	storageMigrations, err := migrations.ProviderMigrations.Build()
+	require.NoError(t, err)
+	var migrate func(context.Context) error
+	p.deals, migrate, err = newProviderStateMachine(ds, env, func(fsm.EventName, fsm.StateType) {}, storageMigrations, versioning.VersionKey("1"))
+	require.NoError(t, err)
+	require.NoError(t, migrate(ctx))
+
+	// Both deals end at the same time, before either final state is saved.
+	// The deal that is checked last destroys the shard.
+	var wg sync.WaitGroup
+	kept := make([][]cid.Cid, len(deals))
+	errs := make([]error, len(deals))
+	for i, deal := range deals {
+		wg.Add(1)
+		go func(i int, deal storagemarket.MinerDeal) {
+			defer wg.Done()
+			kept[i], errs[i] = env.DestroyUnusedShard(ctx, deal)
+		}(i, deal)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 0, dagStore.LenRegistrations())
+	if len(kept[0]) > 0 {
+		require.Equal(t, []cid.Cid{deals[1].ProposalCid}, kept[0])
+		require.Empty(t, kept[1])
+	} else {
+		require.Equal(t, []cid.Cid{deals[0].ProposalCid}, kept[1])
+	}
+}
+
+func TestReserveStagingSpace(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := filestore.NewMultiFileStore([]filestore.Root{{Path: filestore.OsPath(dir)}})
+	require.NoError(t, err)
+
+	makeDeal := func(name string, state storagemarket.StorageDealStatus) storagemarket.MinerDeal {
+		proposal := shared_testutil.MakeTestClientDealProposal()
+		proposal.Proposal.PieceSize = 1024
+		deal := storagemarket.MinerDeal{
+			ClientDealProposal: *proposal,
+			State:              state,
+			InboundCAR:         filepath.Join(dir, name),
+		}
+		require.NoError(t, ioutil.WriteFile(deal.InboundCAR, make([]byte, 100), 0644))
+		return deal
+	}
+	inFlight := makeDeal("inflight.car", storagemarket.StorageDealTransferring)
+	failed := makeDeal("failed.car", storagemarket.StorageDealError)
+	cleanedUp := makeDeal("cleanedup.car", storagemarket.StorageDealFinalizing)
+	require.NoError(t, os.Remove(cleanedUp.InboundCAR))
+
+	p := &Provider{fs: fs}
+	storageMigrations, err := migrations.ProviderMigrations.Build()
+	require.NoError(t, err)
+	p.deals, _, err = newProviderStateMachine(dssync.MutexWrap(datastore.NewMapDatastore()), &providerDealEnvironment{p}, func(fsm.EventName, fsm.StateType) {}, storageMigrations, versioning.VersionKey("1"))
+	require.NoError(t, err)
+
+	// Only the deal that is still in flight gets space reserved for its
+	// data to grow into
+	p.reserveStagingSpace([]storagemarket.MinerDeal{inFlight, failed, cleanedUp})
+	u, err := fs.Usage()
+	require.NoError(t, err)
+	require.Equal(t, int64(1024-100), u.Reserved)
+}
+
 func genProviderCommP(t *testing.T, carv2 string, pieceSize abi.PaddedPieceSize) cid.Cid {
 	env := &providerDealEnvironment{}
 	pieceCid, _, err := env.GeneratePieceCommitment(cid.Cid{}, carv2, pieceSize)
@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/exp/rand"
+	"golang.org/x/xerrors"
 
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/go-state-types/abi"
@@ -20,6 +21,8 @@ import (
 	"github.com/filecoin-project/specs-actors/actors/builtin/market"
 
 	"github.com/filecoin-project/go-fil-markets/filestore"
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	storageimpl "github.com/filecoin-project/go-fil-markets/storagemarket/impl"
@@ -218,6 +221,45 @@ func TestProvider_Migrations(t *testing.T) {
 	require.Equal(t, thirdDeal.ProposalCid, listedDeals[0].ProposalCid)
 }
 
+func TestProviderPieceStoreCompaction(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	deps := dependencies.NewDependenciesWithTestData(t, ctx, shared_testutil.NewLibp2pTestData(ctx, t), testnodes.NewStorageMarketState(), "",
+		noOpDelay, noOpDelay)
+
+	// A piece whose only deal was removed
+	pieceCid := shared_testutil.GenerateCids(1)[0]
+	require.NoError(t, deps.PieceStore.AddDealForPiece(pieceCid, piecestore.DealInfo{DealID: 1}))
+	require.NoError(t, deps.PieceStore.RemoveDealForPiece(pieceCid, 1))
+	_, err := deps.PieceStore.GetPieceInfo(pieceCid)
+	require.NoError(t, err)
+
+	provider, err := storageimpl.NewProvider(
+		network.NewFromLibp2pHost(deps.TestData.Host2, network.RetryParameters(0, 0, 0, 0)),
+		namespace.Wrap(deps.TestData.Ds1, datastore.NewKey("/deals/provider")),
+		deps.Fs,
+		deps.DagStore,
+		shared_testutil.NewMockIndexProvider(),
+		deps.PieceStore,
+		deps.DTProvider,
+		deps.ProviderNode,
+		deps.ProviderAddr,
+		deps.StoredAsk,
+		&testharness.MeshCreatorStub{},
+		storageimpl.PieceStoreCompaction(10*time.Millisecond),
+	)
+	require.NoError(t, err)
+	shared_testutil.StartAndWaitForReady(ctx, t, provider)
+
+	// The provider compacts the piece store in the background
+	require.Eventually(t, func() bool {
+		_, err := deps.PieceStore.GetPieceInfo(pieceCid)
+		return xerrors.Is(err, retrievalmarket.ErrNotFound)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, provider.Stop())
+}
+
 func TestHandleDealStream(t *testing.T) {
 	t.Run("handles cases where the proposal is already being tracked", func(t *testing.T) {
 
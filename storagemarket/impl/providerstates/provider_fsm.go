@@ -2,14 +2,17 @@ package providerstates
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/specs-actors/actors/builtin/market"
 
 	"github.com/filecoin-project/go-fil-markets/filestore"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
@@ -29,12 +32,21 @@ var ProviderEvents = fsm.Events{
 			deal.Message = xerrors.Errorf("deal rejected: %w", err).Error()
 			return nil
 		}),
+	fsm.Event(storagemarket.ProviderEventDealCounterOffered).
+		From(storagemarket.StorageDealValidating).To(storagemarket.StorageDealRejecting).
+		Action(func(deal *storagemarket.MinerDeal, counterOffer market.DealProposal, err error) error {
+			deal.Message = xerrors.Errorf("deal rejected: %w", err).Error()
+			deal.CounterOffer = &counterOffer
+			return nil
+		}),
 	fsm.Event(storagemarket.ProviderEventRejectionSent).
 		From(storagemarket.StorageDealRejecting).To(storagemarket.StorageDealFailing),
 	fsm.Event(storagemarket.ProviderEventDealDeciding).
 		From(storagemarket.StorageDealValidating).To(storagemarket.StorageDealAcceptWait),
 	fsm.Event(storagemarket.ProviderEventDataRequested).
 		From(storagemarket.StorageDealAcceptWait).To(storagemarket.StorageDealWaitingForData),
+	fsm.Event(storagemarket.ProviderEventPieceReused).
+		From(storagemarket.StorageDealAcceptWait).To(storagemarket.StorageDealVerifyData),
 
 	fsm.Event(storagemarket.ProviderEventDataTransferFailed).
 		FromMany(storagemarket.StorageDealTransferring, storagemarket.StorageDealProviderTransferAwaitRestart).
@@ -116,7 +128,7 @@ var ProviderEvents = fsm.Events{
 			return nil
 		}),
 	fsm.Event(storagemarket.ProviderEventDealPublishError).
-		From(storagemarket.StorageDealPublishing).To(storagemarket.StorageDealFailing).
+		FromMany(storagemarket.StorageDealPublishing, storagemarket.StorageDealPublishConfirming).To(storagemarket.StorageDealFailing).
 		Action(func(deal *storagemarket.MinerDeal, err error) error {
 			deal.Message = xerrors.Errorf("PublishStorageDeal error: %w", err).Error()
 			return nil
@@ -127,11 +139,27 @@ var ProviderEvents = fsm.Events{
 			deal.Message = xerrors.Errorf("sending response to deal: %w", err).Error()
 			return nil
 		}),
+	fsm.Event(storagemarket.ProviderEventDealPublishIncluded).
+		From(storagemarket.StorageDealPublishing).To(storagemarket.StorageDealPublishConfirming).
+		Action(func(deal *storagemarket.MinerDeal, dealID abi.DealID, finalCid cid.Cid) error {
+			deal.DealID = dealID
+			deal.PublishCid = &finalCid
+			return nil
+		}),
+	fsm.Event(storagemarket.ProviderEventDealPublishReorged).
+		From(storagemarket.StorageDealPublishConfirming).To(storagemarket.StorageDealPublish).
+		Action(func(deal *storagemarket.MinerDeal) error {
+			deal.Message = fmt.Sprintf("publish message %s was reorged out, publishing deal again", deal.PublishCid)
+			deal.DealID = 0
+			deal.PublishCid = nil
+			return nil
+		}),
 	fsm.Event(storagemarket.ProviderEventDealPublished).
-		From(storagemarket.StorageDealPublishing).To(storagemarket.StorageDealStaged).
+		FromMany(storagemarket.StorageDealPublishing, storagemarket.StorageDealPublishConfirming).To(storagemarket.StorageDealStaged).
 		Action(func(deal *storagemarket.MinerDeal, dealID abi.DealID, finalCid cid.Cid) error {
 			deal.DealID = dealID
 			deal.PublishCid = &finalCid
+			deal.Message = ""
 			return nil
 		}),
 	fsm.Event(storagemarket.ProviderEventFileStoreErrored).
@@ -152,6 +180,25 @@ var ProviderEvents = fsm.Events{
 			deal.Message = xerrors.Errorf("handing off deal to node: %w", err).Error()
 			return nil
 		}),
+	fsm.Event(storagemarket.ProviderEventDealHandoffRetryScheduled).
+		From(storagemarket.StorageDealStaged).To(storagemarket.StorageDealAwaitingHandoffRetry).
+		Action(func(deal *storagemarket.MinerDeal, err error, firstFailure time.Time, nextRetry time.Time) error {
+			deal.HandoffAttempts++
+			deal.HandoffFirstFailure = cbg.CborTime(firstFailure)
+			deal.NextHandoffRetry = cbg.CborTime(nextRetry)
+			deal.Message = xerrors.Errorf("handing off deal to node, retrying at %s: %w", nextRetry.Format(time.RFC3339), err).Error()
+			return nil
+		}),
+	fsm.Event(storagemarket.ProviderEventDealHandoffRetry).
+		From(storagemarket.StorageDealAwaitingHandoffRetry).To(storagemarket.StorageDealStaged).
+		Action(func(deal *storagemarket.MinerDeal, attempts uint64) error {
+			// a retry scheduled before the deal was retried by hand is stale
+			if attempts != deal.HandoffAttempts {
+				return xerrors.Errorf("stale hand-off retry after %d attempts, deal has %d", attempts, deal.HandoffAttempts)
+			}
+			deal.Message = ""
+			return nil
+		}),
 	fsm.Event(storagemarket.ProviderEventPieceStoreErrored).
 		From(storagemarket.StorageDealStaged).ToJustRecord().
 		Action(func(deal *storagemarket.MinerDeal, err error) error {
@@ -240,7 +287,7 @@ var ProviderEvents = fsm.Events{
 			return nil
 		}),
 	fsm.Event(storagemarket.ProviderEventFundsReleased).
-		FromMany(storagemarket.StorageDealPublishing, storagemarket.StorageDealFailing).ToJustRecord().
+		FromMany(storagemarket.StorageDealPublishing, storagemarket.StorageDealPublishConfirming, storagemarket.StorageDealFailing).ToJustRecord().
 		Action(func(deal *storagemarket.MinerDeal, fundsReleased abi.TokenAmount) error {
 			deal.FundsReserved = big.Subtract(deal.FundsReserved, fundsReleased)
 			return nil
@@ -257,7 +304,9 @@ var ProviderStateEntryFuncs = fsm.StateEntryFuncs{
 	storagemarket.StorageDealProviderFunding:              WaitForFunding,
 	storagemarket.StorageDealPublish:                      PublishDeal,
 	storagemarket.StorageDealPublishing:                   WaitForPublish,
+	storagemarket.StorageDealPublishConfirming:            ConfirmDealPublished,
 	storagemarket.StorageDealStaged:                       HandoffDeal,
+	storagemarket.StorageDealAwaitingHandoffRetry:         WaitForHandoffRetry,
 	storagemarket.StorageDealAwaitingPreCommit:            VerifyDealPreCommitted,
 	storagemarket.StorageDealSealing:                      VerifyDealActivated,
 	storagemarket.StorageDealRejecting:                    RejectDeal,
@@ -274,6 +323,23 @@ var ProviderFinalityStates = []fsm.StateKey{
 	storagemarket.StorageDealExpired,
 }
 
+// StatesBeforeStaged are the states of a deal that has not been handed off to
+// the sealing subsystem yet
+var StatesBeforeStaged = []fsm.StateKey{
+	storagemarket.StorageDealUnknown,
+	storagemarket.StorageDealValidating,
+	storagemarket.StorageDealAcceptWait,
+	storagemarket.StorageDealWaitingForData,
+	storagemarket.StorageDealTransferring,
+	storagemarket.StorageDealProviderTransferAwaitRestart,
+	storagemarket.StorageDealVerifyData,
+	storagemarket.StorageDealReserveProviderFunds,
+	storagemarket.StorageDealProviderFunding,
+	storagemarket.StorageDealPublish,
+	storagemarket.StorageDealPublishing,
+	storagemarket.StorageDealPublishConfirming,
+}
+
 // StatesKnownBySealingSubsystem are the states on the happy path after hand-off to
 // the sealing subsystem
 var StatesKnownBySealingSubsystem = []fsm.StateKey{
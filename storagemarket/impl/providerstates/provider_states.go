@@ -17,6 +17,7 @@ import (
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/filecoin-project/go-statemachine/fsm"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
 	"github.com/filecoin-project/specs-actors/actors/builtin/market"
 	market2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/market"
 	"github.com/filecoin-project/specs-actors/v2/actors/builtin/miner"
@@ -34,6 +35,36 @@ var log = logging.Logger("providerstates")
 // TODO: These are copied from spec-actors master, use spec-actors exports when we update
 const DealMaxLabelSize = 256
 
+// CounterOfferStartDelay is the number of epochs after the current epoch that
+// a counter-offer moves the start of a deal to, when the start epoch of the
+// proposal has already elapsed
+const CounterOfferStartDelay = abi.ChainEpoch(2 * builtin.EpochsInDay)
+
+// HandoffRetryPolicy sets how the provider retries handing off a deal to the
+// sealing subsystem when the sealing subsystem is unavailable
+type HandoffRetryPolicy struct {
+	// MinBackoff is the wait before the first retry. The wait doubles with
+	// each failed attempt, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAge is how long after the first failed attempt the provider gives
+	// up and fails the deal
+	MaxAge time.Duration
+}
+
+// Backoff returns the wait before the next attempt, after the given number
+// of failed attempts
+func (hrp HandoffRetryPolicy) Backoff(attempts uint64) time.Duration {
+	backoff := hrp.MinBackoff
+	for i := uint64(1); i < attempts && backoff < hrp.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > hrp.MaxBackoff {
+		backoff = hrp.MaxBackoff
+	}
+	return backoff
+}
+
 // ProviderDealEnvironment are the dependencies needed for processing deals
 // with a ProviderStateEntryFunc
 type ProviderDealEnvironment interface {
@@ -42,6 +73,8 @@ type ProviderDealEnvironment interface {
 	RegisterShard(ctx context.Context, pieceCid cid.Cid, path string, eagerInit bool) error
 	AnnounceIndex(ctx context.Context, deal storagemarket.MinerDeal) (cid.Cid, error)
 	RemoveIndex(ctx context.Context, proposalCid cid.Cid) error
+	DestroyUnusedShard(ctx context.Context, deal storagemarket.MinerDeal) ([]cid.Cid, error)
+	StageHeldPiece(ctx context.Context, deal storagemarket.MinerDeal) (bool, error)
 
 	FinalizeBlockstore(proposalCid cid.Cid) error
 	TerminateBlockstore(proposalCid cid.Cid, path string) error
@@ -51,132 +84,231 @@ type ProviderDealEnvironment interface {
 	Address() address.Address
 	Node() storagemarket.StorageProviderNode
 	Ask() storagemarket.StorageAsk
+	Capabilities() storagemarket.StorageCapabilities
 	SendSignedResponse(ctx context.Context, response *network.Response) error
 	Disconnect(proposalCid cid.Cid) error
 	FileStore() filestore.FileStore
 	PieceStore() piecestore.PieceStore
 	RunCustomDecisionLogic(context.Context, storagemarket.MinerDeal) (bool, string, error)
 	AwaitRestartTimeout() <-chan time.Time
+	HandoffRetryPolicy() HandoffRetryPolicy
+	ConfirmationDepth() abi.ChainEpoch
+	PollingInterval() time.Duration
 	network.PeerTagger
 }
 
 // ProviderStateEntryFunc is the signature for a StateEntryFunc in the provider FSM
 type ProviderStateEntryFunc func(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error
 
-// ValidateDealProposal validates a proposed deal against the provider criteria
-func ValidateDealProposal(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
-	environment.TagPeer(deal.Client, deal.ProposalCid.String())
-
-	tok, curEpoch, err := environment.Node().GetChainHead(ctx.Context())
+// CheckDealProposal checks a proposed deal against the provider criteria. It
+// has no side effects, so it can also check a proposal for a dry run. It
+// does not verify the client's signature, because dry run proposals are not
+// signed.
+func CheckDealProposal(ctx context.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
+	tok, curEpoch, err := environment.Node().GetChainHead(ctx)
 	if err != nil {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("node error getting most recent state id: %w", err))
+		return xerrors.Errorf("node error getting most recent state id: %w", err)
 	}
 
-	if err := providerutils.VerifyProposal(ctx.Context(), deal.ClientDealProposal, tok, environment.Node().VerifySignature); err != nil {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("verifying StorageDealProposal: %w", err))
-	}
+	return checkDealTerms(ctx, environment, deal.Proposal, deal.Ref, tok, curEpoch)
+}
+
+// negotiableError is returned when a deal is rejected because of its price,
+// collateral or start epoch, which the provider can make a counter-offer on
+type negotiableError struct {
+	error
+}
 
-	proposal := deal.Proposal
+// checkDealTerms checks the terms of a deal proposal, without checking the
+// client signature
+func checkDealTerms(ctx context.Context, environment ProviderDealEnvironment, proposal market.DealProposal, ref *storagemarket.DataRef, tok shared.TipSetToken, curEpoch abi.ChainEpoch) error {
 
 	if proposal.Provider != environment.Address() {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("incorrect provider for deal"))
+		return xerrors.Errorf("incorrect provider for deal")
 	}
 
 	if len(proposal.Label) > DealMaxLabelSize {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("deal label can be at most %d bytes, is %d", DealMaxLabelSize, len(proposal.Label)))
+		return xerrors.Errorf("deal label can be at most %d bytes, is %d", DealMaxLabelSize, len(proposal.Label))
 	}
 
 	if err := proposal.PieceSize.Validate(); err != nil {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("proposal piece size is invalid: %w", err))
+		return xerrors.Errorf("proposal piece size is invalid: %w", err)
 	}
 
 	if !proposal.PieceCID.Defined() {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("proposal PieceCID undefined"))
+		return xerrors.Errorf("proposal PieceCID undefined")
 	}
 
 	if proposal.PieceCID.Prefix() != market.PieceCIDPrefix {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("proposal PieceCID had wrong prefix"))
+		return xerrors.Errorf("proposal PieceCID had wrong prefix")
 	}
 
 	if proposal.EndEpoch <= proposal.StartEpoch {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("proposal end before proposal start"))
+		return xerrors.Errorf("proposal end before proposal start")
 	}
 
 	if curEpoch > proposal.StartEpoch {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("deal start epoch has already elapsed"))
+		return negotiableError{xerrors.Errorf("deal start epoch has already elapsed")}
 	}
 
 	// Check that the delta between the start and end epochs (the deal
 	// duration) is within acceptable bounds
 	minDuration, maxDuration := market2.DealDurationBounds(proposal.PieceSize)
 	if proposal.Duration() < minDuration || proposal.Duration() > maxDuration {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("deal duration out of bounds (min, max, provided): %d, %d, %d", minDuration, maxDuration, proposal.Duration()))
+		return xerrors.Errorf("deal duration out of bounds (min, max, provided): %d, %d, %d", minDuration, maxDuration, proposal.Duration())
 	}
 
 	// Check that the proposed end epoch isn't too far beyond the current epoch
 	maxEndEpoch := curEpoch + miner.MaxSectorExpirationExtension
 	if proposal.EndEpoch > maxEndEpoch {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("invalid deal end epoch %d: cannot be more than %d past current epoch %d", proposal.EndEpoch, miner.MaxSectorExpirationExtension, curEpoch))
+		return xerrors.Errorf("invalid deal end epoch %d: cannot be more than %d past current epoch %d", proposal.EndEpoch, miner.MaxSectorExpirationExtension, curEpoch)
 	}
 
-	pcMin, pcMax, err := environment.Node().DealProviderCollateralBounds(ctx.Context(), proposal.PieceSize, proposal.VerifiedDeal)
+	pcMin, pcMax, err := environment.Node().DealProviderCollateralBounds(ctx, proposal.PieceSize, proposal.VerifiedDeal)
 	if err != nil {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("node error getting collateral bounds: %w", err))
+		return xerrors.Errorf("node error getting collateral bounds: %w", err)
 	}
 
 	if proposal.ProviderCollateral.LessThan(pcMin) {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("proposed provider collateral below minimum: %s < %s", proposal.ProviderCollateral, pcMin))
+		return negotiableError{xerrors.Errorf("proposed provider collateral below minimum: %s < %s", proposal.ProviderCollateral, pcMin)}
 	}
 
 	if proposal.ProviderCollateral.GreaterThan(pcMax) {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("proposed provider collateral above maximum: %s > %s", proposal.ProviderCollateral, pcMax))
+		return negotiableError{xerrors.Errorf("proposed provider collateral above maximum: %s > %s", proposal.ProviderCollateral, pcMax)}
 	}
 
-	askPrice := environment.Ask().Price
-	if deal.Proposal.VerifiedDeal {
-		askPrice = environment.Ask().VerifiedPrice
-	}
-
-	minPrice := big.Div(big.Mul(askPrice, abi.NewTokenAmount(int64(proposal.PieceSize))), abi.NewTokenAmount(1<<30))
+	minPrice := minStoragePrice(environment, proposal)
 	if proposal.StoragePricePerEpoch.LessThan(minPrice) {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected,
-			xerrors.Errorf("storage price per epoch less than asking price: %s < %s", proposal.StoragePricePerEpoch, minPrice))
+		return negotiableError{xerrors.Errorf("storage price per epoch less than asking price: %s < %s", proposal.StoragePricePerEpoch, minPrice)}
 	}
 
 	if proposal.PieceSize < environment.Ask().MinPieceSize {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected,
-			xerrors.Errorf("piece size less than minimum required size: %d < %d", proposal.PieceSize, environment.Ask().MinPieceSize))
+		return xerrors.Errorf("piece size less than minimum required size: %d < %d", proposal.PieceSize, environment.Ask().MinPieceSize)
 	}
 
 	if proposal.PieceSize > environment.Ask().MaxPieceSize {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected,
-			xerrors.Errorf("piece size more than maximum allowed size: %d > %d", proposal.PieceSize, environment.Ask().MaxPieceSize))
+		return xerrors.Errorf("piece size more than maximum allowed size: %d > %d", proposal.PieceSize, environment.Ask().MaxPieceSize)
+	}
+
+	// Check the deal against the capabilities the provider advertises
+	transferType := ""
+	if ref != nil {
+		transferType = ref.TransferType
+	}
+	capabilities := environment.Capabilities()
+	if err := capabilities.CheckProposal(transferType, proposal.PieceSize, proposal.VerifiedDeal); err != nil {
+		return xerrors.Errorf("deal not supported by provider: %w", err)
 	}
 
 	// check market funds
-	clientMarketBalance, err := environment.Node().GetBalance(ctx.Context(), proposal.Client, tok)
+	clientMarketBalance, err := environment.Node().GetBalance(ctx, proposal.Client, tok)
 	if err != nil {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("node error getting client market balance failed: %w", err))
+		return xerrors.Errorf("node error getting client market balance failed: %w", err)
 	}
 
 	// This doesn't guarantee that the client won't withdraw / lock those funds
 	// but it's a decent first filter
 	if clientMarketBalance.Available.LessThan(proposal.ClientBalanceRequirement()) {
-		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("clientMarketBalance.Available too small: %d < %d", clientMarketBalance.Available, proposal.ClientBalanceRequirement()))
+		return xerrors.Errorf("clientMarketBalance.Available too small: %d < %d", clientMarketBalance.Available, proposal.ClientBalanceRequirement())
 	}
 
 	// Verified deal checks
 	if proposal.VerifiedDeal {
-		dataCap, err := environment.Node().GetDataCap(ctx.Context(), proposal.Client, tok)
+		dataCap, err := environment.Node().GetDataCap(ctx, proposal.Client, tok)
 		if err != nil {
-			return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("node error fetching verified data cap: %w", err))
+			return xerrors.Errorf("node error fetching verified data cap: %w", err)
 		}
 		if dataCap == nil {
-			return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("node error fetching verified data cap: data cap missing -- client not verified"))
+			return xerrors.Errorf("node error fetching verified data cap: data cap missing -- client not verified")
 		}
 		pieceSize := big.NewIntUnsigned(uint64(proposal.PieceSize))
 		if dataCap.LessThan(pieceSize) {
-			return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("verified deal DataCap too small for proposed piece size"))
+			return xerrors.Errorf("verified deal DataCap too small for proposed piece size")
+		}
+	}
+
+	return nil
+}
+
+// minStoragePrice returns the lowest price per epoch the provider asks for
+// the proposed deal
+func minStoragePrice(environment ProviderDealEnvironment, proposal market.DealProposal) abi.TokenAmount {
+	askPrice := environment.Ask().Price
+	if proposal.VerifiedDeal {
+		askPrice = environment.Ask().VerifiedPrice
+	}
+
+	return big.Div(big.Mul(askPrice, abi.NewTokenAmount(int64(proposal.PieceSize))), abi.NewTokenAmount(1<<30))
+}
+
+// counterOffer adjusts the price, provider collateral and epochs of a deal
+// proposal to terms the provider accepts. It returns false if the proposal
+// would still be rejected with the adjusted terms.
+func counterOffer(ctx context.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) (market.DealProposal, bool) {
+	tok, curEpoch, err := environment.Node().GetChainHead(ctx)
+	if err != nil {
+		log.Warnf("getting chain head for counter-offer: %s", err)
+		return market.DealProposal{}, false
+	}
+
+	counter := deal.Proposal
+	if curEpoch > counter.StartEpoch {
+		delay := curEpoch + CounterOfferStartDelay - counter.StartEpoch
+		counter.StartEpoch += delay
+		counter.EndEpoch += delay
+	}
+
+	pcMin, pcMax, err := environment.Node().DealProviderCollateralBounds(ctx, counter.PieceSize, counter.VerifiedDeal)
+	if err != nil {
+		log.Warnf("getting collateral bounds for counter-offer: %s", err)
+		return market.DealProposal{}, false
+	}
+	if counter.ProviderCollateral.LessThan(pcMin) {
+		counter.ProviderCollateral = pcMin
+	}
+	if counter.ProviderCollateral.GreaterThan(pcMax) {
+		counter.ProviderCollateral = pcMax
+	}
+
+	if minPrice := minStoragePrice(environment, counter); counter.StoragePricePerEpoch.LessThan(minPrice) {
+		counter.StoragePricePerEpoch = minPrice
+	}
+
+	if err := checkDealTerms(ctx, environment, counter, deal.Ref, tok, curEpoch); err != nil {
+		log.Infof("not making counter-offer for deal %s: %s", deal.ProposalCid, err)
+		return market.DealProposal{}, false
+	}
+	return counter, true
+}
+
+// ValidateDealProposal validates a proposed deal against the provider criteria
+func ValidateDealProposal(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
+	environment.TagPeer(deal.Client, deal.ProposalCid.String())
+
+	tok, _, err := environment.Node().GetChainHead(ctx.Context())
+	if err != nil {
+		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("node error getting most recent state id: %w", err))
+	}
+
+	if err := providerutils.VerifyProposal(ctx.Context(), deal.ClientDealProposal, tok, environment.Node().VerifySignature); err != nil {
+		return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("verifying StorageDealProposal: %w", err))
+	}
+
+	if err := CheckDealProposal(ctx.Context(), environment, deal); err != nil {
+		if _, ok := err.(negotiableError); ok {
+			if counter, ok := counterOffer(ctx.Context(), environment, deal); ok {
+				return ctx.Trigger(storagemarket.ProviderEventDealCounterOffered, counter, err)
+			}
+		}
+		return ctx.Trigger(storagemarket.ProviderEventDealRejected, err)
+	}
+
+	// Reserve space in the file store for the deal data to be transferred
+	// into. The padded piece size is more than the size of the CAR data, and
+	// leaves room for the index of the CARv2 file.
+	if reserver, ok := environment.FileStore().(filestore.SpaceReserver); ok && deal.InboundCAR != "" {
+		if err := reserver.Reserve(filestore.OsPath(deal.InboundCAR), int64(deal.Proposal.PieceSize)); err != nil {
+			return ctx.Trigger(storagemarket.ProviderEventDealRejected, xerrors.Errorf("not enough staging space for deal data: %w", err))
 		}
 	}
 
@@ -195,9 +327,34 @@ func DecideOnProposal(ctx fsm.Context, environment ProviderDealEnvironment, deal
 		return ctx.Trigger(storagemarket.ProviderEventDealRejected, fmt.Errorf(reason))
 	}
 
+	// If the client agreed, skip the transfer when we already hold the piece.
+	// Staging the piece copies the whole piece, so it is done in the
+	// background, and the client gets its response once it is done.
+	if deal.ReusePiece && deal.InboundCAR != "" {
+		go func() {
+			reused, err := environment.StageHeldPiece(ctx.Context(), deal)
+			if err != nil {
+				log.Warnf("failed to stage deal data from held piece, requesting transfer instead, proposalCid=%s: %s", deal.ProposalCid, err)
+			}
+			_ = acceptProposal(ctx, environment, deal, reused)
+		}()
+		return nil
+	}
+
+	return acceptProposal(ctx, environment, deal, false)
+}
+
+// acceptProposal tells the client the deal has been accepted, and whether
+// the provider needs the deal data or staged it from a piece it holds
+func acceptProposal(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal, reused bool) error {
+	state := storagemarket.StorageDealWaitingForData
+	if reused {
+		state = storagemarket.StorageDealVerifyData
+	}
+
 	// Send intent to accept
-	err = environment.SendSignedResponse(ctx.Context(), &network.Response{
-		State:    storagemarket.StorageDealWaitingForData,
+	err := environment.SendSignedResponse(ctx.Context(), &network.Response{
+		State:    state,
 		Proposal: deal.ProposalCid,
 	})
 
@@ -209,6 +366,9 @@ func DecideOnProposal(ctx fsm.Context, environment ProviderDealEnvironment, deal
 		log.Warnf("closing client connection: %+v", err)
 	}
 
+	if reused {
+		return ctx.Trigger(storagemarket.ProviderEventPieceReused)
+	}
 	return ctx.Trigger(storagemarket.ProviderEventDataRequested)
 }
 
@@ -323,6 +483,12 @@ func WaitForPublish(ctx fsm.Context, environment ProviderDealEnvironment, deal s
 		return ctx.Trigger(storagemarket.ProviderEventDealPublishError, xerrors.Errorf("PublishStorageDeals errored: %w", err))
 	}
 
+	// With a confirmation depth, funds stay reserved until the publish
+	// message is confirmed, in case a reorg means it must be published again
+	if environment.ConfirmationDepth() > 0 {
+		return ctx.Trigger(storagemarket.ProviderEventDealPublishIncluded, res.DealID, res.FinalCid)
+	}
+
 	// Once the deal has been published, release funds that were reserved
 	// for deal publishing
 	releaseReservedFunds(ctx, environment, deal)
@@ -330,6 +496,100 @@ func WaitForPublish(ctx fsm.Context, environment ProviderDealEnvironment, deal s
 	return ctx.Trigger(storagemarket.ProviderEventDealPublished, res.DealID, res.FinalCid)
 }
 
+// ConfirmDealPublished waits for the publish message to reach the
+// confirmation depth, and then checks the publish result again. If a chain
+// reorg removed the publish message and it is not included again, the deal
+// goes back to be published again.
+func ConfirmDealPublished(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
+	go func() {
+		confirmed, err := awaitPublishConfirmed(ctx.Context(), environment, deal)
+		if ctx.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			_ = ctx.Trigger(storagemarket.ProviderEventDealPublishError, err)
+			return
+		}
+		if !confirmed {
+			log.Warnw("deal publish message was reorged out", "proposalCid", deal.ProposalCid, "publishCid", deal.PublishCid)
+			_ = ctx.Trigger(storagemarket.ProviderEventDealPublishReorged)
+			return
+		}
+
+		res, err := environment.Node().WaitForPublishDeals(ctx.Context(), *deal.PublishCid, deal.Proposal)
+		if err != nil {
+			_ = ctx.Trigger(storagemarket.ProviderEventDealPublishError, xerrors.Errorf("PublishStorageDeals errored: %w", err))
+			return
+		}
+		if res.DealID != deal.DealID {
+			log.Warnw("deal ID changed while confirming publish message", "proposalCid", deal.ProposalCid,
+				"oldDealID", deal.DealID, "dealID", res.DealID)
+		}
+
+		releaseReservedFunds(ctx, environment, deal)
+
+		_ = ctx.Trigger(storagemarket.ProviderEventDealPublished, res.DealID, res.FinalCid)
+	}()
+	return nil
+}
+
+// awaitPublishConfirmed polls the chain until the deal's publish message is
+// the confirmation depth deep. It returns false if the message was reorged
+// out and has not been included again.
+//
+// A message that is reorged out usually goes back to the message pool and is
+// included again in a later tipset, so the message is only given up on once
+// it has been missing while the chain advanced by the confirmation depth.
+// Publishing the deal again before that risks publishing it twice.
+func awaitPublishConfirmed(ctx context.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) (bool, error) {
+	// missingSince is the chain head epoch when the message was found to be
+	// missing, or -1 while it is on chain
+	missingSince := abi.ChainEpoch(-1)
+	for {
+		epoch, found, err := environment.Node().MessageInclusionEpoch(ctx, *deal.PublishCid)
+		if err != nil {
+			return false, xerrors.Errorf("looking up publish message: %w", err)
+		}
+
+		_, head, err := environment.Node().GetChainHead(ctx)
+		switch {
+		case err != nil:
+			log.Warnf("getting chain head: %s", err)
+		case found:
+			missingSince = -1
+			if head >= epoch+environment.ConfirmationDepth() {
+				return true, nil
+			}
+		default:
+			if missingSince < 0 {
+				log.Infow("deal publish message is not on chain, waiting for it to be included again",
+					"proposalCid", deal.ProposalCid, "publishCid", deal.PublishCid, "epoch", head)
+				missingSince = head
+			}
+			if head >= missingSince+environment.ConfirmationDepth() {
+				return false, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(environment.PollingInterval()):
+		}
+	}
+}
+
+// isConfirmed checks whether the chain head is at least the confirmation
+// depth past the given epoch
+func isConfirmed(ctx context.Context, environment ProviderDealEnvironment, epoch abi.ChainEpoch) bool {
+	_, head, err := environment.Node().GetChainHead(ctx)
+	if err != nil {
+		log.Warnf("getting chain head: %s", err)
+		return false
+	}
+	return head >= epoch+environment.ConfirmationDepth()
+}
+
 // HandoffDeal hands off a published deal for sealing and commitment in a sector
 func HandoffDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
 	var packingInfo *storagemarket.PackingResult
@@ -353,7 +613,7 @@ func HandoffDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal stor
 
 		if err != nil {
 			err = xerrors.Errorf("packing piece at path %s: %w", deal.PiecePath, err)
-			return ctx.Trigger(storagemarket.ProviderEventDealHandoffFailed, err)
+			return retryHandoff(ctx, environment, deal, err)
 		}
 	} else {
 		carFilePath = deal.InboundCAR
@@ -375,11 +635,11 @@ func HandoffDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal stor
 		log.Infow("closed car datareader after handing off deal to sealing subsystem", "pieceCid", deal.Proposal.PieceCID, "proposalCid", deal.ProposalCid)
 		if packingErr != nil {
 			err = xerrors.Errorf("packing piece %s: %w", deal.Ref.PieceCid, packingErr)
-			return ctx.Trigger(storagemarket.ProviderEventDealHandoffFailed, err)
+			return retryHandoff(ctx, environment, deal, err)
 		}
 	}
 
-	if err := recordPiece(environment, deal, packingInfo.SectorNumber, packingInfo.Offset, packingInfo.Size); err != nil {
+	if err := RecordPiece(environment, deal, packingInfo.SectorNumber, packingInfo.Offset, packingInfo.Size); err != nil {
 		err = xerrors.Errorf("failed to register deal data for piece %s for retrieval: %w", deal.Ref.PieceCid, err)
 		log.Error(err.Error())
 		_ = ctx.Trigger(storagemarket.ProviderEventPieceStoreErrored, err)
@@ -405,6 +665,60 @@ func HandoffDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal stor
 	return ctx.Trigger(storagemarket.ProviderEventDealHandedOff)
 }
 
+// retryHandoff schedules another attempt to hand off a deal after the sealing
+// subsystem failed to accept it. It fails the deal instead once the retries
+// exceed the maximum age, or when the next attempt would come too late to
+// seal the deal before its start epoch.
+func retryHandoff(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal, handoffErr error) error {
+	policy := environment.HandoffRetryPolicy()
+	attempts := deal.HandoffAttempts + 1
+
+	now := time.Now()
+	firstFailure := now
+	if deal.HandoffAttempts > 0 {
+		firstFailure = time.Time(deal.HandoffFirstFailure)
+	}
+	if now.Sub(firstFailure) >= policy.MaxAge {
+		return ctx.Trigger(storagemarket.ProviderEventDealHandoffFailed,
+			xerrors.Errorf("giving up after %d attempts: %w", attempts, handoffErr))
+	}
+
+	backoff := policy.Backoff(attempts)
+	// if the chain head is not available, the start epoch is checked again
+	// when the next attempt fails
+	_, curEpoch, err := environment.Node().GetChainHead(ctx.Context())
+	if err != nil {
+		log.Warnw("getting chain head to check start epoch of deal", "proposalCid", deal.ProposalCid, "err", err)
+	} else {
+		retryEpoch := curEpoch + abi.ChainEpoch(backoff/(builtin.EpochDurationSeconds*time.Second))
+		if retryEpoch >= deal.Proposal.StartEpoch {
+			return ctx.Trigger(storagemarket.ProviderEventDealHandoffFailed,
+				xerrors.Errorf("start epoch %d would pass before the next attempt at epoch %d: %w",
+					deal.Proposal.StartEpoch, retryEpoch, handoffErr))
+		}
+	}
+
+	log.Warnw("handing off deal to sealing subsystem failed, scheduling retry",
+		"proposalCid", deal.ProposalCid, "attempts", attempts, "backoff", backoff, "err", handoffErr)
+	return ctx.Trigger(storagemarket.ProviderEventDealHandoffRetryScheduled, handoffErr, firstFailure, now.Add(backoff))
+}
+
+// WaitForHandoffRetry waits until the next scheduled attempt to hand off the
+// deal to the sealing subsystem
+func WaitForHandoffRetry(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
+	attempts := deal.HandoffAttempts
+	timer := time.NewTimer(time.Until(time.Time(deal.NextHandoffRetry)))
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-ctx.Context().Done():
+		case <-timer.C:
+			_ = ctx.Trigger(storagemarket.ProviderEventDealHandoffRetry, attempts)
+		}
+	}()
+	return nil
+}
+
 func handoffDeal(ctx context.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal, reader io.ReadSeeker, payloadSize uint64) (*storagemarket.PackingResult, error) {
 	// because we use the PadReader directly during Add Piece we need to produce the
 	// correct amount of zeroes
@@ -432,7 +746,9 @@ func handoffDeal(ctx context.Context, environment ProviderDealEnvironment, deal
 	)
 }
 
-func recordPiece(environment ProviderDealEnvironment, deal storagemarket.MinerDeal, sectorID abi.SectorNumber, offset, length abi.PaddedPieceSize) error {
+// RecordPiece records the location of a deal's piece in a sector, and the
+// block locations of its payload, in the piece store
+func RecordPiece(environment ProviderDealEnvironment, deal storagemarket.MinerDeal, sectorID abi.SectorNumber, offset, length abi.PaddedPieceSize) error {
 
 	var blockLocations map[cid.Cid]piecestore.BlockLocation
 	if deal.MetadataPath != filestore.Path("") {
@@ -447,10 +763,8 @@ func recordPiece(environment ProviderDealEnvironment, deal storagemarket.MinerDe
 		}
 	}
 
-	if err := environment.PieceStore().AddPieceBlockLocations(deal.Proposal.PieceCID, blockLocations); err != nil {
-		return xerrors.Errorf("failed to add piece block locations: %s", err)
-	}
-
+	// Add the deal before the block locations, so that the piece store is
+	// not compacted in between
 	err := environment.PieceStore().AddDealForPiece(deal.Proposal.PieceCID, piecestore.DealInfo{
 		DealID:   deal.DealID,
 		SectorID: sectorID,
@@ -461,6 +775,10 @@ func recordPiece(environment ProviderDealEnvironment, deal storagemarket.MinerDe
 		return xerrors.Errorf("failed to add deal for piece: %s", err)
 	}
 
+	if err := environment.PieceStore().AddPieceBlockLocations(deal.Proposal.PieceCID, blockLocations); err != nil {
+		return xerrors.Errorf("failed to add piece block locations: %s", err)
+	}
+
 	return nil
 }
 
@@ -484,6 +802,7 @@ func CleanupDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal stor
 			log.Warnf("failed to cleanup blockstore, car_path=%s: %s", deal.InboundCAR, err)
 		}
 	}
+	releaseStagingSpace(environment, deal)
 
 	return ctx.Trigger(storagemarket.ProviderEventFinalized)
 }
@@ -517,20 +836,60 @@ func VerifyDealPreCommitted(ctx fsm.Context, environment ProviderDealEnvironment
 // VerifyDealActivated verifies that a deal has been committed to a sector and activated
 func VerifyDealActivated(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
 	// TODO: consider waiting for seal to happen
+	err := awaitDealCommitted(ctx, environment, deal)
+	if err != nil {
+		return ctx.Trigger(storagemarket.ProviderEventDealActivationFailed, err)
+	}
+	return nil
+}
+
+// awaitDealCommitted waits for the deal's sector to be committed, and then
+// for the commit to be confirmed if there is a confirmation depth
+func awaitDealCommitted(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
 	cb := func(err error) {
-		if err != nil {
+		switch {
+		case err != nil:
 			_ = ctx.Trigger(storagemarket.ProviderEventDealActivationFailed, err)
-		} else {
+		case environment.ConfirmationDepth() > 0:
+			go confirmDealActivated(ctx, environment, deal)
+		default:
 			_ = ctx.Trigger(storagemarket.ProviderEventDealActivated)
 		}
 	}
 
-	err := environment.Node().OnDealSectorCommitted(ctx.Context(), deal.Proposal.Provider, deal.DealID, deal.SectorNumber, deal.Proposal, deal.PublishCid, cb)
+	return environment.Node().OnDealSectorCommitted(ctx.Context(), deal.Proposal.Provider, deal.DealID, deal.SectorNumber, deal.Proposal, deal.PublishCid, cb)
+}
 
-	if err != nil {
-		return ctx.Trigger(storagemarket.ProviderEventDealActivationFailed, err)
+// confirmDealActivated waits for the chain to advance by the confirmation
+// depth past the epoch the deal's sector was committed at. If the commit is
+// no longer on chain, eg after a reorg, it waits for the sector to be
+// committed again.
+func confirmDealActivated(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) {
+	for {
+		committedEpoch, active, err := environment.Node().DealActivationEpoch(ctx.Context(), deal.DealID)
+		if err != nil {
+			_ = ctx.Trigger(storagemarket.ProviderEventDealActivationFailed, xerrors.Errorf("getting deal activation epoch: %w", err))
+			return
+		}
+		if !active {
+			log.Warnw("deal sector commit is no longer on chain, waiting for sector to be committed again",
+				"proposalCid", deal.ProposalCid, "dealID", deal.DealID, "sectorNumber", deal.SectorNumber)
+			if err := awaitDealCommitted(ctx, environment, deal); err != nil {
+				_ = ctx.Trigger(storagemarket.ProviderEventDealActivationFailed, err)
+			}
+			return
+		}
+		if isConfirmed(ctx.Context(), environment, committedEpoch) {
+			_ = ctx.Trigger(storagemarket.ProviderEventDealActivated)
+			return
+		}
+
+		select {
+		case <-ctx.Context().Done():
+			return
+		case <-time.After(environment.PollingInterval()):
+		}
 	}
-	return nil
 }
 
 // WaitForDealCompletion waits for the deal to be slashed or to expire
@@ -548,6 +907,8 @@ func WaitForDealCompletion(ctx fsm.Context, environment ProviderDealEnvironment,
 		if err != nil {
 			_ = ctx.Trigger(storagemarket.ProviderEventDealCompletionFailed, xerrors.Errorf("deal expiration err: %w", err))
 		} else {
+			removePieceStoreDeal(environment, deal)
+			destroyUnusedShard(ctx.Context(), environment, deal)
 			_ = ctx.Trigger(storagemarket.ProviderEventDealExpired)
 		}
 	}
@@ -560,6 +921,8 @@ func WaitForDealCompletion(ctx fsm.Context, environment ProviderDealEnvironment,
 		if err != nil {
 			_ = ctx.Trigger(storagemarket.ProviderEventDealCompletionFailed, xerrors.Errorf("deal slashing err: %w", err))
 		} else {
+			removePieceStoreDeal(environment, deal)
+			destroyUnusedShard(ctx.Context(), environment, deal)
 			_ = ctx.Trigger(storagemarket.ProviderEventDealSlashed, slashEpoch)
 		}
 	}
@@ -571,12 +934,37 @@ func WaitForDealCompletion(ctx fsm.Context, environment ProviderDealEnvironment,
 	return nil
 }
 
+// removePieceStoreDeal removes the deal from the piece store once the deal
+// has expired or been slashed. The piece info is removed when the piece
+// store is next compacted, if the piece has no other deals.
+func removePieceStoreDeal(environment ProviderDealEnvironment, deal storagemarket.MinerDeal) {
+	if err := environment.PieceStore().RemoveDealForPiece(deal.Proposal.PieceCID, deal.DealID); err != nil {
+		log.Warnf("deal %s: removing deal from piece store: %s", deal.ProposalCid, err)
+	}
+}
+
+// destroyUnusedShard removes the shard for the deal's piece from the DAG
+// store once the deal has expired or been slashed, unless another deal that
+// is still active uses the same piece
+func destroyUnusedShard(ctx context.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) {
+	pieceCid := deal.Proposal.PieceCID
+	active, err := environment.DestroyUnusedShard(ctx, deal)
+	if err != nil {
+		log.Warnf("deal %s: destroying shard for piece %s: %s", deal.ProposalCid, pieceCid, err)
+		return
+	}
+	if len(active) > 0 {
+		log.Infof("deal %s: keeping shard for piece %s, which is used by deal %s", deal.ProposalCid, pieceCid, active[0])
+	}
+}
+
 // RejectDeal sends a failure response before terminating a deal
 func RejectDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) error {
 	err := environment.SendSignedResponse(ctx.Context(), &network.Response{
-		State:    storagemarket.StorageDealFailing,
-		Message:  deal.Message,
-		Proposal: deal.ProposalCid,
+		State:        storagemarket.StorageDealFailing,
+		Message:      deal.Message,
+		Proposal:     deal.ProposalCid,
+		CounterOffer: deal.CounterOffer,
 	})
 
 	if err != nil {
@@ -587,6 +975,8 @@ func RejectDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal stora
 		log.Warnf("closing client connection: %+v", err)
 	}
 
+	releaseStagingSpace(environment, deal)
+
 	return ctx.Trigger(storagemarket.ProviderEventRejectionSent)
 }
 
@@ -618,12 +1008,21 @@ func FailDeal(ctx fsm.Context, environment ProviderDealEnvironment, deal storage
 			log.Warnf("error deleting store, car_path=%s: %s", deal.InboundCAR, err)
 		}
 	}
+	releaseStagingSpace(environment, deal)
 
 	releaseReservedFunds(ctx, environment, deal)
 
 	return ctx.Trigger(storagemarket.ProviderEventFailed)
 }
 
+// releaseStagingSpace releases the space reserved in the file store for the
+// deal data when the deal proposal was validated
+func releaseStagingSpace(environment ProviderDealEnvironment, deal storagemarket.MinerDeal) {
+	if reserver, ok := environment.FileStore().(filestore.SpaceReserver); ok && deal.InboundCAR != "" {
+		reserver.Release(filestore.OsPath(deal.InboundCAR))
+	}
+}
+
 func releaseReservedFunds(ctx fsm.Context, environment ProviderDealEnvironment, deal storagemarket.MinerDeal) {
 	if !deal.FundsReserved.Nil() && !deal.FundsReserved.IsZero() {
 		err := environment.Node().ReleaseFunds(ctx.Context(), deal.Proposal.Provider, deal.FundsReserved)
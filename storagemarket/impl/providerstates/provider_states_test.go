@@ -19,6 +19,7 @@ import (
 	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
@@ -72,6 +73,27 @@ func TestValidateDealProposal(t *testing.T) {
 				require.Equal(t, deal.Client, env.peerTagger.TagCalls[0])
 			},
 		},
+		"reserves staging space": {
+			dealParams: dealParams{
+				InboundCAR: "inbound.car",
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealAcceptWait, deal.State)
+				require.Equal(t, map[filestore.OsPath]int64{"inbound.car": int64(defaultPieceSize)}, env.fs.(*tut.TestFileStore).Reservations())
+			},
+		},
+		"not enough staging space": {
+			dealParams: dealParams{
+				InboundCAR: "inbound.car",
+			},
+			fileStoreParams: tut.TestFileStoreParams{
+				ReserveError: filestore.ErrInsufficientSpace,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealRejecting, deal.State)
+				require.Equal(t, "deal rejected: not enough staging space for deal data: insufficient space in file store", deal.Message)
+			},
+		},
 		"verify signature fails": {
 			nodeParams: nodeParams{
 				VerifySignatureFails: true,
@@ -106,6 +128,24 @@ func TestValidateDealProposal(t *testing.T) {
 			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
 				tut.AssertDealState(t, storagemarket.StorageDealRejecting, deal.State)
 				require.Equal(t, "deal rejected: storage price per epoch less than asking price: 5000 < 9765", deal.Message)
+				require.NotNil(t, deal.CounterOffer)
+				require.Equal(t, abi.NewTokenAmount(9765), deal.CounterOffer.StoragePricePerEpoch)
+				expected := deal.Proposal
+				expected.StoragePricePerEpoch = abi.NewTokenAmount(9765)
+				require.Equal(t, expected, *deal.CounterOffer)
+			},
+		},
+		"PricePerEpoch too low, client cannot afford asking price": {
+			nodeParams: nodeParams{
+				ClientMarketBalance: big.Mul(big.NewInt(int64(defaultEndEpoch-defaultStartEpoch)), big.NewInt(5000)),
+			},
+			dealParams: dealParams{
+				StoragePricePerEpoch: abi.NewTokenAmount(5000),
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealRejecting, deal.State)
+				require.Equal(t, "deal rejected: storage price per epoch less than asking price: 5000 < 9765", deal.Message)
+				require.Nil(t, deal.CounterOffer)
 			},
 		},
 		"PieceSize < MinPieceSize": {
@@ -195,6 +235,30 @@ func TestValidateDealProposal(t *testing.T) {
 				require.Equal(t, "deal rejected: verified deal DataCap too small for proposed piece size", deal.Message)
 			},
 		},
+		"transfer type not supported": {
+			environmentParams: environmentParams{
+				TransferTypes: []string{storagemarket.TTManual},
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealRejecting, deal.State)
+				require.Equal(t, "deal rejected: deal not supported by provider: transfer type graphsync not supported, provider supports [manual]", deal.Message)
+			},
+		},
+		"verified deals not accepted": {
+			dealParams: dealParams{
+				VerifiedDeal: true,
+			},
+			nodeParams: nodeParams{
+				DataCap: &bigDataCap,
+			},
+			environmentParams: environmentParams{
+				VerifiedDeals: storagemarket.VerifiedDealsRejected,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealRejecting, deal.State)
+				require.Equal(t, "deal rejected: deal not supported by provider: verified deals not accepted", deal.Message)
+			},
+		},
 		"label is too long": {
 			dealParams: dealParams{
 				Label: invalidLabel,
@@ -235,10 +299,14 @@ func TestValidateDealProposal(t *testing.T) {
 		"start epoch has already passed": {
 			dealParams: dealParams{
 				StartEpoch: defaultHeight - 1,
+				EndEpoch:   defaultHeight - 1 + defaultEndEpoch - defaultStartEpoch,
 			},
 			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
 				tut.AssertDealState(t, storagemarket.StorageDealRejecting, deal.State)
 				require.Equal(t, "deal rejected: deal start epoch has already elapsed", deal.Message)
+				require.NotNil(t, deal.CounterOffer)
+				require.Equal(t, defaultHeight+providerstates.CounterOfferStartDelay, deal.CounterOffer.StartEpoch)
+				require.Equal(t, deal.Proposal.Duration(), deal.CounterOffer.Duration())
 			},
 		},
 		"deal duration too short (less than 180 days)": {
@@ -331,6 +399,54 @@ func TestDecideOnProposal(t *testing.T) {
 				require.Equal(t, "sending response to deal: could not send", deal.Message)
 			},
 		},
+		"reuses held piece": {
+			dealParams: dealParams{
+				ReusePiece: true,
+				InboundCAR: "inbound.car",
+			},
+			environmentParams: environmentParams{
+				HeldPiece: true,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealVerifyData, deal.State)
+				require.Equal(t, []cid.Cid{deal.Proposal.PieceCID}, env.stagedHeldPieces)
+			},
+		},
+		"requests data when client did not agree to reuse": {
+			dealParams: dealParams{
+				InboundCAR: "inbound.car",
+			},
+			environmentParams: environmentParams{
+				HeldPiece: true,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealWaitingForData, deal.State)
+				require.Empty(t, env.stagedHeldPieces)
+			},
+		},
+		"requests data when piece is not held": {
+			dealParams: dealParams{
+				ReusePiece: true,
+				InboundCAR: "inbound.car",
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealWaitingForData, deal.State)
+			},
+		},
+		"requests data when staging held piece errors": {
+			dealParams: dealParams{
+				ReusePiece: true,
+				InboundCAR: "inbound.car",
+			},
+			environmentParams: environmentParams{
+				HeldPiece:           true,
+				StageHeldPieceError: errors.New("staged data has a different piece CID"),
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealWaitingForData, deal.State)
+				require.Empty(t, env.stagedHeldPieces)
+			},
+		},
 	}
 	for test, data := range tests {
 		t.Run(test, func(t *testing.T) {
@@ -659,6 +775,24 @@ func TestWaitForPublish(t *testing.T) {
 				require.Equal(t, "PublishStorageDeal error: PublishStorageDeals errored: wait publish err", deal.Message)
 			},
 		},
+		"succeeds, waits for confirmation depth": {
+			dealParams: dealParams{
+				ReserveFunds: true,
+			},
+			nodeParams: nodeParams{
+				PublishDealID:            expDealID,
+				WaitForMessagePublishCid: finalCid,
+			},
+			environmentParams: environmentParams{
+				ConfirmationDepth: 5,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealPublishConfirming, deal.State)
+				require.Equal(t, expDealID, deal.DealID)
+				assert.Equal(t, deal.PublishCid, &finalCid)
+				assert.Len(t, env.node.DealFunds.ReleaseCalls, 0)
+			},
+		},
 	}
 	for test, data := range tests {
 		t.Run(test, func(t *testing.T) {
@@ -667,6 +801,166 @@ func TestWaitForPublish(t *testing.T) {
 	}
 }
 
+func TestConfirmDealPublished(t *testing.T) {
+	ctx := context.Background()
+	eventProcessor, err := fsm.NewEventProcessor(storagemarket.MinerDeal{}, "State", providerstates.ProviderEvents)
+	require.NoError(t, err)
+	runConfirmDealPublished := makeExecutor(ctx, eventProcessor, providerstates.ConfirmDealPublished, storagemarket.StorageDealPublishConfirming)
+	expDealID := abi.DealID(11)
+
+	tests := map[string]struct {
+		nodeParams        nodeParams
+		dealParams        dealParams
+		environmentParams environmentParams
+		fileStoreParams   tut.TestFileStoreParams
+		pieceStoreParams  tut.TestPieceStoreParams
+		dealInspector     func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment)
+	}{
+		"succeeds at confirmation depth": {
+			dealParams: dealParams{
+				ReserveFunds: true,
+				PublishEpoch: defaultHeight - 5,
+			},
+			nodeParams: nodeParams{
+				PublishDealID: expDealID,
+			},
+			environmentParams: environmentParams{
+				ConfirmationDepth: 5,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealStaged, deal.State)
+				require.Equal(t, expDealID, deal.DealID)
+				assert.Equal(t, env.node.DealFunds.ReleaseCalls[0], deal.Proposal.ProviderBalanceRequirement())
+				assert.True(t, deal.FundsReserved.Nil() || deal.FundsReserved.IsZero())
+			},
+		},
+		"waits for confirmation depth": {
+			dealParams: dealParams{
+				PublishEpoch: defaultHeight - 2,
+			},
+			environmentParams: environmentParams{
+				ConfirmationDepth: 5,
+				PollingInterval:   time.Hour,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealPublishConfirming, deal.State)
+			},
+		},
+		"publish message reorged out": {
+			dealParams: dealParams{
+				ReserveFunds: true,
+				PublishEpoch: defaultHeight - 2,
+			},
+			environmentParams: environmentParams{
+				ConfirmationDepth:   5,
+				PollingInterval:     time.Millisecond,
+				ReorgPublishMessage: true,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealPublish, deal.State)
+				require.Nil(t, deal.PublishCid)
+				require.Equal(t, abi.DealID(0), deal.DealID)
+				require.Contains(t, deal.Message, "was reorged out, publishing deal again")
+				assert.Len(t, env.node.DealFunds.ReleaseCalls, 0)
+			},
+		},
+		"publish message included again after reorg": {
+			dealParams: dealParams{
+				ReserveFunds: true,
+				PublishEpoch: defaultHeight - 2,
+			},
+			environmentParams: environmentParams{
+				ConfirmationDepth:       5,
+				PollingInterval:         time.Millisecond,
+				ReorgPublishMessage:     true,
+				ReincludePublishMessage: true,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				// The deal waits for the new inclusion to be confirmed
+				// instead of publishing the deal again
+				tut.AssertDealState(t, storagemarket.StorageDealPublishConfirming, deal.State)
+				require.NotNil(t, deal.PublishCid)
+			},
+		},
+		"PublishStorageDeal errors at confirmation depth": {
+			dealParams: dealParams{
+				PublishEpoch: defaultHeight - 5,
+			},
+			nodeParams: nodeParams{
+				WaitForPublishDealsError: errors.New("wait publish err"),
+			},
+			environmentParams: environmentParams{
+				ConfirmationDepth: 5,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
+				require.Equal(t, "PublishStorageDeal error: PublishStorageDeals errored: wait publish err", deal.Message)
+			},
+		},
+	}
+	for test, data := range tests {
+		t.Run(test, func(t *testing.T) {
+			runConfirmDealPublished(t, data.nodeParams, data.environmentParams, data.dealParams, data.fileStoreParams, data.pieceStoreParams, data.dealInspector)
+		})
+	}
+}
+
+var handoffRetryPolicy = providerstates.HandoffRetryPolicy{
+	MinBackoff: time.Minute,
+	MaxBackoff: time.Hour,
+	MaxAge:     24 * time.Hour,
+}
+
+func TestWaitForHandoffRetry(t *testing.T) {
+	ctx := context.Background()
+	eventProcessor, err := fsm.NewEventProcessor(storagemarket.MinerDeal{}, "State", providerstates.ProviderEvents)
+	require.NoError(t, err)
+	runWaitForHandoffRetry := makeExecutor(ctx, eventProcessor, providerstates.WaitForHandoffRetry, storagemarket.StorageDealAwaitingHandoffRetry)
+	tests := map[string]struct {
+		nodeParams        nodeParams
+		dealParams        dealParams
+		environmentParams environmentParams
+		fileStoreParams   tut.TestFileStoreParams
+		pieceStoreParams  tut.TestPieceStoreParams
+		dealInspector     func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment)
+	}{
+		"retries when the next attempt is due": {
+			dealParams: dealParams{
+				HandoffAttempts:     1,
+				HandoffFirstFailure: time.Now().Add(-time.Minute),
+				NextHandoffRetry:    time.Now(),
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealStaged, deal.State)
+				require.Equal(t, "", deal.Message)
+			},
+		},
+		"waits for the next attempt": {
+			dealParams: dealParams{
+				HandoffAttempts:     1,
+				HandoffFirstFailure: time.Now(),
+				NextHandoffRetry:    time.Now().Add(time.Hour),
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealAwaitingHandoffRetry, deal.State)
+			},
+		},
+	}
+	for test, data := range tests {
+		t.Run(test, func(t *testing.T) {
+			runWaitForHandoffRetry(t, data.nodeParams, data.environmentParams, data.dealParams, data.fileStoreParams, data.pieceStoreParams, data.dealInspector)
+		})
+	}
+}
+
+func TestHandoffRetryPolicyBackoff(t *testing.T) {
+	require.Equal(t, time.Minute, handoffRetryPolicy.Backoff(1))
+	require.Equal(t, 2*time.Minute, handoffRetryPolicy.Backoff(2))
+	require.Equal(t, 32*time.Minute, handoffRetryPolicy.Backoff(6))
+	require.Equal(t, time.Hour, handoffRetryPolicy.Backoff(7))
+	require.Equal(t, time.Hour, handoffRetryPolicy.Backoff(100))
+}
+
 func TestHandoffDeal(t *testing.T) {
 	ctx := context.Background()
 	eventProcessor, err := fsm.NewEventProcessor(storagemarket.MinerDeal{}, "State", providerstates.ProviderEvents)
@@ -822,7 +1116,97 @@ func TestHandoffDeal(t *testing.T) {
 			},
 			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
 				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
-				require.Equal(t, "handing off deal to node: packing piece at path file.txt: failed building sector", deal.Message)
+				require.Equal(t, "handing off deal to node: giving up after 1 attempts: packing piece at path file.txt: failed building sector", deal.Message)
+			},
+		},
+
+		"OnDealComplete errors, retry scheduled": {
+			dealParams: dealParams{
+				PiecePath: defaultPath,
+			},
+			fileStoreParams: tut.TestFileStoreParams{
+				Files:         []filestore.File{defaultDataFile},
+				ExpectedOpens: []filestore.Path{defaultPath},
+			},
+			nodeParams: nodeParams{
+				OnDealCompleteError: errors.New("failed building sector"),
+			},
+			environmentParams: environmentParams{
+				HandoffRetryPolicy: handoffRetryPolicy,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealAwaitingHandoffRetry, deal.State)
+				require.Equal(t, uint64(1), deal.HandoffAttempts)
+				require.Equal(t, handoffRetryPolicy.MinBackoff, time.Time(deal.NextHandoffRetry).Sub(time.Time(deal.HandoffFirstFailure)))
+				require.Contains(t, deal.Message, "packing piece at path file.txt: failed building sector")
+			},
+		},
+
+		"OnDealComplete errors again, retry backs off": {
+			dealParams: dealParams{
+				PiecePath:           defaultPath,
+				HandoffAttempts:     2,
+				HandoffFirstFailure: time.Now().Add(-10 * time.Minute),
+			},
+			fileStoreParams: tut.TestFileStoreParams{
+				Files:         []filestore.File{defaultDataFile},
+				ExpectedOpens: []filestore.Path{defaultPath},
+			},
+			nodeParams: nodeParams{
+				OnDealCompleteError: errors.New("failed building sector"),
+			},
+			environmentParams: environmentParams{
+				HandoffRetryPolicy: handoffRetryPolicy,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealAwaitingHandoffRetry, deal.State)
+				require.Equal(t, uint64(3), deal.HandoffAttempts)
+				require.WithinDuration(t, time.Now().Add(4*handoffRetryPolicy.MinBackoff), time.Time(deal.NextHandoffRetry), time.Minute)
+				require.WithinDuration(t, time.Now().Add(-10*time.Minute), time.Time(deal.HandoffFirstFailure), time.Minute)
+			},
+		},
+
+		"OnDealComplete errors after retrying for too long": {
+			dealParams: dealParams{
+				PiecePath:           defaultPath,
+				HandoffAttempts:     5,
+				HandoffFirstFailure: time.Now().Add(-2 * handoffRetryPolicy.MaxAge),
+			},
+			fileStoreParams: tut.TestFileStoreParams{
+				Files:         []filestore.File{defaultDataFile},
+				ExpectedOpens: []filestore.Path{defaultPath},
+			},
+			nodeParams: nodeParams{
+				OnDealCompleteError: errors.New("failed building sector"),
+			},
+			environmentParams: environmentParams{
+				HandoffRetryPolicy: handoffRetryPolicy,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
+				require.Equal(t, "handing off deal to node: giving up after 6 attempts: packing piece at path file.txt: failed building sector", deal.Message)
+			},
+		},
+
+		"OnDealComplete errors, start epoch reached before retry": {
+			dealParams: dealParams{
+				PiecePath:  defaultPath,
+				StartEpoch: defaultHeight + 1,
+			},
+			fileStoreParams: tut.TestFileStoreParams{
+				Files:         []filestore.File{defaultDataFile},
+				ExpectedOpens: []filestore.Path{defaultPath},
+			},
+			nodeParams: nodeParams{
+				OnDealCompleteError: errors.New("failed building sector"),
+			},
+			environmentParams: environmentParams{
+				HandoffRetryPolicy: handoffRetryPolicy,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
+				require.Equal(t, fmt.Sprintf("handing off deal to node: start epoch %d would pass before the next attempt at epoch %d: packing piece at path file.txt: failed building sector",
+					defaultHeight+1, defaultHeight+2), deal.Message)
 			},
 		},
 
@@ -940,6 +1324,27 @@ func TestVerifyDealActivated(t *testing.T) {
 				tut.AssertDealState(t, storagemarket.StorageDealFinalizing, deal.State)
 			},
 		},
+		"waits for confirmation depth": {
+			environmentParams: environmentParams{
+				ConfirmationDepth: 5,
+				PollingInterval:   time.Hour,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealSealing, deal.State)
+			},
+		},
+		"confirmation depth counts from the commit epoch": {
+			dealParams: dealParams{
+				ActivationEpoch: defaultHeight - 5,
+			},
+			environmentParams: environmentParams{
+				ConfirmationDepth: 5,
+				PollingInterval:   time.Hour,
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFinalizing, deal.State)
+			},
+		},
 		"sync error": {
 			nodeParams: nodeParams{
 				DealCommittedSyncError: errors.New("couldn't check deal commitment"),
@@ -1032,6 +1437,18 @@ func TestWaitForDealCompletion(t *testing.T) {
 				require.Equal(t, abi.ChainEpoch(5), deal.SlashEpoch)
 				require.Len(t, env.peerTagger.UntagCalls, 1)
 				require.Equal(t, deal.Client, env.peerTagger.UntagCalls[0])
+				require.Equal(t, []cid.Cid{deal.ProposalCid}, env.removedIndexes)
+				require.Equal(t, []cid.Cid{deal.Proposal.PieceCID}, env.destroyedShards)
+				require.Equal(t, []abi.DealID{deal.DealID}, env.pieceStore.(*tut.TestPieceStore).DealsRemoved(deal.Proposal.PieceCID))
+			},
+		},
+		"slashing keeps shard used by another active deal": {
+			nodeParams:        nodeParams{OnDealSlashedEpoch: abi.ChainEpoch(5)},
+			environmentParams: environmentParams{ActiveDealsForPiece: tut.GenerateCids(1)},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealSlashed, deal.State)
+				require.Equal(t, []cid.Cid{deal.ProposalCid}, env.removedIndexes)
+				require.Empty(t, env.destroyedShards)
 			},
 		},
 		"expiration succeeds": {
@@ -1041,6 +1458,8 @@ func TestWaitForDealCompletion(t *testing.T) {
 				tut.AssertDealState(t, storagemarket.StorageDealExpired, deal.State)
 				require.Len(t, env.peerTagger.UntagCalls, 1)
 				require.Equal(t, deal.Client, env.peerTagger.UntagCalls[0])
+				require.Equal(t, []cid.Cid{deal.Proposal.PieceCID}, env.destroyedShards)
+				require.Equal(t, []abi.DealID{deal.DealID}, env.pieceStore.(*tut.TestPieceStore).DealsRemoved(deal.Proposal.PieceCID))
 			},
 		},
 		"slashing fails": {
@@ -1055,6 +1474,8 @@ func TestWaitForDealCompletion(t *testing.T) {
 			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
 				tut.AssertDealState(t, storagemarket.StorageDealError, deal.State)
 				require.Equal(t, "error waiting for deal completion: deal expiration err: an err", deal.Message)
+				require.Empty(t, env.destroyedShards)
+				require.Empty(t, env.pieceStore.(*tut.TestPieceStore).DealsRemoved(deal.Proposal.PieceCID))
 			},
 		},
 		"fails synchronously": {
@@ -1101,6 +1522,18 @@ func TestRejectDeal(t *testing.T) {
 				require.Equal(t, deal.Message, "sending response to deal: error sending response")
 			},
 		},
+		"releases the staging space reserved for the deal data": {
+			dealParams: dealParams{
+				InboundCAR: "inbound.car",
+			},
+			fileStoreParams: tut.TestFileStoreParams{
+				Reservations: map[filestore.OsPath]int64{"inbound.car": int64(defaultPieceSize)},
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealFailing, deal.State)
+				require.Empty(t, env.fs.(*tut.TestFileStore).Reservations())
+			},
+		},
 	}
 	for test, data := range tests {
 		t.Run(test, func(t *testing.T) {
@@ -1150,6 +1583,18 @@ func TestFailDeal(t *testing.T) {
 				tut.AssertDealState(t, storagemarket.StorageDealError, deal.State)
 			},
 		},
+		"succeeds, staging space released": {
+			dealParams: dealParams{
+				InboundCAR: "inbound.car",
+			},
+			fileStoreParams: tut.TestFileStoreParams{
+				Reservations: map[filestore.OsPath]int64{"inbound.car": int64(defaultPieceSize)},
+			},
+			dealInspector: func(t *testing.T, deal storagemarket.MinerDeal, env *fakeEnvironment) {
+				tut.AssertDealState(t, storagemarket.StorageDealError, deal.State)
+				require.Empty(t, env.fs.(*tut.TestFileStore).Reservations())
+			},
+		},
 	}
 	for test, data := range tests {
 		t.Run(test, func(t *testing.T) {
@@ -1282,6 +1727,7 @@ type dealParams struct {
 	PieceCid             *cid.Cid
 	PiecePath            filestore.Path
 	MetadataPath         filestore.Path
+	InboundCAR           string
 	DealID               abi.DealID
 	DataRef              *storagemarket.DataRef
 	StoragePricePerEpoch abi.TokenAmount
@@ -1295,6 +1741,14 @@ type dealParams struct {
 	ReserveFunds         bool
 	TransferChannelId    *datatransfer.ChannelID
 	Label                string
+	HandoffAttempts      uint64
+	HandoffFirstFailure  time.Time
+	NextHandoffRetry     time.Time
+	// PublishEpoch is the epoch the publish message is included on chain at
+	PublishEpoch abi.ChainEpoch
+	// ActivationEpoch is the epoch the deal's sector is committed on chain at
+	ActivationEpoch abi.ChainEpoch
+	ReusePiece      bool
 }
 
 type environmentParams struct {
@@ -1320,6 +1774,22 @@ type environmentParams struct {
 	Carv2Error  error
 
 	ShardActivationError error
+	ActiveDealsForPiece  []cid.Cid
+
+	TransferTypes []string
+	VerifiedDeals storagemarket.VerifiedDealPolicy
+
+	HandoffRetryPolicy providerstates.HandoffRetryPolicy
+
+	ConfirmationDepth   abi.ChainEpoch
+	PollingInterval     time.Duration
+	ReorgPublishMessage bool
+	// ReincludePublishMessage includes the publish message on chain again
+	// after it was reorged out
+	ReincludePublishMessage bool
+
+	HeldPiece           bool
+	StageHeldPieceError error
 }
 
 type executor func(t *testing.T,
@@ -1453,16 +1923,31 @@ func makeExecutor(ctx context.Context,
 		if dealParams.MetadataPath != filestore.Path("") {
 			dealState.MetadataPath = dealParams.MetadataPath
 		}
+		if dealParams.InboundCAR != "" {
+			dealState.InboundCAR = dealParams.InboundCAR
+		}
 		if dealParams.DealID != abi.DealID(0) {
 			dealState.DealID = dealParams.DealID
 		}
 		dealState.FastRetrieval = dealParams.FastRetrieval
+		dealState.ReusePiece = dealParams.ReusePiece
 		if dealParams.ReserveFunds {
 			dealState.FundsReserved = proposal.ProviderCollateral
 		}
 		if dealParams.TransferChannelId != nil {
 			dealState.TransferChannelId = dealParams.TransferChannelId
 		}
+		if dealParams.PublishEpoch != 0 {
+			node.SMState.IncludeMessage(*dealState.PublishCid, dealParams.PublishEpoch)
+		}
+		if dealParams.ActivationEpoch != 0 {
+			node.SMState.ActivateDeal(dealState.DealID, dealParams.ActivationEpoch)
+		}
+		if dealParams.HandoffAttempts != 0 {
+			dealState.HandoffAttempts = dealParams.HandoffAttempts
+			dealState.HandoffFirstFailure = cbg.CborTime(dealParams.HandoffFirstFailure)
+			dealState.NextHandoffRetry = cbg.CborTime(dealParams.NextHandoffRetry)
+		}
 
 		fs := tut.NewTestFileStore(fileStoreParams)
 		pieceStore := tut.NewTestPieceStoreWithParams(pieceStoreParams)
@@ -1499,6 +1984,14 @@ func makeExecutor(ctx context.Context,
 			carV2Error:           params.Carv2Error,
 			shardActivationError: params.ShardActivationError,
 			awaitRestartTimeout:  params.AwaitRestartTimeout,
+			activeDealsForPiece:  params.ActiveDealsForPiece,
+			transferTypes:        params.TransferTypes,
+			verifiedDeals:        params.VerifiedDeals,
+			handoffRetryPolicy:   params.HandoffRetryPolicy,
+			confirmationDepth:    params.ConfirmationDepth,
+			pollingInterval:      params.PollingInterval,
+			heldPiece:            params.HeldPiece,
+			stageHeldPieceError:  params.StageHeldPieceError,
 		}
 		if environment.pieceCid == cid.Undef {
 			environment.pieceCid = defaultPieceCid
@@ -1512,6 +2005,9 @@ func makeExecutor(ctx context.Context,
 		if environment.ask == storagemarket.StorageAskUndefined {
 			environment.ask = defaultAsk
 		}
+		if environment.transferTypes == nil {
+			environment.transferTypes = []string{storagemarket.TTGraphsync, storagemarket.TTManual}
+		}
 		if environment.pieceSize == 0 {
 			environment.pieceSize = uint64(defaultPieceSize.Unpadded())
 		}
@@ -1526,6 +2022,24 @@ func makeExecutor(ctx context.Context,
 			environment.awaitRestartTimeout <- time.Now()
 			time.Sleep(10 * time.Millisecond)
 		}
+		if params.ReorgPublishMessage {
+			node.SMState.ReorgMessage(*dealState.PublishCid)
+			// give the deal time to find that the message is missing, and
+			// then either include the message again, or advance the chain
+			// past the confirmation depth
+			time.Sleep(10 * time.Millisecond)
+			if params.ReincludePublishMessage {
+				_, epoch := node.SMState.StateKey()
+				node.SMState.IncludeMessage(*dealState.PublishCid, epoch)
+			} else {
+				node.SMState.AdvanceEpoch(params.ConfirmationDepth)
+			}
+		}
+		if initialState == storagemarket.StorageDealAwaitingHandoffRetry || params.ConfirmationDepth > 0 || dealState.ReusePiece {
+			// give state entry funcs that wait in the background time to
+			// trigger their events
+			time.Sleep(10 * time.Millisecond)
+		}
 		fsmCtx.ReplayEvents(t, dealState)
 		dealInspector(t, *dealState, environment)
 
@@ -1570,12 +2084,44 @@ type fakeEnvironment struct {
 	carV2Error           error
 	awaitRestartTimeout  chan time.Time
 	shardActivationError error
+
+	activeDealsForPiece []cid.Cid
+	destroyedShards     []cid.Cid
+	removedIndexes      []cid.Cid
+
+	transferTypes []string
+	verifiedDeals storagemarket.VerifiedDealPolicy
+
+	handoffRetryPolicy providerstates.HandoffRetryPolicy
+	confirmationDepth  abi.ChainEpoch
+	pollingInterval    time.Duration
+
+	heldPiece           bool
+	stageHeldPieceError error
+	stagedHeldPieces    []cid.Cid
 }
 
 func (fe *fakeEnvironment) RemoveIndex(ctx context.Context, proposalCid cid.Cid) error {
+	fe.removedIndexes = append(fe.removedIndexes, proposalCid)
 	return nil
 }
 
+func (fe *fakeEnvironment) DestroyUnusedShard(ctx context.Context, deal storagemarket.MinerDeal) ([]cid.Cid, error) {
+	if len(fe.activeDealsForPiece) > 0 {
+		return fe.activeDealsForPiece, nil
+	}
+	fe.destroyedShards = append(fe.destroyedShards, deal.Proposal.PieceCID)
+	return nil, nil
+}
+
+func (fe *fakeEnvironment) StageHeldPiece(ctx context.Context, deal storagemarket.MinerDeal) (bool, error) {
+	if fe.stageHeldPieceError != nil || !fe.heldPiece {
+		return false, fe.stageHeldPieceError
+	}
+	fe.stagedHeldPieces = append(fe.stagedHeldPieces, deal.Proposal.PieceCID)
+	return true, nil
+}
+
 func (fe *fakeEnvironment) RestartDataTransfer(_ context.Context, chId datatransfer.ChannelID) error {
 	fe.restartDataTransferCalls = append(fe.restartDataTransferCalls, restartDataTransferCall{chId})
 	return fe.restartDataTransferError
@@ -1593,6 +2139,17 @@ func (fe *fakeEnvironment) Ask() storagemarket.StorageAsk {
 	return fe.ask
 }
 
+func (fe *fakeEnvironment) Capabilities() storagemarket.StorageCapabilities {
+	return storagemarket.StorageCapabilities{
+		Miner:         fe.address,
+		TransferTypes: fe.transferTypes,
+		MinPieceSize:  fe.ask.MinPieceSize,
+		MaxPieceSize:  fe.ask.MaxPieceSize,
+		VerifiedDeals: fe.verifiedDeals,
+		DealProtocols: []string{storagemarket.DealProtocolID},
+	}
+}
+
 func (fe *fakeEnvironment) SendSignedResponse(ctx context.Context, response *network.Response) error {
 	return fe.sendSignedResponseError
 }
@@ -1650,6 +2207,18 @@ func (fe *fakeEnvironment) AwaitRestartTimeout() <-chan time.Time {
 	return fe.awaitRestartTimeout
 }
 
+func (fe *fakeEnvironment) HandoffRetryPolicy() providerstates.HandoffRetryPolicy {
+	return fe.handoffRetryPolicy
+}
+
+func (fe *fakeEnvironment) ConfirmationDepth() abi.ChainEpoch {
+	return fe.confirmationDepth
+}
+
+func (fe *fakeEnvironment) PollingInterval() time.Duration {
+	return fe.pollingInterval
+}
+
 func (fe *fakeEnvironment) AnnounceIndex(ctx context.Context, deal storagemarket.MinerDeal) (cid.Cid, error) {
 	return cid.Undef, nil
 }
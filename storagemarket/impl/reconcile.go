@@ -0,0 +1,270 @@
+package storageimpl
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-statemachine/fsm"
+
+	"github.com/filecoin-project/go-fil-markets/filestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerstates"
+	"github.com/filecoin-project/go-fil-markets/stores"
+)
+
+// PieceLocatorFunc finds the sector, offset and size of a deal's piece, eg
+// by asking the sealing subsystem
+type PieceLocatorFunc func(ctx context.Context, deal storagemarket.MinerDeal) (*storagemarket.PackingResult, error)
+
+// AnnouncedDealsFunc lists the proposal CIDs of the deals that have been
+// announced to the indexer
+type AnnouncedDealsFunc func(ctx context.Context) ([]cid.Cid, error)
+
+// MismatchKind is a kind of inconsistency between the deals of a provider
+// and the piece store, DAG store or indexer
+type MismatchKind string
+
+const (
+	// MismatchPieceNotRecorded is an active deal that is not in the piece
+	// info of its piece
+	MismatchPieceNotRecorded MismatchKind = "PieceNotRecorded"
+	// MismatchShardNotRegistered is an active deal whose piece has no shard
+	// in the DAG store
+	MismatchShardNotRegistered MismatchKind = "ShardNotRegistered"
+	// MismatchDealNotAnnounced is an active deal that was not announced to
+	// the indexer
+	MismatchDealNotAnnounced MismatchKind = "DealNotAnnounced"
+	// MismatchOrphanShard is a shard in the DAG store for a piece with no
+	// active deal
+	MismatchOrphanShard MismatchKind = "OrphanShard"
+	// MismatchStalePieceDeal is a deal that has expired or been slashed but
+	// is still in the piece info of its piece
+	MismatchStalePieceDeal MismatchKind = "StalePieceDeal"
+	// MismatchStaleAnnouncement is a deal announced to the indexer that is
+	// not active
+	MismatchStaleAnnouncement MismatchKind = "StaleAnnouncement"
+)
+
+// Mismatch is an inconsistency found by Reconcile
+type Mismatch struct {
+	Kind MismatchKind
+	// ProposalCid is undefined for orphan shards
+	ProposalCid cid.Cid
+	// PieceCid is undefined for stale announcements of unknown deals
+	PieceCid cid.Cid
+	DealID   abi.DealID
+	// Fixed is true if the mismatch was fixed
+	Fixed bool
+	// FixError is set if fixing the mismatch failed
+	FixError error
+}
+
+// ReconciliationReport is the result of Reconcile
+type ReconciliationReport struct {
+	// ActiveDeals is the number of deals that were handed off to the
+	// sealing subsystem and have not expired
+	ActiveDeals int
+	// Shards is the number of shards in the DAG store
+	Shards int
+	// Announced is the number of deals announced to the indexer, or -1 if
+	// announcements were not checked
+	Announced  int
+	Mismatches []Mismatch
+}
+
+// Unfixed returns the mismatches that were not fixed
+func (r *ReconciliationReport) Unfixed() []Mismatch {
+	var unfixed []Mismatch
+	for _, m := range r.Mismatches {
+		if !m.Fixed {
+			unfixed = append(unfixed, m)
+		}
+	}
+	return unfixed
+}
+
+// Reconcile cross-checks the provider's deals against the piece store, the
+// shards in the DAG store and, if AnnouncedDealsOpt is set, the deals
+// announced to the indexer. If fix is true, it re-records missing pieces
+// (when PieceLocatorOpt is set), re-registers missing shards and
+// re-announces deals. Orphan shards and stale entries are only reported.
+func (p *Provider) Reconcile(ctx context.Context, fix bool) (*ReconciliationReport, error) {
+	var deals []storagemarket.MinerDeal
+	if err := p.deals.List(&deals); err != nil {
+		return nil, xerrors.Errorf("failed to list deals: %w", err)
+	}
+
+	shardList, err := p.dagStore.ListShards(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to list shards: %w", err)
+	}
+	shards := make(map[cid.Cid]struct{}, len(shardList))
+	for _, pieceCid := range shardList {
+		shards[pieceCid] = struct{}{}
+	}
+
+	report := &ReconciliationReport{Shards: len(shardList), Announced: -1}
+
+	var announced map[cid.Cid]struct{}
+	if p.announcedDeals != nil {
+		announcedList, err := p.announcedDeals(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to list announced deals: %w", err)
+		}
+		announced = make(map[cid.Cid]struct{}, len(announcedList))
+		for _, propCid := range announcedList {
+			announced[propCid] = struct{}{}
+		}
+		report.Announced = len(announcedList)
+	}
+
+	inSealingSubsystem := make(map[fsm.StateKey]struct{}, len(providerstates.StatesKnownBySealingSubsystem))
+	for _, s := range providerstates.StatesKnownBySealingSubsystem {
+		inSealingSubsystem[s] = struct{}{}
+	}
+
+	activePieces := make(map[cid.Cid]struct{})
+	activeDeals := make(map[cid.Cid]struct{})
+	for _, deal := range deals {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		pieceCid := deal.Proposal.PieceCID
+		if deal.State == storagemarket.StorageDealExpired || deal.State == storagemarket.StorageDealSlashed {
+			recorded, err := p.isDealRecorded(deal)
+			if err != nil {
+				log.Warnw("failed to check piece info of finished deal", "proposalCid", deal.ProposalCid, "err", err)
+			} else if recorded {
+				report.Mismatches = append(report.Mismatches, newMismatch(MismatchStalePieceDeal, deal))
+			}
+			continue
+		}
+		if _, ok := inSealingSubsystem[deal.State]; !ok {
+			continue
+		}
+
+		report.ActiveDeals++
+		activePieces[pieceCid] = struct{}{}
+		activeDeals[deal.ProposalCid] = struct{}{}
+
+		recorded, err := p.isDealRecorded(deal)
+		if err != nil {
+			return report, xerrors.Errorf("failed to get piece info for piece %s: %w", pieceCid, err)
+		}
+		if !recorded {
+			m := newMismatch(MismatchPieceNotRecorded, deal)
+			if fix {
+				m.FixError = p.rerecordPiece(ctx, deal)
+				m.Fixed = m.FixError == nil
+			}
+			report.Mismatches = append(report.Mismatches, m)
+		}
+
+		if _, ok := shards[pieceCid]; !ok {
+			m := newMismatch(MismatchShardNotRegistered, deal)
+			if fix {
+				// The shard is registered without a CAR file, so that the
+				// DAG store fetches the piece from the sector when it is
+				// first accessed
+				m.FixError = stores.RegisterShardSync(ctx, p.dagStore, pieceCid, "", false)
+				m.Fixed = m.FixError == nil
+				if m.Fixed {
+					shards[pieceCid] = struct{}{}
+				}
+			}
+			report.Mismatches = append(report.Mismatches, m)
+		}
+
+		if announced != nil {
+			if _, ok := announced[deal.ProposalCid]; !ok {
+				m := newMismatch(MismatchDealNotAnnounced, deal)
+				if fix {
+					m.FixError = p.AnnounceDealToIndexer(ctx, deal.ProposalCid)
+					m.Fixed = m.FixError == nil
+				}
+				report.Mismatches = append(report.Mismatches, m)
+			}
+		}
+	}
+
+	for _, pieceCid := range shardList {
+		if _, ok := activePieces[pieceCid]; !ok {
+			report.Mismatches = append(report.Mismatches, Mismatch{Kind: MismatchOrphanShard, PieceCid: pieceCid})
+		}
+	}
+
+	if announced != nil {
+		dealsByProposal := make(map[cid.Cid]storagemarket.MinerDeal, len(deals))
+		for _, deal := range deals {
+			dealsByProposal[deal.ProposalCid] = deal
+		}
+		for propCid := range announced {
+			if _, ok := activeDeals[propCid]; ok {
+				continue
+			}
+			m := Mismatch{Kind: MismatchStaleAnnouncement, ProposalCid: propCid}
+			if deal, ok := dealsByProposal[propCid]; ok {
+				m = newMismatch(MismatchStaleAnnouncement, deal)
+			}
+			report.Mismatches = append(report.Mismatches, m)
+		}
+	}
+
+	return report, nil
+}
+
+func newMismatch(kind MismatchKind, deal storagemarket.MinerDeal) Mismatch {
+	return Mismatch{
+		Kind:        kind,
+		ProposalCid: deal.ProposalCid,
+		PieceCid:    deal.Proposal.PieceCID,
+		DealID:      deal.DealID,
+	}
+}
+
+// isDealRecorded checks whether the piece info of a deal's piece has the deal
+func (p *Provider) isDealRecorded(deal storagemarket.MinerDeal) (bool, error) {
+	pi, err := p.pieceStore.GetPieceInfo(deal.Proposal.PieceCID)
+	if xerrors.Is(err, retrievalmarket.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, di := range pi.Deals {
+		if di.DealID == deal.DealID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rerecordPiece records the piece of a deal in the piece store, at the
+// location given by the piece locator
+func (p *Provider) rerecordPiece(ctx context.Context, deal storagemarket.MinerDeal) error {
+	if p.pieceLocator == nil {
+		return xerrors.New("no piece locator configured")
+	}
+	loc, err := p.pieceLocator(ctx, deal)
+	if err != nil {
+		return xerrors.Errorf("failed to locate piece %s: %w", deal.Proposal.PieceCID, err)
+	}
+
+	// The block metadata is deleted once the deal is in a sector, in which
+	// case only the payload root is recorded
+	if deal.MetadataPath != filestore.Path("") {
+		f, err := p.fs.Open(deal.MetadataPath)
+		if err != nil {
+			deal.MetadataPath = ""
+		} else {
+			_ = f.Close()
+		}
+	}
+
+	return providerstates.RecordPiece(&providerDealEnvironment{p}, deal, loc.SectorNumber, loc.Offset, loc.Size)
+}
@@ -0,0 +1,175 @@
+package storageimpl_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/stretchr/testify/require"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	storageimpl "github.com/filecoin-project/go-fil-markets/storagemarket/impl"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/testharness"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/testharness/dependencies"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/testnodes"
+	"github.com/filecoin-project/go-fil-markets/stores"
+)
+
+func TestProvider_Reconcile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Keep active deals from expiring while the test runs
+	providerDelay := testnodes.DelayFakeCommonNode{
+		OnDealExpiredOrSlashed:     true,
+		OnDealExpiredOrSlashedChan: make(chan struct{}),
+	}
+	deps := dependencies.NewDependenciesWithTestData(t, ctx, shared_testutil.NewLibp2pTestData(ctx, t), testnodes.NewStorageMarketState(), "",
+		noOpDelay, providerDelay)
+	var providerDs datastore.Batching = namespace.Wrap(deps.TestData.Ds1, datastore.NewKey("/deals/provider"))
+	namespaced := shared_testutil.DatastoreAtVersion(t, providerDs, "1")
+
+	pieceCids := shared_testutil.GenerateCids(4)
+	consistentPiece, brokenPiece, expiredPiece, orphanPiece := pieceCids[0], pieceCids[1], pieceCids[2], pieceCids[3]
+
+	makeDeal := func(pieceCid cid.Cid, dealID abi.DealID, state storagemarket.StorageDealStatus) storagemarket.MinerDeal {
+		proposal := shared_testutil.MakeTestClientDealProposal()
+		proposal.Proposal.PieceCID = pieceCid
+		proposalNd, err := cborutil.AsIpld(proposal)
+		require.NoError(t, err)
+		deal := storagemarket.MinerDeal{
+			ClientDealProposal: *proposal,
+			ProposalCid:        proposalNd.Cid(),
+			State:              state,
+			DealID:             dealID,
+			Ref: &storagemarket.DataRef{
+				TransferType: storagemarket.TTGraphsync,
+				Root:         shared_testutil.GenerateCids(1)[0],
+			},
+		}
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, deal.MarshalCBOR(buf))
+		require.NoError(t, namespaced.Put(ctx, datastore.NewKey(deal.ProposalCid.String()), buf.Bytes()))
+		return deal
+	}
+
+	consistentDeal := makeDeal(consistentPiece, 1, storagemarket.StorageDealActive)
+	brokenDeal := makeDeal(brokenPiece, 2, storagemarket.StorageDealActive)
+	expiredDeal := makeDeal(expiredPiece, 3, storagemarket.StorageDealExpired)
+
+	// Only the consistent deal is in the piece store, the DAG store and the
+	// indexer. The expired deal was never removed from the piece store and
+	// there is a shard for a piece with no deal.
+	for _, deal := range []storagemarket.MinerDeal{consistentDeal, expiredDeal} {
+		require.NoError(t, deps.PieceStore.AddDealForPiece(deal.Proposal.PieceCID, piecestore.DealInfo{DealID: deal.DealID}))
+	}
+	for _, pieceCid := range []cid.Cid{consistentPiece, orphanPiece} {
+		require.NoError(t, stores.RegisterShardSync(ctx, deps.DagStore, pieceCid, "", false))
+	}
+
+	indexProvider := shared_testutil.NewMockIndexProvider()
+	announced := func(ctx context.Context) ([]cid.Cid, error) {
+		var propCids []cid.Cid
+		for contextID := range indexProvider.GetNotifs() {
+			propCid, err := cid.Cast([]byte(contextID))
+			if err != nil {
+				return nil, err
+			}
+			propCids = append(propCids, propCid)
+		}
+		return propCids, nil
+	}
+	locator := func(ctx context.Context, deal storagemarket.MinerDeal) (*storagemarket.PackingResult, error) {
+		return &storagemarket.PackingResult{SectorNumber: 7, Offset: 0, Size: deal.Proposal.PieceSize}, nil
+	}
+
+	p, err := storageimpl.NewProvider(
+		network.NewFromLibp2pHost(deps.TestData.Host2, network.RetryParameters(0, 0, 0, 0)),
+		providerDs,
+		deps.Fs,
+		deps.DagStore,
+		indexProvider,
+		deps.PieceStore,
+		deps.DTProvider,
+		deps.ProviderNode,
+		deps.ProviderAddr,
+		deps.StoredAsk,
+		&testharness.MeshCreatorStub{},
+		storageimpl.PieceLocatorOpt(locator),
+		storageimpl.AnnouncedDealsOpt(announced),
+	)
+	require.NoError(t, err)
+	provider := p.(*storageimpl.Provider)
+	shared_testutil.StartAndWaitForReady(ctx, t, provider)
+	require.NoError(t, provider.AnnounceDealToIndexer(ctx, consistentDeal.ProposalCid))
+
+	mismatchKinds := func(report *storageimpl.ReconciliationReport) map[storageimpl.MismatchKind][]storageimpl.Mismatch {
+		kinds := make(map[storageimpl.MismatchKind][]storageimpl.Mismatch)
+		for _, m := range report.Mismatches {
+			kinds[m.Kind] = append(kinds[m.Kind], m)
+		}
+		return kinds
+	}
+
+	// Check without fixing
+	report, err := provider.Reconcile(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.ActiveDeals)
+	require.Equal(t, 2, report.Shards)
+	require.Equal(t, 1, report.Announced)
+	require.Len(t, report.Unfixed(), len(report.Mismatches))
+
+	kinds := mismatchKinds(report)
+	require.Len(t, kinds, 5)
+	for _, kind := range []storageimpl.MismatchKind{
+		storageimpl.MismatchPieceNotRecorded,
+		storageimpl.MismatchShardNotRegistered,
+		storageimpl.MismatchDealNotAnnounced,
+	} {
+		require.Len(t, kinds[kind], 1, kind)
+		require.Equal(t, brokenDeal.ProposalCid, kinds[kind][0].ProposalCid)
+		require.Equal(t, brokenPiece, kinds[kind][0].PieceCid)
+	}
+	require.Len(t, kinds[storageimpl.MismatchOrphanShard], 1)
+	require.Equal(t, orphanPiece, kinds[storageimpl.MismatchOrphanShard][0].PieceCid)
+	require.Len(t, kinds[storageimpl.MismatchStalePieceDeal], 1)
+	require.Equal(t, expiredDeal.ProposalCid, kinds[storageimpl.MismatchStalePieceDeal][0].ProposalCid)
+
+	// Fix the broken deal
+	report, err = provider.Reconcile(ctx, true)
+	require.NoError(t, err)
+	for _, m := range mismatchKinds(report)[storageimpl.MismatchPieceNotRecorded] {
+		require.True(t, m.Fixed, m.FixError)
+	}
+	unfixed := mismatchKinds(&storageimpl.ReconciliationReport{Mismatches: report.Unfixed()})
+	require.Len(t, unfixed, 2)
+	require.Len(t, unfixed[storageimpl.MismatchOrphanShard], 1)
+	require.Len(t, unfixed[storageimpl.MismatchStalePieceDeal], 1)
+
+	pi, err := deps.PieceStore.GetPieceInfo(brokenPiece)
+	require.NoError(t, err)
+	require.Len(t, pi.Deals, 1)
+	require.Equal(t, brokenDeal.DealID, pi.Deals[0].DealID)
+	require.Equal(t, abi.SectorNumber(7), pi.Deals[0].SectorID)
+	_, err = deps.PieceStore.GetCIDInfo(brokenDeal.Ref.Root)
+	require.NoError(t, err)
+
+	// Only the mismatches that are reported but not fixed are left
+	report, err = provider.Reconcile(ctx, false)
+	require.NoError(t, err)
+	kinds = mismatchKinds(report)
+	require.Len(t, kinds, 2)
+	require.Len(t, kinds[storageimpl.MismatchOrphanShard], 1)
+	require.Len(t, kinds[storageimpl.MismatchStalePieceDeal], 1)
+}
@@ -0,0 +1,77 @@
+package storageimpl
+
+import (
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// shardLocks serializes the changes to the DAG store shard of each piece, so
+// that a shard is not destroyed while it is being registered for a new deal,
+// and so that deals for the same piece that end at the same time do not each
+// keep the shard because they see the other deal as still active
+type shardLocks struct {
+	lk     sync.Mutex
+	pieces map[cid.Cid]*pieceShardLock
+	// finished holds the deals that have expired or been slashed but whose
+	// final state has not been saved yet
+	finished map[cid.Cid]struct{}
+}
+
+type pieceShardLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the shard of a piece and returns the function that unlocks it
+func (l *shardLocks) lock(pieceCid cid.Cid) func() {
+	l.lk.Lock()
+	if l.pieces == nil {
+		l.pieces = make(map[cid.Cid]*pieceShardLock)
+	}
+	pl, ok := l.pieces[pieceCid]
+	if !ok {
+		pl = &pieceShardLock{}
+		l.pieces[pieceCid] = pl
+	}
+	pl.refs++
+	l.lk.Unlock()
+
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+
+		l.lk.Lock()
+		defer l.lk.Unlock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.pieces, pieceCid)
+		}
+	}
+}
+
+// finish records that a deal has ended, until its final state is saved
+func (l *shardLocks) finish(proposalCid cid.Cid) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.finished == nil {
+		l.finished = make(map[cid.Cid]struct{})
+	}
+	l.finished[proposalCid] = struct{}{}
+}
+
+// isFinished returns true if a deal has ended but its final state has not
+// been saved yet
+func (l *shardLocks) isFinished(proposalCid cid.Cid) bool {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	_, ok := l.finished[proposalCid]
+	return ok
+}
+
+// saved forgets a deal once its final state has been saved
+func (l *shardLocks) saved(proposalCid cid.Cid) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	delete(l.finished, proposalCid)
+}
@@ -49,6 +49,10 @@ type StoredAsk struct {
 	dsKey datastore.Key
 	spn   storagemarket.StorageProviderNode
 	actor address.Address
+
+	// unavailableAsk is published instead of ask while the miner is not
+	// accepting deals. It is kept in memory only.
+	unavailableAsk *storagemarket.SignedStorageAsk
 }
 
 // NewStoredAsk returns a new instance of StoredAsk
@@ -109,6 +113,9 @@ func (s *StoredAsk) SetAsk(price abi.TokenAmount, verifiedPrice abi.TokenAmount,
 		minPieceSize = s.ask.Ask.MinPieceSize
 		maxPieceSize = s.ask.Ask.MaxPieceSize
 	}
+	if s.unavailableAsk != nil {
+		seqno = s.unavailableAsk.Ask.SeqNo + 1
+	}
 
 	ctx := context.TODO()
 
@@ -135,11 +142,73 @@ func (s *StoredAsk) SetAsk(price abi.TokenAmount, verifiedPrice abi.TokenAmount,
 	if err != nil {
 		return err
 	}
-	return s.saveAsk(&storagemarket.SignedStorageAsk{
+	err = s.saveAsk(&storagemarket.SignedStorageAsk{
 		Ask:       ask,
 		Signature: sig,
 	})
+	if err != nil {
+		return err
+	}
 
+	if s.unavailableAsk != nil {
+		return s.setUnavailableAsk(ctx)
+	}
+	return nil
+}
+
+// SetUnavailable sets whether the miner is unavailable for deals. While it is
+// unavailable, an ask that expires at the current epoch is published in place
+// of the stored ask. The stored ask is published again, with a new sequence
+// number, once the miner is available.
+func (s *StoredAsk) SetUnavailable(unavailable bool) error {
+	s.askLk.Lock()
+	defer s.askLk.Unlock()
+
+	if s.ask == nil || unavailable == (s.unavailableAsk != nil) {
+		return nil
+	}
+
+	ctx := context.TODO()
+	if unavailable {
+		return s.setUnavailableAsk(ctx)
+	}
+
+	ask := *s.ask.Ask
+	ask.SeqNo = s.unavailableAsk.Ask.SeqNo + 1
+	sig, err := s.sign(ctx, &ask)
+	if err != nil {
+		return err
+	}
+	err = s.saveAsk(&storagemarket.SignedStorageAsk{
+		Ask:       &ask,
+		Signature: sig,
+	})
+	if err != nil {
+		return err
+	}
+	s.unavailableAsk = nil
+	return nil
+}
+
+func (s *StoredAsk) setUnavailableAsk(ctx context.Context) error {
+	_, height, err := s.spn.GetChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	ask := *s.ask.Ask
+	ask.SeqNo++
+	ask.Timestamp = height
+	ask.Expiry = height
+	sig, err := s.sign(ctx, &ask)
+	if err != nil {
+		return err
+	}
+	s.unavailableAsk = &storagemarket.SignedStorageAsk{
+		Ask:       &ask,
+		Signature: sig,
+	}
+	return nil
 }
 
 func (s *StoredAsk) sign(ctx context.Context, ask *storagemarket.StorageAsk) (*crypto.Signature, error) {
@@ -155,6 +224,10 @@ func (s *StoredAsk) sign(ctx context.Context, ask *storagemarket.StorageAsk) (*c
 func (s *StoredAsk) GetAsk() *storagemarket.SignedStorageAsk {
 	s.askLk.RLock()
 	defer s.askLk.RUnlock()
+	if s.unavailableAsk != nil {
+		ask := *s.unavailableAsk
+		return &ask
+	}
 	if s.ask == nil {
 		return nil
 	}
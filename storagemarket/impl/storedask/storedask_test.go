@@ -96,6 +96,51 @@ func TestStoredAsk(t *testing.T) {
 	})
 }
 
+func TestUnavailable(t *testing.T) {
+	ds := dss.MutexWrap(datastore.NewMapDatastore())
+	spn := &testnodes.FakeProviderNode{
+		FakeCommonNode: testnodes.FakeCommonNode{
+			SMState: testnodes.NewStorageMarketState(),
+		},
+	}
+	actor := address.TestAddress2
+	storedAsk, err := storedask.NewStoredAsk(ds, datastore.NewKey("latest-ask"), spn, actor)
+	require.NoError(t, err)
+
+	testPrice := abi.NewTokenAmount(1000000000)
+	testVerifiedPrice := abi.NewTokenAmount(100000000)
+	testDuration := abi.ChainEpoch(200)
+	require.NoError(t, storedAsk.SetAsk(testPrice, testVerifiedPrice, testDuration))
+	available := storedAsk.GetAsk()
+
+	// While unavailable, the published ask has expired
+	require.NoError(t, storedAsk.SetUnavailable(true))
+	ask := storedAsk.GetAsk()
+	require.Equal(t, ask.Ask.Timestamp, ask.Ask.Expiry)
+	require.Equal(t, testPrice, ask.Ask.Price)
+	require.Greater(t, ask.Ask.SeqNo, available.Ask.SeqNo)
+
+	// The unavailable ask is not persisted
+	storedAsk2, err := storedask.NewStoredAsk(ds, datastore.NewKey("latest-ask"), spn, actor)
+	require.NoError(t, err)
+	require.Equal(t, available, storedAsk2.GetAsk())
+
+	// Setting the ask while unavailable changes the ask that is published
+	// once the miner is available again
+	newPrice := abi.NewTokenAmount(2000000000)
+	require.NoError(t, storedAsk.SetAsk(newPrice, testVerifiedPrice, testDuration))
+	unavailable := storedAsk.GetAsk()
+	require.Equal(t, newPrice, unavailable.Ask.Price)
+	require.Equal(t, unavailable.Ask.Timestamp, unavailable.Ask.Expiry)
+	require.Greater(t, unavailable.Ask.SeqNo, ask.Ask.SeqNo)
+
+	require.NoError(t, storedAsk.SetUnavailable(false))
+	ask = storedAsk.GetAsk()
+	require.Equal(t, newPrice, ask.Ask.Price)
+	require.Equal(t, testDuration, ask.Ask.Expiry-ask.Ask.Timestamp)
+	require.Greater(t, ask.Ask.SeqNo, unavailable.Ask.SeqNo)
+}
+
 func TestPieceSizeLimits(t *testing.T) {
 	// create ask with options
 	ds := dss.MutexWrap(datastore.NewMapDatastore())
@@ -20,10 +20,13 @@ import (
 	"github.com/filecoin-project/go-data-transfer/channelmonitor"
 	dtimpl "github.com/filecoin-project/go-data-transfer/impl"
 	dtnet "github.com/filecoin-project/go-data-transfer/network"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
 
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	storageimpl "github.com/filecoin-project/go-fil-markets/storagemarket/impl"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/clientutils"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/testharness"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/testharness/dependencies"
@@ -298,6 +301,76 @@ func TestMakeDealOffline(t *testing.T) {
 	}
 }
 
+func TestDrainProvider(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	h := testharness.NewHarness(t, ctx, true, noOpDelay, noOpDelay, false)
+
+	shared_testutil.StartAndWaitForReady(ctx, t, h.Provider)
+	shared_testutil.StartAndWaitForReady(ctx, t, h.Client)
+
+	// Start an offline deal, which waits for its data to be imported
+	commP, size, err := clientutils.CommP(ctx, h.Data, &storagemarket.DataRef{
+		TransferType: storagemarket.TTGraphsync,
+		Root:         h.PayloadCid,
+	}, 2<<29)
+	require.NoError(t, err)
+	inFlight := h.ProposeStorageDeal(t, &storagemarket.DataRef{
+		TransferType: storagemarket.TTManual,
+		Root:         h.PayloadCid,
+		PieceCid:     &commP,
+		PieceSize:    size,
+	}, false, false)
+
+	wg := sync.WaitGroup{}
+	h.WaitForProviderEvent(&wg, storagemarket.ProviderEventDataRequested)
+	waitGroupWait(ctx, &wg)
+
+	require.NoError(t, h.Provider.SetDraining(true))
+	status, err := h.Provider.DrainStatus()
+	require.NoError(t, err)
+	require.Equal(t, storagemarket.DrainStatus{Draining: true, DealsBeforeStaged: 1}, status)
+
+	// The published ask has expired
+	ask, err := h.Client.GetAsk(ctx, h.ProviderInfo)
+	require.NoError(t, err)
+	require.Equal(t, ask.Timestamp, ask.Expiry)
+
+	// New proposals are rejected
+	h.WaitForClientEvent(&wg, storagemarket.ClientEventUnexpectedDealState)
+	rejected := h.ProposeStorageDeal(t, &storagemarket.DataRef{TransferType: storagemarket.TTGraphsync, Root: h.PayloadCid}, false, false)
+	waitGroupWait(ctx, &wg)
+	cd, err := h.Client.GetLocalDeal(ctx, rejected.ProposalCid)
+	require.NoError(t, err)
+	require.Contains(t, cd.Message, "provider is draining in-flight deals")
+
+	// The in-flight deal carries on
+	sc := car.NewSelectiveCar(ctx, h.Data, []car.Dag{{Root: h.PayloadCid, Selector: selectorparse.CommonSelector_ExploreAllRecursively}})
+	prepared, err := sc.Prepare()
+	require.NoError(t, err)
+	carBuf := new(bytes.Buffer)
+	require.NoError(t, prepared.Write(carBuf))
+
+	h.WaitForProviderEvent(&wg, storagemarket.ProviderEventDealHandedOff)
+	require.NoError(t, h.Provider.ImportDataForDeal(ctx, inFlight.ProposalCid, carBuf))
+	waitGroupWait(ctx, &wg)
+
+	require.Eventually(t, func() bool {
+		status, err = h.Provider.DrainStatus()
+		return err == nil && status.DealsBeforeStaged == 0
+	}, time.Second, 50*time.Millisecond)
+
+	// Once the provider stops draining, it accepts deals again
+	require.NoError(t, h.Provider.SetDraining(false))
+	ask, err = h.Client.GetAsk(ctx, h.ProviderInfo)
+	require.NoError(t, err)
+	require.Greater(t, int64(ask.Expiry), int64(ask.Timestamp))
+	status, err = h.Provider.DrainStatus()
+	require.NoError(t, err)
+	require.False(t, status.Draining)
+}
+
 func TestMakeDealNonBlocking(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
@@ -338,6 +411,192 @@ func TestMakeDealNonBlocking(t *testing.T) {
 	}, 1*time.Second, 100*time.Millisecond, "actual deal status is %s", storagemarket.DealStates[pd.State])
 }
 
+func TestProposeDealProviderCannotAccept(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	h := testharness.NewHarness(t, ctx, true, noOpDelay, noOpDelay, false)
+
+	// The provider only accepts offline deals
+	h.Provider.(*storageimpl.Provider).Configure(storageimpl.TransferTypes(storagemarket.TTManual))
+	shared_testutil.StartAndWaitForReady(ctx, t, h.Provider)
+	shared_testutil.StartAndWaitForReady(ctx, t, h.Client)
+
+	capabilities, err := h.Client.GetCapabilities(ctx, h.ProviderInfo)
+	require.NoError(t, err)
+	require.Equal(t, h.ProviderAddr, capabilities.Miner)
+	require.Equal(t, []string{storagemarket.TTManual}, capabilities.TransferTypes)
+	require.Equal(t, storagemarket.VerifiedDealsAccepted, capabilities.VerifiedDeals)
+	require.Contains(t, capabilities.DealProtocols, storagemarket.DealProtocolID)
+
+	// The proposal fails before it is sent
+	_, err = h.Client.ProposeStorageDeal(ctx, storagemarket.ProposeStorageDealParams{
+		Addr:       h.ClientAddr,
+		Info:       &h.ProviderInfo,
+		Data:       &storagemarket.DataRef{TransferType: storagemarket.TTGraphsync, Root: h.PayloadCid},
+		StartEpoch: h.Epoch + 100,
+		EndEpoch:   h.Epoch + 100 + abi.ChainEpoch(180*builtin.EpochsInDay),
+		Price:      big.NewInt(1),
+		Collateral: big.NewInt(0),
+		Rt:         abi.RegisteredSealProof_StackedDrg2KiBV1,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "provider cannot accept deal: transfer type graphsync not supported")
+
+	clientDeals, err := h.Client.ListLocalDeals(ctx)
+	require.NoError(t, err)
+	require.Empty(t, clientDeals)
+	providerDeals, err := h.Provider.ListLocalDeals()
+	require.NoError(t, err)
+	require.Empty(t, providerDeals)
+}
+
+func TestDryRunStorageDeal(t *testing.T) {
+	testCases := map[string]struct {
+		disableNewDeals bool
+		providerOpts    []storageimpl.StorageProviderOption
+		expectedErr     string
+		expectedReason  string
+	}{
+		"accepted": {},
+		"rejected by provider checks": {
+			providerOpts:   []storageimpl.StorageProviderOption{storageimpl.TransferTypes(storagemarket.TTManual)},
+			expectedReason: "deal rejected: deal not supported by provider: transfer type graphsync not supported",
+		},
+		"rejected by custom decision logic": {
+			providerOpts: []storageimpl.StorageProviderOption{storageimpl.CustomDealDecisionLogic(
+				func(ctx context.Context, deal storagemarket.MinerDeal) (bool, string, error) {
+					return false, "not accepting deals today", nil
+				})},
+			expectedReason: "deal rejected: not accepting deals today",
+		},
+		"provider does not support dry runs": {
+			disableNewDeals: true,
+			expectedErr:     "failed to open dry run stream to provider",
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			h := testharness.NewHarness(t, ctx, true, noOpDelay, noOpDelay, data.disableNewDeals)
+
+			h.Provider.(*storageimpl.Provider).Configure(data.providerOpts...)
+			shared_testutil.StartAndWaitForReady(ctx, t, h.Provider)
+			shared_testutil.StartAndWaitForReady(ctx, t, h.Client)
+
+			result, err := h.Client.DryRunStorageDeal(ctx, storagemarket.ProposeStorageDealParams{
+				Addr:       h.ClientAddr,
+				Info:       &h.ProviderInfo,
+				Data:       &storagemarket.DataRef{TransferType: storagemarket.TTGraphsync, Root: h.PayloadCid},
+				StartEpoch: h.Epoch + 100,
+				EndEpoch:   h.Epoch + 100 + abi.ChainEpoch(180*builtin.EpochsInDay),
+				Price:      big.NewInt(1),
+				Collateral: big.NewInt(0),
+				Rt:         abi.RegisteredSealProof_StackedDrg2KiBV1,
+			})
+			if data.expectedErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), data.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.True(t, result.ProposalCid.Defined())
+				require.Equal(t, data.expectedReason == "", result.Accepted)
+				require.Equal(t, data.expectedReason, result.Reason)
+			}
+
+			// No deal is started on either side
+			clientDeals, err := h.Client.ListLocalDeals(ctx)
+			require.NoError(t, err)
+			require.Empty(t, clientDeals)
+			providerDeals, err := h.Provider.ListLocalDeals()
+			require.NoError(t, err)
+			require.Empty(t, providerDeals)
+		})
+	}
+}
+
+func TestCounterOffer(t *testing.T) {
+	testCases := map[string]struct {
+		autoAccept     *storageimpl.CounterOfferLimits
+		expectAccepted bool
+	}{
+		"accepted by the caller": {
+			expectAccepted: true,
+		},
+		"accepted automatically": {
+			autoAccept:     &storageimpl.CounterOfferLimits{MaxStoragePricePerEpoch: abi.NewTokenAmount(1 << 30)},
+			expectAccepted: true,
+		},
+		"price over the limit": {
+			autoAccept: &storageimpl.CounterOfferLimits{MaxStoragePricePerEpoch: abi.NewTokenAmount(1)},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx := context.Background()
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			h := testharness.NewHarness(t, ctx, true, noOpDelay, noOpDelay, false)
+			if data.autoAccept != nil {
+				h.Client.(*storageimpl.Client).Configure(storageimpl.AutoAcceptCounterOffers(*data.autoAccept))
+			}
+
+			// The provider asks for more than the client proposes, and the
+			// client can afford the asking price
+			require.NoError(t, h.Provider.SetAsk(big.NewInt(1<<30), big.NewInt(0), 50000))
+			h.SMState.AddFunds(h.ClientAddr, abi.NewTokenAmount(1<<50))
+			shared_testutil.StartAndWaitForReady(ctx, t, h.Provider)
+			shared_testutil.StartAndWaitForReady(ctx, t, h.Client)
+
+			wg := sync.WaitGroup{}
+			h.WaitForClientEvent(&wg, storagemarket.ClientEventCounterOffered)
+			result := h.ProposeStorageDeal(t, &storagemarket.DataRef{TransferType: storagemarket.TTGraphsync, Root: h.PayloadCid}, false, false)
+			waitGroupWait(ctx, &wg)
+
+			var cd storagemarket.ClientDeal
+			require.Eventually(t, func() bool {
+				cd, _ = h.Client.GetLocalDeal(ctx, result.ProposalCid)
+				return cd.State == storagemarket.StorageDealError
+			}, 1*time.Second, 50*time.Millisecond, "actual deal status is %s", storagemarket.DealStates[cd.State])
+			require.NotNil(t, cd.CounterOffer)
+			askPrice := big.NewInt(int64(cd.Proposal.PieceSize))
+			require.Equal(t, askPrice, cd.CounterOffer.StoragePricePerEpoch)
+
+			if data.autoAccept == nil {
+				h.WaitForProviderEvent(&wg, storagemarket.ProviderEventDataRequested)
+				_, err := h.Client.AcceptCounterOffer(ctx, result.ProposalCid)
+				require.NoError(t, err)
+				waitGroupWait(ctx, &wg)
+			} else if data.expectAccepted {
+				h.WaitForProviderEvent(&wg, storagemarket.ProviderEventDataRequested)
+				waitGroupWait(ctx, &wg)
+			}
+
+			providerDeals, err := h.Provider.ListLocalDeals()
+			require.NoError(t, err)
+			if !data.expectAccepted {
+				require.Len(t, providerDeals, 1)
+				return
+			}
+
+			// The counter-offer is proposed as a new deal, which the provider
+			// accepts
+			require.Len(t, providerDeals, 2)
+			var accepted *storagemarket.MinerDeal
+			for i := range providerDeals {
+				if !providerDeals[i].ProposalCid.Equals(result.ProposalCid) {
+					accepted = &providerDeals[i]
+				}
+			}
+			require.NotNil(t, accepted)
+			require.Equal(t, askPrice, accepted.Proposal.StoragePricePerEpoch)
+			require.Nil(t, accepted.CounterOffer)
+		})
+	}
+}
+
 // TestRestartOnlyProviderDataTransfer tests that when the provider is shut
 // down, the connection is broken and then the provider is restarted, the
 // data transfer will resume and the deal will complete successfully.
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"bufio"
+
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+)
+
+type capabilitiesStream struct {
+	p        peer.ID
+	rw       mux.MuxedStream
+	buffered *bufio.Reader
+}
+
+var _ StorageCapabilitiesStream = (*capabilitiesStream)(nil)
+
+func (cs *capabilitiesStream) ReadCapabilitiesRequest() (CapabilitiesRequest, error) {
+	var q CapabilitiesRequest
+
+	if err := q.UnmarshalCBOR(cs.buffered); err != nil {
+		log.Warn(err)
+		return CapabilitiesRequestUndefined, err
+	}
+
+	return q, nil
+}
+
+func (cs *capabilitiesStream) WriteCapabilitiesRequest(q CapabilitiesRequest) error {
+	return cborutil.WriteCborRPC(cs.rw, &q)
+}
+
+func (cs *capabilitiesStream) ReadCapabilitiesResponse() (CapabilitiesResponse, []byte, error) {
+	var resp CapabilitiesResponse
+
+	if err := resp.UnmarshalCBOR(cs.buffered); err != nil {
+		log.Warn(err)
+		return CapabilitiesResponseUndefined, nil, err
+	}
+
+	if resp.Capabilities == nil {
+		return resp, nil, nil
+	}
+
+	origBytes, err := cborutil.Dump(resp.Capabilities.Capabilities)
+	if err != nil {
+		log.Warn(err)
+		return CapabilitiesResponseUndefined, nil, err
+	}
+	return resp, origBytes, nil
+}
+
+func (cs *capabilitiesStream) WriteCapabilitiesResponse(qr CapabilitiesResponse) error {
+	return cborutil.WriteCborRPC(cs.rw, &qr)
+}
+
+func (cs *capabilitiesStream) Close() error {
+	return cs.rw.Close()
+}
@@ -59,6 +59,7 @@ func NewFromLibp2pHost(h host.Host, options ...Option) StorageMarketNetwork {
 			storagemarket.OldAskProtocolID,
 		},
 		supportedDealProtocols: []protocol.ID{
+			storagemarket.DryRunDealProtocolID,
 			storagemarket.DealProtocolID,
 			storagemarket.OldDealProtocolID,
 		},
@@ -110,6 +111,18 @@ func (impl *libp2pStorageMarketNetwork) NewDealStream(ctx context.Context, id pe
 	return &dealStream{p: id, rw: s, buffered: buffered, host: impl.host}, nil
 }
 
+// NewDryRunDealStream opens a deal stream on the deal protocol version that
+// supports dry runs. The stream is not retried, and older versions of the
+// protocol are not negotiated.
+func (impl *libp2pStorageMarketNetwork) NewDryRunDealStream(ctx context.Context, id peer.ID) (StorageDealStream, error) {
+	s, err := impl.host.NewStream(ctx, id, storagemarket.DryRunDealProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReaderSize(s, 16)
+	return &dealStream{p: id, rw: s, buffered: buffered, host: impl.host}, nil
+}
+
 func (impl *libp2pStorageMarketNetwork) NewDealStatusStream(ctx context.Context, id peer.ID) (DealStatusStream, error) {
 	s, err := impl.retryStream.OpenStream(ctx, id, impl.supportedDealStatusProtocols)
 	if err != nil {
@@ -123,6 +136,18 @@ func (impl *libp2pStorageMarketNetwork) NewDealStatusStream(ctx context.Context,
 	return &dealStatusStream{p: id, rw: s, buffered: buffered}, nil
 }
 
+// NewCapabilitiesStream opens a stream on the capabilities protocol. The
+// stream is not retried, as providers running older versions do not support
+// the protocol.
+func (impl *libp2pStorageMarketNetwork) NewCapabilitiesStream(ctx context.Context, id peer.ID) (StorageCapabilitiesStream, error) {
+	s, err := impl.host.NewStream(ctx, id, storagemarket.CapabilitiesProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReaderSize(s, 16)
+	return &capabilitiesStream{p: id, rw: s, buffered: buffered}, nil
+}
+
 func (impl *libp2pStorageMarketNetwork) SetDelegate(r StorageReceiver) error {
 	impl.receiver = r
 	for _, proto := range impl.supportedAskProtocols {
@@ -134,6 +159,7 @@ func (impl *libp2pStorageMarketNetwork) SetDelegate(r StorageReceiver) error {
 	for _, proto := range impl.supportedDealStatusProtocols {
 		impl.host.SetStreamHandler(proto, impl.handleNewDealStatusStream)
 	}
+	impl.host.SetStreamHandler(storagemarket.CapabilitiesProtocolID, impl.handleNewCapabilitiesStream)
 	return nil
 }
 
@@ -148,6 +174,7 @@ func (impl *libp2pStorageMarketNetwork) StopHandlingRequests() error {
 	for _, proto := range impl.supportedDealStatusProtocols {
 		impl.host.RemoveStreamHandler(proto)
 	}
+	impl.host.RemoveStreamHandler(storagemarket.CapabilitiesProtocolID)
 	return nil
 }
 
@@ -190,6 +217,13 @@ func (impl *libp2pStorageMarketNetwork) handleNewDealStatusStream(s network.Stre
 	}
 }
 
+func (impl *libp2pStorageMarketNetwork) handleNewCapabilitiesStream(s network.Stream) {
+	reader := impl.getReaderOrReset(s)
+	if reader != nil {
+		impl.receiver.HandleCapabilitiesStream(&capabilitiesStream{s.Conn().RemotePeer(), s, reader})
+	}
+}
+
 func (impl *libp2pStorageMarketNetwork) getReaderOrReset(s network.Stream) *bufio.Reader {
 	if impl.receiver == nil {
 		log.Warn("no receiver set")
@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/crypto"
 
 	"github.com/filecoin-project/go-fil-markets/shared_testutil"
@@ -22,6 +23,7 @@ type testReceiver struct {
 	dealStreamHandler       func(network.StorageDealStream)
 	askStreamHandler        func(network.StorageAskStream)
 	dealStatusStreamHandler func(stream network.DealStatusStream)
+	capabilitiesHandler     func(network.StorageCapabilitiesStream)
 }
 
 var _ network.StorageReceiver = &testReceiver{}
@@ -47,6 +49,13 @@ func (tr *testReceiver) HandleDealStatusStream(s network.DealStatusStream) {
 	}
 }
 
+func (tr *testReceiver) HandleCapabilitiesStream(s network.StorageCapabilitiesStream) {
+	defer s.Close()
+	if tr.capabilitiesHandler != nil {
+		tr.capabilitiesHandler(s)
+	}
+}
+
 func TestOpenStreamWithRetries(t *testing.T) {
 	ctx := context.Background()
 	td := shared_testutil.NewLibp2pTestData(ctx, t)
@@ -517,6 +526,110 @@ func TestDealStatusStreamSendReceiveMultipleSuccessful(t *testing.T) {
 	assert.Equal(t, ar, resp)
 }
 
+func TestCapabilitiesStreamSendReceive(t *testing.T) {
+	ctxBg := context.Background()
+	td := shared_testutil.NewLibp2pTestData(ctxBg, t)
+	nw1 := network.NewFromLibp2pHost(td.Host1)
+	nw2 := network.NewFromLibp2pHost(td.Host2)
+	require.NoError(t, td.Host1.Connect(ctxBg, peer.AddrInfo{ID: td.Host2.ID()}))
+
+	request := network.CapabilitiesRequest{Miner: address.TestAddress2}
+	response := network.CapabilitiesResponse{
+		Capabilities: &storagemarket.SignedStorageCapabilities{
+			Capabilities: &storagemarket.StorageCapabilities{
+				Miner:         address.TestAddress2,
+				TransferTypes: []string{storagemarket.TTGraphsync},
+				MinPieceSize:  256,
+				MaxPieceSize:  1 << 20,
+				VerifiedDeals: storagemarket.VerifiedDealsOnly,
+				DealProtocols: []string{storagemarket.DealProtocolID},
+				Timestamp:     -1,
+			},
+			Signature: shared_testutil.MakeTestSignature(),
+		},
+	}
+
+	// host2 gets a capabilities request and sends a response
+	qchan := make(chan network.CapabilitiesRequest, 1)
+	tr2 := &testReceiver{t: t, capabilitiesHandler: func(s network.StorageCapabilitiesStream) {
+		q, err := s.ReadCapabilitiesRequest()
+		require.NoError(t, err)
+		qchan <- q
+		require.NoError(t, s.WriteCapabilitiesResponse(response))
+	}}
+	require.NoError(t, nw2.SetDelegate(tr2))
+
+	ctx, cancel := context.WithTimeout(ctxBg, 10*time.Second)
+	defer cancel()
+
+	cs, err := nw1.NewCapabilitiesStream(ctx, td.Host2.ID())
+	require.NoError(t, err)
+	defer cs.Close()
+
+	require.NoError(t, cs.WriteCapabilitiesRequest(request))
+	resp, origBytes, err := cs.ReadCapabilitiesResponse()
+	require.NoError(t, err)
+	require.NotEmpty(t, origBytes)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("request not received")
+	case q := <-qchan:
+		assert.Equal(t, request, q)
+	}
+	assert.Equal(t, response, resp)
+
+	// The protocol is not retried when the provider does not support it
+	require.NoError(t, nw2.StopHandlingRequests())
+	_, err = nw1.NewCapabilitiesStream(ctx, td.Host2.ID())
+	require.Error(t, err)
+}
+
+func TestDryRunDealStreamSendReceive(t *testing.T) {
+	ctxBg := context.Background()
+	td := shared_testutil.NewLibp2pTestData(ctxBg, t)
+	nw1 := network.NewFromLibp2pHost(td.Host1)
+	nw2 := network.NewFromLibp2pHost(td.Host2)
+	require.NoError(t, td.Host1.Connect(ctxBg, peer.AddrInfo{ID: td.Host2.ID()}))
+
+	// host2 reads the dry run proposal on the new protocol version
+	dchan := make(chan network.Proposal, 1)
+	tr2 := &testReceiver{t: t, dealStreamHandler: func(s network.StorageDealStream) {
+		readD, err := s.ReadDealProposal()
+		require.NoError(t, err)
+		dchan <- readD
+	}}
+	require.NoError(t, nw2.SetDelegate(tr2))
+
+	ctx, cancel := context.WithTimeout(ctxBg, 10*time.Second)
+	defer cancel()
+
+	ds, err := nw1.NewDryRunDealStream(ctx, td.Host2.ID())
+	require.NoError(t, err)
+	defer ds.Close()
+
+	// The dry run proposal is sent unsigned
+	dp := shared_testutil.MakeTestStorageNetworkProposal()
+	dp.DryRunProposal = &dp.DealProposal.Proposal
+	dp.DealProposal = nil
+	require.NoError(t, ds.WriteDealProposal(dp))
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("dry run proposal not received")
+	case received := <-dchan:
+		assert.Equal(t, dp, received)
+	}
+
+	// A dry run is not sent to a provider that only supports older versions
+	// of the deal protocol
+	require.NoError(t, nw2.StopHandlingRequests())
+	nw2 = network.NewFromLibp2pHost(td.Host2, network.SupportedDealProtocols([]protocol.ID{storagemarket.DealProtocolID, storagemarket.OldDealProtocolID}))
+	require.NoError(t, nw2.SetDelegate(tr2))
+	_, err = nw1.NewDryRunDealStream(ctx, td.Host2.ID())
+	require.Error(t, err)
+}
+
 func TestLibp2pStorageMarketNetwork_StopHandlingRequests(t *testing.T) {
 	bgCtx := context.Background()
 	td := shared_testutil.NewLibp2pTestData(bgCtx, t)
@@ -46,19 +46,32 @@ type DealStatusStream interface {
 	Close() error
 }
 
+// StorageCapabilitiesStream is a stream for reading and writing requests
+// and responses on the storage capabilities protocol
+type StorageCapabilitiesStream interface {
+	ReadCapabilitiesRequest() (CapabilitiesRequest, error)
+	WriteCapabilitiesRequest(CapabilitiesRequest) error
+	ReadCapabilitiesResponse() (CapabilitiesResponse, []byte, error)
+	WriteCapabilitiesResponse(CapabilitiesResponse) error
+	Close() error
+}
+
 // StorageReceiver implements functions for receiving
 // incoming data on storage protocols
 type StorageReceiver interface {
 	HandleAskStream(StorageAskStream)
 	HandleDealStream(StorageDealStream)
 	HandleDealStatusStream(DealStatusStream)
+	HandleCapabilitiesStream(StorageCapabilitiesStream)
 }
 
 // StorageMarketNetwork is a network abstraction for the storage market
 type StorageMarketNetwork interface {
 	NewAskStream(context.Context, peer.ID) (StorageAskStream, error)
 	NewDealStream(context.Context, peer.ID) (StorageDealStream, error)
+	NewDryRunDealStream(context.Context, peer.ID) (StorageDealStream, error)
 	NewDealStatusStream(context.Context, peer.ID) (DealStatusStream, error)
+	NewCapabilitiesStream(context.Context, peer.ID) (StorageCapabilitiesStream, error)
 	SetDelegate(StorageReceiver) error
 	StopHandlingRequests() error
 	ID() peer.ID
@@ -10,7 +10,7 @@ import (
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
-//go:generate cbor-gen-for --map-encoding AskRequest AskResponse Proposal Response SignedResponse DealStatusRequest DealStatusResponse
+//go:generate cbor-gen-for --map-encoding AskRequest AskResponse Proposal Response SignedResponse DealStatusRequest DealStatusResponse CapabilitiesRequest CapabilitiesResponse
 
 // Proposal is the data sent over the network from client to provider when proposing
 // a deal
@@ -18,6 +18,14 @@ type Proposal struct {
 	DealProposal  *market.ClientDealProposal
 	Piece         *storagemarket.DataRef
 	FastRetrieval bool
+	// DryRunProposal is sent instead of DealProposal when the client only
+	// asks whether the provider would accept the deal. It is not signed, so
+	// it cannot be published.
+	DryRunProposal *market.DealProposal
+	// ReusePiece is true if the client agrees that the provider may skip
+	// the data transfer, and stage the data from a copy of the piece that it
+	// already holds
+	ReusePiece bool
 }
 
 // ProposalUndefined is an empty Proposal message
@@ -33,6 +41,10 @@ type Response struct {
 
 	// StorageDealProposalAccepted
 	PublishMessage *cid.Cid
+
+	// CounterOffer holds terms the provider would accept instead, when it
+	// rejects a proposal because of its price, collateral or start epoch
+	CounterOffer *market.DealProposal
 }
 
 // SignedResponse is a response that is signed
@@ -79,3 +91,21 @@ type DealStatusResponse struct {
 
 // DealStatusResponseUndefined represents an empty DealStatusResponse message
 var DealStatusResponseUndefined = DealStatusResponse{}
+
+// CapabilitiesRequest is a request for the storage capabilities of a given
+// miner
+type CapabilitiesRequest struct {
+	Miner address.Address
+}
+
+// CapabilitiesRequestUndefined represents an empty CapabilitiesRequest message
+var CapabilitiesRequestUndefined = CapabilitiesRequest{}
+
+// CapabilitiesResponse is the response sent over the network in response
+// to a capabilities request
+type CapabilitiesResponse struct {
+	Capabilities *storagemarket.SignedStorageCapabilities
+}
+
+// CapabilitiesResponseUndefined represents an empty CapabilitiesResponse message
+var CapabilitiesResponseUndefined = CapabilitiesResponse{}
@@ -198,7 +198,7 @@ func (t *Proposal) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{163}); err != nil {
+	if _, err := w.Write([]byte{165}); err != nil {
 		return err
 	}
 
@@ -251,6 +251,38 @@ func (t *Proposal) MarshalCBOR(w io.Writer) error {
 	if err := cbg.WriteBool(w, t.FastRetrieval); err != nil {
 		return err
 	}
+
+	// t.DryRunProposal (market.DealProposal) (struct)
+	if len("DryRunProposal") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"DryRunProposal\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("DryRunProposal"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("DryRunProposal")); err != nil {
+		return err
+	}
+
+	if err := t.DryRunProposal.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.ReusePiece (bool) (bool)
+	if len("ReusePiece") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"ReusePiece\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("ReusePiece"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("ReusePiece")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.ReusePiece); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -345,6 +377,44 @@ func (t *Proposal) UnmarshalCBOR(r io.Reader) error {
 			default:
 				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
 			}
+			// t.DryRunProposal (market.DealProposal) (struct)
+		case "DryRunProposal":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.DryRunProposal = new(market.DealProposal)
+					if err := t.DryRunProposal.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.DryRunProposal pointer: %w", err)
+					}
+				}
+
+			}
+			// t.ReusePiece (bool) (bool)
+		case "ReusePiece":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.ReusePiece = false
+			case 21:
+				t.ReusePiece = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -359,7 +429,7 @@ func (t *Response) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{164}); err != nil {
+	if _, err := w.Write([]byte{165}); err != nil {
 		return err
 	}
 
@@ -442,6 +512,21 @@ func (t *Response) MarshalCBOR(w io.Writer) error {
 		}
 	}
 
+	// t.CounterOffer (market.DealProposal) (struct)
+	if len("CounterOffer") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"CounterOffer\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("CounterOffer"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("CounterOffer")); err != nil {
+		return err
+	}
+
+	if err := t.CounterOffer.MarshalCBOR(w); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -540,6 +625,26 @@ func (t *Response) UnmarshalCBOR(r io.Reader) error {
 				}
 
 			}
+			// t.CounterOffer (market.DealProposal) (struct)
+		case "CounterOffer":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.CounterOffer = new(market.DealProposal)
+					if err := t.CounterOffer.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.CounterOffer pointer: %w", err)
+					}
+				}
+
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -883,3 +988,175 @@ func (t *DealStatusResponse) UnmarshalCBOR(r io.Reader) error {
 
 	return nil
 }
+func (t *CapabilitiesRequest) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{161}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Miner (address.Address) (struct)
+	if len("Miner") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Miner\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Miner"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Miner")); err != nil {
+		return err
+	}
+
+	if err := t.Miner.MarshalCBOR(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *CapabilitiesRequest) UnmarshalCBOR(r io.Reader) error {
+	*t = CapabilitiesRequest{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("CapabilitiesRequest: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Miner (address.Address) (struct)
+		case "Miner":
+
+			{
+
+				if err := t.Miner.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.Miner: %w", err)
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *CapabilitiesResponse) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{161}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Capabilities (storagemarket.SignedStorageCapabilities) (struct)
+	if len("Capabilities") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Capabilities\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Capabilities"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Capabilities")); err != nil {
+		return err
+	}
+
+	if err := t.Capabilities.MarshalCBOR(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *CapabilitiesResponse) UnmarshalCBOR(r io.Reader) error {
+	*t = CapabilitiesResponse{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("CapabilitiesResponse: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Capabilities (storagemarket.SignedStorageCapabilities) (struct)
+		case "Capabilities":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.Capabilities = new(storagemarket.SignedStorageCapabilities)
+					if err := t.Capabilities.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.Capabilities pointer: %w", err)
+					}
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
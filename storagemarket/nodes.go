@@ -53,6 +53,18 @@ type StorageCommon interface {
 	// WaitForMessage waits until a message appears on chain. If it is already on chain, the callback is called immediately
 	WaitForMessage(ctx context.Context, mcid cid.Cid, onCompletion func(exitcode.ExitCode, []byte, cid.Cid, error) error) error
 
+	// MessageInclusionEpoch returns the epoch of the tipset that includes the
+	// given message on the current chain, following message replacement.
+	// found is false if the current chain does not include the message, for
+	// example because it was reorged out.
+	MessageInclusionEpoch(ctx context.Context, mcid cid.Cid) (epoch abi.ChainEpoch, found bool, err error)
+
+	// DealActivationEpoch returns the epoch at which the sector with the
+	// deal was committed on the current chain. active is false if the deal
+	// is not active on the current chain, for example because the sector
+	// commit was reorged out.
+	DealActivationEpoch(ctx context.Context, dealID abi.DealID) (epoch abi.ChainEpoch, active bool, err error)
+
 	// SignsBytes signs the given data with the given address's private key
 	SignBytes(ctx context.Context, signer address.Address, b []byte) (*crypto.Signature, error)
 
@@ -36,6 +36,15 @@ type StorageProvider interface {
 	// GetAsk returns the storage miner's ask, or nil if one does not exist.
 	GetAsk() *SignedStorageAsk
 
+	// SetDraining turns drain mode on or off. While draining, the provider
+	// rejects new deal proposals and publishes an expired ask, and in-flight
+	// deals carry on.
+	SetDraining(draining bool) error
+
+	// DrainStatus reports whether the provider is draining, and how many deals
+	// have not been handed off to the sealing subsystem yet
+	DrainStatus() (DrainStatus, error)
+
 	// GetLocalDeal gets a deal by signed proposal cid
 	GetLocalDeal(cid cid.Cid) (MinerDeal, error)
 
@@ -64,6 +73,14 @@ type StorageProvider interface {
 
 	RetryDealPublishing(propCid cid.Cid) error
 
+	// ListHandoffRetries lists deals waiting to retry the hand-off to the
+	// sealing subsystem
+	ListHandoffRetries() ([]MinerDeal, error)
+
+	// RetryHandoff hands a deal waiting for a hand-off retry to the sealing
+	// subsystem right away, instead of waiting for the next scheduled attempt
+	RetryHandoff(propCid cid.Cid) error
+
 	AnnounceDealToIndexer(ctx context.Context, proposalCid cid.Cid) error
 
 	AnnounceAllDealsToIndexer(ctx context.Context) error
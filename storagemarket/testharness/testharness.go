@@ -1,7 +1,6 @@
 package testharness
 
 import (
-	"os"
 	"path/filepath"
 	"sync"
 	"testing"
@@ -78,7 +77,7 @@ func NewHarnessWithTestData(t *testing.T, td *shared_testutil.Libp2pTestData, de
 	} else {
 		rootLink, path = td.LoadUnixFSFile(t, fPath, false)
 	}
-	t.Cleanup(func() { _ = os.Remove(path) })
+	t.Cleanup(func() { _ = stores.RemoveFilestore(path) })
 
 	payloadCid := rootLink.(cidlink.Link).Cid
 
@@ -38,6 +38,14 @@ type StorageMarketState struct {
 	DealID      abi.DealID
 	Balances    map[address.Address]abi.TokenAmount
 	Providers   map[address.Address]*storagemarket.StorageProviderInfo
+
+	// chainLk guards the message inclusions and deal activations, and
+	// changes to Epoch while the chain state is in use
+	chainLk     sync.Mutex
+	inclusions  map[cid.Cid]abi.ChainEpoch
+	reorgedOut  map[cid.Cid]struct{}
+	activations map[abi.DealID]abi.ChainEpoch
+	deactivated map[abi.DealID]struct{}
 }
 
 // NewStorageMarketState returns a new empty state for the storage market
@@ -50,6 +58,53 @@ func NewStorageMarketState() *StorageMarketState {
 	}
 }
 
+// IncludeMessage simulates a message being included on chain at the given
+// epoch, replacing any earlier inclusion
+func (sma *StorageMarketState) IncludeMessage(mcid cid.Cid, epoch abi.ChainEpoch) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
+	if sma.inclusions == nil {
+		sma.inclusions = make(map[cid.Cid]abi.ChainEpoch)
+	}
+	sma.inclusions[mcid] = epoch
+	delete(sma.reorgedOut, mcid)
+}
+
+// ReorgMessage simulates a chain reorg that removes a message from the
+// current chain
+func (sma *StorageMarketState) ReorgMessage(mcid cid.Cid) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
+	if sma.reorgedOut == nil {
+		sma.reorgedOut = make(map[cid.Cid]struct{})
+	}
+	sma.reorgedOut[mcid] = struct{}{}
+	delete(sma.inclusions, mcid)
+}
+
+// MessageInclusion returns the epoch a message was included at. A message
+// that has not been looked up before is included at the current epoch,
+// unless it was reorged out.
+func (sma *StorageMarketState) MessageInclusion(mcid cid.Cid) (abi.ChainEpoch, bool) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
+	if _, ok := sma.reorgedOut[mcid]; ok {
+		return 0, false
+	}
+	if sma.inclusions == nil {
+		sma.inclusions = make(map[cid.Cid]abi.ChainEpoch)
+	}
+	epoch, ok := sma.inclusions[mcid]
+	if !ok {
+		epoch = sma.Epoch
+		sma.inclusions[mcid] = epoch
+	}
+	return epoch, true
+}
+
 // AddFunds adds funds for a given address in the storage market
 func (sma *StorageMarketState) AddFunds(addr address.Address, amount abi.TokenAmount) {
 	if existing, ok := sma.Balances[addr]; ok {
@@ -69,9 +124,67 @@ func (sma *StorageMarketState) Balance(addr address.Address) storagemarket.Balan
 
 // StateKey returns a state key with the storage market states set Epoch
 func (sma *StorageMarketState) StateKey() (shared.TipSetToken, abi.ChainEpoch) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
 	return sma.TipSetToken, sma.Epoch
 }
 
+// AdvanceEpoch simulates the chain advancing by the given number of epochs
+func (sma *StorageMarketState) AdvanceEpoch(epochs abi.ChainEpoch) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
+	sma.Epoch += epochs
+}
+
+// ActivateDeal simulates the sector with a deal being committed on chain at
+// the given epoch, replacing any earlier activation
+func (sma *StorageMarketState) ActivateDeal(dealID abi.DealID, epoch abi.ChainEpoch) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
+	if sma.activations == nil {
+		sma.activations = make(map[abi.DealID]abi.ChainEpoch)
+	}
+	sma.activations[dealID] = epoch
+	delete(sma.deactivated, dealID)
+}
+
+// ReorgDealActivation simulates a chain reorg that removes the commit of the
+// sector with a deal from the current chain
+func (sma *StorageMarketState) ReorgDealActivation(dealID abi.DealID) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
+	if sma.deactivated == nil {
+		sma.deactivated = make(map[abi.DealID]struct{})
+	}
+	sma.deactivated[dealID] = struct{}{}
+	delete(sma.activations, dealID)
+}
+
+// DealActivation returns the epoch a deal was activated at. A deal that has
+// not been looked up before is activated at the current epoch, unless its
+// activation was reorged out.
+func (sma *StorageMarketState) DealActivation(dealID abi.DealID) (abi.ChainEpoch, bool) {
+	sma.chainLk.Lock()
+	defer sma.chainLk.Unlock()
+
+	if _, ok := sma.deactivated[dealID]; ok {
+		return 0, false
+	}
+	if sma.activations == nil {
+		sma.activations = make(map[abi.DealID]abi.ChainEpoch)
+	}
+	epoch, ok := sma.activations[dealID]
+	if !ok {
+		epoch = sma.Epoch
+		sma.activations[dealID] = epoch
+	}
+	return epoch, true
+}
+
 // FakeCommonNode implements common methods for the storage & client node adapters
 // where responses are stubbed
 type FakeCommonNode struct {
@@ -102,6 +215,9 @@ type FakeCommonNode struct {
 	WaitForMessageNodeError error
 	WaitForMessageCalls     []cid.Cid
 
+	MessageInclusionError error
+	DealActivationError   error
+
 	DelayFakeCommonNode DelayFakeCommonNode
 }
 
@@ -176,6 +292,28 @@ func (n *FakeCommonNode) WaitForMessage(ctx context.Context, mcid cid.Cid, onCom
 	return onCompletion(n.WaitForMessageExitCode, n.WaitForMessageRetBytes, finalCid, n.WaitForMessageNodeError)
 }
 
+// MessageInclusionEpoch returns the epoch a message was included at in the
+// storage market state
+func (n *FakeCommonNode) MessageInclusionEpoch(ctx context.Context, mcid cid.Cid) (abi.ChainEpoch, bool, error) {
+	if n.MessageInclusionError != nil {
+		return 0, false, n.MessageInclusionError
+	}
+
+	epoch, found := n.SMState.MessageInclusion(mcid)
+	return epoch, found, nil
+}
+
+// DealActivationEpoch returns the epoch a deal was activated at in the
+// storage market state
+func (n *FakeCommonNode) DealActivationEpoch(ctx context.Context, dealID abi.DealID) (abi.ChainEpoch, bool, error) {
+	if n.DealActivationError != nil {
+		return 0, false, n.DealActivationError
+	}
+
+	epoch, active := n.SMState.DealActivation(dealID)
+	return epoch, active, nil
+}
+
 // GetBalance returns the funds in the storage market state
 func (n *FakeCommonNode) GetBalance(ctx context.Context, addr address.Address, tok shared.TipSetToken) (storagemarket.Balance, error) {
 	if n.GetBalanceError == nil {
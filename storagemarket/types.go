@@ -21,12 +21,17 @@ import (
 
 var log = logging.Logger("storagemrkt")
 
-//go:generate cbor-gen-for --map-encoding ClientDeal MinerDeal Balance SignedStorageAsk StorageAsk DataRef ProviderDealState DealStages DealStage Log
+//go:generate cbor-gen-for --map-encoding ClientDeal MinerDeal Balance SignedStorageAsk StorageAsk DataRef ProviderDealState DealStages DealStage Log StorageCapabilities SignedStorageCapabilities
 
 // DealProtocolID is the ID for the libp2p protocol for proposing storage deals.
 const OldDealProtocolID = "/fil/storage/mk/1.0.1"
 const DealProtocolID = "/fil/storage/mk/1.1.0"
 
+// DryRunDealProtocolID is the ID for the version of the deal protocol that
+// supports dry run proposals. Providers running older versions would treat a
+// dry run as a real proposal, so dry runs are only sent on this version.
+const DryRunDealProtocolID = "/fil/storage/mk/1.2.0"
+
 // AskProtocolID is the ID for the libp2p protocol for querying miners for their current StorageAsk.
 const OldAskProtocolID = "/fil/storage/ask/1.0.1"
 const AskProtocolID = "/fil/storage/ask/1.1.0"
@@ -35,6 +40,9 @@ const AskProtocolID = "/fil/storage/ask/1.1.0"
 const OldDealStatusProtocolID = "/fil/storage/status/1.0.1"
 const DealStatusProtocolID = "/fil/storage/status/1.1.0"
 
+// CapabilitiesProtocolID is the ID for the libp2p protocol for querying miners for the deals they can accept.
+const CapabilitiesProtocolID = "/fil/storage/capabilities/1.0.0"
+
 // Balance represents a current balance of funds in the StorageMarketActor.
 type Balance struct {
 	Locked    abi.TokenAmount
@@ -87,6 +95,81 @@ func MaxPieceSize(maxPieceSize abi.PaddedPieceSize) StorageAskOption {
 // StorageAskUndefined represents an empty value for StorageAsk
 var StorageAskUndefined = StorageAsk{}
 
+// VerifiedDealPolicy is whether a provider accepts verified deals
+type VerifiedDealPolicy uint64
+
+const (
+	// VerifiedDealsAccepted means both verified and unverified deals are accepted
+	VerifiedDealsAccepted VerifiedDealPolicy = iota
+
+	// VerifiedDealsOnly means only verified deals are accepted
+	VerifiedDealsOnly
+
+	// VerifiedDealsRejected means only unverified deals are accepted
+	VerifiedDealsRejected
+)
+
+// StorageCapabilities describes the deals a provider can accept, so that a
+// client can find out before proposing a deal that it would be rejected
+type StorageCapabilities struct {
+	Miner address.Address
+	// TransferTypes are the ways deal data can be transferred, eg TTGraphsync
+	TransferTypes []string
+	MinPieceSize  abi.PaddedPieceSize
+	MaxPieceSize  abi.PaddedPieceSize
+	VerifiedDeals VerifiedDealPolicy
+	// DealProtocols are the versions of the deal protocol the provider
+	// supports
+	DealProtocols []string
+	Timestamp     abi.ChainEpoch
+}
+
+// SignedStorageCapabilities are capabilities signed by the miner's private key
+type SignedStorageCapabilities struct {
+	Capabilities *StorageCapabilities
+	Signature    *crypto.Signature
+}
+
+// CheckProposal returns an error if a provider with these capabilities
+// cannot accept a deal with the given transfer type, piece size and
+// verified status. An empty transfer type is a graphsync transfer.
+func (sc *StorageCapabilities) CheckProposal(transferType string, pieceSize abi.PaddedPieceSize, verified bool) error {
+	if transferType == "" {
+		transferType = TTGraphsync
+	}
+	if !containsString(sc.TransferTypes, transferType) {
+		return fmt.Errorf("transfer type %s not supported, provider supports %v", transferType, sc.TransferTypes)
+	}
+
+	if pieceSize < sc.MinPieceSize {
+		return fmt.Errorf("piece size less than minimum required size: %d < %d", pieceSize, sc.MinPieceSize)
+	}
+	if pieceSize > sc.MaxPieceSize {
+		return fmt.Errorf("piece size more than maximum allowed size: %d > %d", pieceSize, sc.MaxPieceSize)
+	}
+
+	if verified && sc.VerifiedDeals == VerifiedDealsRejected {
+		return fmt.Errorf("verified deals not accepted")
+	}
+	if !verified && sc.VerifiedDeals == VerifiedDealsOnly {
+		return fmt.Errorf("only verified deals accepted")
+	}
+
+	if !containsString(sc.DealProtocols, DealProtocolID) && !containsString(sc.DealProtocols, OldDealProtocolID) {
+		return fmt.Errorf("no supported deal protocol version, provider supports %v", sc.DealProtocols)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // MinerDeal is the local state tracked for a deal by a StorageProvider
 type MinerDeal struct {
 	market.ClientDealProposal
@@ -112,6 +195,22 @@ type MinerDeal struct {
 	SectorNumber      abi.SectorNumber
 
 	InboundCAR string
+
+	// CounterOffer holds the terms the provider offered the client instead,
+	// when the deal was rejected because of its price, collateral or start
+	// epoch
+	CounterOffer *market.DealProposal
+
+	// HandoffAttempts counts the failed attempts to hand the deal off to the
+	// sealing subsystem. HandoffFirstFailure is the time of the first failed
+	// attempt, and NextHandoffRetry the time of the next scheduled attempt.
+	HandoffAttempts     uint64
+	HandoffFirstFailure cbg.CborTime
+	NextHandoffRetry    cbg.CborTime
+
+	// ReusePiece is true if the client agreed that the data for the deal may
+	// be staged from a copy of the piece the provider already holds
+	ReusePiece bool
 }
 
 // NewDealStages creates a new DealStages object ready to be used.
@@ -247,6 +346,12 @@ type ClientDeal struct {
 	CreationTime      cbg.CborTime
 	TransferChannelID *datatransfer.ChannelID
 	SectorNumber      abi.SectorNumber
+	// CounterOffer holds the terms the provider offered instead, when it
+	// rejected the proposal with a counter-offer
+	CounterOffer *market.DealProposal
+	// ReusePiece is true if the client agreed that the provider may use a
+	// copy of the piece it already holds, instead of the transferred data
+	ReusePiece bool
 }
 
 // StorageProviderInfo describes on chain information about a StorageProvider
@@ -265,6 +370,25 @@ type ProposeStorageDealResult struct {
 	ProposalCid cid.Cid
 }
 
+// DrainStatus reports on a storage provider that is draining deals before a
+// restart
+type DrainStatus struct {
+	// Draining is true while the provider rejects new deal proposals
+	Draining bool
+	// DealsBeforeStaged is the number of deals that have not been handed off
+	// to the sealing subsystem yet
+	DealsBeforeStaged int
+}
+
+// DryRunStorageDealResult is the result of a dry run of a deal proposal
+type DryRunStorageDealResult struct {
+	// ProposalCid is the CID of the unsigned deal proposal
+	ProposalCid cid.Cid
+	Accepted    bool
+	// Reason is the reason the provider gave for rejecting the deal
+	Reason string
+}
+
 // ProposeStorageDealParams describes the parameters for proposing a storage deal
 type ProposeStorageDealParams struct {
 	Addr          address.Address
@@ -277,6 +401,9 @@ type ProposeStorageDealParams struct {
 	Rt            abi.RegisteredSealProof
 	FastRetrieval bool
 	VerifiedDeal  bool
+	// ReusePiece allows the provider to skip the data transfer if it
+	// already holds the piece for the deal
+	ReusePiece bool
 }
 
 const (
@@ -29,7 +29,7 @@ func (t *ClientDeal) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{179}); err != nil {
+	if _, err := w.Write([]byte{181}); err != nil {
 		return err
 	}
 
@@ -371,6 +371,37 @@ func (t *ClientDeal) MarshalCBOR(w io.Writer) error {
 		return err
 	}
 
+	// t.CounterOffer (market.DealProposal) (struct)
+	if len("CounterOffer") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"CounterOffer\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("CounterOffer"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("CounterOffer")); err != nil {
+		return err
+	}
+
+	if err := t.CounterOffer.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.ReusePiece (bool) (bool)
+	if len("ReusePiece") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"ReusePiece\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("ReusePiece"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("ReusePiece")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.ReusePiece); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -707,6 +738,44 @@ func (t *ClientDeal) UnmarshalCBOR(r io.Reader) error {
 				t.SectorNumber = abi.SectorNumber(extra)
 
 			}
+			// t.CounterOffer (market.DealProposal) (struct)
+		case "CounterOffer":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.CounterOffer = new(market.DealProposal)
+					if err := t.CounterOffer.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.CounterOffer pointer: %w", err)
+					}
+				}
+
+			}
+			// t.ReusePiece (bool) (bool)
+		case "ReusePiece":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.ReusePiece = false
+			case 21:
+				t.ReusePiece = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -721,7 +790,7 @@ func (t *MinerDeal) MarshalCBOR(w io.Writer) error {
 		_, err := w.Write(cbg.CborNull)
 		return err
 	}
-	if _, err := w.Write([]byte{180}); err != nil {
+	if _, err := w.Write([]byte{184, 25}); err != nil {
 		return err
 	}
 
@@ -1106,6 +1175,86 @@ func (t *MinerDeal) MarshalCBOR(w io.Writer) error {
 	if _, err := io.WriteString(w, string(t.InboundCAR)); err != nil {
 		return err
 	}
+
+	// t.CounterOffer (market.DealProposal) (struct)
+	if len("CounterOffer") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"CounterOffer\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("CounterOffer"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("CounterOffer")); err != nil {
+		return err
+	}
+
+	if err := t.CounterOffer.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.HandoffAttempts (uint64) (uint64)
+	if len("HandoffAttempts") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"HandoffAttempts\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("HandoffAttempts"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("HandoffAttempts")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.HandoffAttempts)); err != nil {
+		return err
+	}
+
+	// t.HandoffFirstFailure (typegen.CborTime) (struct)
+	if len("HandoffFirstFailure") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"HandoffFirstFailure\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("HandoffFirstFailure"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("HandoffFirstFailure")); err != nil {
+		return err
+	}
+
+	if err := t.HandoffFirstFailure.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.NextHandoffRetry (typegen.CborTime) (struct)
+	if len("NextHandoffRetry") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"NextHandoffRetry\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("NextHandoffRetry"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("NextHandoffRetry")); err != nil {
+		return err
+	}
+
+	if err := t.NextHandoffRetry.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.ReusePiece (bool) (bool)
+	if len("ReusePiece") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"ReusePiece\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("ReusePiece"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("ReusePiece")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteBool(w, t.ReusePiece); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -1444,6 +1593,79 @@ func (t *MinerDeal) UnmarshalCBOR(r io.Reader) error {
 
 				t.InboundCAR = string(sval)
 			}
+			// t.CounterOffer (market.DealProposal) (struct)
+		case "CounterOffer":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.CounterOffer = new(market.DealProposal)
+					if err := t.CounterOffer.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.CounterOffer pointer: %w", err)
+					}
+				}
+
+			}
+			// t.HandoffAttempts (uint64) (uint64)
+		case "HandoffAttempts":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.HandoffAttempts = uint64(extra)
+
+			}
+			// t.HandoffFirstFailure (typegen.CborTime) (struct)
+		case "HandoffFirstFailure":
+
+			{
+
+				if err := t.HandoffFirstFailure.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.HandoffFirstFailure: %w", err)
+				}
+
+			}
+			// t.NextHandoffRetry (typegen.CborTime) (struct)
+		case "NextHandoffRetry":
+
+			{
+
+				if err := t.NextHandoffRetry.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.NextHandoffRetry: %w", err)
+				}
+
+			}
+			// t.ReusePiece (bool) (bool)
+		case "ReusePiece":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+			if maj != cbg.MajOther {
+				return fmt.Errorf("booleans must be major type 7")
+			}
+			switch extra {
+			case 20:
+				t.ReusePiece = false
+			case 21:
+				t.ReusePiece = true
+			default:
+				return fmt.Errorf("booleans are either major type 7, value 20 or 21 (got %d)", extra)
+			}
 
 		default:
 			// Field doesn't exist on this type, so ignore it
@@ -3079,3 +3301,478 @@ func (t *Log) UnmarshalCBOR(r io.Reader) error {
 
 	return nil
 }
+func (t *StorageCapabilities) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{167}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Miner (address.Address) (struct)
+	if len("Miner") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Miner\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Miner"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Miner")); err != nil {
+		return err
+	}
+
+	if err := t.Miner.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.TransferTypes ([]string) (slice)
+	if len("TransferTypes") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"TransferTypes\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("TransferTypes"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("TransferTypes")); err != nil {
+		return err
+	}
+
+	if len(t.TransferTypes) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.TransferTypes was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, uint64(len(t.TransferTypes))); err != nil {
+		return err
+	}
+	for _, v := range t.TransferTypes {
+		if len(v) > cbg.MaxLength {
+			return xerrors.Errorf("Value in field v was too long")
+		}
+
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(v))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, string(v)); err != nil {
+			return err
+		}
+	}
+
+	// t.MinPieceSize (abi.PaddedPieceSize) (uint64)
+	if len("MinPieceSize") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"MinPieceSize\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("MinPieceSize"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("MinPieceSize")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.MinPieceSize)); err != nil {
+		return err
+	}
+
+	// t.MaxPieceSize (abi.PaddedPieceSize) (uint64)
+	if len("MaxPieceSize") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"MaxPieceSize\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("MaxPieceSize"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("MaxPieceSize")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.MaxPieceSize)); err != nil {
+		return err
+	}
+
+	// t.VerifiedDeals (storagemarket.VerifiedDealPolicy) (uint64)
+	if len("VerifiedDeals") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"VerifiedDeals\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("VerifiedDeals"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("VerifiedDeals")); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.VerifiedDeals)); err != nil {
+		return err
+	}
+
+	// t.DealProtocols ([]string) (slice)
+	if len("DealProtocols") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"DealProtocols\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("DealProtocols"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("DealProtocols")); err != nil {
+		return err
+	}
+
+	if len(t.DealProtocols) > cbg.MaxLength {
+		return xerrors.Errorf("Slice value in field t.DealProtocols was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, uint64(len(t.DealProtocols))); err != nil {
+		return err
+	}
+	for _, v := range t.DealProtocols {
+		if len(v) > cbg.MaxLength {
+			return xerrors.Errorf("Value in field v was too long")
+		}
+
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(v))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, string(v)); err != nil {
+			return err
+		}
+	}
+
+	// t.Timestamp (abi.ChainEpoch) (int64)
+	if len("Timestamp") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Timestamp\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Timestamp"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Timestamp")); err != nil {
+		return err
+	}
+
+	if t.Timestamp >= 0 {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.Timestamp)); err != nil {
+			return err
+		}
+	} else {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-t.Timestamp-1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *StorageCapabilities) UnmarshalCBOR(r io.Reader) error {
+	*t = StorageCapabilities{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("StorageCapabilities: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Miner (address.Address) (struct)
+		case "Miner":
+
+			{
+
+				if err := t.Miner.UnmarshalCBOR(br); err != nil {
+					return xerrors.Errorf("unmarshaling t.Miner: %w", err)
+				}
+
+			}
+			// t.TransferTypes ([]string) (slice)
+		case "TransferTypes":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.TransferTypes: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.TransferTypes = make([]string, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				{
+					sval, err := cbg.ReadStringBuf(br, scratch)
+					if err != nil {
+						return err
+					}
+
+					t.TransferTypes[i] = string(sval)
+				}
+			}
+			// t.MinPieceSize (abi.PaddedPieceSize) (uint64)
+		case "MinPieceSize":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.MinPieceSize = abi.PaddedPieceSize(extra)
+
+			}
+			// t.MaxPieceSize (abi.PaddedPieceSize) (uint64)
+		case "MaxPieceSize":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.MaxPieceSize = abi.PaddedPieceSize(extra)
+
+			}
+			// t.VerifiedDeals (storagemarket.VerifiedDealPolicy) (uint64)
+		case "VerifiedDeals":
+
+			{
+
+				maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+				if err != nil {
+					return err
+				}
+				if maj != cbg.MajUnsignedInt {
+					return fmt.Errorf("wrong type for uint64 field")
+				}
+				t.VerifiedDeals = VerifiedDealPolicy(extra)
+
+			}
+			// t.DealProtocols ([]string) (slice)
+		case "DealProtocols":
+
+			maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			if extra > cbg.MaxLength {
+				return fmt.Errorf("t.DealProtocols: array too large (%d)", extra)
+			}
+
+			if maj != cbg.MajArray {
+				return fmt.Errorf("expected cbor array")
+			}
+
+			if extra > 0 {
+				t.DealProtocols = make([]string, extra)
+			}
+
+			for i := 0; i < int(extra); i++ {
+
+				{
+					sval, err := cbg.ReadStringBuf(br, scratch)
+					if err != nil {
+						return err
+					}
+
+					t.DealProtocols[i] = string(sval)
+				}
+			}
+			// t.Timestamp (abi.ChainEpoch) (int64)
+		case "Timestamp":
+			{
+				maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+				var extraI int64
+				if err != nil {
+					return err
+				}
+				switch maj {
+				case cbg.MajUnsignedInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 positive overflow")
+					}
+				case cbg.MajNegativeInt:
+					extraI = int64(extra)
+					if extraI < 0 {
+						return fmt.Errorf("int64 negative oveflow")
+					}
+					extraI = -1 - extraI
+				default:
+					return fmt.Errorf("wrong type for int64 field: %d", maj)
+				}
+
+				t.Timestamp = abi.ChainEpoch(extraI)
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
+func (t *SignedStorageCapabilities) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+	if _, err := w.Write([]byte{162}); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	// t.Capabilities (storagemarket.StorageCapabilities) (struct)
+	if len("Capabilities") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Capabilities\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Capabilities"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Capabilities")); err != nil {
+		return err
+	}
+
+	if err := t.Capabilities.MarshalCBOR(w); err != nil {
+		return err
+	}
+
+	// t.Signature (crypto.Signature) (struct)
+	if len("Signature") > cbg.MaxLength {
+		return xerrors.Errorf("Value in field \"Signature\" was too long")
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("Signature"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, string("Signature")); err != nil {
+		return err
+	}
+
+	if err := t.Signature.MarshalCBOR(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *SignedStorageCapabilities) UnmarshalCBOR(r io.Reader) error {
+	*t = SignedStorageCapabilities{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("cbor input should be of type map")
+	}
+
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("SignedStorageCapabilities: map struct too large (%d)", extra)
+	}
+
+	var name string
+	n := extra
+
+	for i := uint64(0); i < n; i++ {
+
+		{
+			sval, err := cbg.ReadStringBuf(br, scratch)
+			if err != nil {
+				return err
+			}
+
+			name = string(sval)
+		}
+
+		switch name {
+		// t.Capabilities (storagemarket.StorageCapabilities) (struct)
+		case "Capabilities":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.Capabilities = new(StorageCapabilities)
+					if err := t.Capabilities.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.Capabilities pointer: %w", err)
+					}
+				}
+
+			}
+			// t.Signature (crypto.Signature) (struct)
+		case "Signature":
+
+			{
+
+				b, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if b != cbg.CborNull[0] {
+					if err := br.UnreadByte(); err != nil {
+						return err
+					}
+					t.Signature = new(crypto.Signature)
+					if err := t.Signature.UnmarshalCBOR(br); err != nil {
+						return xerrors.Errorf("unmarshaling t.Signature pointer: %w", err)
+					}
+				}
+
+			}
+
+		default:
+			// Field doesn't exist on this type, so ignore it
+			cbg.ScanForLinks(r, func(cid.Cid) {})
+		}
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@ package storagemarket_test
 import (
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 )
 
@@ -11,3 +13,34 @@ func TestDealStagesNil(t *testing.T) {
 	ds.GetStage("none")                                  // no panic.
 	ds.AddStageLog("MyStage", "desc", "duration", "msg") // no panic.
 }
+
+func TestCheckProposal(t *testing.T) {
+	capabilities := storagemarket.StorageCapabilities{
+		TransferTypes: []string{storagemarket.TTGraphsync},
+		MinPieceSize:  256,
+		MaxPieceSize:  1 << 20,
+		VerifiedDeals: storagemarket.VerifiedDealsOnly,
+		DealProtocols: []string{storagemarket.OldDealProtocolID},
+	}
+
+	require.NoError(t, capabilities.CheckProposal(storagemarket.TTGraphsync, 1024, true))
+	// An empty transfer type is a graphsync transfer
+	require.NoError(t, capabilities.CheckProposal("", 1024, true))
+
+	require.EqualError(t, capabilities.CheckProposal(storagemarket.TTManual, 1024, true),
+		"transfer type manual not supported, provider supports [graphsync]")
+	require.EqualError(t, capabilities.CheckProposal(storagemarket.TTGraphsync, 128, true),
+		"piece size less than minimum required size: 128 < 256")
+	require.EqualError(t, capabilities.CheckProposal(storagemarket.TTGraphsync, 2<<20, true),
+		"piece size more than maximum allowed size: 2097152 > 1048576")
+	require.EqualError(t, capabilities.CheckProposal(storagemarket.TTGraphsync, 1024, false),
+		"only verified deals accepted")
+
+	capabilities.VerifiedDeals = storagemarket.VerifiedDealsRejected
+	require.EqualError(t, capabilities.CheckProposal(storagemarket.TTGraphsync, 1024, true),
+		"verified deals not accepted")
+
+	capabilities.DealProtocols = []string{"/fil/storage/mk/2.0.0"}
+	require.EqualError(t, capabilities.CheckProposal(storagemarket.TTGraphsync, 1024, false),
+		"no supported deal protocol version, provider supports [/fil/storage/mk/2.0.0]")
+}
@@ -40,6 +40,23 @@ type DAGStoreWrapper interface {
 
 	GetIterableIndexForPiece(pieceCid cid.Cid) (carindex.IterableIndex, error)
 
+	// ListShards returns the piece CID of every shard in the DAG store
+	ListShards(ctx context.Context) ([]cid.Cid, error)
+
+	// ReplaceIndexForPiece replaces the stored index of the shard for a
+	// piece, eg with an index rebuilt after it was found to be corrupt, and
+	// adds the blocks in the index to the top-level index
+	ReplaceIndexForPiece(ctx context.Context, pieceCid cid.Cid, idx carindex.Index) error
+
+	// DestroyShard removes the shard for a piece from the DAG store, along
+	// with its index and any transient copy of its data, sending the result
+	// on the supplied channel on completion
+	DestroyShard(ctx context.Context, pieceCid cid.Cid, resch chan dagstore.ShardResult) error
+
+	// GC removes the transient copies of shard data that are not in use,
+	// and returns the result for each shard that was collected
+	GC(ctx context.Context) (*dagstore.GCResult, error)
+
 	// Close closes the dag store wrapper.
 	Close() error
 }
@@ -61,3 +78,19 @@ func RegisterShardSync(ctx context.Context, ds DAGStoreWrapper, pieceCid cid.Cid
 		return res.Error
 	}
 }
+
+// DestroyShardSync calls the DAGStore DestroyShard method and waits
+// synchronously in a dedicated channel until the shard has been destroyed.
+func DestroyShardSync(ctx context.Context, ds DAGStoreWrapper, pieceCid cid.Cid) error {
+	resch := make(chan dagstore.ShardResult, 1)
+	if err := ds.DestroyShard(ctx, pieceCid, resch); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-resch:
+		return res.Error
+	}
+}
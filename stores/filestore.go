@@ -17,8 +17,29 @@ import (
 
 // ReadOnlyFilestore opens the CAR in the specified path as as a read-only
 // blockstore, and fronts it with a Filestore whose positional mappings are
-// stored inside the CAR itself. It must be closed after done.
+// stored in a key-value datastore next to the CAR. Filestores created before
+// the positional mappings were moved out of the CAR, that have not yet been
+// migrated with MigrateFilestore, are read from the CAR. It must be closed
+// after done. The datastore is created if it does not exist, so a filestore
+// must be deleted with RemoveFilestore.
 func ReadOnlyFilestore(path string) (ClosableBlockstore, error) {
+	lk := filestoreLock(path)
+	lk.RLock()
+	defer lk.RUnlock()
+
+	legacy, err := isLegacyFilestore(path)
+	if err != nil {
+		return nil, err
+	}
+	if !legacy {
+		return kvReadOnlyFilestore(path)
+	}
+	return legacyReadOnlyFilestore(path)
+}
+
+// legacyReadOnlyFilestore opens a filestore whose positional mappings are
+// stored inside the CAR itself
+func legacyReadOnlyFilestore(path string) (ClosableBlockstore, error) {
 	ro, err := OpenReadOnly(path,
 		carv2.ZeroLengthSectionAsEOF(true),
 		blockstore.UseWholeCIDs(true),
@@ -38,9 +59,28 @@ func ReadOnlyFilestore(path string) (ClosableBlockstore, error) {
 
 // ReadWriteFilestore opens the CAR in the specified path as as a read-write
 // blockstore, and fronts it with a Filestore whose positional mappings are
-// stored inside the CAR itself. It must be closed after done. Closing will
-// finalize the CAR blockstore.
+// stored in a key-value datastore next to the CAR. An existing filestore
+// that stores its positional mappings inside the CAR keeps doing so. It must
+// be closed after done. Closing will finalize the CAR blockstore. A filestore
+// must be deleted with RemoveFilestore, which also deletes the datastore.
 func ReadWriteFilestore(path string, roots ...cid.Cid) (ClosableBlockstore, error) {
+	lk := filestoreLock(path)
+	lk.RLock()
+	defer lk.RUnlock()
+
+	legacy, err := isLegacyFilestore(path)
+	if err != nil {
+		return nil, err
+	}
+	if !legacy {
+		return kvReadWriteFilestore(path, roots...)
+	}
+	return legacyReadWriteFilestore(path, roots...)
+}
+
+// legacyReadWriteFilestore opens a read-write filestore whose positional
+// mappings are stored inside the CAR itself
+func legacyReadWriteFilestore(path string, roots ...cid.Cid) (ClosableBlockstore, error) {
 	rw, err := OpenReadWrite(path, roots,
 		carv2.ZeroLengthSectionAsEOF(true),
 		blockstore.UseWholeCIDs(true),
@@ -62,24 +102,24 @@ func ReadWriteFilestore(path string, roots ...cid.Cid) (ClosableBlockstore, erro
 // blockstore into a datastore. The resulting blockstore is suitable for usage
 // with DagBuilderHelper with DagBuilderParams#NoCopy=true.
 func FilestoreOf(bs bstore.Blockstore) (bstore.Blockstore, error) {
-	coercer := &dsCoercer{bs}
-
 	// the FileManager stores positional infos (positional mappings) in a
 	// datastore, which in our case is the blockstore coerced into a datastore.
-	//
+	return filestoreWithDatastore(bs, &dsCoercer{bs}), nil
+}
+
+// filestoreWithDatastore returns a Filestore that stores intermediate nodes
+// in the blockstore and positional mappings in the datastore.
+func filestoreWithDatastore(bs bstore.Blockstore, ds datastore.Batching) bstore.Blockstore {
 	// Passing the root dir as a base path makes me uneasy, but these filestores
 	// are only used locally.
-	fm := filestore.NewFileManager(coercer, "/")
+	fm := filestore.NewFileManager(ds, "/")
 	fm.AllowFiles = true
 
 	// the Filestore sifts leaves (PosInfos) from intermediate nodes. It writes
-	// PosInfo leaves to the datastore (which in our case is the coerced
-	// blockstore), and the intermediate nodes to the blockstore proper (since
-	// they cannot be mapped to the file.
+	// PosInfo leaves to the datastore, and the intermediate nodes to the
+	// blockstore proper (since they cannot be mapped to the file.
 	fstore := filestore.NewFilestore(bs, fm)
-	bs = bstore.NewIdStore(fstore)
-
-	return bs, nil
+	return bstore.NewIdStore(fstore)
 }
 
 var cidBuilder = cid.V1Builder{Codec: cid.Raw, MhType: mh.SHA2_256}
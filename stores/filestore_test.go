@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ipfs/go-blockservice"
@@ -44,6 +45,10 @@ func TestFilestoreRoundtrip(t *testing.T) {
 	require.NoError(t, fs.Close())
 	require.Equal(t, root, root2)
 
+	// the positional mappings are stored next to the CAR file
+	_, err = os.Stat(tmpCARv2.Name() + PosInfoSuffix)
+	require.NoError(t, err)
+
 	// it works if we use a Filestore backed by the given CAR file
 	fs, err = ReadOnlyFilestore(tmpCARv2.Name())
 	require.NoError(t, err)
@@ -88,6 +93,136 @@ func TestReadOnlyFilestoreWithDenseCARFile(t *testing.T) {
 	require.EqualValues(t, origContent, finalBytes)
 }
 
+func TestMigrateLegacyFilestore(t *testing.T) {
+	ctx := context.Background()
+	normalFilePath, origBytes := createFile(t, 10, 10485760)
+	path := filepath.Join(t.TempDir(), "car")
+	root := writeLegacyFilestore(t, path, normalFilePath)
+
+	legacy, err := isLegacyFilestore(path)
+	require.NoError(t, err)
+	require.True(t, legacy)
+
+	// the legacy filestore can be read before it is migrated
+	before, err := ReadOnlyFilestore(path)
+	require.NoError(t, err)
+
+	migrated, err := MigrateFilestore(ctx, path)
+	require.NoError(t, err)
+	require.True(t, migrated)
+
+	legacy, err = isLegacyFilestore(path)
+	require.NoError(t, err)
+	require.False(t, legacy)
+	_, err = os.Stat(path + migratingSuffix)
+	require.True(t, os.IsNotExist(err))
+
+	// a reader opened before the migration keeps working
+	fbz, err := dagToNormalFile(t, ctx, root, before)
+	require.NoError(t, err)
+	require.EqualValues(t, origBytes, fbz)
+	require.NoError(t, before.Close())
+
+	// the migrated filestore has the same contents
+	after, err := ReadOnlyFilestore(path)
+	require.NoError(t, err)
+	fbz, err = dagToNormalFile(t, ctx, root, after)
+	require.NoError(t, err)
+	require.EqualValues(t, origBytes, fbz)
+	require.NoError(t, after.Close())
+
+	// migrating again does nothing
+	migrated, err = MigrateFilestore(ctx, path)
+	require.NoError(t, err)
+	require.False(t, migrated)
+}
+
+func TestMigrateFilestores(t *testing.T) {
+	ctx := context.Background()
+	normalFilePath, origBytes := createFile(t, 10, 1024)
+	dir := t.TempDir()
+
+	legacyPath := filepath.Join(dir, "legacy")
+	root := writeLegacyFilestore(t, legacyPath, normalFilePath)
+
+	kvPath := filepath.Join(dir, "kv")
+	fs, err := ReadWriteFilestore(kvPath, root)
+	require.NoError(t, err)
+	dagSvc := merkledag.NewDAGService(blockservice.New(fs, offline.Exchange(fs)))
+	require.Equal(t, root, unixfs.WriteUnixfsDAGTo(t, normalFilePath, dagSvc))
+	require.NoError(t, fs.Close())
+
+	// filestores that don't need migrating, or don't exist, are skipped
+	MigrateFilestores(ctx, []string{kvPath, filepath.Join(dir, "missing"), legacyPath})
+
+	for _, path := range []string{legacyPath, kvPath} {
+		legacy, err := isLegacyFilestore(path)
+		require.NoError(t, err)
+		require.False(t, legacy)
+
+		fs, err := ReadOnlyFilestore(path)
+		require.NoError(t, err)
+		fbz, err := dagToNormalFile(t, ctx, root, fs)
+		require.NoError(t, err)
+		require.EqualValues(t, origBytes, fbz)
+		require.NoError(t, fs.Close())
+	}
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCompleteInterruptedFilestoreMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "car")
+	require.NoError(t, ioutil.WriteFile(path, []byte("car"), 0644))
+	require.NoError(t, os.Mkdir(path+PosInfoSuffix+migratingSuffix, 0755))
+
+	// the migrated CAR replaced the legacy CAR, but the positional mappings
+	// were not moved into place
+	legacy, err := isLegacyFilestore(path)
+	require.NoError(t, err)
+	require.False(t, legacy)
+	_, err = os.Stat(path + PosInfoSuffix)
+	require.NoError(t, err)
+}
+
+func TestRemoveFilestore(t *testing.T) {
+	normalFilePath, _ := createFile(t, 10, 1024)
+	root := writeUnixfsDAGInmemory(t, normalFilePath)
+	path := filepath.Join(t.TempDir(), "car")
+
+	fs, err := ReadWriteFilestore(path, root)
+	require.NoError(t, err)
+	dagSvc := merkledag.NewDAGService(blockservice.New(fs, offline.Exchange(fs)))
+	require.Equal(t, root, unixfs.WriteUnixfsDAGTo(t, normalFilePath, dagSvc))
+
+	// an open filestore is not removed
+	require.Error(t, RemoveFilestore(path))
+	require.NoError(t, fs.Close())
+
+	// the CAR and its positional mappings are removed together
+	require.NoError(t, RemoveFilestore(path))
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + PosInfoSuffix)
+	require.True(t, os.IsNotExist(err))
+
+	// removing a filestore that does not exist is not an error
+	require.NoError(t, RemoveFilestore(path))
+}
+
+// writeLegacyFilestore writes the file to a filestore that stores its
+// positional mappings in the CAR, and returns the root of the DAG
+func writeLegacyFilestore(t *testing.T, path string, normalFilePath string) cid.Cid {
+	root := writeUnixfsDAGInmemory(t, normalFilePath)
+
+	fs, err := legacyReadWriteFilestore(path, root)
+	require.NoError(t, err)
+	dagSvc := merkledag.NewDAGService(blockservice.New(fs, offline.Exchange(fs)))
+	require.Equal(t, root, unixfs.WriteUnixfsDAGTo(t, normalFilePath, dagSvc))
+	require.NoError(t, fs.Close())
+	return root
+}
+
 func dagToNormalFile(t *testing.T, ctx context.Context, root cid.Cid, bs bstore.Blockstore) ([]byte, error) {
 	outputF, err := os.CreateTemp(t.TempDir(), "rand")
 	if err != nil {
@@ -41,8 +41,9 @@ import (
 	existing nodes, or adding an option to go-car which would break the CAR spec
 	(it also contains this hack to a single repo).
 
-	Ideally we should migrate to a real KV store, but even for that we'll still
-	need this code for the migration process.
+	New filestores keep their positional mappings in a real KV store (see
+	kvfilestore.go). This code is still needed to read filestores created
+	before that, and to migrate them with MigrateFilestore.
 
 */
 
@@ -0,0 +1,442 @@
+package stores
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/ipfs/go-filestore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipfs/go-merkledag"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+var log = logging.Logger("stores")
+
+// PosInfoSuffix is appended to the path of a filestore CAR to get the path
+// of the key-value datastore that holds its positional mappings. The
+// datastore is a leveldb directory next to the CAR, and is part of the
+// filestore: the CAR cannot be read as a filestore without it, and it must
+// be moved or deleted together with the CAR. Use RemoveFilestore to delete
+// a filestore.
+const PosInfoSuffix = ".posinfo"
+
+// migratingSuffix is appended to the paths of the CAR and the datastore
+// that a legacy filestore is migrated to, until the migration completes
+const migratingSuffix = ".migrating"
+
+// filestoreLocks serialises opening a filestore with the last step of
+// migrating it, so that a filestore is never opened half-migrated. It also
+// tracks the filestores being migrated, so that each is only migrated once
+// at a time.
+var filestoreLocks = struct {
+	sync.Mutex
+	paths     map[string]*sync.RWMutex
+	migrating map[string]struct{}
+}{
+	paths:     make(map[string]*sync.RWMutex),
+	migrating: make(map[string]struct{}),
+}
+
+func filestoreLock(path string) *sync.RWMutex {
+	filestoreLocks.Lock()
+	defer filestoreLocks.Unlock()
+
+	lk, ok := filestoreLocks.paths[path]
+	if !ok {
+		lk = &sync.RWMutex{}
+		filestoreLocks.paths[path] = lk
+	}
+	return lk
+}
+
+// posInfoStores shares open positional mapping datastores between the
+// filestores for the same CAR, as the datastore can only be opened once
+var posInfoStores = struct {
+	sync.Mutex
+	open map[string]*sharedPosInfoStore
+}{open: make(map[string]*sharedPosInfoStore)}
+
+type sharedPosInfoStore struct {
+	*leveldb.Datastore
+	refs int
+}
+
+func openPosInfoStore(path string) (*leveldb.Datastore, error) {
+	posInfoStores.Lock()
+	defer posInfoStores.Unlock()
+
+	if s, ok := posInfoStores.open[path]; ok {
+		s.refs++
+		return s.Datastore, nil
+	}
+	ds, err := leveldb.NewDatastore(path, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("opening positional mappings datastore %s: %w", path, err)
+	}
+	posInfoStores.open[path] = &sharedPosInfoStore{Datastore: ds, refs: 1}
+	return ds, nil
+}
+
+func closePosInfoStore(path string) error {
+	posInfoStores.Lock()
+	defer posInfoStores.Unlock()
+
+	s, ok := posInfoStores.open[path]
+	if !ok {
+		return nil
+	}
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(posInfoStores.open, path)
+	return s.Close()
+}
+
+// RemoveFilestore deletes a filestore CAR together with the key-value
+// datastore of its positional mappings, and any files left behind by an
+// interrupted migration. The filestore must have been closed. It is not an
+// error if the CAR or the datastore do not exist, so it can also be used to
+// delete a CAR that is not a filestore.
+func RemoveFilestore(path string) error {
+	lk := filestoreLock(path)
+	lk.Lock()
+	defer lk.Unlock()
+
+	posInfoStores.Lock()
+	_, open := posInfoStores.open[path+PosInfoSuffix]
+	posInfoStores.Unlock()
+	if open {
+		return xerrors.Errorf("removing filestore %s: filestore is still open", path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("removing filestore %s: %w", path, err)
+	}
+	for _, p := range []string{path + PosInfoSuffix, path + migratingSuffix, path + PosInfoSuffix + migratingSuffix} {
+		if err := os.RemoveAll(p); err != nil {
+			return xerrors.Errorf("removing filestore %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// isLegacyFilestore returns true if the CAR in the specified path is a
+// filestore whose positional mappings are stored inside the CAR itself
+func isLegacyFilestore(path string) (bool, error) {
+	// Finish a migration that was interrupted after the migrated CAR
+	// replaced the legacy CAR
+	if err := completeMigration(path); err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(path + PosInfoSuffix); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return st.Size() > 0, nil
+}
+
+// kvReadOnlyFilestore opens a filestore whose positional mappings are
+// stored in a key-value datastore next to the CAR
+func kvReadOnlyFilestore(path string) (ClosableBlockstore, error) {
+	ro, err := blockstore.OpenReadOnly(path,
+		carv2.ZeroLengthSectionAsEOF(true),
+		blockstore.UseWholeCIDs(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := openPosInfoStore(path + PosInfoSuffix)
+	if err != nil {
+		_ = ro.Close()
+		return nil, err
+	}
+
+	return &closableBlockstore{
+		Blockstore: filestoreWithDatastore(ro, ds),
+		closeFn: func() error {
+			err := ro.Close()
+			if dsErr := closePosInfoStore(path + PosInfoSuffix); err == nil {
+				err = dsErr
+			}
+			return err
+		},
+	}, nil
+}
+
+// kvReadWriteFilestore opens a read-write filestore whose positional
+// mappings are stored in a key-value datastore next to the CAR
+func kvReadWriteFilestore(path string, roots ...cid.Cid) (ClosableBlockstore, error) {
+	// Create the datastore before the CAR: a CAR without a datastore is a
+	// legacy filestore, so a new CAR must never exist without one
+	ds, err := openPosInfoStore(path + PosInfoSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := blockstore.OpenReadWrite(path, roots,
+		carv2.ZeroLengthSectionAsEOF(true),
+		blockstore.UseWholeCIDs(true),
+	)
+	if err != nil {
+		_ = closePosInfoStore(path + PosInfoSuffix)
+		return nil, err
+	}
+
+	return &closableBlockstore{
+		Blockstore: filestoreWithDatastore(rw, ds),
+		closeFn: func() error {
+			err := rw.Finalize()
+			if dsErr := closePosInfoStore(path + PosInfoSuffix); err == nil {
+				err = dsErr
+			}
+			return err
+		},
+	}, nil
+}
+
+// MigrateFilestore converts a filestore CAR that stores its positional
+// mappings inside the CAR itself to a CAR with a key-value datastore for
+// its positional mappings. Filestores can be read while they are being
+// migrated; the migrated filestore replaces the legacy one once it is
+// complete. It returns false if the filestore did not need migrating.
+func MigrateFilestore(ctx context.Context, path string) (bool, error) {
+	filestoreLocks.Lock()
+	if _, ok := filestoreLocks.migrating[path]; ok {
+		filestoreLocks.Unlock()
+		return false, xerrors.Errorf("filestore %s is already being migrated", path)
+	}
+	filestoreLocks.migrating[path] = struct{}{}
+	filestoreLocks.Unlock()
+	defer func() {
+		filestoreLocks.Lock()
+		delete(filestoreLocks.migrating, path)
+		filestoreLocks.Unlock()
+	}()
+
+	lk := filestoreLock(path)
+	lk.Lock()
+	legacy, err := isLegacyFilestore(path)
+	lk.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !legacy {
+		return false, nil
+	}
+
+	// Start again from scratch if an earlier migration was interrupted
+	carTmp := path + migratingSuffix
+	kvTmp := path + PosInfoSuffix + migratingSuffix
+	if err := os.RemoveAll(carTmp); err != nil {
+		return false, err
+	}
+	if err := os.RemoveAll(kvTmp); err != nil {
+		return false, err
+	}
+
+	before, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if err := copyLegacyFilestore(ctx, path, carTmp, kvTmp); err != nil {
+		_ = os.RemoveAll(carTmp)
+		_ = os.RemoveAll(kvTmp)
+		return false, xerrors.Errorf("migrating filestore %s: %w", path, err)
+	}
+
+	// Swap in the migrated filestore. Readers that already have the legacy
+	// CAR open keep reading it until they close it.
+	lk.Lock()
+	defer lk.Unlock()
+
+	// Give up if the legacy filestore was written to during the migration
+	after, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		_ = os.RemoveAll(carTmp)
+		_ = os.RemoveAll(kvTmp)
+		return false, xerrors.Errorf("migrating filestore %s: filestore was modified during migration", path)
+	}
+
+	if err := os.Rename(carTmp, path); err != nil {
+		return false, xerrors.Errorf("replacing legacy filestore %s: %w", path, err)
+	}
+	if err := completeMigration(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MigrateFilestores migrates each of the legacy filestores in the list,
+// logging any that fail. It is safe to run in the background while the
+// filestores are in use.
+//
+// Only the application knows where its filestores are, so it must call
+// MigrateFilestores itself, eg at start-up with the paths of its imports.
+// Filestores that are not migrated keep working, but keep their positional
+// mappings in the CAR. Paths that are not legacy filestores, or that do not
+// exist, are skipped.
+func MigrateFilestores(ctx context.Context, paths []string) {
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+		migrated, err := MigrateFilestore(ctx, path)
+		if err != nil {
+			log.Errorf("migrating filestore %s: %s", path, err)
+			continue
+		}
+		if migrated {
+			log.Infof("migrated filestore %s to key-value positional mappings", path)
+		}
+	}
+}
+
+// completeMigration moves the migrated positional mappings into place if
+// the migrated CAR has already replaced the legacy CAR
+func completeMigration(path string) error {
+	kvTmp := path + PosInfoSuffix + migratingSuffix
+	if _, err := os.Stat(kvTmp); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(path + migratingSuffix); err == nil {
+		// The CAR has not been replaced yet
+		return nil
+	}
+	if err := os.Rename(kvTmp, path+PosInfoSuffix); err != nil {
+		if _, statErr := os.Stat(kvTmp); os.IsNotExist(statErr) {
+			// Completed by another reader at the same time
+			return nil
+		}
+		return xerrors.Errorf("completing migration of filestore %s: %w", path, err)
+	}
+	return nil
+}
+
+// copyLegacyFilestore walks the DAGs in a legacy filestore CAR, copying
+// intermediate blocks to a new CAR and positional mappings to a new
+// key-value datastore
+func copyLegacyFilestore(ctx context.Context, path string, carPath string, kvPath string) error {
+	ro, err := OpenReadOnly(path,
+		carv2.ZeroLengthSectionAsEOF(true),
+		blockstore.UseWholeCIDs(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer ro.Close() // nolint
+
+	roots, err := ro.Roots()
+	if err != nil {
+		return xerrors.Errorf("reading roots: %w", err)
+	}
+	legacyFs, err := FilestoreOf(ro)
+	if err != nil {
+		return err
+	}
+	legacyMappings := datastore.Datastore(&dsCoercer{ro})
+
+	// Create the CAR before the datastore: a datastore without a CAR means
+	// the migrated CAR is already in place
+	rw, err := blockstore.OpenReadWrite(carPath, roots,
+		carv2.ZeroLengthSectionAsEOF(true),
+		blockstore.UseWholeCIDs(true),
+	)
+	if err != nil {
+		return err
+	}
+	kv, err := leveldb.NewDatastore(kvPath, nil)
+	if err != nil {
+		rw.Discard()
+		return err
+	}
+
+	dag := merkledag.NewDAGService(blockservice.New(legacyFs, offline.Exchange(legacyFs)))
+	seen := make(map[cid.Cid]struct{})
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if _, ok := seen[c]; ok {
+			return nil
+		}
+		seen[c] = struct{}{}
+		if c.Prefix().MhType == mh.IDENTITY {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		has, err := ro.Has(ctx, c)
+		if err != nil {
+			return err
+		}
+		if has {
+			blk, err := ro.Get(ctx, c)
+			if err != nil {
+				return err
+			}
+			if err := rw.Put(ctx, blk); err != nil {
+				return err
+			}
+		} else {
+			// The block is a leaf that refers to a position in a file
+			key := filestore.FilestorePrefix.Child(dshelp.MultihashToDsKey(c.Hash()))
+			posInfo, err := legacyMappings.Get(ctx, key)
+			if err != nil {
+				return xerrors.Errorf("getting positional mapping for %s: %w", c, err)
+			}
+			if err := kv.Put(ctx, key, posInfo); err != nil {
+				return err
+			}
+		}
+
+		nd, err := dag.Get(ctx, c)
+		if err != nil {
+			return xerrors.Errorf("getting node %s: %w", c, err)
+		}
+		for _, l := range nd.Links() {
+			if err := walk(l.Cid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := walk(root); err != nil {
+			rw.Discard()
+			_ = kv.Close()
+			return err
+		}
+	}
+
+	if err := rw.Finalize(); err != nil {
+		_ = kv.Close()
+		return xerrors.Errorf("finalizing migrated CAR: %w", err)
+	}
+	return kv.Close()
+}
@@ -1,60 +1,413 @@
 package stores
 
 import (
+	"container/list"
+	"context"
 	"io"
 	"sync"
+	"time"
 
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	"golang.org/x/xerrors"
 )
 
-// ReadOnlyBlockstores tracks open read blockstores.
+// DefaultIdleShardTimeout is how long a shard that is no longer used by any
+// deal stays open, in case another deal for the same piece comes along
+const DefaultIdleShardTimeout = time.Minute
+
+// DefaultMaxOpenShards is the default maximum number of shards that are kept
+// open. Shards in use by a deal are never closed, so the number of open
+// shards can go above the maximum when that many are in use.
+const DefaultMaxOpenShards = 64
+
+// ReadOnlyBlockstoresStats are statistics about the shards opened by a
+// ReadOnlyBlockstores, for monitoring
+type ReadOnlyBlockstoresStats struct {
+	// Open is the number of shards that are open
+	Open int
+	// InUse is the number of open shards used by at least one deal
+	InUse int
+	// Idle is the number of open shards that no deal is using
+	Idle int
+	// Deals is the number of deals using a blockstore
+	Deals int
+	// Shared is the number of times a deal used a shard that was
+	// already open
+	Shared uint64
+	// Loaded is the number of times a shard was opened
+	Loaded uint64
+	// Evicted is the number of idle shards closed to stay within the
+	// maximum number of open shards
+	Evicted uint64
+	// Expired is the number of shards closed because they were idle for
+	// longer than the idle timeout
+	Expired uint64
+	// LeasesOverrun is the number of times a deal used a shard for longer
+	// than the shard lease
+	LeasesOverrun uint64
+}
+
+// ReadOnlyBlockstoresOption configures a ReadOnlyBlockstores
+type ReadOnlyBlockstoresOption func(*ReadOnlyBlockstores)
+
+// IdleShardTimeout sets how long a shard stays open after the last deal
+// using it is done. A timeout of zero closes shards as soon as they are
+// idle.
+func IdleShardTimeout(timeout time.Duration) ReadOnlyBlockstoresOption {
+	return func(r *ReadOnlyBlockstores) {
+		r.idleTimeout = timeout
+	}
+}
+
+// MaxOpenShards sets the maximum number of shards to keep open. When there
+// are more, the least recently used idle shards are closed. Zero means no
+// maximum.
+func MaxOpenShards(max int) ReadOnlyBlockstoresOption {
+	return func(r *ReadOnlyBlockstores) {
+		r.maxOpen = max
+	}
+}
+
+// ShardLease sets how long a deal is expected to use a shard. A deal that
+// uses a shard for longer is logged and counted in the stats, but the shard
+// stays open, as the deal may still be reading from it. Zero, the default,
+// turns the check off.
+func ShardLease(lease time.Duration) ReadOnlyBlockstoresOption {
+	return func(r *ReadOnlyBlockstores) {
+		r.lease = lease
+	}
+}
+
+// sharedBlockstore is a shard shared by the deals that use it
+type sharedBlockstore struct {
+	key string
+	bs  bstore.Blockstore
+	err error
+	// ready is closed once the shard has been opened, or failed to open
+	ready chan struct{}
+	refs  int
+	// idle is the shard's element in the idle list, when no deal uses it
+	idle      *list.Element
+	idleTimer *time.Timer
+	// idleGen identifies the latest time the shard became idle, so that a
+	// timer from an earlier idle period does not close it
+	idleGen uint64
+	// shared is false for blockstores that were opened by the caller
+	shared bool
+}
+
+// dealLease is a deal's reference to a shard
+type dealLease struct {
+	s *sharedBlockstore
+	// timer reports the deal when the lease runs over
+	timer *time.Timer
+}
+
+// ReadOnlyBlockstores tracks open read blockstores. Deals that read the same
+// shard share one open blockstore, which is reference counted. When no deal
+// is using a blockstore any more, it is kept open until it has been idle for
+// a timeout, or is evicted to keep the number of open blockstores within a
+// maximum. A blockstore is never closed while a deal is using it; deals that
+// use one for longer than the shard lease are reported, to find deals that
+// are never untracked.
 type ReadOnlyBlockstores struct {
-	mu     sync.RWMutex
-	stores map[string]bstore.Blockstore
+	idleTimeout time.Duration
+	maxOpen     int
+	lease       time.Duration
+
+	mu     sync.Mutex
+	shards map[string]*sharedBlockstore
+	deals  map[string]*dealLease
+	// idle holds the shards no deal is using, the most recently used first
+	idle  *list.List
+	stats ReadOnlyBlockstoresStats
 }
 
-func NewReadOnlyBlockstores() *ReadOnlyBlockstores {
-	return &ReadOnlyBlockstores{
-		stores: make(map[string]bstore.Blockstore),
+func NewReadOnlyBlockstores(opts ...ReadOnlyBlockstoresOption) *ReadOnlyBlockstores {
+	r := &ReadOnlyBlockstores{
+		idleTimeout: DefaultIdleShardTimeout,
+		maxOpen:     DefaultMaxOpenShards,
+		shards:      make(map[string]*sharedBlockstore),
+		deals:       make(map[string]*dealLease),
+		idle:        list.New(),
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
+// Track tracks a blockstore that the caller opened for the given key. The
+// blockstore is not shared with other keys, and is closed as soon as the
+// key is untracked. It returns false if the key is already tracked.
 func (r *ReadOnlyBlockstores) Track(key string, bs bstore.Blockstore) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, ok := r.stores[key]; ok {
+	if _, ok := r.deals[key]; ok {
 		return false, nil
 	}
 
-	r.stores[key] = bs
+	s := &sharedBlockstore{key: key, bs: bs, ready: make(chan struct{}), refs: 1}
+	close(s.ready)
+	r.leaseLocked(key, s)
 	return true, nil
 }
 
+// Acquire returns the blockstore for the shard with the given shard key,
+// and tracks it for the deal with the given key. If the shard is already
+// open it is shared, otherwise it is opened with the open function.
+func (r *ReadOnlyBlockstores) Acquire(ctx context.Context, key string, shardKey string, open func(context.Context) (bstore.Blockstore, error)) (bstore.Blockstore, error) {
+	r.mu.Lock()
+	if l, ok := r.deals[key]; ok {
+		r.mu.Unlock()
+		return r.await(ctx, key, l.s)
+	}
+
+	s, ok := r.shards[shardKey]
+	if ok {
+		r.refLocked(s)
+		r.leaseLocked(key, s)
+		r.stats.Shared++
+		r.mu.Unlock()
+		return r.await(ctx, key, s)
+	}
+
+	s = &sharedBlockstore{key: shardKey, ready: make(chan struct{}), refs: 1, shared: true}
+	r.shards[shardKey] = s
+	r.leaseLocked(key, s)
+	r.stats.Loaded++
+	r.mu.Unlock()
+
+	bs, err := open(ctx)
+
+	r.mu.Lock()
+	s.bs, s.err = bs, err
+	close(s.ready)
+	var toClose []*sharedBlockstore
+	if err == nil {
+		toClose = r.evictLocked()
+	}
+	r.mu.Unlock()
+	_ = closeShards(toClose)
+
+	return r.await(ctx, key, s)
+}
+
+// await waits for a shard to be opened. If it fails to open, the deal
+// stops tracking it.
+func (r *ReadOnlyBlockstores) await(ctx context.Context, key string, s *sharedBlockstore) (bstore.Blockstore, error) {
+	select {
+	case <-ctx.Done():
+		_ = r.Untrack(key)
+		return nil, ctx.Err()
+	case <-s.ready:
+	}
+
+	if s.err != nil {
+		_ = r.Untrack(key)
+		return nil, xerrors.Errorf("failed to open shard %s: %w", s.key, s.err)
+	}
+	return s.bs, nil
+}
+
 func (r *ReadOnlyBlockstores) Get(key string) (bstore.Blockstore, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	if bs, ok := r.stores[key]; ok {
-		return bs, nil
+	if l, ok := r.deals[key]; ok {
+		select {
+		case <-l.s.ready:
+			if l.s.err == nil {
+				return l.s.bs, nil
+			}
+		default:
+		}
 	}
 
 	return nil, xerrors.Errorf("could not get blockstore for key %s: %w", key, ErrNotFound)
 }
 
+// Untrack stops tracking the blockstore for the given key. Once no key is
+// using a shard, the shard is closed when it has been idle for the idle
+// timeout, or when it is evicted.
 func (r *ReadOnlyBlockstores) Untrack(key string) error {
 	r.mu.Lock()
+
+	l, ok := r.deals[key]
+	if !ok {
+		r.mu.Unlock()
+		return nil
+	}
+	delete(r.deals, key)
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	s := l.s
+	s.refs--
+	if s.refs > 0 {
+		r.mu.Unlock()
+		return nil
+	}
+
+	// Shards that failed to open, or that were opened by the caller, are
+	// not kept once they are no longer used
+	if s.err != nil || r.idleTimeout == 0 || !s.shared || r.shards[s.key] != s {
+		r.removeLocked(s)
+		r.mu.Unlock()
+		return closeShard(s)
+	}
+
+	s.idle = r.idle.PushFront(s)
+	s.idleGen++
+	gen := s.idleGen
+	s.idleTimer = time.AfterFunc(r.idleTimeout, func() { r.expire(s, gen) })
+	toClose := r.evictLocked()
+	r.mu.Unlock()
+
+	_ = closeShards(toClose)
+	return nil
+}
+
+// Stats returns statistics about the open shards
+func (r *ReadOnlyBlockstores) Stats() ReadOnlyBlockstoresStats {
+	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if bs, ok := r.stores[key]; ok {
-		delete(r.stores, key)
-		if closer, ok := bs.(io.Closer); ok {
-			if err := closer.Close(); err != nil {
-				return xerrors.Errorf("failed to close read-only blockstore: %w", err)
-			}
+	stats := r.stats
+	stats.Open = len(r.shards)
+	stats.Idle = r.idle.Len()
+	stats.InUse = stats.Open - stats.Idle
+	stats.Deals = len(r.deals)
+	return stats
+}
+
+// Close closes all the open blockstores
+func (r *ReadOnlyBlockstores) Close() error {
+	r.mu.Lock()
+	toClose := make([]*sharedBlockstore, 0, len(r.shards))
+	for _, s := range r.shards {
+		toClose = append(toClose, s)
+	}
+	for _, l := range r.deals {
+		if l.timer != nil {
+			l.timer.Stop()
+		}
+		if !l.s.shared {
+			toClose = append(toClose, l.s)
 		}
 	}
+	for _, s := range toClose {
+		r.removeLocked(s)
+	}
+	r.deals = make(map[string]*dealLease)
+	r.mu.Unlock()
+
+	return closeShards(toClose)
+}
+
+// expire closes a shard that has been idle for the idle timeout
+func (r *ReadOnlyBlockstores) expire(s *sharedBlockstore, gen uint64) {
+	r.mu.Lock()
+	if s.idle == nil || s.idleGen != gen || r.shards[s.key] != s {
+		// The shard was used again, or has already been closed
+		r.mu.Unlock()
+		return
+	}
+	r.removeLocked(s)
+	r.stats.Expired++
+	r.mu.Unlock()
+
+	if err := closeShard(s); err != nil {
+		log.Warnf("closing idle shard %s: %s", s.key, err)
+	}
+}
+
+// leaseLocked records that the deal with the given key uses a shard, until
+// it is untracked
+func (r *ReadOnlyBlockstores) leaseLocked(key string, s *sharedBlockstore) {
+	l := &dealLease{s: s}
+	if r.lease > 0 {
+		l.timer = time.AfterFunc(r.lease, func() { r.overrunLease(key, l) })
+	}
+	r.deals[key] = l
+}
+
+// overrunLease reports a deal that has used a shard for longer than the
+// lease. The deal keeps using the shard until it is untracked.
+func (r *ReadOnlyBlockstores) overrunLease(key string, l *dealLease) {
+	r.mu.Lock()
+	current := r.deals[key] == l
+	if current {
+		r.stats.LeasesOverrun++
+	}
+	r.mu.Unlock()
+	if !current {
+		return
+	}
+
+	log.Warnf("deal %s has used shard %s for longer than the shard lease of %s", key, l.s.key, r.lease)
+}
+
+// refLocked adds a reference to a shard, taking it off the idle list
+func (r *ReadOnlyBlockstores) refLocked(s *sharedBlockstore) {
+	s.refs++
+	if s.idle != nil {
+		r.idle.Remove(s.idle)
+		s.idle = nil
+		s.idleTimer.Stop()
+	}
+}
+
+// removeLocked stops tracking a shard
+func (r *ReadOnlyBlockstores) removeLocked(s *sharedBlockstore) {
+	if r.shards[s.key] == s {
+		delete(r.shards, s.key)
+	}
+	if s.idle != nil {
+		r.idle.Remove(s.idle)
+		s.idle = nil
+		s.idleTimer.Stop()
+	}
+}
+
+// evictLocked removes the least recently used idle shards until the number
+// of open shards is within the maximum, and returns the shards to close
+func (r *ReadOnlyBlockstores) evictLocked() []*sharedBlockstore {
+	if r.maxOpen == 0 {
+		return nil
+	}
+	var evicted []*sharedBlockstore
+	for len(r.shards) > r.maxOpen && r.idle.Len() > 0 {
+		s := r.idle.Back().Value.(*sharedBlockstore)
+		r.removeLocked(s)
+		r.stats.Evicted++
+		evicted = append(evicted, s)
+	}
+	return evicted
+}
 
+func closeShard(s *sharedBlockstore) error {
+	if s.err != nil {
+		return nil
+	}
+	if closer, ok := s.bs.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return xerrors.Errorf("failed to close read-only blockstore: %w", err)
+		}
+	}
 	return nil
 }
+
+func closeShards(shards []*sharedBlockstore) error {
+	var firstErr error
+	for _, s := range shards {
+		if err := closeShard(s); err != nil {
+			log.Warnf("closing shard %s: %s", s.key, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -3,11 +3,17 @@ package stores_test
 import (
 	"context"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
 	carv2 "github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/dagstore"
 
@@ -83,3 +89,231 @@ func getBstoreLen(ctx context.Context, t *testing.T, bs dagstore.ReadBlockstore)
 	}
 	return len
 }
+
+// countingBlockstore counts how many times it is closed
+type countingBlockstore struct {
+	bstore.Blockstore
+	lk     sync.Mutex
+	closed int
+}
+
+func (c *countingBlockstore) Close() error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.closed++
+	return nil
+}
+
+func (c *countingBlockstore) closeCount() int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.closed
+}
+
+// shardOpener opens a counting blockstore for each shard, and counts how
+// many times each shard is opened
+type shardOpener struct {
+	lk     sync.Mutex
+	opened map[string][]*countingBlockstore
+}
+
+func newShardOpener() *shardOpener {
+	return &shardOpener{opened: make(map[string][]*countingBlockstore)}
+}
+
+func (o *shardOpener) open(shard string) func(context.Context) (bstore.Blockstore, error) {
+	return func(context.Context) (bstore.Blockstore, error) {
+		o.lk.Lock()
+		defer o.lk.Unlock()
+		bs := &countingBlockstore{Blockstore: bstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+		o.opened[shard] = append(o.opened[shard], bs)
+		return bs, nil
+	}
+}
+
+func (o *shardOpener) get(shard string) []*countingBlockstore {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	return append([]*countingBlockstore{}, o.opened[shard]...)
+}
+
+func TestReadOnlyBlockstoresSharing(t *testing.T) {
+	ctx := context.Background()
+	opener := newShardOpener()
+	tracker := stores.NewReadOnlyBlockstores(stores.IdleShardTimeout(time.Hour))
+
+	// Deals for the same shard share one blockstore
+	bs1, err := tracker.Acquire(ctx, "deal1", "shard", opener.open("shard"))
+	require.NoError(t, err)
+	bs2, err := tracker.Acquire(ctx, "deal2", "shard", opener.open("shard"))
+	require.NoError(t, err)
+	require.Same(t, bs1, bs2)
+	require.Len(t, opener.get("shard"), 1)
+
+	got, err := tracker.Get("deal2")
+	require.NoError(t, err)
+	require.Same(t, bs1, got)
+
+	stats := tracker.Stats()
+	require.Equal(t, 1, stats.Open)
+	require.Equal(t, 1, stats.InUse)
+	require.Equal(t, 2, stats.Deals)
+	require.EqualValues(t, 1, stats.Loaded)
+	require.EqualValues(t, 1, stats.Shared)
+
+	// The shard stays open while any deal is using it
+	require.NoError(t, tracker.Untrack("deal1"))
+	_, err = tracker.Get("deal1")
+	require.True(t, stores.IsNotFound(err))
+	require.NoError(t, tracker.Untrack("deal2"))
+	require.Zero(t, opener.get("shard")[0].closeCount())
+
+	stats = tracker.Stats()
+	require.Equal(t, 1, stats.Open)
+	require.Equal(t, 1, stats.Idle)
+	require.Equal(t, 0, stats.Deals)
+
+	// An idle shard is reused by the next deal
+	bs3, err := tracker.Acquire(ctx, "deal3", "shard", opener.open("shard"))
+	require.NoError(t, err)
+	require.Same(t, bs1, bs3)
+	require.Len(t, opener.get("shard"), 1)
+
+	// Closing the tracker closes the shard
+	require.NoError(t, tracker.Close())
+	require.Equal(t, 1, opener.get("shard")[0].closeCount())
+	require.Equal(t, 0, tracker.Stats().Open)
+}
+
+func TestReadOnlyBlockstoresOpenError(t *testing.T) {
+	ctx := context.Background()
+	tracker := stores.NewReadOnlyBlockstores()
+
+	_, err := tracker.Acquire(ctx, "deal", "shard", func(context.Context) (bstore.Blockstore, error) {
+		return nil, xerrors.New("no such shard")
+	})
+	require.Error(t, err)
+
+	// A shard that failed to open is not tracked
+	_, err = tracker.Get("deal")
+	require.True(t, stores.IsNotFound(err))
+	stats := tracker.Stats()
+	require.Equal(t, 0, stats.Open)
+	require.Equal(t, 0, stats.Deals)
+
+	// and is opened again by the next deal
+	opener := newShardOpener()
+	_, err = tracker.Acquire(ctx, "deal", "shard", opener.open("shard"))
+	require.NoError(t, err)
+	require.Len(t, opener.get("shard"), 1)
+}
+
+func TestReadOnlyBlockstoresIdleTimeout(t *testing.T) {
+	ctx := context.Background()
+	opener := newShardOpener()
+	tracker := stores.NewReadOnlyBlockstores(stores.IdleShardTimeout(50 * time.Millisecond))
+
+	_, err := tracker.Acquire(ctx, "deal", "shard", opener.open("shard"))
+	require.NoError(t, err)
+	require.NoError(t, tracker.Untrack("deal"))
+
+	bs := opener.get("shard")[0]
+	require.Eventually(t, func() bool {
+		return bs.closeCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	stats := tracker.Stats()
+	require.Equal(t, 0, stats.Open)
+	require.EqualValues(t, 1, stats.Expired)
+
+	// With no idle timeout, shards are closed as soon as they are idle
+	tracker = stores.NewReadOnlyBlockstores(stores.IdleShardTimeout(0))
+	_, err = tracker.Acquire(ctx, "deal", "shard2", opener.open("shard2"))
+	require.NoError(t, err)
+	require.NoError(t, tracker.Untrack("deal"))
+	require.Equal(t, 1, opener.get("shard2")[0].closeCount())
+}
+
+func TestReadOnlyBlockstoresShardLease(t *testing.T) {
+	ctx := context.Background()
+	opener := newShardOpener()
+	tracker := stores.NewReadOnlyBlockstores(
+		stores.IdleShardTimeout(0),
+		stores.ShardLease(50*time.Millisecond),
+	)
+
+	// A deal that uses its shard for longer than the lease is reported,
+	// but keeps the shard open
+	_, err := tracker.Acquire(ctx, "slow", "shard", opener.open("shard"))
+	require.NoError(t, err)
+	bs := opener.get("shard")[0]
+	require.Eventually(t, func() bool {
+		return tracker.Stats().LeasesOverrun == 1
+	}, time.Second, 10*time.Millisecond)
+
+	stats := tracker.Stats()
+	require.Equal(t, 1, stats.Open)
+	require.Equal(t, 1, stats.Deals)
+	require.Equal(t, 0, bs.closeCount())
+
+	// The shard is closed once the deal is done with it
+	require.NoError(t, tracker.Untrack("slow"))
+	require.Equal(t, 1, bs.closeCount())
+
+	// A deal that untracks its shard in time is not reported
+	_, err = tracker.Acquire(ctx, "deal", "shard2", opener.open("shard2"))
+	require.NoError(t, err)
+	require.NoError(t, tracker.Untrack("deal"))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, opener.get("shard2")[0].closeCount())
+	require.EqualValues(t, 1, tracker.Stats().LeasesOverrun)
+
+	// The lease is off by default
+	tracker = stores.NewReadOnlyBlockstores(stores.IdleShardTimeout(0))
+	_, err = tracker.Acquire(ctx, "deal", "shard3", opener.open("shard3"))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 0, tracker.Stats().LeasesOverrun)
+	require.NoError(t, tracker.Untrack("deal"))
+}
+
+func TestReadOnlyBlockstoresEviction(t *testing.T) {
+	ctx := context.Background()
+	opener := newShardOpener()
+	tracker := stores.NewReadOnlyBlockstores(
+		stores.IdleShardTimeout(time.Hour),
+		stores.MaxOpenShards(2),
+	)
+
+	for _, shard := range []string{"a", "b", "c"} {
+		_, err := tracker.Acquire(ctx, "deal-"+shard, shard, opener.open(shard))
+		require.NoError(t, err)
+	}
+
+	// Shards in use are never evicted
+	require.Equal(t, 3, tracker.Stats().Open)
+
+	// Once idle, the least recently used shards are evicted
+	require.NoError(t, tracker.Untrack("deal-a"))
+	require.Equal(t, 1, opener.get("a")[0].closeCount())
+	require.NoError(t, tracker.Untrack("deal-b"))
+	require.NoError(t, tracker.Untrack("deal-c"))
+	require.Zero(t, opener.get("b")[0].closeCount())
+	require.Zero(t, opener.get("c")[0].closeCount())
+
+	// Using b makes c the least recently used
+	_, err := tracker.Acquire(ctx, "deal-b2", "b", opener.open("b"))
+	require.NoError(t, err)
+	require.NoError(t, tracker.Untrack("deal-b2"))
+	_, err = tracker.Acquire(ctx, "deal-d", "d", opener.open("d"))
+	require.NoError(t, err)
+	require.Equal(t, 1, opener.get("c")[0].closeCount())
+	require.Zero(t, opener.get("b")[0].closeCount())
+	require.Len(t, opener.get("b"), 1)
+
+	stats := tracker.Stats()
+	require.Equal(t, 2, stats.Open)
+	require.Equal(t, 1, stats.InUse)
+	require.Equal(t, 1, stats.Idle)
+	require.EqualValues(t, 2, stats.Evicted)
+}
@@ -0,0 +1,383 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+
+	"github.com/filecoin-project/go-fil-markets/piecestore"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+)
+
+// ShardIndexes is the part of the DAG store that holds the index of each
+// shard, and the top-level index of the shards that have each block. It is
+// implemented by DAGStoreWrapper.
+type ShardIndexes interface {
+	ListShards(ctx context.Context) ([]cid.Cid, error)
+	GetIterableIndexForPiece(pieceCid cid.Cid) (carindex.IterableIndex, error)
+	GetPiecesContainingBlock(blockCID cid.Cid) ([]cid.Cid, error)
+	ReplaceIndexForPiece(ctx context.Context, pieceCid cid.Cid, idx carindex.Index) error
+}
+
+var _ ShardIndexes = (DAGStoreWrapper)(nil)
+
+// ShardDataSource opens the CARv1 data of a piece, so that its index can be
+// rebuilt. It returns ErrNotFound if it does not have the piece data.
+type ShardDataSource func(ctx context.Context, pieceCid cid.Cid) (io.ReadCloser, error)
+
+// UnsealedShardData reads piece data from an unsealed copy of a sector that
+// has a deal for the piece
+func UnsealedShardData(pieceStore piecestore.PieceStore, sa retrievalmarket.SectorAccessor) ShardDataSource {
+	return func(ctx context.Context, pieceCid cid.Cid) (io.ReadCloser, error) {
+		pi, err := pieceStore.GetPieceInfo(pieceCid)
+		if err != nil {
+			return nil, xerrors.Errorf("getting piece info for piece %s: %w", pieceCid, err)
+		}
+
+		for _, deal := range pi.Deals {
+			isUnsealed, err := sa.IsUnsealed(ctx, deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded())
+			if err != nil {
+				log.Warnf("checking if sector %d with piece %s is unsealed: %s", deal.SectorID, pieceCid, err)
+				continue
+			}
+			if !isUnsealed {
+				continue
+			}
+			return sa.UnsealSector(ctx, deal.SectorID, deal.Offset.Unpadded(), deal.Length.Unpadded())
+		}
+		return nil, xerrors.Errorf("no unsealed sector with piece %s: %w", pieceCid, ErrNotFound)
+	}
+}
+
+// CARFileShardData reads piece data from CAR files (v1 or v2) in a
+// directory, named after the piece CID with an optional .car extension
+func CARFileShardData(dir string) ShardDataSource {
+	return func(ctx context.Context, pieceCid cid.Cid) (io.ReadCloser, error) {
+		for _, name := range []string{pieceCid.String(), pieceCid.String() + ".car"} {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				continue
+			}
+
+			rd, err := carv2.OpenReader(path)
+			if err != nil {
+				return nil, xerrors.Errorf("opening CAR file %s: %w", path, err)
+			}
+			return &readCloser{Reader: rd.DataReader(), closeFn: rd.Close}, nil
+		}
+		return nil, xerrors.Errorf("no CAR file for piece %s in %s: %w", pieceCid, dir, ErrNotFound)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	closeFn func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.closeFn()
+}
+
+// ShardIndexReport is the result of checking the index of a shard
+type ShardIndexReport struct {
+	PieceCid cid.Cid
+	// Entries is the number of entries in the index rebuilt from the data
+	Entries int
+	// NoIndex is true if the DAG store has no index for the shard
+	NoIndex bool
+	// Missing is the number of entries in the data that the stored index
+	// does not have
+	Missing int
+	// Unexpected is the number of entries in the stored index that are not
+	// in the data, or are at the wrong offset
+	Unexpected int
+	// MissingTopLevel is the number of blocks in the data that the
+	// top-level index does not map to the shard
+	MissingTopLevel int
+	// Repaired is true if the stored index was replaced with the rebuilt
+	// index
+	Repaired bool
+	// Error is set if the shard could not be checked or repaired
+	Error error
+}
+
+// OK returns true if the stored index matches the data
+func (r ShardIndexReport) OK() bool {
+	return r.Error == nil && !r.NoIndex && r.Missing == 0 && r.Unexpected == 0 && r.MissingTopLevel == 0
+}
+
+// CheckShardIndexes checks the index of every shard in the DAG store against
+// an index rebuilt from the shard's data, read from the first of the sources
+// that has it, and checks that the top-level index maps each block in the
+// data to the shard. If repair is true, the indexes of shards that do not
+// match are replaced with the rebuilt index. It returns a report for each
+// shard.
+func CheckShardIndexes(ctx context.Context, shards ShardIndexes, sources []ShardDataSource, repair bool) ([]ShardIndexReport, error) {
+	pieceCids, err := shards.ListShards(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("listing shards: %w", err)
+	}
+
+	reports := make([]ShardIndexReport, 0, len(pieceCids))
+	for _, pieceCid := range pieceCids {
+		if ctx.Err() != nil {
+			return reports, ctx.Err()
+		}
+		reports = append(reports, CheckShardIndex(ctx, shards, sources, pieceCid, repair))
+	}
+	return reports, nil
+}
+
+// CheckShardIndex checks the index of the shard for a piece. See
+// CheckShardIndexes.
+func CheckShardIndex(ctx context.Context, shards ShardIndexes, sources []ShardDataSource, pieceCid cid.Cid, repair bool) ShardIndexReport {
+	report := ShardIndexReport{PieceCid: pieceCid}
+
+	rebuilt, err := rebuildShardIndex(ctx, sources, pieceCid)
+	if err != nil {
+		report.Error = xerrors.Errorf("rebuilding index for piece %s: %w", pieceCid, err)
+		return report
+	}
+	expected, err := indexEntries(rebuilt)
+	if err != nil {
+		report.Error = xerrors.Errorf("reading rebuilt index for piece %s: %w", pieceCid, err)
+		return report
+	}
+	report.Entries = len(expected)
+
+	stored, err := shards.GetIterableIndexForPiece(pieceCid)
+	if err != nil {
+		log.Warnf("getting stored index for piece %s: %s", pieceCid, err)
+	}
+	if err != nil || stored == nil {
+		report.NoIndex = true
+		report.Missing = len(expected)
+	} else {
+		actual, err := indexEntries(stored)
+		if err != nil {
+			report.Error = xerrors.Errorf("reading stored index for piece %s: %w", pieceCid, err)
+			return report
+		}
+		for e := range expected {
+			if _, ok := actual[e]; !ok {
+				report.Missing++
+			}
+		}
+		for e := range actual {
+			if _, ok := expected[e]; !ok {
+				report.Unexpected++
+			}
+		}
+	}
+
+	report.MissingTopLevel = missingTopLevel(shards, pieceCid, expected)
+
+	if report.OK() || !repair {
+		return report
+	}
+	if err := shards.ReplaceIndexForPiece(ctx, pieceCid, rebuilt); err != nil {
+		report.Error = xerrors.Errorf("replacing index for piece %s: %w", pieceCid, err)
+		return report
+	}
+	report.Repaired = true
+	return report
+}
+
+// WriteShardIndexReports writes a line for each report, and returns false
+// if any shard has an index that does not match its data and was not
+// repaired
+func WriteShardIndexReports(w io.Writer, reports []ShardIndexReport) bool {
+	allOK := true
+	for _, r := range reports {
+		switch {
+		case r.Error != nil:
+			fmt.Fprintf(w, "%s: error: %s\n", r.PieceCid, r.Error)
+			allOK = false
+		case r.OK():
+			fmt.Fprintf(w, "%s: ok (%d entries)\n", r.PieceCid, r.Entries)
+		default:
+			status := "corrupt"
+			if r.NoIndex {
+				status = "no index"
+			}
+			if r.Repaired {
+				status += ", repaired"
+			} else {
+				allOK = false
+			}
+			fmt.Fprintf(w, "%s: %s (%d entries, %d missing, %d unexpected, %d missing from top-level index)\n",
+				r.PieceCid, status, r.Entries, r.Missing, r.Unexpected, r.MissingTopLevel)
+		}
+	}
+	return allOK
+}
+
+// rebuildShardIndex generates an index from the data of a piece
+func rebuildShardIndex(ctx context.Context, sources []ShardDataSource, pieceCid cid.Cid) (carindex.IterableIndex, error) {
+	for _, source := range sources {
+		rd, err := source(ctx, pieceCid)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Unsealed piece data is padded with zeros after the CAR data
+		idx, err := carv2.GenerateIndex(rd, carv2.ZeroLengthSectionAsEOF(true))
+		_ = rd.Close()
+		if err != nil {
+			return nil, err
+		}
+		iterable, ok := idx.(carindex.IterableIndex)
+		if !ok {
+			return nil, xerrors.Errorf("index of type %T is not iterable", idx)
+		}
+		return iterable, nil
+	}
+	return nil, xerrors.Errorf("no data for piece %s: %w", pieceCid, ErrNotFound)
+}
+
+// missingTopLevel returns the number of blocks in the index entries that
+// the top-level index does not map to the piece
+func missingTopLevel(shards ShardIndexes, pieceCid cid.Cid, entries map[indexEntry]struct{}) int {
+	checked := make(map[string]struct{}, len(entries))
+	missing := 0
+	for e := range entries {
+		if _, ok := checked[e.mh]; ok {
+			continue
+		}
+		checked[e.mh] = struct{}{}
+
+		pieces, err := shards.GetPiecesContainingBlock(cid.NewCidV1(cid.Raw, multihash.Multihash(e.mh)))
+		if err != nil && !xerrors.Is(err, retrievalmarket.ErrNotFound) {
+			log.Warnf("looking up pieces with block in piece %s in top-level index: %s", pieceCid, err)
+		}
+		found := false
+		for _, p := range pieces {
+			if p.Equals(pieceCid) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing++
+		}
+	}
+	return missing
+}
+
+type indexEntry struct {
+	mh     string
+	offset uint64
+}
+
+func indexEntries(idx carindex.IterableIndex) (map[indexEntry]struct{}, error) {
+	entries := make(map[indexEntry]struct{})
+	err := idx.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		entries[indexEntry{mh: string(mh), offset: offset}] = struct{}{}
+		return nil
+	})
+	return entries, err
+}
+
+// IndexRepoShards checks the indexes in a DAG store's index repository and
+// top-level index directly, eg when the DAG store is not running.
+//
+// A repaired index replaces the full index of the shard, and its blocks are
+// added to the top-level index. The top-level index has no way to remove
+// the entries of a single shard, so entries for blocks that were wrongly
+// indexed stay in it, and the shard is found not to have those blocks when
+// it is read.
+func IndexRepoShards(repo index.FullIndexRepo, top index.Inverted) ShardIndexes {
+	return &indexRepoShards{repo: repo, top: top}
+}
+
+type indexRepoShards struct {
+	repo index.FullIndexRepo
+	top  index.Inverted
+}
+
+func (s *indexRepoShards) ListShards(ctx context.Context) ([]cid.Cid, error) {
+	var pieceCids []cid.Cid
+	err := s.repo.ForEach(func(key shard.Key) (bool, error) {
+		pieceCid, err := cid.Parse(key.String())
+		if err != nil {
+			log.Warnf("skipping index for shard %s: shard key is not a piece CID", key)
+			return true, nil
+		}
+		pieceCids = append(pieceCids, pieceCid)
+		return true, nil
+	})
+	return pieceCids, err
+}
+
+func (s *indexRepoShards) GetIterableIndexForPiece(pieceCid cid.Cid) (carindex.IterableIndex, error) {
+	idx, err := s.repo.GetFullIndex(shard.KeyFromCID(pieceCid))
+	if err != nil {
+		return nil, err
+	}
+	iterable, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return nil, xerrors.Errorf("index of type %T for piece %s is not iterable", idx, pieceCid)
+	}
+	return iterable, nil
+}
+
+func (s *indexRepoShards) GetPiecesContainingBlock(blockCID cid.Cid) ([]cid.Cid, error) {
+	keys, err := s.top.GetShardsForMultihash(context.TODO(), blockCID.Hash())
+	if err != nil {
+		return nil, xerrors.Errorf("getting shards for block %s: %w", blockCID, err)
+	}
+	if len(keys) == 0 {
+		return nil, xerrors.Errorf("getting shards for block %s: %w", blockCID, retrievalmarket.ErrNotFound)
+	}
+
+	pieceCids := make([]cid.Cid, 0, len(keys))
+	for _, key := range keys {
+		pieceCid, err := cid.Parse(key.String())
+		if err != nil {
+			return nil, xerrors.Errorf("parsing shard key %s: %w", key, err)
+		}
+		pieceCids = append(pieceCids, pieceCid)
+	}
+	return pieceCids, nil
+}
+
+func (s *indexRepoShards) ReplaceIndexForPiece(ctx context.Context, pieceCid cid.Cid, idx carindex.Index) error {
+	iterable, ok := idx.(carindex.IterableIndex)
+	if !ok {
+		return xerrors.Errorf("index of type %T for piece %s is not iterable", idx, pieceCid)
+	}
+
+	key := shard.KeyFromCID(pieceCid)
+	if err := s.repo.AddFullIndex(key, idx); err != nil {
+		return xerrors.Errorf("replacing full index: %w", err)
+	}
+	if err := s.top.AddMultihashesForShard(ctx, &indexMultihashes{idx: iterable}, key); err != nil {
+		return xerrors.Errorf("adding to top-level index: %w", err)
+	}
+	return nil
+}
+
+// indexMultihashes iterates over the multihashes in a CAR index
+type indexMultihashes struct {
+	idx carindex.IterableIndex
+}
+
+func (i *indexMultihashes) ForEach(f func(mh multihash.Multihash) error) error {
+	return i.idx.ForEach(func(mh multihash.Multihash, _ uint64) error {
+		return f(mh)
+	})
+}
@@ -0,0 +1,146 @@
+package stores_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	carv2 "github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+
+	tut "github.com/filecoin-project/go-fil-markets/shared_testutil"
+	"github.com/filecoin-project/go-fil-markets/stores"
+)
+
+func TestCheckShardIndexes(t *testing.T) {
+	ctx := context.Background()
+	testData := tut.NewLibp2pTestData(ctx, t)
+
+	_, carPath1 := testData.LoadUnixFSFileToStore(t, filepath.Join(tut.ThisDir(t), "../retrievalmarket/impl/fixtures/lorem.txt"))
+	_, carPath2 := testData.LoadUnixFSFileToStore(t, filepath.Join(tut.ThisDir(t), "../retrievalmarket/impl/fixtures/lorem_under_1_block.txt"))
+
+	pieceCids := tut.GenerateCids(4)
+	goodPiece, corruptPiece, unindexedPiece, noDataPiece := pieceCids[0], pieceCids[1], pieceCids[2], pieceCids[3]
+
+	// Put the CAR files for the pieces that have data in a directory
+	carDir := t.TempDir()
+	copyCAR := func(src string, pieceCid cid.Cid) {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(carDir, pieceCid.String()+".car"), data, 0644))
+	}
+	copyCAR(carPath1, goodPiece)
+	copyCAR(carPath1, corruptPiece)
+	copyCAR(carPath2, unindexedPiece)
+
+	dagStore := tut.NewMockDagStoreWrapper(nil, nil)
+	for _, pieceCid := range pieceCids {
+		require.NoError(t, stores.RegisterShardSync(ctx, dagStore, pieceCid, "", false))
+	}
+	require.NoError(t, dagStore.ReplaceIndexForPiece(ctx, goodPiece, generateIndex(t, carPath1)))
+	require.NoError(t, dagStore.ReplaceIndexForPiece(ctx, corruptPiece, generateIndex(t, carPath2)))
+
+	sources := []stores.ShardDataSource{stores.CARFileShardData(carDir)}
+	checkAll := func(repair bool) map[cid.Cid]stores.ShardIndexReport {
+		reports, err := stores.CheckShardIndexes(ctx, dagStore, sources, repair)
+		require.NoError(t, err)
+		require.Len(t, reports, len(pieceCids))
+		byPiece := make(map[cid.Cid]stores.ShardIndexReport)
+		for _, r := range reports {
+			byPiece[r.PieceCid] = r
+		}
+		return byPiece
+	}
+
+	// Check without repairing
+	reports := checkAll(false)
+	require.True(t, reports[goodPiece].OK())
+	require.NotZero(t, reports[goodPiece].Entries)
+
+	corrupt := reports[corruptPiece]
+	require.False(t, corrupt.OK())
+	require.NoError(t, corrupt.Error)
+	require.NotZero(t, corrupt.Missing)
+	require.NotZero(t, corrupt.Unexpected)
+	require.False(t, corrupt.Repaired)
+
+	unindexed := reports[unindexedPiece]
+	require.True(t, unindexed.NoIndex)
+	require.Equal(t, unindexed.Entries, unindexed.Missing)
+	require.False(t, unindexed.Repaired)
+
+	require.True(t, stores.IsNotFound(reports[noDataPiece].Error))
+
+	// Repair the indexes that do not match
+	reports = checkAll(true)
+	require.False(t, reports[goodPiece].Repaired)
+	require.True(t, reports[corruptPiece].Repaired)
+	require.True(t, reports[unindexedPiece].Repaired)
+	require.Error(t, reports[noDataPiece].Error)
+
+	// The repaired indexes now match the data
+	reports = checkAll(false)
+	for _, pieceCid := range []cid.Cid{goodPiece, corruptPiece, unindexedPiece} {
+		require.True(t, reports[pieceCid].OK(), "piece %s", pieceCid)
+	}
+}
+
+func TestIndexRepoShardsTopLevelIndex(t *testing.T) {
+	ctx := context.Background()
+	testData := tut.NewLibp2pTestData(ctx, t)
+	_, carPath := testData.LoadUnixFSFileToStore(t, filepath.Join(tut.ThisDir(t), "../retrievalmarket/impl/fixtures/lorem.txt"))
+
+	pieceCid := tut.GenerateCids(1)[0]
+	carDir := t.TempDir()
+	data, err := os.ReadFile(carPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(carDir, pieceCid.String()+".car"), data, 0644))
+	sources := []stores.ShardDataSource{stores.CARFileShardData(carDir)}
+
+	repo := index.NewMemoryRepo()
+	top := index.NewInverted(dssync.MutexWrap(ds.NewMapDatastore()))
+	shards := stores.IndexRepoShards(repo, top)
+
+	// The full index is correct, but the top-level index does not have the
+	// blocks of the shard
+	require.NoError(t, repo.AddFullIndex(shard.KeyFromCID(pieceCid), generateIndex(t, carPath)))
+	report := stores.CheckShardIndex(ctx, shards, sources, pieceCid, false)
+	require.NoError(t, report.Error)
+	require.False(t, report.OK())
+	require.Zero(t, report.Missing)
+	require.Zero(t, report.Unexpected)
+	require.NotZero(t, report.MissingTopLevel)
+
+	// Repairing the shard adds its blocks to the top-level index
+	report = stores.CheckShardIndex(ctx, shards, sources, pieceCid, true)
+	require.True(t, report.Repaired)
+	report = stores.CheckShardIndex(ctx, shards, sources, pieceCid, false)
+	require.True(t, report.OK())
+
+	rd, err := carv2.OpenReader(carPath)
+	require.NoError(t, err)
+	defer rd.Close() // nolint
+	roots, err := rd.Roots()
+	require.NoError(t, err)
+	pieces, err := shards.GetPiecesContainingBlock(roots[0])
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{pieceCid}, pieces)
+}
+
+func generateIndex(t *testing.T, carPath string) carindex.Index {
+	rd, err := carv2.OpenReader(carPath)
+	require.NoError(t, err)
+	defer rd.Close() // nolint
+
+	idx, err := carv2.GenerateIndex(rd.DataReader())
+	require.NoError(t, err)
+	return idx
+}